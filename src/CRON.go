@@ -210,13 +210,18 @@ func CRON() {
 		s.Every(1).Hours().Do(utils.CleanBannedIPs)
 		s.Every(1).Hours().Do(proxy.CleanUp)
 		s.Every(1).Hours().Do(proxy.CleanUpSocket)
+		s.Every(15).Minutes().Do(docker.ApplyScheduledUpdates)
+		s.Every(1).Minute().Do(proxy.StopIdleServApps)
 		s.Every(1).Day().At("2:00").Do(func() {
 			checkVersion()
 			utils.CleanupByDate("notifications")
 			utils.CleanupByDate("events")
+			utils.CleanupByDate("container_status")
+			cron.CleanupJobsHistory()
 			imageCleanUp()
 			checkCerts()
 			checkUpdatesAvailable()
+			docker.ScanAllContainers()
 		})
 
 		s.Start()
@@ -10,6 +10,17 @@ import (
 	"github.com/azukaar/cosmos-server/src/utils"
 )
 
+// backupEngine returns the engine of a backup, or writes the error if it is unknown
+func backupEngine(w http.ResponseWriter, backup utils.SingleBackupConfig) (BackupEngine, bool) {
+	engine, err := GetEngine(backup.Engine)
+	if err != nil {
+		utils.Error("Backups: Invalid engine", err)
+		utils.HTTPError(w, "Invalid engine: "+err.Error(), http.StatusInternalServerError, "BCK018")
+		return nil, false
+	}
+	return engine, true
+}
+
 func AddBackupRoute(w http.ResponseWriter, req *http.Request) {
 	if utils.AdminOnly(w, req) != nil {
 		return
@@ -43,6 +54,24 @@ func AddBackupRoute(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		engine, err := GetEngine(request.Engine)
+		if err != nil {
+			utils.Error("AddBackup: Invalid engine", err)
+			utils.HTTPError(w, "Invalid engine: "+err.Error(), http.StatusBadRequest, "BCK018")
+			return
+		}
+		request.Engine = EngineName(request.Engine)
+
+		if err := NormalizeRetention(&request); err != nil {
+			utils.HTTPError(w, "Invalid retention policy: "+err.Error(), http.StatusBadRequest, "BCK019")
+			return
+		}
+
+		if err := ValidateRetryPolicy(request); err != nil {
+			utils.HTTPError(w, "Invalid retry policy: "+err.Error(), http.StatusBadRequest, "BCK021")
+			return
+		}
+
 		// Check repository status
 		repoInfo, err := os.Stat(request.Repository)
 		if err != nil && !os.IsNotExist(err) {
@@ -71,7 +100,7 @@ func AddBackupRoute(w http.ResponseWriter, req *http.Request) {
 		if isNewRepo {
 			utils.Log("AddBackup: Creating new repository")
 			password = utils.GenerateRandomString(16)
-			if err := CreateRepository(request.Repository, password); err != nil {
+			if err := engine.Init(request.Repository, password); err != nil {
 				utils.Error("AddBackup: Failed to create repository", err)
 				utils.HTTPError(w, "Failed to create repository: "+err.Error(), http.StatusInternalServerError, "BCK004")
 				return
@@ -80,7 +109,7 @@ func AddBackupRoute(w http.ResponseWriter, req *http.Request) {
 			utils.Log("AddBackup: Repository exists")
 			found := false
 			for _, backup := range config.Backup.Backups {
-				if backup.Repository == request.Repository {
+				if backup.Repository == request.Repository && EngineName(backup.Engine) == request.Engine {
 					password = backup.Password
 					found = true
 					break
@@ -93,7 +122,7 @@ func AddBackupRoute(w http.ResponseWriter, req *http.Request) {
 				return
 			}
 
-			if err := CheckRepository(request.Repository, password); err != nil {
+			if err := engine.Check(request.Repository, password); err != nil {
 				utils.Error("AddBackup: Invalid repository", err)
 				utils.HTTPError(w, "Invalid repository: "+err.Error(), http.StatusInternalServerError, "BCK007")
 				return
@@ -143,7 +172,22 @@ func EditBackupRoute(w http.ResponseWriter, req *http.Request) {
 		current.Crontab = request.Crontab
 		current.CrontabForget = request.CrontabForget
 		current.RetentionPolicy = request.RetentionPolicy
+		current.Retention = request.Retention
 		current.AutoStopContainers = request.AutoStopContainers
+		current.Timeout = request.Timeout
+		current.Retries = request.Retries
+		current.RetryBackoff = request.RetryBackoff
+		current.NotifyOnFailure = request.NotifyOnFailure
+
+		if err := ValidateRetryPolicy(current); err != nil {
+			utils.HTTPError(w, "Invalid retry policy: "+err.Error(), http.StatusBadRequest, "BCK021")
+			return
+		}
+
+		if err := NormalizeRetention(&current); err != nil {
+			utils.HTTPError(w, "Invalid retention policy: "+err.Error(), http.StatusBadRequest, "BCK019")
+			return
+		}
 
 		config.Backup.Backups[request.Name] = current
 		utils.SetBaseMainConfig(config)
@@ -174,6 +218,11 @@ func RemoveBackupRoute(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		engine, ok := backupEngine(w, backup)
+		if !ok {
+			return
+		}
+
 		// Check if other backups use same repository
 		otherBackupsUsingRepo := false
 		for n, b := range config.Backup.Backups {
@@ -198,7 +247,7 @@ func RemoveBackupRoute(w http.ResponseWriter, req *http.Request) {
 		// 		}
 		// 	}
 		// } else {
-			if err := DeleteByTag(backup.Repository, backup.Password, backup.Name); err != nil {
+			if err := engine.DeleteByTag(backup.Repository, backup.Password, backup.Name); err != nil {
 				utils.Error("RemoveBackup: Failed to delete snapshots", err)
 				utils.HTTPError(w, "Failed to delete snapshots: " + err.Error(), http.StatusInternalServerError, "BCK005")
 				return
@@ -207,12 +256,12 @@ func RemoveBackupRoute(w http.ResponseWriter, req *http.Request) {
 
 		// list snapshots, if none left, delete repo
 		if !otherBackupsUsingRepo {
-			output, err := ListSnapshots(backup.Repository, backup.Password)
+			output, err := engine.ListSnapshots(backup.Repository, backup.Password, []string{})
 			if err == nil {
 				var outputJSON []map[string]interface{}
 				if err := json.Unmarshal([]byte(output), &outputJSON); err == nil {
 					if len(outputJSON) == 0 {
-						err = DeleteRepository(backup.Repository)
+						err = engine.DeleteRepository(backup.Repository, backup.Password)
 						if err != nil {
 							utils.Error("RemoveBackup: Failed to delete repository", err)
 						}
@@ -252,7 +301,13 @@ func ListSnapshotsRoute(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		output, err := ListSnapshotsWithFilters(backup.Repository, backup.Password, []string{backup.Name}, "", "")
+
+		engine, ok := backupEngine(w, backup)
+		if !ok {
+			return
+		}
+
+		output, err := engine.ListSnapshots(backup.Repository, backup.Password, []string{backup.Name})
 		if err != nil {
 			utils.Error("ListSnapshots: Failed to list snapshots", err)
 			utils.HTTPError(w, "Failed to list snapshots: "+err.Error(), http.StatusInternalServerError, "BCK006")
@@ -293,7 +348,13 @@ func ListFoldersRoute(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		output, err := ListDirectory(backup.Repository, backup.Password, snapshot, path)
+
+		engine, ok := backupEngine(w, backup)
+		if !ok {
+			return
+		}
+
+		output, err := engine.Ls(backup.Repository, backup.Password, snapshot, path)
 		if err != nil {
 			utils.Error("ListFolders: Failed to list folders", err)
 			utils.HTTPError(w, "Failed to list folders: "+err.Error(), http.StatusInternalServerError, "BCK007")
@@ -346,34 +407,20 @@ func RestoreBackupRoute(w http.ResponseWriter, req *http.Request) {
 		}
 
 		// Verify snapshot belongs to this backup
-		snapshots, err := ListSnapshotsWithFilters(backup.Repository, backup.Password, []string{backup.Name}, "", "")
+		snapshotFound, err := snapshotBelongsToBackup(backup, request.SnapshotID)
 		if err != nil {
 			utils.Error("RestoreBackup: Failed to verify snapshot", err)
 			utils.HTTPError(w, "Failed to verify snapshot: "+err.Error(), http.StatusInternalServerError, "BCK009")
 			return
 		}
 
-		var snapshotsArray []map[string]interface{}
-		if err := json.Unmarshal([]byte(snapshots), &snapshotsArray); err != nil {
-			utils.Error("RestoreBackup: Failed to parse snapshots", err)
-			utils.HTTPError(w, "Failed to parse snapshots: "+err.Error(), http.StatusInternalServerError, "BCK010")
-			return
-		}
-
-		snapshotFound := false
-		for _, s := range snapshotsArray {
-			if s["id"].(string) == request.SnapshotID {
-				snapshotFound = true
-				break
-			}
-		}
-
 		if !snapshotFound {
 			utils.HTTPError(w, "Snapshot not found for this backup", http.StatusNotFound, "BCK011")
 			return
 		}
 
 		CreateRestoreJob(RestoreConfig{
+			Engine:     backup.Engine,
 			Repository: backup.Repository,
 			Password:   backup.Password,
 			SnapshotID: request.SnapshotID,
@@ -408,7 +455,13 @@ func ListSnapshotsRouteFromRepo(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		output, err := ListSnapshotsWithFilters(backup.Repository, backup.Password, []string{}, "", "")
+
+		engine, ok := backupEngine(w, backup)
+		if !ok {
+			return
+		}
+
+		output, err := engine.ListSnapshots(backup.Repository, backup.Password, []string{})
 		if err != nil {
 			utils.Error("ListSnapshots: Failed to list snapshots", err)
 			utils.HTTPError(w, "Failed to list snapshots: "+err.Error(), http.StatusInternalServerError, "BCK006")
@@ -451,7 +504,11 @@ func ListRepos(w http.ResponseWriter, req *http.Request) {
 			if !found {
 				repos[backup.Repository] = backup
 
-				output, err := StatsRepository(backup.Repository, backup.Password)
+				output := ""
+				engine, err := GetEngine(backup.Engine)
+				if err == nil {
+					output, err = engine.Stats(backup.Repository, backup.Password)
+				}
 				if err != nil {
 					utils.Error("ListRepos: Failed to get repository stats", err)
 					results[backup.Repository] = map[string]interface{}{
@@ -506,7 +563,13 @@ func ForgetSnapshotRoute(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		err := ForgetSnapshot(backup.Repository, backup.Password, snapshot)
+
+		engine, ok := backupEngine(w, backup)
+		if !ok {
+			return
+		}
+
+		err := engine.ForgetSnapshot(backup.Repository, backup.Password, snapshot)
 		if err != nil {
 			utils.Error("ForgetSnapshotRoute: Failed to forget snapshot", err)
 			utils.HTTPError(w, "Failed to forget snapshot: "+err.Error(), http.StatusInternalServerError, "BCK008")
@@ -539,7 +602,13 @@ func StatsRepositorySubfolderRoute(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		output, err := StatsRepositorySubfolder(backup.Repository, backup.Password, snapshot, path)
+
+		engine, ok := backupEngine(w, backup)
+		if !ok {
+			return
+		}
+
+		output, err := engine.StatsSubfolder(backup.Repository, backup.Password, snapshot, path)
 		if err != nil {
 			utils.Error("StatsRepositorySubfolder: Failed to get repository stats", err)
 			utils.HTTPError(w, "Failed to get repository stats: "+err.Error(), http.StatusInternalServerError, "BCK009")
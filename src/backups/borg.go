@@ -0,0 +1,500 @@
+package backups
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/cron"
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// BorgEngine stores backups in a BorgBackup repository, using the borg binary installed on the host.
+// Borg has no tags, so archives are named "<tag>-<timestamp>" and the tag is read back from the name
+type BorgEngine struct{}
+
+const borgTimeFormat = "2006-01-02T15.04.05"
+
+// retention flags borg understands, restic only flags are dropped
+var borgRetentionFlags = []string{
+	"--keep-within", "--keep-last", "--keep-secondly", "--keep-minutely",
+	"--keep-hourly", "--keep-daily", "--keep-weekly", "--keep-monthly", "--keep-yearly",
+}
+
+func borgEnv(password string) []string {
+	return []string{
+		fmt.Sprintf("BORG_PASSPHRASE=%s", password),
+		"BORG_RELOCATED_REPO_ACCESS_IS_OK=yes",
+		"BORG_DISPLAY_PASSPHRASE=no",
+	}
+}
+
+func borgRepository(repository string) (string, error) {
+	if strings.HasPrefix(repository, "rclone:") {
+		return "", fmt.Errorf("[Borg] rclone repositories are not supported by borg: %s", repository)
+	}
+	return repository, nil
+}
+
+// ExecBorg executes a borg command and returns its standard output
+func ExecBorg(args []string, env []string) (string, error) {
+	cmd := exec.Command("borg", args...)
+
+	utils.Debug("[Borg] Executing command: " + strings.Join(cmd.Args, " "))
+
+	cmd.Env = append(os.Environ(), env...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("[Borg] command failed: %w\nOutput: %s", err, stderr.String())
+	}
+
+	return stdout.String(), nil
+}
+
+// borgJob is a cron job running borg in dir, streaming its output to the job logs
+func borgJob(env []string, dir string, args ...string) cron.ExecuterFn {
+	return commandJob("borg", env, dir, nil, args...)
+}
+
+func borgFail(err error) cron.ExecuterFn {
+	return func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+		OnFail(err)
+	}
+}
+
+// borgArchiveGlob matches the archives of a tag only, the archives being named <tag>-<time> and another
+// backup name possibly starting with the tag, like app and app-db
+func borgArchiveGlob(tag string) string {
+	escaped := strings.NewReplacer("[", "[[]", "*", "[*]", "?", "[?]").Replace(tag)
+	return escaped + "-????-??-??T??.??.??"
+}
+
+func borgArchiveTag(name string) string {
+	if len(name) > len(borgTimeFormat)+1 {
+		if _, err := time.Parse(borgTimeFormat, name[len(name)-len(borgTimeFormat):]); err == nil {
+			return name[:len(name)-len(borgTimeFormat)-1]
+		}
+	}
+	return ""
+}
+
+func (BorgEngine) Label() string {
+	return "Borg"
+}
+
+func (BorgEngine) Init(repository, password string) error {
+	repository, err := borgRepository(repository)
+	if err != nil {
+		return err
+	}
+
+	_, err = ExecBorg([]string{"init", "--encryption=repokey", repository}, borgEnv(password))
+	return err
+}
+
+func (BorgEngine) Check(repository, password string) error {
+	repository, err := borgRepository(repository)
+	if err != nil {
+		return err
+	}
+
+	_, err = ExecBorg([]string{"check", "--repository-only", repository}, borgEnv(password))
+	return err
+}
+
+func (BorgEngine) DeleteRepository(repository, password string) error {
+	repository, err := borgRepository(repository)
+	if err != nil {
+		return err
+	}
+
+	env := append(borgEnv(password), "BORG_DELETE_I_KNOW_WHAT_I_AM_DOING=YES")
+	_, err = ExecBorg([]string{"delete", repository}, env)
+	return err
+}
+
+func (BorgEngine) Backup(config BackupConfig) cron.ExecuterFn {
+	repository, err := borgRepository(config.Repository)
+	if err != nil {
+		return borgFail(err)
+	}
+
+	tag := config.Name
+	if len(config.Tags) > 0 {
+		tag = config.Tags[0]
+	}
+
+	args := []string{"create", "--stats", "--comment", config.Source}
+
+	for _, exclude := range config.Exclude {
+		args = append(args, "--exclude", exclude)
+	}
+
+	archive := repository+"::"+tag+"-{now:%Y-%m-%dT%H.%M.%S}"
+
+	if config.Stdin != nil {
+		args = append(args, "--stdin-name", path.Base(config.Source), archive, "-")
+		return commandJob("borg", borgEnv(config.Password), "", config.Stdin, args...)
+	}
+
+	args = append(args, archive, config.Source)
+
+	return borgJob(borgEnv(config.Password), "", args...)
+}
+
+func borgPruneArgs(repository string, tags []string, retention string) []string {
+	args := []string{"prune", "--list"}
+
+	fields := strings.Fields(retention)
+	for i := 0; i < len(fields); i++ {
+		if utils.StringArrayContains(borgRetentionFlags, fields[i]) && i+1 < len(fields) {
+			args = append(args, fields[i], fields[i+1])
+			i++
+		}
+	}
+
+	for _, tag := range tags {
+		args = append(args, "--glob-archives", borgArchiveGlob(tag))
+	}
+
+	return append(args, repository)
+}
+
+func (BorgEngine) Forget(config BackupConfig) cron.ExecuterFn {
+	repository, err := borgRepository(config.Repository)
+	if err != nil {
+		return borgFail(err)
+	}
+
+	args := borgPruneArgs(repository, config.Tags, config.Retention)
+
+	env := borgEnv(config.Password)
+	return jobSteps(
+		borgJob(env, "", args...),
+		borgJob(env, "", "compact", repository),
+	)
+}
+
+// ForgetDryRun runs prune in dry-run mode and sorts the archives by the verdict borg prints for each of them
+func (e BorgEngine) ForgetDryRun(repository, password string, tags []string, retention string) (string, error) {
+	repo, err := borgRepository(repository)
+	if err != nil {
+		return "", err
+	}
+
+	snapshots, err := e.ListSnapshots(repository, password, tags)
+	if err != nil {
+		return "", err
+	}
+	var snapshotsArray []map[string]interface{}
+	if err := json.Unmarshal([]byte(snapshots), &snapshotsArray); err != nil {
+		return "", err
+	}
+
+	args := append([]string{"prune", "--dry-run"}, borgPruneArgs(repo, tags, retention)[1:]...)
+	cmd := exec.Command("borg", args...)
+	cmd.Env = append(os.Environ(), borgEnv(password)...)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("[Borg] failed to preview prune: %w\nOutput: %s", err, string(output))
+	}
+
+	group := map[string][]map[string]interface{}{
+		"keep":   {},
+		"remove": {},
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		verdict := ""
+		if strings.HasPrefix(line, "Would prune") {
+			verdict = "remove"
+		} else if strings.HasPrefix(line, "Keeping") {
+			verdict = "keep"
+		} else {
+			continue
+		}
+
+		// archive names can contain spaces, pick the longest known name in the line
+		var match map[string]interface{}
+		for _, snapshot := range snapshotsArray {
+			name := snapshot["id"].(string)
+			if strings.Contains(line, name) && (match == nil || len(name) > len(match["id"].(string))) {
+				match = snapshot
+			}
+		}
+
+		if match != nil {
+			group[verdict] = append(group[verdict], match)
+		}
+	}
+
+	result, err := json.Marshal([]interface{}{group})
+	return string(result), err
+}
+
+func (BorgEngine) ForgetSnapshot(repository, password, snapshot string) error {
+	repository, err := borgRepository(repository)
+	if err != nil {
+		return err
+	}
+
+	env := borgEnv(password)
+	if _, err := ExecBorg([]string{"delete", repository + "::" + snapshot}, env); err != nil {
+		return fmt.Errorf("[Borg] failed to forget snapshot: %w", err)
+	}
+
+	_, err = ExecBorg([]string{"compact", repository}, env)
+	return err
+}
+
+func (BorgEngine) DeleteByTag(repository, password, tag string) error {
+	repository, err := borgRepository(repository)
+	if err != nil {
+		return err
+	}
+
+	env := borgEnv(password)
+	if _, err := ExecBorg([]string{"delete", "--glob-archives", borgArchiveGlob(tag), repository}, env); err != nil {
+		return fmt.Errorf("[Borg] failed to delete snapshots: %w", err)
+	}
+
+	_, err = ExecBorg([]string{"compact", repository}, env)
+	return err
+}
+
+// ListSnapshots lists the archives of the repository in the restic snapshot format
+func (BorgEngine) ListSnapshots(repository, password string, tags []string) (string, error) {
+	repository, err := borgRepository(repository)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"list", "--json", "--format", "{comment}"}
+	for _, tag := range tags {
+		args = append(args, "--glob-archives", borgArchiveGlob(tag))
+	}
+	args = append(args, repository)
+
+	output, err := ExecBorg(args, borgEnv(password))
+	if err != nil {
+		return "", fmt.Errorf("[Borg] failed to list snapshots: %w", err)
+	}
+
+	var list struct {
+		Archives []struct {
+			Name    string `json:"name"`
+			ID      string `json:"id"`
+			Time    string `json:"time"`
+			Comment string `json:"comment"`
+		} `json:"archives"`
+	}
+	if err := json.Unmarshal([]byte(output), &list); err != nil {
+		return "", fmt.Errorf("[Borg] failed to parse snapshots: %w", err)
+	}
+
+	snapshots := []map[string]interface{}{}
+	for _, archive := range list.Archives {
+		snapshotTags := []string{}
+		if tag := borgArchiveTag(archive.Name); tag != "" {
+			snapshotTags = append(snapshotTags, tag)
+		}
+
+		paths := []string{}
+		if archive.Comment != "" {
+			paths = append(paths, archive.Comment)
+		}
+
+		snapshots = append(snapshots, map[string]interface{}{
+			"id":              archive.Name,
+			"short_id":        archive.Name,
+			"time":            archive.Time,
+			"tags":            snapshotTags,
+			"paths":           paths,
+			"program_version": "borg",
+		})
+	}
+
+	result, err := json.Marshal(snapshots)
+	return string(result), err
+}
+
+type borgItem struct {
+	Type  string `json:"type"`
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Mtime string `json:"mtime"`
+}
+
+func borgListItems(repository, password, snapshotID, dir string) ([]borgItem, error) {
+	repository, err := borgRepository(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"list", "--json-lines", repository + "::" + snapshotID}
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		args = append(args, dir)
+	}
+
+	output, err := ExecBorg(args, borgEnv(password))
+	if err != nil {
+		return nil, err
+	}
+
+	items := []borgItem{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var item borgItem
+		if err := json.Unmarshal([]byte(line), &item); err != nil {
+			return nil, fmt.Errorf("[Borg] failed to parse archive content: %w", err)
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// Ls lists the direct children of path in an archive in the restic ls format
+func (BorgEngine) Ls(repository, password, snapshotID, dir string) (string, error) {
+	items, err := borgListItems(repository, password, snapshotID, dir)
+	if err != nil {
+		return "", fmt.Errorf("[Borg] failed to list directory contents: %w", err)
+	}
+
+	parent := strings.Trim(dir, "/")
+	entries := []map[string]interface{}{}
+	for _, item := range items {
+		if path.Dir(item.Path) != parent && !(parent == "" && path.Dir(item.Path) == ".") {
+			continue
+		}
+
+		itemType := "file"
+		if item.Type == "d" {
+			itemType = "dir"
+		}
+
+		entries = append(entries, map[string]interface{}{
+			"name":  path.Base(item.Path),
+			"type":  itemType,
+			"path":  "/" + item.Path,
+			"size":  item.Size,
+			"mtime": item.Mtime,
+		})
+	}
+
+	result, err := json.Marshal(entries)
+	return string(result), err
+}
+
+// Restore extracts the original source of the archive into the target, like restic does
+func (BorgEngine) Restore(config RestoreConfig) cron.ExecuterFn {
+	repository, err := borgRepository(config.Repository)
+	if err != nil {
+		return borgFail(err)
+	}
+
+	source := strings.Trim(config.OriginalSource, "/")
+
+	// a backup of / has no component to strip, and is extracted whole
+	components := 0
+	if source != "" {
+		components = len(strings.Split(source, "/"))
+	}
+
+	args := []string{
+		"extract", "--list",
+		"--strip-components", fmt.Sprintf("%d", components),
+		repository + "::" + config.SnapshotID,
+	}
+
+	if len(config.Include) > 0 {
+		for _, include := range config.Include {
+			args = append(args, strings.TrimPrefix(include, "/"))
+		}
+	} else if source != "" {
+		args = append(args, source)
+	}
+
+	job := borgJob(borgEnv(config.Password), config.Target, args...)
+
+	return func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+		if err := os.MkdirAll(config.Target, 0755); err != nil {
+			OnFail(err)
+			return
+		}
+		job(OnLog, OnFail, OnSuccess, ctx, cancel)
+	}
+}
+
+func (e BorgEngine) Stats(repository, password string) (string, error) {
+	repo, err := borgRepository(repository)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := ExecBorg([]string{"info", "--json", repo}, borgEnv(password))
+	if err != nil {
+		return "", err
+	}
+
+	var info struct {
+		Cache struct {
+			Stats struct {
+				UniqueCSize int64 `json:"unique_csize"`
+				UniqueSize  int64 `json:"unique_size"`
+			} `json:"stats"`
+		} `json:"cache"`
+	}
+	if err := json.Unmarshal([]byte(output), &info); err != nil {
+		return "", fmt.Errorf("[Borg] failed to parse repository stats: %w", err)
+	}
+
+	snapshots, err := e.ListSnapshots(repository, password, []string{})
+	if err != nil {
+		return "", err
+	}
+	var snapshotsArray []map[string]interface{}
+	json.Unmarshal([]byte(snapshots), &snapshotsArray)
+
+	result, err := json.Marshal(map[string]interface{}{
+		"total_size":              info.Cache.Stats.UniqueCSize,
+		"total_uncompressed_size": info.Cache.Stats.UniqueSize,
+		"snapshots_count":         len(snapshotsArray),
+	})
+	return string(result), err
+}
+
+func (BorgEngine) StatsSubfolder(repository, password, snapshot, dir string) (string, error) {
+	items, err := borgListItems(repository, password, snapshot, dir)
+	if err != nil {
+		return "", err
+	}
+
+	var size int64
+	count := 0
+	for _, item := range items {
+		if item.Type != "d" {
+			size += item.Size
+			count++
+		}
+	}
+
+	result, err := json.Marshal(map[string]interface{}{
+		"total_size":       size,
+		"total_file_count": count,
+	})
+	return string(result), err
+}
@@ -0,0 +1,707 @@
+package backups
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/azukaar/cosmos-server/src/cron"
+	"github.com/azukaar/cosmos-server/src/docker"
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// bundleMagic prefixes every encrypted DR bundle so restore can reject random files early
+var bundleMagic = []byte("COSMOSDR2")
+
+// the archive is encrypted in chunks so that it never has to fit in memory, the nonce of each chunk
+// being a random prefix, the chunk number and whether it is the last one, so chunks cannot be reordered
+// or dropped
+const bundleChunkSize = 64 * 1024
+const bundleNoncePrefixSize = 7
+
+const bundleConfigFile = "cosmos.config.json"
+const bundleComposeFile = "backup.cosmos-compose.json"
+const bundleManifestFile = "bundle.manifest.json"
+const BundleTag = "cosmos-dr-bundle"
+const defaultBundleRetentionPolicy = "--keep-last 7"
+
+type BundleManifest struct {
+	CreatedAt   time.Time
+	Hostname    string
+	ConfigFolder string
+	Files       []string
+	Backups     map[string]utils.SingleBackupConfig
+	// collections of the main MongoDB database in the bundle
+	Collections []string
+	// why the main database is not in the bundle, empty when it is
+	DatabaseMissing string `json:",omitempty"`
+}
+
+// bundleSkip lists the files of the config folder that are not worth shipping in a bundle
+func bundleSkip(info os.FileInfo) bool {
+	name := info.Name()
+
+	if info.IsDir() {
+		return false
+	}
+
+	if filepath.Ext(name) == ".zip" || filepath.Ext(name) == ".log" || filepath.Ext(name) == ".pid" || strings.HasSuffix(name, ".cosmos-dr") {
+		return true
+	}
+
+	if strings.HasPrefix(name, "cosmos.log") || strings.HasPrefix(name, "cosmos.plain.log") || strings.HasPrefix(name, "nebula.log") {
+		return true
+	}
+
+	return false
+}
+
+func addFileToTar(tw *tar.Writer, path string, name string, info os.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func addBytesToTar(tw *tar.Writer, name string, content []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(content)
+	return err
+}
+
+// buildBundleArchive packs the config folder, the config file, a fresh cosmos-compose export
+// and the backup definitions into a gzipped tarball written to out
+func buildBundleArchive(out io.Writer) error {
+	docker.ExportDocker()
+	if docker.ExportError != "" {
+		utils.Warn("[DRBundle] Docker export reported an error, bundle will use the last export: " + docker.ExportError)
+	}
+
+	gw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gw)
+
+	config := utils.GetBaseMainConfig()
+	configFolder := filepath.Clean(utils.CONFIGFOLDER)
+	configFile := filepath.Clean(utils.GetConfigFileName())
+
+	manifest := BundleManifest{
+		CreatedAt:    time.Now(),
+		Hostname:     config.HTTPConfig.Hostname,
+		ConfigFolder: utils.CONFIGFOLDER,
+		Files:        []string{},
+		Backups:      config.Backup.Backups,
+	}
+
+	err := filepath.Walk(configFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(configFolder, path)
+		if err != nil {
+			return err
+		}
+
+		// a dump left by a restore that could not load it is not part of the config
+		if info.IsDir() && rel == bundleDatabaseDump {
+			return filepath.SkipDir
+		}
+
+		if rel == "." || filepath.Clean(path) == configFile || bundleSkip(info) {
+			return nil
+		}
+
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		manifest.Files = append(manifest.Files, rel)
+		return addFileToTar(tw, path, "config/"+filepath.ToSlash(rel), info)
+	})
+	if err != nil {
+		return fmt.Errorf("[DRBundle] failed to read config folder: %w", err)
+	}
+
+	collections, err := addDatabaseToTar(tw)
+	manifest.Collections = collections
+	if err != nil {
+		utils.Warn("[DRBundle] the main database is not in the bundle: " + err.Error())
+		manifest.DatabaseMissing = err.Error()
+	}
+
+	// the config file can live outside of the config folder (CONFIG_FILE)
+	configContent, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("[DRBundle] failed to marshal config: %w", err)
+	}
+	if err := addBytesToTar(tw, bundleConfigFile, configContent); err != nil {
+		return err
+	}
+
+	manifestContent, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("[DRBundle] failed to marshal manifest: %w", err)
+	}
+	if err := addBytesToTar(tw, bundleManifestFile, manifestContent); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func bundleKey(password string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(password), salt, 1<<15, 8, 1, 32)
+}
+
+func bundleAEAD(password string, salt []byte) (cipher.AEAD, error) {
+	key, err := bundleKey(password, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func bundleNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, bundleNoncePrefixSize + 5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// bundleEncrypter seals what is written to it with AES-256-GCM, the key being derived from the password
+// with scrypt. Close seals the last chunk, without it the bundle cannot be decrypted
+type bundleEncrypter struct {
+	out     io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newBundleEncrypter(out io.Writer, password string) (*bundleEncrypter, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := bundleAEAD(password, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, bundleNoncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	header := append(append(append([]byte{}, bundleMagic...), salt...), prefix...)
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &bundleEncrypter{
+		out:    out,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, bundleChunkSize),
+	}, nil
+}
+
+func (e *bundleEncrypter) seal(chunk []byte, last bool) error {
+	sealed := e.aead.Seal(nil, bundleNonce(e.prefix, e.counter, last), chunk, bundleMagic)
+	e.counter++
+	_, err := e.out.Write(sealed)
+	return err
+}
+
+func (e *bundleEncrypter) Write(p []byte) (int, error) {
+	written := len(p)
+
+	for len(p) > 0 {
+		n := bundleChunkSize - len(e.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+
+		// a full chunk is only sealed once more data comes, the last chunk being sealed by Close
+		if len(e.buf) == bundleChunkSize && len(p) > 0 {
+			if err := e.seal(e.buf, false); err != nil {
+				return 0, err
+			}
+			e.buf = e.buf[:0]
+		}
+	}
+
+	return written, nil
+}
+
+func (e *bundleEncrypter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+// bundleDecrypter reads back what a bundleEncrypter wrote, failing on a wrong password or a truncated bundle
+type bundleDecrypter struct {
+	in      *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte
+	done    bool
+}
+
+func newBundleDecrypter(in io.Reader, password string) (*bundleDecrypter, error) {
+	reader := bufio.NewReader(in)
+
+	header := make([]byte, len(bundleMagic) + 16 + bundleNoncePrefixSize)
+	if _, err := io.ReadFull(reader, header); err != nil || !bytes.HasPrefix(header, bundleMagic) {
+		return nil, errors.New("[DRBundle] file is not a Cosmos DR bundle")
+	}
+
+	aead, err := bundleAEAD(password, header[len(bundleMagic):len(bundleMagic) + 16])
+	if err != nil {
+		return nil, err
+	}
+
+	return &bundleDecrypter{
+		in:     reader,
+		aead:   aead,
+		prefix: header[len(bundleMagic) + 16:],
+	}, nil
+}
+
+func (d *bundleDecrypter) Read(p []byte) (int, error) {
+	for len(d.chunk) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		sealed := make([]byte, bundleChunkSize + d.aead.Overhead())
+		n, err := io.ReadFull(d.in, sealed)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, errors.New("[DRBundle] bundle is truncated")
+		}
+
+		// the last chunk is the one not followed by anything
+		last := err == io.ErrUnexpectedEOF
+		if !last {
+			if _, errP := d.in.Peek(1); errP == io.EOF {
+				last = true
+			}
+		}
+
+		chunk, errO := d.aead.Open(nil, bundleNonce(d.prefix, d.counter, last), sealed[:n], bundleMagic)
+		if errO != nil {
+			return 0, errors.New("[DRBundle] cannot decrypt bundle, wrong password or corrupted file")
+		}
+
+		d.counter++
+		d.chunk = chunk
+		d.done = last
+	}
+
+	n := copy(p, d.chunk)
+	d.chunk = d.chunk[n:]
+	return n, nil
+}
+
+// CreateBundle writes an encrypted disaster recovery bundle of the whole server to out
+func CreateBundle(out io.Writer, password string) error {
+	if password == "" {
+		return errors.New("[DRBundle] a password is required to encrypt the bundle")
+	}
+
+	encrypter, err := newBundleEncrypter(out, password)
+	if err != nil {
+		return err
+	}
+
+	if err := buildBundleArchive(encrypter); err != nil {
+		return err
+	}
+
+	return encrypter.Close()
+}
+
+// bundleStream returns a reader of a bundle built as it is read, any failure to build it being returned by Read
+func bundleStream(password string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(CreateBundle(pw, password))
+	}()
+	return pr
+}
+
+// safeJoin prevents entries of the archive from escaping the destination folder
+func safeJoin(dest string, name string) (string, error) {
+	target := filepath.Join(dest, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dest, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("[DRBundle] invalid path in bundle: %s", name)
+	}
+	return target, nil
+}
+
+// ExtractBundle decrypts a bundle and writes its content into configFolder.
+// The config file is written to configFile. It returns the manifest of the bundle.
+func ExtractBundle(bundle io.Reader, password string, configFolder string, configFile string) (BundleManifest, error) {
+	manifest := BundleManifest{}
+
+	archive, err := newBundleDecrypter(bundle, password)
+	if err != nil {
+		return manifest, err
+	}
+
+	gr, err := gzip.NewReader(archive)
+	if err != nil {
+		return manifest, fmt.Errorf("[DRBundle] invalid archive: %w", err)
+	}
+	defer gr.Close()
+
+	if err := os.MkdirAll(configFolder, 0750); err != nil {
+		return manifest, err
+	}
+
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, fmt.Errorf("[DRBundle] invalid archive: %w", err)
+		}
+
+		var target string
+		switch {
+		case header.Name == bundleManifestFile:
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return manifest, fmt.Errorf("[DRBundle] invalid manifest: %w", err)
+			}
+			continue
+		case header.Name == bundleConfigFile:
+			target = configFile
+		case strings.HasPrefix(header.Name, bundleDatabaseFolder):
+			target, err = safeJoin(filepath.Join(configFolder, bundleDatabaseDump), strings.TrimPrefix(header.Name, bundleDatabaseFolder))
+			if err != nil {
+				return manifest, err
+			}
+		case strings.HasPrefix(header.Name, "config/"):
+			target, err = safeJoin(configFolder, strings.TrimPrefix(header.Name, "config/"))
+			if err != nil {
+				return manifest, err
+			}
+		default:
+			continue
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(target, os.FileMode(header.Mode)|0700); err != nil {
+				return manifest, err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+			return manifest, err
+		}
+
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)|0600)
+		if err != nil {
+			return manifest, err
+		}
+
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return manifest, err
+		}
+	}
+
+	return manifest, nil
+}
+
+// RestoreBundle rebuilds a host from a bundle: config, database, constellation keys
+// and finally the containers from the cosmos-compose export
+func RestoreBundle(bundlePath string, password string, force bool, OnLog func(string)) error {
+	bundleFile, err := os.Open(bundlePath)
+	if err != nil {
+		return fmt.Errorf("[DRBundle] cannot read bundle: %w", err)
+	}
+	defer bundleFile.Close()
+
+	configFile := utils.GetConfigFileName()
+	if _, err := os.Stat(configFile); err == nil && !force {
+		return fmt.Errorf("[DRBundle] %s already exists, use --force to overwrite this host", configFile)
+	}
+
+	OnLog("Extracting bundle to " + utils.CONFIGFOLDER)
+
+	manifest, err := ExtractBundle(bundleFile, password, utils.CONFIGFOLDER, configFile)
+	if err != nil {
+		return err
+	}
+
+	OnLog(fmt.Sprintf("Restored %d files from bundle created on %s for %s", len(manifest.Files), manifest.CreatedAt.Format(time.RFC3339), manifest.Hostname))
+	if manifest.DatabaseMissing != "" {
+		OnLog("The bundle has no copy of the main database: " + manifest.DatabaseMissing)
+	}
+
+	utils.LoadBaseMainConfig(utils.ReadConfigFromFile())
+
+	composeContent, err := ioutil.ReadFile(utils.CONFIGFOLDER + bundleComposeFile)
+	if err != nil {
+		return fmt.Errorf("[DRBundle] bundle has no cosmos-compose export: %w", err)
+	}
+
+	var compose docker.DockerServiceCreateRequest
+	if err := json.Unmarshal(composeContent, &compose); err != nil {
+		return fmt.Errorf("[DRBundle] invalid cosmos-compose export: %w", err)
+	}
+
+	if len(compose.Services) == 0 {
+		OnLog("No containers to recreate")
+		return restoreDatabaseDump(utils.CONFIGFOLDER, OnLog)
+	}
+
+	if err := docker.Connect(); err != nil {
+		return fmt.Errorf("[DRBundle] cannot connect to docker to recreate containers: %w", err)
+	}
+
+	OnLog(fmt.Sprintf("Recreating %d containers", len(compose.Services)))
+
+	if err := docker.CreateService(compose, OnLog); err != nil {
+		return fmt.Errorf("[DRBundle] failed to recreate containers: %w", err)
+	}
+
+	OnLog(fmt.Sprintf("Restoring %d collections of the database", len(manifest.Collections)))
+
+	if err := restoreDatabaseDump(utils.CONFIGFOLDER, OnLog); err != nil {
+		return err
+	}
+
+	for name, backup := range manifest.Backups {
+		OnLog("Backup definition restored: " + name + " (" + backup.Repository + ")")
+	}
+
+	return nil
+}
+
+// CreateBundleJob schedules an encrypted bundle to be pushed to the repository of an existing backup
+func CreateBundleJob(bundle utils.DRBundleConfig, repo utils.SingleBackupConfig) {
+	utils.Log("Creating DR bundle job to " + repo.Repository + " with crontab " + bundle.Crontab)
+
+	engine, err := GetEngine(repo.Engine)
+	if err != nil {
+		utils.MajorError("Cannot create DR bundle job", err)
+		return
+	}
+
+	retention := defaultBundleRetentionPolicy
+	if bundle.Retention != nil {
+		retention = RetentionPolicyString(*bundle.Retention)
+	}
+
+	// the bundle is built while the engine reads it, then the old bundles are forgotten. The forget job of
+	// the backup only covers its own tag
+	job := jobSteps(
+		engine.Backup(BackupConfig{
+			Repository: repo.Repository,
+			Password:   repo.Password,
+			Source:     "cosmos.cosmos-dr",
+			Stdin:      func() io.ReadCloser { return bundleStream(bundle.Password) },
+			Name:       repo.Name,
+			Tags:       []string{BundleTag},
+		}),
+		engine.Forget(BackupConfig{
+			Repository: repo.Repository,
+			Password:   repo.Password,
+			Name:       repo.Name,
+			Tags:       []string{BundleTag},
+			Retention:  retention,
+		}),
+	)
+
+	cron.RegisterJob(cron.ConfigJob{
+		Scheduler:   "Restic",
+		Name:        engine.Label() + " DR bundle",
+		Cancellable: true,
+		Job: func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+			OnLog("Sending DR bundle to " + repo.Repository)
+			job(OnLog, OnFail, OnSuccess, ctx, cancel)
+		},
+		Crontab:  bundle.Crontab,
+		Resource: "backup@" + repo.Name,
+	})
+}
+
+func DownloadBundleRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		var request struct {
+			Password string `json:"password"`
+		}
+
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			utils.Error("DownloadBundle: Invalid request", err)
+			utils.HTTPError(w, "Invalid request: "+err.Error(), http.StatusBadRequest, "BCK001")
+			return
+		}
+
+		if len(request.Password) < 8 {
+			utils.HTTPError(w, "Bundle password must be at least 8 characters", http.StatusBadRequest, "BCK012")
+			return
+		}
+
+		// the bundle is streamed as it is built, a failure can only abort the download
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"cosmos-"+time.Now().Format("2006-01-02")+".cosmos-dr\"")
+		w.WriteHeader(http.StatusOK)
+
+		counter := &countingWriter{out: w}
+		if err := CreateBundle(counter, request.Password); err != nil {
+			utils.Error("DownloadBundle: Failed to create bundle", err)
+			panic(http.ErrAbortHandler)
+		}
+
+		utils.TriggerEvent(
+			"cosmos.backup.bundle",
+			"DR bundle downloaded",
+			"important",
+			"",
+			map[string]interface{}{
+				"size": counter.size,
+			})
+	} else {
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+	}
+}
+
+type countingWriter struct {
+	out  io.Writer
+	size int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.out.Write(p)
+	c.size += int64(n)
+	return n, err
+}
+
+func EditBundleRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		var request utils.DRBundleConfig
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			utils.Error("EditBundle: Invalid request", err)
+			utils.HTTPError(w, "Invalid request: "+err.Error(), http.StatusBadRequest, "BCK001")
+			return
+		}
+
+		config := utils.GetMainConfig()
+
+		if request.Enabled {
+			if _, exists := config.Backup.Backups[request.Backup]; !exists {
+				utils.HTTPError(w, "Backup does not exist", http.StatusBadRequest, "BCK002")
+				return
+			}
+
+			if request.Crontab == "" {
+				utils.HTTPError(w, "Crontab is required", http.StatusBadRequest, "BCK014")
+				return
+			}
+		}
+
+		// keep the existing password if none is provided, the bundles cannot be decrypted without it
+		if request.Password == "" {
+			request.Password = config.Backup.DRBundle.Password
+		}
+		if request.Enabled && len(request.Password) < 8 {
+			utils.HTTPError(w, "Bundle password must be at least 8 characters", http.StatusBadRequest, "BCK012")
+			return
+		}
+
+		if request.Retention != nil {
+			if err := ValidateRetentionPolicy(*request.Retention, config.Backup.Backups[request.Backup].Engine); err != nil {
+				utils.HTTPError(w, "Invalid retention policy: "+err.Error(), http.StatusBadRequest, "BCK019")
+				return
+			}
+		}
+
+		config.Backup.DRBundle = request
+		utils.SetBaseMainConfig(config)
+		go InitBackups()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "OK",
+			"message": "Edited DR bundle schedule",
+		})
+	} else {
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+	}
+}
@@ -0,0 +1,192 @@
+package backups
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// The main MongoDB database is shipped in the bundle as one file of extended JSON documents per
+// collection. On restore, the dump is extracted next to the config and loaded once the containers,
+// including the database one, are recreated
+
+const bundleDatabaseFolder = "mongodb/"
+
+// folder of the config folder the dump is extracted to until it is loaded
+const bundleDatabaseDump = "mongodb-dump"
+
+// restoring a collection inserts its documents in batches
+const bundleDatabaseBatch = 500
+
+// addDatabaseToTar dumps the collections of the main database, it returns their names
+func addDatabaseToTar(tw *tar.Writer) ([]string, error) {
+	collections := []string{}
+
+	db, err := utils.GetDatabase()
+	if err != nil {
+		return collections, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Minute)
+	defer cancel()
+
+	names, err := db.ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return collections, err
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.") {
+			continue
+		}
+
+		cursor, err := db.Collection(name).Find(ctx, bson.D{})
+		if err != nil {
+			return collections, fmt.Errorf("cannot read collection %s: %w", name, err)
+		}
+
+		// a tar entry needs its size first, the collection is dumped to a temp file rather than in memory
+		if err := addCollectionToTar(ctx, tw, name, cursor); err != nil {
+			return collections, err
+		}
+
+		collections = append(collections, name)
+	}
+
+	return collections, nil
+}
+
+func addCollectionToTar(ctx context.Context, tw *tar.Writer, name string, cursor *mongo.Cursor) error {
+	defer cursor.Close(ctx)
+
+	dump, err := ioutil.TempFile("", "cosmos-dr-collection-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dump.Name())
+	defer dump.Close()
+
+	content := bufio.NewWriter(dump)
+	for cursor.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cursor.Current, true, false)
+		if err != nil {
+			return fmt.Errorf("cannot export collection %s: %w", name, err)
+		}
+		content.Write(line)
+		content.WriteByte('\n')
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("cannot read collection %s: %w", name, err)
+	}
+	if err := content.Flush(); err != nil {
+		return fmt.Errorf("cannot export collection %s: %w", name, err)
+	}
+
+	info, err := dump.Stat()
+	if err != nil {
+		return err
+	}
+
+	return addFileToTar(tw, dump.Name(), bundleDatabaseFolder + name + ".jsonl", info)
+}
+
+// restoreDatabaseDump loads the dump extracted from a bundle into the main database, replacing the
+// collections it contains. The dump is removed once loaded
+func restoreDatabaseDump(configFolder string, OnLog func(string)) error {
+	dumpFolder := filepath.Join(configFolder, bundleDatabaseDump)
+
+	files, err := ioutil.ReadDir(dumpFolder)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the database container may still be starting
+	var db *mongo.Database
+	for attempt := 0; attempt < 10; attempt++ {
+		db, err = utils.GetDatabase()
+		if err == nil {
+			break
+		}
+		OnLog("Waiting for the database: " + err.Error())
+		time.Sleep(5 * time.Second)
+	}
+	if err != nil {
+		return fmt.Errorf("[DRBundle] cannot connect to the database, the dump is kept in %s: %w", dumpFolder, err)
+	}
+
+	ctx := context.Background()
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".jsonl") {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), ".jsonl")
+
+		f, err := os.Open(filepath.Join(dumpFolder, file.Name()))
+		if err != nil {
+			return err
+		}
+
+		collection := db.Collection(name)
+		if err := collection.Drop(ctx); err != nil {
+			f.Close()
+			return fmt.Errorf("[DRBundle] cannot replace collection %s: %w", name, err)
+		}
+
+		count := 0
+		batch := []interface{}{}
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			_, err := collection.InsertMany(ctx, batch)
+			count += len(batch)
+			batch = []interface{}{}
+			return err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 1024 * 1024), 64 * 1024 * 1024)
+		for scanner.Scan() {
+			var document bson.D
+			if err := bson.UnmarshalExtJSON(scanner.Bytes(), true, &document); err != nil {
+				f.Close()
+				return fmt.Errorf("[DRBundle] invalid document in collection %s: %w", name, err)
+			}
+
+			batch = append(batch, document)
+			if len(batch) >= bundleDatabaseBatch {
+				if err := flush(); err != nil {
+					f.Close()
+					return fmt.Errorf("[DRBundle] cannot restore collection %s: %w", name, err)
+				}
+			}
+		}
+		err = scanner.Err()
+		if err == nil {
+			err = flush()
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("[DRBundle] cannot restore collection %s: %w", name, err)
+		}
+
+		OnLog(fmt.Sprintf("Restored %d documents in collection %s", count, name))
+	}
+
+	return os.RemoveAll(dumpFolder)
+}
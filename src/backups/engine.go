@@ -0,0 +1,134 @@
+package backups
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/azukaar/cosmos-server/src/cron"
+)
+
+// BackupEngine is the tool storing the snapshots of a backup (restic, borg...).
+// Listing and stats outputs are JSON strings in the restic format, so that the API
+// and the UI do not need to know which engine a backup is using.
+type BackupEngine interface {
+	// Label is the name of the engine displayed in job names
+	Label() string
+
+	Init(repository, password string) error
+	Check(repository, password string) error
+	DeleteRepository(repository, password string) error
+
+	Backup(config BackupConfig) cron.ExecuterFn
+	Forget(config BackupConfig) cron.ExecuterFn
+	// ForgetDryRun returns the snapshots the retention would keep and remove, in the restic forget format
+	ForgetDryRun(repository, password string, tags []string, retention string) (string, error)
+	ForgetSnapshot(repository, password, snapshot string) error
+	DeleteByTag(repository, password, tag string) error
+
+	ListSnapshots(repository, password string, tags []string) (string, error)
+	Ls(repository, password, snapshotID, path string) (string, error)
+	Restore(config RestoreConfig) cron.ExecuterFn
+
+	Stats(repository, password string) (string, error)
+	StatsSubfolder(repository, password, snapshot, path string) (string, error)
+}
+
+const DefaultEngine = "restic"
+
+var engines = map[string]BackupEngine{
+	"restic": ResticEngine{},
+	"borg":   BorgEngine{},
+}
+
+// EngineName returns the name of the engine, restic being the default
+func EngineName(name string) string {
+	if name == "" {
+		return DefaultEngine
+	}
+	return name
+}
+
+// GetEngine returns the engine with the given name
+func GetEngine(name string) (BackupEngine, error) {
+	name = EngineName(name)
+
+	engine, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backup engine: %s", name)
+	}
+
+	return engine, nil
+}
+
+// ListEngines returns the names of the available engines
+func ListEngines() []string {
+	names := []string{}
+	for name := range engines {
+		names = append(names, name)
+	}
+	return names
+}
+
+// commandJob is a cron job running a command in dir, streaming its output to the job logs. When stdin is
+// set, it is opened for each run and piped to the command
+func commandJob(command string, env []string, dir string, stdin func() io.ReadCloser, args ...string) cron.ExecuterFn {
+	return func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+		cmd := exec.CommandContext(ctx, command, args...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Dir = dir
+
+		if stdin != nil {
+			in := stdin()
+			// unblocks the producer if the command exits before reading everything
+			defer in.Close()
+			cmd.Stdin = in
+		}
+
+		pipe, err := cmd.StdoutPipe()
+		if err != nil {
+			OnFail(err)
+			return
+		}
+		cmd.Stderr = cmd.Stdout
+
+		if err := cmd.Start(); err != nil {
+			OnFail(fmt.Errorf("failed to start %s: %v", command, err))
+			return
+		}
+
+		scanner := bufio.NewScanner(pipe)
+		for scanner.Scan() {
+			OnLog(scanner.Text() + "\n")
+		}
+
+		if err := cmd.Wait(); err != nil {
+			OnFail(fmt.Errorf("command failed: %v", err))
+			return
+		}
+
+		OnSuccess()
+	}
+}
+
+// jobSteps runs jobs one after the other, stopping at the first failure
+func jobSteps(jobs ...cron.ExecuterFn) cron.ExecuterFn {
+	return func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+		for _, job := range jobs {
+			var stepErr error
+			job(OnLog, func(err error) {
+				stepErr = err
+			}, func() {}, ctx, cancel)
+
+			if stepErr != nil {
+				OnFail(stepErr)
+				return
+			}
+		}
+
+		OnSuccess()
+	}
+}
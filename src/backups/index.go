@@ -60,6 +60,7 @@ func InitBackups() {
 			CrontabForget: intBack.CrontabForget,
 			RetentionPolicy: intBack.RetentionPolicy,
 			Name:       "Cosmos Internal Backup",
+			Engine:     intBack.Engine,
 		}
 
 		utils.SetBaseMainConfig(config)
@@ -68,31 +69,53 @@ func InitBackups() {
 
 
 	for _, repo := range Repositories {
-		err := CheckRepository(repo.Repository, repo.Password)
+		engine, err := GetEngine(repo.Engine)
+		if err == nil {
+			err = engine.Check(repo.Repository, repo.Password)
+		}
 
 		if err != nil {
 			utils.MajorError("Backups destination unavailable", err)
 		} else {
 			// create backup job
 			CreateBackupJob(BackupConfig{
+				Engine:     repo.Engine,
 				Repository: repo.Repository,
 				Password:   repo.Password,
 				Source:     repo.Source,
 				Name:       repo.Name,
 				AutoStopContainers: repo.AutoStopContainers,
 				Tags:       []string{repo.Name},
+				Timeout:    repo.Timeout,
+				Retries:    repo.Retries,
+				RetryBackoff: repo.RetryBackoff,
+				NotifyOnFailure: repo.NotifyOnFailure,
 				// Exclude:    repo.Exclude,
 			}, repo.Crontab)
 			
 			// create backup job
 			CreateForgetJob(BackupConfig{
+				Engine:     repo.Engine,
 				Repository: repo.Repository,
 				Password:   repo.Password,
 				Source:     repo.Source,
 				Name:       repo.Name,
 				Tags:       []string{repo.Name},
 				Retention:  repo.RetentionPolicy,
+				Timeout:    repo.Timeout,
+				Retries:    repo.Retries,
+				RetryBackoff: repo.RetryBackoff,
+				NotifyOnFailure: repo.NotifyOnFailure,
 			}, repo.CrontabForget)
 		}
 	}
+
+	bundle := config.Backup.DRBundle
+	if bundle.Enabled {
+		if repo, ok := config.Backup.Backups[bundle.Backup]; ok {
+			CreateBundleJob(bundle, repo)
+		} else {
+			utils.MajorError("DR bundle destination " + bundle.Backup + " does not exist", nil)
+		}
+	}
 }
\ No newline at end of file
@@ -0,0 +1,176 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"strings"
+	"context"
+	"io"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+	"github.com/azukaar/cosmos-server/src/cron"
+	"github.com/azukaar/cosmos-server/src/docker"
+)
+
+const defaultRetentionPolicy = "--keep-last 3 --keep-daily 7 --keep-weekly 8 --keep-yearly 3"
+
+type BackupConfig struct {
+	Engine     string
+	Repository string
+	Password   string
+	Source     string
+	// when set, the snapshot is made of what Stdin reads, opened for each run, and Source only names the file
+	Stdin      func() io.ReadCloser
+	Name       string
+	Tags       []string
+	Exclude    []string
+	Retention	 string
+	AutoStopContainers bool
+	Timeout string
+	Retries int
+	RetryBackoff string
+	NotifyOnFailure []utils.AlertAction
+}
+
+// ValidateRetryPolicy checks the timeout, retries and retry backoff of the jobs of a backup
+func ValidateRetryPolicy(config utils.SingleBackupConfig) error {
+	if config.Retries < 0 {
+		return errors.New("retries cannot be negative")
+	}
+	if config.Timeout != "" {
+		if _, err := time.ParseDuration(config.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout %s: %w", config.Timeout, err)
+		}
+	}
+	if config.RetryBackoff != "" {
+		if _, err := time.ParseDuration(config.RetryBackoff); err != nil {
+			return fmt.Errorf("invalid retry backoff %s: %w", config.RetryBackoff, err)
+		}
+	}
+	return nil
+}
+
+// backupJob is the job of a backup, with its retry policy
+func backupJob(config BackupConfig, job cron.ConfigJob) cron.ConfigJob {
+	job.Retries = config.Retries
+	job.NotifyOnFailure = config.NotifyOnFailure
+	cron.SetJobRetryPolicy(&job, config.Timeout, config.RetryBackoff)
+	return job
+}
+
+// withStoppedContainers runs job with the containers using path stopped, and restarts them afterward
+func withStoppedContainers(path string, job cron.ExecuterFn) cron.ExecuterFn {
+	return func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+		containers, err := docker.GetContainersUsingPath(path)
+		if err != nil {
+			OnFail(err)
+			return
+		}
+
+		OnLog("Found container(s) using path: " + strings.Join(containers, ", "))
+
+		// Stop all containers
+		err = docker.StopContainers(containers)
+		if err != nil {
+			docker.StartContainers(containers)
+			OnFail(err)
+			return
+		}
+
+		OnLog("Stopped containers, starting job")
+
+		job(OnLog, OnFail, OnSuccess, ctx, cancel)
+
+		// Start all containers
+		err = docker.StartContainers(containers)
+		if err != nil {
+			OnFail(err)
+			return
+		}
+	}
+}
+
+// CreateBackupJob creates a backup job configuration
+func CreateBackupJob(config BackupConfig, crontab string) {
+	utils.Log("Creating backup job for " + config.Name + " with crontab " + crontab)
+
+	engine, err := GetEngine(config.Engine)
+	if err != nil {
+		utils.MajorError("Cannot create backup job for " + config.Name, err)
+		return
+	}
+
+	job := engine.Backup(config)
+	if config.AutoStopContainers {
+		job = withStoppedContainers(config.Source, job)
+	}
+
+	cron.RegisterJob(backupJob(config, cron.ConfigJob{
+		Scheduler:   "Restic",
+		Name:       fmt.Sprintf("%s backup %s", engine.Label(), config.Name),
+		Cancellable: true,
+		Job:        job,
+		Crontab: 		 crontab,
+		Resource:   "backup@" + config.Name,
+	}))
+}
+
+func CreateForgetJob(config BackupConfig, crontab string) {
+	utils.Log("Creating forget job for " + config.Name + " with crontab " + crontab)
+
+	engine, err := GetEngine(config.Engine)
+	if err != nil {
+		utils.MajorError("Cannot create forget job for " + config.Name, err)
+		return
+	}
+
+	if config.Retention == "" {
+		config.Retention = defaultRetentionPolicy
+	}
+
+	cron.RegisterJob(backupJob(config, cron.ConfigJob{
+		Scheduler:   "Restic",
+		Name:       fmt.Sprintf("%s forget %s", engine.Label(), config.Name),
+		Cancellable: true,
+		Job:        engine.Forget(config),
+		Crontab: 		 crontab,
+		Resource:   "backup@" + config.Name,
+	}))
+}
+
+type RestoreConfig struct {
+	Engine      string
+	Repository  string
+	Password    string
+	SnapshotID  string
+	Target      string
+	Name        string
+	Include     []string
+	OriginalSource string
+	AutoStopContainers bool
+}
+
+// CreateRestoreJob creates a restore job configuration
+func CreateRestoreJob(config RestoreConfig) {
+	engine, err := GetEngine(config.Engine)
+	if err != nil {
+		utils.MajorError("Cannot create restore job for " + config.Name, err)
+		return
+	}
+
+	job := engine.Restore(config)
+	if config.AutoStopContainers {
+		job = withStoppedContainers(config.OriginalSource, job)
+	}
+
+	go (func() {
+		cron.RunOneTimeJob(cron.ConfigJob{
+			Scheduler:    "Restic",
+			Name:         fmt.Sprintf("%s restore %s", engine.Label(), config.Name),
+			Cancellable:  true,
+			Job:          job,
+			Resource: "backup@" + config.Name,
+		})
+	})()
+}
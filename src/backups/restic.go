@@ -5,14 +5,13 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strings"
-	"context"
 
 	"github.com/creack/pty"
 	"github.com/azukaar/cosmos-server/src/utils"
 	"github.com/azukaar/cosmos-server/src/cron"
-	"github.com/azukaar/cosmos-server/src/docker"
 	"encoding/json"
 )
 
@@ -229,192 +228,6 @@ func StatsRepositorySubfolder(repository, password, snapshot, path string) (stri
 	return output,err
 }
 
-type BackupConfig struct {
-	Repository string
-	Password   string
-	Source     string
-	Name       string
-	Tags       []string
-	Exclude    []string
-	Retention	 string
-	AutoStopContainers bool
-}
-
-// CreateBackupJob creates a backup job configuration
-func CreateBackupJob(config BackupConfig, crontab string) {
-	utils.Log("Creating backup job for " + config.Name + " with crontab " + crontab)
-
-	args := []string{"backup", "--repo", config.Repository, config.Source}
-
-	// Add tags if specified
-	for _, tag := range config.Tags {
-		args = append(args, "--tag", tag)
-	}
-
-	// Add exclude patterns if specified
-	for _, exclude := range config.Exclude {
-		args = append(args, "--exclude", exclude)
-	}
-
-	env := []string{
-		fmt.Sprintf("RESTIC_PASSWORD=%s", config.Password),
-	}
-
-	cron.RegisterJob(cron.ConfigJob{
-		Scheduler:   "Restic",
-		Name:       fmt.Sprintf("Restic backup %s", config.Name),
-		Cancellable: true,
-		Job:  func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
-			var containers []string
-			var err error
-
-			if config.AutoStopContainers {
-				containers, err = docker.GetContainersUsingPath(config.Source)
-				if err != nil {
-					OnFail(err)
-					return
-				}
-
-				OnLog("Found container(s) using path: " + strings.Join(containers, ", "))
-
-
-				// Stop all containers
-				err = docker.StopContainers(containers)
-				if err != nil {
-					docker.StartContainers(containers)
-					OnFail(err)
-					return
-				}
-
-				OnLog("Stopped containers, starting backup")
-			}
-
-			cron.JobFromCommandWithEnv(env, "./restic", prependResticArgs(args)...)(OnLog, OnFail, OnSuccess, ctx, cancel)
-		
-			if config.AutoStopContainers {
-				// Start all containers
-				err = docker.StartContainers(containers)
-				if err != nil {
-					OnFail(err)
-					return
-				}
-			}
-		},
-		Crontab: 		 crontab,
-		Resource:   "backup@" + config.Name,
-	})
-}
-
-func CreateForgetJob(config BackupConfig, crontab string) {
-	utils.Log("Creating forget job for " + config.Name + " with crontab " + crontab)
-
-	args := []string{"forget", "--repo", config.Repository, "--prune"}
-
-	ret := config.Retention
-	if ret == "" {
-		ret = "--keep-last 3 --keep-daily 7 --keep-weekly 8 --keep-yearly 3"
-	}
-
-	retArr := strings.Split(ret, " ")
-	args = append(args, retArr...)
-
-	// Add tags if specified
-	for _, tag := range config.Tags {
-		args = append(args, "--tag", tag)
-	}
-
-	env := []string{
-		fmt.Sprintf("RESTIC_PASSWORD=%s", config.Password),
-	}
-
-	cron.RegisterJob(cron.ConfigJob{
-		Scheduler:   "Restic",
-		Name:       fmt.Sprintf("Restic forget %s", config.Name),
-		Cancellable: true,
-		Job:        cron.JobFromCommandWithEnv(env, "./restic", prependResticArgs(args)...),
-		Crontab: 		 crontab,
-		Resource:   "backup@" + config.Name,
-	})
-}
-
-type RestoreConfig struct {
-	Repository  string
-	Password    string
-	SnapshotID  string
-	Target      string
-	Name        string
-	Include     []string
-	OriginalSource string
-	AutoStopContainers bool
-}
-
-// CreateRestoreJob creates a restore job configuration
-func CreateRestoreJob(config RestoreConfig) {
-	args := []string{
-		"restore",
-		"--repo", config.Repository,
-		config.SnapshotID + ":/" + config.OriginalSource,
-		"--target", config.Target,
-	}
-
-	// Add include patterns if specified
-	for _, include := range config.Include {
-		//remove OriginalSource from include path
-		include := strings.TrimPrefix(include, config.OriginalSource)
-		utils.Debug("[RESTIC] Restore includes: " + include)
-		args = append(args, "--include", include)
-	}
-
-	env := []string{
-		fmt.Sprintf("RESTIC_PASSWORD=%s", config.Password),
-	}
-
-	go (func() {
-		cron.RunOneTimeJob(cron.ConfigJob{
-			Scheduler:    "Restic",
-			Name:         fmt.Sprintf("Restic restore %s", config.Name),
-			Cancellable:  true,
-			Job:            func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
-				var containers []string
-				var err error
-	
-				if config.AutoStopContainers {
-					containers, err = docker.GetContainersUsingPath(config.OriginalSource)
-					if err != nil {
-						OnFail(err)
-						return
-					}
-	
-					OnLog("Found container(s) using path: " + strings.Join(containers, ", "))
-	
-	
-					// Stop all containers
-					err = docker.StopContainers(containers)
-					if err != nil {
-						docker.StartContainers(containers)
-						OnFail(err)
-						return
-					}
-	
-					OnLog("Stopped containers, starting backup")
-				}
-	
-				cron.JobFromCommandWithEnv(env, "./restic", prependResticArgs(args)...)(OnLog, OnFail, OnSuccess, ctx, cancel)
-			
-				if config.AutoStopContainers {
-					// Start all containers
-					err = docker.StartContainers(containers)
-					if err != nil {
-						OnFail(err)
-						return
-					}
-				}
-			},
-			Resource: "backup@" + config.Name,
-		})
-	})()
-}
-
 // ListSnapshots returns a list of all snapshots in the repository
 func ListSnapshots(repository, password string) (string, error) {
 	args := []string{
@@ -554,3 +367,131 @@ func ForgetSnapshot(repository, password, snapshot string) error {
 
 	return nil
 }
+
+// ResticEngine is the default backup engine, wrapping the bundled restic binary
+type ResticEngine struct{}
+
+func (ResticEngine) Label() string {
+	return "Restic"
+}
+
+func (ResticEngine) Init(repository, password string) error {
+	return CreateRepository(repository, password)
+}
+
+func (ResticEngine) Check(repository, password string) error {
+	return CheckRepository(repository, password)
+}
+
+func (ResticEngine) DeleteRepository(repository, password string) error {
+	return DeleteRepository(repository)
+}
+
+func (ResticEngine) Backup(config BackupConfig) cron.ExecuterFn {
+	args := []string{"backup", "--repo", config.Repository, config.Source}
+	if config.Stdin != nil {
+		args = []string{"backup", "--repo", config.Repository, "--stdin", "--stdin-filename", filepath.Base(config.Source)}
+	}
+
+	// Add tags if specified
+	for _, tag := range config.Tags {
+		args = append(args, "--tag", tag)
+	}
+
+	// Add exclude patterns if specified
+	for _, exclude := range config.Exclude {
+		args = append(args, "--exclude", exclude)
+	}
+
+	env := []string{
+		fmt.Sprintf("RESTIC_PASSWORD=%s", config.Password),
+	}
+
+	// the pty of JobFromCommandWithEnv would alter a binary stdin
+	if config.Stdin != nil {
+		return commandJob("./restic", env, "", config.Stdin, prependResticArgs(args)...)
+	}
+
+	return cron.JobFromCommandWithEnv(env, "./restic", prependResticArgs(args)...)
+}
+
+func (ResticEngine) Forget(config BackupConfig) cron.ExecuterFn {
+	args := []string{"forget", "--repo", config.Repository, "--prune"}
+	args = append(args, strings.Fields(config.Retention)...)
+
+	// Add tags if specified
+	for _, tag := range config.Tags {
+		args = append(args, "--tag", tag)
+	}
+
+	env := []string{
+		fmt.Sprintf("RESTIC_PASSWORD=%s", config.Password),
+	}
+
+	return cron.JobFromCommandWithEnv(env, "./restic", prependResticArgs(args)...)
+}
+
+func (ResticEngine) ForgetDryRun(repository, password string, tags []string, retention string) (string, error) {
+	args := []string{"forget", "--repo", repository, "--dry-run", "--json"}
+	args = append(args, strings.Fields(retention)...)
+
+	for _, tag := range tags {
+		args = append(args, "--tag", tag)
+	}
+
+	env := []string{fmt.Sprintf("RESTIC_PASSWORD=%s", password)}
+
+	output, err := ExecRestic(args, env)
+	if err != nil {
+		return "", fmt.Errorf("[Restic] failed to preview forget: %w", err)
+	}
+
+	return output, nil
+}
+
+func (ResticEngine) ForgetSnapshot(repository, password, snapshot string) error {
+	return ForgetSnapshot(repository, password, snapshot)
+}
+
+func (ResticEngine) DeleteByTag(repository, password, tag string) error {
+	return DeleteByTag(repository, password, tag)
+}
+
+func (ResticEngine) ListSnapshots(repository, password string, tags []string) (string, error) {
+	return ListSnapshotsWithFilters(repository, password, tags, "", "")
+}
+
+func (ResticEngine) Ls(repository, password, snapshotID, path string) (string, error) {
+	return ListDirectory(repository, password, snapshotID, path)
+}
+
+func (ResticEngine) Restore(config RestoreConfig) cron.ExecuterFn {
+	args := []string{
+		"restore",
+		"--repo", config.Repository,
+		config.SnapshotID + ":/" + config.OriginalSource,
+		"--target", config.Target,
+	}
+
+	// Add include patterns if specified
+	for _, include := range config.Include {
+		//remove OriginalSource from include path
+		include := strings.TrimPrefix(include, config.OriginalSource)
+		utils.Debug("[RESTIC] Restore includes: " + include)
+		args = append(args, "--include", include)
+	}
+
+	env := []string{
+		fmt.Sprintf("RESTIC_PASSWORD=%s", config.Password),
+	}
+
+	return cron.JobFromCommandWithEnv(env, "./restic", prependResticArgs(args)...)
+}
+
+func (ResticEngine) Stats(repository, password string) (string, error) {
+	return StatsRepository(repository, password)
+}
+
+func (ResticEngine) StatsSubfolder(repository, password, snapshot, path string) (string, error) {
+	return StatsRepositorySubfolder(repository, password, snapshot, path)
+}
@@ -0,0 +1,276 @@
+package backups
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+var retentionDurationRegex = regexp.MustCompile(`^(\d+y)?(\d+m)?(\d+d)?(\d+h)?$`)
+
+// borg --keep-within only takes a single interval, with H for hours
+var borgRetentionDurationRegex = regexp.MustCompile(`^\d+[Hdwmy]$`)
+
+// ParseRetentionPolicy reads a retention policy written as restic forget flags (ex: "--keep-last 3 --keep-daily 7")
+func ParseRetentionPolicy(policy string) (utils.BackupRetentionPolicy, error) {
+	result := utils.BackupRetentionPolicy{}
+	fields := strings.Fields(policy)
+
+	for i := 0; i < len(fields); i++ {
+		flag := fields[i]
+		value := ""
+
+		if strings.Contains(flag, "=") {
+			parts := strings.SplitN(flag, "=", 2)
+			flag, value = parts[0], parts[1]
+		} else if i+1 < len(fields) {
+			value = fields[i+1]
+			i++
+		} else {
+			return result, fmt.Errorf("missing value for %s", flag)
+		}
+
+		if flag == "--keep-within" {
+			result.KeepWithin = value
+			continue
+		}
+		if flag == "--keep-tag" {
+			result.KeepTags = append(result.KeepTags, value)
+			continue
+		}
+
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return result, fmt.Errorf("invalid value for %s: %s", flag, value)
+		}
+
+		switch flag {
+		case "--keep-last":
+			result.KeepLast = count
+		case "--keep-hourly":
+			result.KeepHourly = count
+		case "--keep-daily":
+			result.KeepDaily = count
+		case "--keep-weekly":
+			result.KeepWeekly = count
+		case "--keep-monthly":
+			result.KeepMonthly = count
+		case "--keep-yearly":
+			result.KeepYearly = count
+		default:
+			return result, fmt.Errorf("unknown retention option: %s", flag)
+		}
+	}
+
+	return result, nil
+}
+
+// ValidateRetentionPolicy makes sure a policy keeps at least something, so forget never empties a backup,
+// and that the engine of the backup can apply all of its rules
+func ValidateRetentionPolicy(policy utils.BackupRetentionPolicy, engine string) error {
+	isBorg := EngineName(engine) == "borg"
+
+	counts := map[string]int{
+		"KeepLast":    policy.KeepLast,
+		"KeepHourly":  policy.KeepHourly,
+		"KeepDaily":   policy.KeepDaily,
+		"KeepWeekly":  policy.KeepWeekly,
+		"KeepMonthly": policy.KeepMonthly,
+		"KeepYearly":  policy.KeepYearly,
+	}
+
+	keeps := false
+	for name, count := range counts {
+		if count < 0 {
+			return fmt.Errorf("%s cannot be negative", name)
+		}
+		if count > 0 {
+			keeps = true
+		}
+	}
+
+	if policy.KeepWithin != "" {
+		if isBorg {
+			if !borgRetentionDurationRegex.MatchString(policy.KeepWithin) {
+				return fmt.Errorf("invalid KeepWithin duration for borg: %s (expected a single interval, ex: 12H, 7d, 2w, 6m, 1y)", policy.KeepWithin)
+			}
+		} else if !retentionDurationRegex.MatchString(policy.KeepWithin) {
+			return fmt.Errorf("invalid KeepWithin duration: %s (expected ex: 1y2m3d4h)", policy.KeepWithin)
+		}
+		keeps = true
+	}
+
+	if isBorg && len(policy.KeepTags) > 0 {
+		return errors.New("KeepTags is not supported by borg")
+	}
+
+	for _, tag := range policy.KeepTags {
+		if strings.TrimSpace(tag) == "" || strings.ContainsAny(tag, " ,") {
+			return fmt.Errorf("invalid KeepTags tag: %q", tag)
+		}
+	}
+
+	if !keeps {
+		return errors.New("retention policy needs at least one keep rule")
+	}
+
+	return nil
+}
+
+// RetentionPolicyString writes a policy as restic forget flags
+func RetentionPolicyString(policy utils.BackupRetentionPolicy) string {
+	args := []string{}
+
+	add := func(flag string, count int) {
+		if count > 0 {
+			args = append(args, flag, strconv.Itoa(count))
+		}
+	}
+
+	add("--keep-last", policy.KeepLast)
+	add("--keep-hourly", policy.KeepHourly)
+	add("--keep-daily", policy.KeepDaily)
+	add("--keep-weekly", policy.KeepWeekly)
+	add("--keep-monthly", policy.KeepMonthly)
+	add("--keep-yearly", policy.KeepYearly)
+
+	if policy.KeepWithin != "" {
+		args = append(args, "--keep-within", policy.KeepWithin)
+	}
+
+	for _, tag := range policy.KeepTags {
+		args = append(args, "--keep-tag", tag)
+	}
+
+	return strings.Join(args, " ")
+}
+
+// NormalizeRetention validates the retention of a backup and fills both the structured and the string form.
+// An empty retention is left as is, the default policy being applied by the forget job
+func NormalizeRetention(backup *utils.SingleBackupConfig) error {
+	if backup.Retention == nil {
+		if strings.TrimSpace(backup.RetentionPolicy) == "" {
+			backup.RetentionPolicy = ""
+			return nil
+		}
+
+		policy, err := ParseRetentionPolicy(backup.RetentionPolicy)
+		if err != nil {
+			return err
+		}
+		backup.Retention = &policy
+	}
+
+	if err := ValidateRetentionPolicy(*backup.Retention, backup.Engine); err != nil {
+		return err
+	}
+
+	backup.RetentionPolicy = RetentionPolicyString(*backup.Retention)
+	return nil
+}
+
+type RetentionPreview struct {
+	Keep   []map[string]interface{}
+	Remove []map[string]interface{}
+}
+
+// PreviewRetention lists the snapshots of a backup a retention policy would keep and remove, without removing anything
+func PreviewRetention(backup utils.SingleBackupConfig, retention string) (RetentionPreview, error) {
+	preview := RetentionPreview{
+		Keep:   []map[string]interface{}{},
+		Remove: []map[string]interface{}{},
+	}
+
+	engine, err := GetEngine(backup.Engine)
+	if err != nil {
+		return preview, err
+	}
+
+	output, err := engine.ForgetDryRun(backup.Repository, backup.Password, []string{backup.Name}, retention)
+	if err != nil {
+		return preview, err
+	}
+
+	var groups []struct {
+		Keep   []map[string]interface{} `json:"keep"`
+		Remove []map[string]interface{} `json:"remove"`
+	}
+	if err := json.Unmarshal([]byte(SplitJSONObjects(output)), &groups); err != nil {
+		return preview, err
+	}
+
+	for _, group := range groups {
+		preview.Keep = append(preview.Keep, group.Keep...)
+		preview.Remove = append(preview.Remove, group.Remove...)
+	}
+
+	return preview, nil
+}
+
+func PreviewRetentionRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		vars := mux.Vars(req)
+		name := vars["name"]
+
+		var request struct {
+			RetentionPolicy string
+			Retention       *utils.BackupRetentionPolicy
+		}
+
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			utils.Error("PreviewRetention: Invalid request", err)
+			utils.HTTPError(w, "Invalid request: "+err.Error(), http.StatusBadRequest, "BCK001")
+			return
+		}
+
+		backup, exists := utils.GetMainConfig().Backup.Backups[name]
+		if !exists {
+			utils.HTTPError(w, "Backup not found", http.StatusNotFound, "BCK004")
+			return
+		}
+
+		candidate := utils.SingleBackupConfig{
+			Engine:          backup.Engine,
+			RetentionPolicy: request.RetentionPolicy,
+			Retention:       request.Retention,
+		}
+		if err := NormalizeRetention(&candidate); err != nil {
+			utils.HTTPError(w, "Invalid retention policy: "+err.Error(), http.StatusBadRequest, "BCK019")
+			return
+		}
+
+		if candidate.RetentionPolicy == "" {
+			candidate.RetentionPolicy = defaultRetentionPolicy
+		}
+
+		preview, err := PreviewRetention(backup, candidate.RetentionPolicy)
+		if err != nil {
+			utils.Error("PreviewRetention: Failed to preview retention policy", err)
+			utils.HTTPError(w, "Failed to preview retention policy: "+err.Error(), http.StatusInternalServerError, "BCK020")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": map[string]interface{}{
+				"retentionPolicy": candidate.RetentionPolicy,
+				"keep":            preview.Keep,
+				"remove":          preview.Remove,
+			},
+		})
+	} else {
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+	}
+}
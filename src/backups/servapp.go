@@ -0,0 +1,339 @@
+package backups
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/azukaar/cosmos-server/src/cron"
+	"github.com/azukaar/cosmos-server/src/docker"
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// ServAppBackupPath is a path of a container covered by a backup.
+// Path is the part of the mount that can actually be restored from the backup
+type ServAppBackupPath struct {
+	Backup string
+	Mount  docker.ContainerMount
+	Path   string
+}
+
+// isPathWithin checks if path is equal to or inside parent
+func isPathWithin(parent, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(parent), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// GetServAppBackupPaths maps the volumes and binds of a container to the backups covering them
+func GetServAppBackupPaths(containerID string) ([]ServAppBackupPath, error) {
+	mounts, err := docker.GetContainerMounts(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []ServAppBackupPath{}
+	config := utils.GetMainConfig()
+
+	for _, mount := range mounts {
+		for _, backup := range config.Backup.Backups {
+			path := ""
+			if isPathWithin(backup.Source, mount.Source) {
+				path = mount.Source
+			} else if isPathWithin(mount.Source, backup.Source) {
+				path = backup.Source
+			}
+
+			if path != "" {
+				paths = append(paths, ServAppBackupPath{
+					Backup: backup.Name,
+					Mount:  mount,
+					Path:   filepath.Clean(path),
+				})
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// snapshotBelongsToBackup checks the snapshot exists in the repository under the backup's tag
+func snapshotBelongsToBackup(backup utils.SingleBackupConfig, snapshotID string) (bool, error) {
+	engine, err := GetEngine(backup.Engine)
+	if err != nil {
+		return false, err
+	}
+
+	snapshots, err := engine.ListSnapshots(backup.Repository, backup.Password, []string{backup.Name})
+	if err != nil {
+		return false, err
+	}
+
+	var snapshotsArray []map[string]interface{}
+	if err := json.Unmarshal([]byte(snapshots), &snapshotsArray); err != nil {
+		return false, err
+	}
+
+	for _, s := range snapshotsArray {
+		if id, ok := s["id"].(string); ok && id == snapshotID {
+			return true, nil
+		}
+		if id, ok := s["short_id"].(string); ok && id == snapshotID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+type ServAppRestoreConfig struct {
+	Container  string
+	Backup     utils.SingleBackupConfig
+	SnapshotID string
+	Paths      []string
+}
+
+type restoredPath struct {
+	Path     string
+	Temp     string
+	Rollback string
+	Swapped  bool
+}
+
+// rollbackServAppRestore puts the original data back in place for every path already swapped
+func rollbackServAppRestore(restored []restoredPath, OnLog func(string)) {
+	for _, r := range restored {
+		if r.Swapped {
+			OnLog("Rolling back " + r.Path)
+			if err := os.RemoveAll(r.Path); err != nil {
+				OnLog("Failed to remove restored data in " + r.Path + ": " + err.Error())
+				continue
+			}
+			if err := os.Rename(r.Rollback, r.Path); err != nil {
+				OnLog("Failed to roll back " + r.Path + ", original data is in " + r.Rollback + ": " + err.Error())
+				continue
+			}
+		}
+		os.RemoveAll(r.Temp)
+	}
+}
+
+// CreateServAppRestoreJob stops the stack of a container, restores its paths from a snapshot and restarts it.
+// The data is first restored next to the original, and only swapped in once every path restored successfully.
+func CreateServAppRestoreJob(config ServAppRestoreConfig) {
+	engine, err := GetEngine(config.Backup.Engine)
+	if err != nil {
+		utils.MajorError("Cannot restore ServApp " + config.Container, err)
+		return
+	}
+
+	go (func() {
+		cron.RunOneTimeJob(cron.ConfigJob{
+			Scheduler:   "Restic",
+			Name:        fmt.Sprintf("%s restore ServApp %s", engine.Label(), config.Container),
+			Cancellable: true,
+			Container:   config.Container,
+			Job: func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+				containers, err := docker.GetStackContainers(config.Container)
+				if err != nil {
+					OnFail(err)
+					return
+				}
+
+				OnLog("Stopping stack: " + strings.Join(containers, ", "))
+
+				err = docker.StopContainers(containers)
+				if err != nil {
+					docker.StartContainers(containers)
+					OnFail(err)
+					return
+				}
+
+				suffix := strconv.FormatInt(time.Now().Unix(), 10)
+				restored := []restoredPath{}
+
+				fail := func(err error) {
+					rollbackServAppRestore(restored, OnLog)
+					OnLog("Restarting stack")
+					if errS := docker.StartContainers(containers); errS != nil {
+						OnLog("Failed to restart stack: " + errS.Error())
+					}
+					OnFail(err)
+				}
+
+				// restore every path next to the original first
+				for _, path := range config.Paths {
+					r := restoredPath{
+						Path:     path,
+						Temp:     path + ".cosmos-restore-" + suffix,
+						Rollback: path + ".cosmos-rollback-" + suffix,
+					}
+					restored = append(restored, r)
+
+					OnLog("Restoring " + path + " from snapshot " + config.SnapshotID)
+
+					var stepErr error
+					engine.Restore(RestoreConfig{
+						Repository:     config.Backup.Repository,
+						Password:       config.Backup.Password,
+						SnapshotID:     config.SnapshotID,
+						Target:         r.Temp,
+						OriginalSource: path,
+					})(OnLog, func(err error) {
+						stepErr = err
+					}, func() {}, ctx, cancel)
+
+					if stepErr != nil {
+						fail(fmt.Errorf("failed to restore %s: %w", path, stepErr))
+						return
+					}
+				}
+
+				// then swap them in place
+				for i, r := range restored {
+					if _, err := os.Stat(r.Path); err == nil {
+						if err := os.Rename(r.Path, r.Rollback); err != nil {
+							fail(fmt.Errorf("failed to move away %s: %w", r.Path, err))
+							return
+						}
+					} else {
+						os.MkdirAll(r.Rollback, 0755)
+					}
+
+					restored[i].Swapped = true
+
+					if err := os.Rename(r.Temp, r.Path); err != nil {
+						fail(fmt.Errorf("failed to move restored data to %s: %w", r.Path, err))
+						return
+					}
+				}
+
+				for _, r := range restored {
+					os.RemoveAll(r.Rollback)
+				}
+
+				OnLog("Restore done, restarting stack")
+
+				err = docker.StartContainers(containers)
+				if err != nil {
+					OnFail(err)
+					return
+				}
+
+				OnSuccess()
+			},
+			Resource: "backup@" + config.Backup.Name,
+		})
+	})()
+}
+
+func ServAppBackupsRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		vars := mux.Vars(req)
+		containerID := utils.SanitizeSafe(vars["containerId"])
+
+		paths, err := GetServAppBackupPaths(containerID)
+		if err != nil {
+			utils.Error("ServAppBackups: Failed to list container paths", err)
+			utils.HTTPError(w, "Failed to list container paths: "+err.Error(), http.StatusInternalServerError, "BCK015")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data":   paths,
+		})
+	} else {
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+	}
+}
+
+func RestoreServAppRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		vars := mux.Vars(req)
+		containerID := utils.SanitizeSafe(vars["containerId"])
+
+		var request struct {
+			Backup     string `json:"backup"`
+			SnapshotID string `json:"snapshotId"`
+		}
+
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			utils.Error("RestoreServApp: Invalid request", err)
+			utils.HTTPError(w, "Invalid request: "+err.Error(), http.StatusBadRequest, "BCK008")
+			return
+		}
+
+		if utils.IsInsideContainer && containerID == os.Getenv("HOSTNAME") {
+			utils.HTTPError(w, "Cosmos cannot restore itself", http.StatusBadRequest, "BCK016")
+			return
+		}
+
+		backup, exists := utils.GetMainConfig().Backup.Backups[request.Backup]
+		if !exists {
+			utils.HTTPError(w, "Backup not found", http.StatusNotFound, "BCK004")
+			return
+		}
+
+		paths, err := GetServAppBackupPaths(containerID)
+		if err != nil {
+			utils.Error("RestoreServApp: Failed to list container paths", err)
+			utils.HTTPError(w, "Failed to list container paths: "+err.Error(), http.StatusInternalServerError, "BCK015")
+			return
+		}
+
+		toRestore := []string{}
+		for _, p := range paths {
+			if p.Backup == backup.Name && !utils.StringArrayContains(toRestore, p.Path) {
+				toRestore = append(toRestore, p.Path)
+			}
+		}
+
+		if len(toRestore) == 0 {
+			utils.HTTPError(w, "No volume or bind of this container is covered by this backup", http.StatusBadRequest, "BCK017")
+			return
+		}
+
+		found, err := snapshotBelongsToBackup(backup, request.SnapshotID)
+		if err != nil {
+			utils.Error("RestoreServApp: Failed to verify snapshot", err)
+			utils.HTTPError(w, "Failed to verify snapshot: "+err.Error(), http.StatusInternalServerError, "BCK009")
+			return
+		}
+
+		if !found {
+			utils.HTTPError(w, "Snapshot not found for this backup", http.StatusNotFound, "BCK011")
+			return
+		}
+
+		CreateServAppRestoreJob(ServAppRestoreConfig{
+			Container:  containerID,
+			Backup:     backup,
+			SnapshotID: request.SnapshotID,
+			Paths:      toRestore,
+		})
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "OK",
+			"message": "Restore job created",
+			"data":    toRestore,
+		})
+	} else {
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+	}
+}
@@ -32,6 +32,15 @@ func ConfigApiGet(w http.ResponseWriter, req *http.Request) {
 			config.HTTPConfig.DNSChallengeConfig = map[string]string{}
 			config.Licence = "***"
 			config.ServerToken = "***"
+			config.Backup.DRBundle.Password = "***"
+
+			// the forwarder URLs can hold credentials
+			forwarders := make([]utils.LogForwarderConfig, len(config.DockerConfig.LogCollector.Forwarders))
+			for i, forwarder := range config.DockerConfig.LogCollector.Forwarders {
+				forwarder.URL = "***"
+				forwarders[i] = forwarder
+			}
+			config.DockerConfig.LogCollector.Forwarders = forwarders
 
 			// filter admin only routes
 			filteredRoutes := make([]utils.ProxyRouteConfig, 0)
@@ -0,0 +1,185 @@
+package constellation
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// The master manages the Docker of the other Cosmos nodes by proxying the ServApps API to them over the
+// Constellation network. The requests are authenticated with the API key of the node, that only the node
+// and the master know
+
+const masterIP = "192.168.201.1"
+
+// API paths of a node that the master can use
+var remoteDockerPaths = []string{
+	"/cosmos/api/servapps",
+	"/cosmos/api/docker-service",
+	"/cosmos/api/stacks",
+	"/cosmos/api/volume",
+	"/cosmos/api/network",
+	"/cosmos/api/images",
+	"/cosmos/api/logs",
+	"/cosmos/api/vulnerabilities",
+}
+
+func IsRemoteDockerPath(path string) bool {
+	for _, prefix := range remoteDockerPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsMasterRequest checks that a request to this node comes from the master with the API key of this node
+func IsMasterRequest(req *http.Request) bool {
+	if !utils.GetMainConfig().ConstellationConfig.Enabled || !utils.GetMainConfig().ConstellationConfig.SlaveMode || APIKey == "" {
+		return false
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil || ip != masterIP {
+		return false
+	}
+
+	auth := strings.Replace(req.Header.Get("x-cstln-auth"), "Bearer ", "", 1)
+	return subtle.ConstantTimeCompare([]byte(auth), []byte(APIKey)) == 1
+}
+
+// GetCosmosNodes returns the other Cosmos servers of the Constellation, which are its lighthouses
+func GetCosmosNodes() []utils.ConstellationDevice {
+	nodes := []utils.ConstellationDevice{}
+	seen := map[string]bool{}
+
+	for _, device := range CachedDevices {
+		if !device.IsLighthouse || device.Blocked || device.DeviceName == DeviceName || seen[device.DeviceName] {
+			continue
+		}
+		seen[device.DeviceName] = true
+		nodes = append(nodes, device)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].DeviceName < nodes[j].DeviceName
+	})
+
+	return nodes
+}
+
+func getCosmosNode(name string) (utils.ConstellationDevice, error) {
+	if utils.GetMainConfig().ConstellationConfig.SlaveMode {
+		return utils.ConstellationDevice{}, errors.New("only the Constellation master can manage other hosts")
+	}
+
+	for _, node := range GetCosmosNodes() {
+		if node.DeviceName == name {
+			return node, nil
+		}
+	}
+
+	return utils.ConstellationDevice{}, errors.New("unknown host " + name)
+}
+
+// the nodes are reached by their Constellation IP, which their certificate does not cover
+var remoteTransport = &http.Transport{
+	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+}
+
+var remoteClient = &http.Client{
+	Transport: remoteTransport,
+	Timeout: 30 * time.Second,
+}
+
+func remoteNodeURL(node utils.ConstellationDevice) *url.URL {
+	return &url.URL{
+		Scheme: "https",
+		Host: strings.ReplaceAll(node.IP, "/24", ""),
+	}
+}
+
+// RemoteNodeRequest sends an API request to a node, path being the API path like /cosmos/api/servapps
+func RemoteNodeRequest(name string, method string, path string, body io.Reader) (*http.Response, error) {
+	node, err := getCosmosNode(name)
+	if err != nil {
+		return nil, err
+	}
+
+	target := remoteNodeURL(node)
+	request, err := http.NewRequest(method, target.String() + path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("x-cstln-auth", node.APIKey)
+
+	return remoteClient.Do(request)
+}
+
+// RemoteHostMiddleware proxies the Docker API requests with a ?host= parameter to that node.
+// It needs to run after the authentication
+func RemoteHostMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.URL.Query().Get("host")
+
+		if host == "" || host == "local" || host == "all" || host == DeviceName || !IsRemoteDockerPath(req.URL.Path) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if utils.AdminOnly(w, req) != nil {
+			return
+		}
+
+		node, err := getCosmosNode(host)
+		if err != nil {
+			utils.Error("RemoteHost", err)
+			utils.HTTPError(w, err.Error(), http.StatusNotFound, "CR001")
+			return
+		}
+
+		nickname := req.Header.Get("x-cosmos-user")
+		target := remoteNodeURL(node)
+
+		proxy := &httputil.ReverseProxy{
+			Transport: remoteTransport,
+			// stream the logs and the deployments as they come
+			FlushInterval: -1,
+			Director: func(r *http.Request) {
+				r.URL.Scheme = target.Scheme
+				r.URL.Host = target.Host
+				r.Host = target.Host
+
+				query := r.URL.Query()
+				query.Del("host")
+				r.URL.RawQuery = query.Encode()
+
+				// the session of the master is not valid on the node
+				r.Header.Del("Cookie")
+				r.Header.Del("Origin")
+				r.Header.Set("x-cstln-auth", node.APIKey)
+				r.Header.Set("x-cstln-remote-user", nickname)
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				utils.Error("RemoteHost: " + host, err)
+				utils.HTTPError(w, "Host " + host + " unreachable: " + err.Error(), http.StatusBadGateway, "CR002")
+			},
+		}
+
+		utils.Debug("RemoteHost: proxying " + req.URL.Path + " to " + host)
+
+		proxy.ServeHTTP(w, req)
+	})
+}
@@ -34,6 +34,11 @@ func ListJobs(w http.ResponseWriter, req *http.Request) {
 				LastStarted: job.LastStarted,
 				LastRun: job.LastRun,
 				LastRunSuccess: job.LastRunSuccess,
+				Retries: job.Retries,
+				DisableAfterFailures: job.DisableAfterFailures,
+				ConsecutiveFailures: job.ConsecutiveFailures,
+				After: job.After,
+				Triggers: job.Triggers,
 			}
 		}
 	}
@@ -0,0 +1,397 @@
+package cron
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// ChainStep is one job run inside a chain. Trigger is the job it ran after, empty for the first step
+type ChainStep struct {
+	Scheduler string
+	Name string
+	Trigger string
+	Started time.Time
+	Ended time.Time
+	Status string
+	Error string
+}
+
+// ChainRun is a job and all the jobs that ran after it through their After dependencies. Finished chains are
+// stored in the jobs_chains collection, next to the jobs history
+type ChainRun struct {
+	ID string `bson:"_id"`
+	Started time.Time
+	Ended time.Time
+	Status string
+	FailedStep string
+	Steps []ChainStep
+	pending int
+}
+
+const maxChainRuns = 100
+
+// chain runs are only accessed with CRONLock held, the running ones and the last finished ones are kept in memory
+var chainRuns = []*ChainRun{}
+
+func getChainRun(chainID string) *ChainRun {
+	for _, chain := range chainRuns {
+		if chain.ID == chainID {
+			return chain
+		}
+	}
+	return nil
+}
+
+func dependencyMatches(dep utils.CRONJobDependency, job ConfigJob, success bool) bool {
+	if dep.Scheduler != job.Scheduler || dep.Job != job.Name {
+		return false
+	}
+
+	switch dep.On {
+	case "always":
+		return true
+	case "failure":
+		return !success
+	default:
+		return success
+	}
+}
+
+// chainReachableJobs returns the jobs that can run in a chain, the first one and the jobs running after them
+func chainReachableJobs(chain *ChainRun) map[[2]string]bool {
+	reachable := map[[2]string]bool{}
+	if len(chain.Steps) == 0 {
+		return reachable
+	}
+
+	queue := [][2]string{{chain.Steps[0].Scheduler, chain.Steps[0].Name}}
+	reachable[queue[0]] = true
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, schedulerList := range jobsList {
+			for _, other := range schedulerList {
+				key := [2]string{other.Scheduler, other.Name}
+				if reachable[key] {
+					continue
+				}
+				for _, dep := range other.After {
+					if dep.Scheduler == current[0] && dep.Job == current[1] {
+						reachable[key] = true
+						queue = append(queue, key)
+						break
+					}
+				}
+			}
+		}
+	}
+
+	return reachable
+}
+
+// chainDependenciesEnded tells whether all the dependencies of a job that can run in the chain have ended,
+// and whether they all ended as the job requires. A job with several dependencies waits for all of them
+func chainDependenciesEnded(chain *ChainRun, job ConfigJob, reachable map[[2]string]bool) (bool, bool) {
+	met := true
+
+	for _, dep := range job.After {
+		if !reachable[[2]string{dep.Scheduler, dep.Job}] {
+			continue
+		}
+
+		var ended *ChainStep
+		for i := len(chain.Steps) - 1; i >= 0; i-- {
+			step := &chain.Steps[i]
+			if step.Scheduler == dep.Scheduler && step.Name == dep.Job {
+				if step.Status != "running" {
+					ended = step
+				}
+				break
+			}
+		}
+
+		if ended == nil {
+			return false, false
+		}
+
+		if ended.Status == "skipped" || !dependencyMatches(dep, ConfigJob{Scheduler: ended.Scheduler, Name: ended.Name}, ended.Status == "success") {
+			met = false
+		}
+	}
+
+	return true, met
+}
+
+func hasDependents(job ConfigJob) bool {
+	for _, schedulerList := range jobsList {
+		for _, other := range schedulerList {
+			for _, dep := range other.After {
+				if dep.Scheduler == job.Scheduler && dep.Job == job.Name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func newChainRun() string {
+	chain := &ChainRun{
+		ID: strconv.FormatInt(time.Now().UnixNano(), 10),
+		Started: time.Now(),
+		Status: "running",
+		Steps: []ChainStep{},
+		pending: 1,
+	}
+
+	chainRuns = append(chainRuns, chain)
+
+	// only the oldest finished runs are dropped, the running ones still have steps to record
+	excess := len(chainRuns) - maxChainRuns
+	if excess > 0 {
+		kept := []*ChainRun{}
+		for _, run := range chainRuns {
+			if excess > 0 && run.Status != "running" {
+				excess--
+				continue
+			}
+			kept = append(kept, run)
+		}
+		chainRuns = kept
+	}
+
+	return chain.ID
+}
+
+func startChainStep(chainID string, job ConfigJob, trigger string) {
+	chain := getChainRun(chainID)
+	if chain == nil {
+		return
+	}
+
+	chain.Steps = append(chain.Steps, ChainStep{
+		Scheduler: job.Scheduler,
+		Name: job.Name,
+		Trigger: trigger,
+		Started: time.Now(),
+		Status: "running",
+	})
+}
+
+// skipChainStep records a job of the chain that did not run, and evaluates the jobs running after it
+func skipChainStep(chainID, schedulerName, jobName, trigger, reason string) {
+	chain := getChainRun(chainID)
+	if chain == nil {
+		return
+	}
+
+	recordSkippedStep(chain, schedulerName, jobName, trigger, reason)
+
+	chain.pending--
+	finishChainRun(chain)
+}
+
+func recordSkippedStep(chain *ChainRun, schedulerName, jobName, trigger, reason string) {
+	chain.Steps = append(chain.Steps, ChainStep{
+		Scheduler: schedulerName,
+		Name: jobName,
+		Trigger: trigger,
+		Started: time.Now(),
+		Ended: time.Now(),
+		Status: "skipped",
+		Error: reason,
+	})
+
+	// the jobs waiting for the skipped one are evaluated as if it had ended
+	runChainDependents(chain, schedulerName, jobName)
+}
+
+func finishChainRun(chain *ChainRun) {
+	if chain.pending > 0 {
+		return
+	}
+
+	chain.Ended = time.Now()
+	chain.Status = "success"
+	if chain.FailedStep != "" {
+		chain.Status = "fail"
+	}
+
+	utils.Log("CRON chain " + chain.ID + " finished with status " + chain.Status)
+
+	saveChainRun(*chain)
+}
+
+// saveChainRun stores a finished chain in the jobs_chains collection
+func saveChainRun(chain ChainRun) {
+	chain.Steps = append([]ChainStep{}, chain.Steps...)
+
+	go (func() {
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "jobs_chains")
+		if errCo != nil {
+			utils.Error("Jobs chains - Database Connect", errCo)
+			return
+		}
+
+		if _, err := c.InsertOne(context.Background(), chain); err != nil {
+			utils.Error("Jobs chains - Failed to save chain " + chain.ID, err)
+		}
+	})()
+}
+
+// endChainStep records the result of a job in its chain and starts the jobs running after it
+func endChainStep(job ConfigJob, success bool, err error) {
+	chain := getChainRun(job.ChainID)
+	if chain == nil {
+		return
+	}
+
+	for i := len(chain.Steps) - 1; i >= 0; i-- {
+		step := &chain.Steps[i]
+		if step.Scheduler == job.Scheduler && step.Name == job.Name && step.Status == "running" {
+			step.Ended = time.Now()
+			step.Status = "success"
+			if !success {
+				step.Status = "fail"
+				if err != nil {
+					step.Error = err.Error()
+				}
+				if chain.FailedStep == "" {
+					chain.FailedStep = job.Name
+				}
+			}
+			break
+		}
+	}
+
+	runChainDependents(chain, job.Scheduler, job.Name)
+
+	chain.pending--
+	finishChainRun(chain)
+}
+
+// runChainDependents starts the jobs running after a job that ended or was skipped, once all their dependencies
+// ended. The jobs that will not run are recorded as skipped, so that the jobs after them are evaluated as well
+func runChainDependents(chain *ChainRun, schedulerName, jobName string) {
+	reachable := chainReachableJobs(chain)
+
+	for _, schedulerList := range jobsList {
+		for _, next := range schedulerList {
+			dependsOnJob := false
+			for _, dep := range next.After {
+				if dep.Scheduler == schedulerName && dep.Job == jobName {
+					dependsOnJob = true
+				}
+			}
+			if !dependsOnJob {
+				continue
+			}
+
+			alreadyRan := false
+			for _, step := range chain.Steps {
+				if step.Scheduler == next.Scheduler && step.Name == next.Name {
+					alreadyRan = true
+				}
+			}
+			if alreadyRan {
+				utils.Warn("CRON job " + next.Name + " already ran in chain " + chain.ID + ", dependency cycle ignored")
+				continue
+			}
+
+			ended, met := chainDependenciesEnded(chain, next, reachable)
+			if !ended {
+				utils.Debug("CRON job " + next.Name + " waits for its other dependencies in chain " + chain.ID)
+				continue
+			}
+			if !met {
+				utils.Log("CRON job " + next.Name + " not running in chain " + chain.ID + ", its dependencies did not end as required")
+				recordSkippedStep(chain, next.Scheduler, next.Name, jobName, "dependencies did not end as required")
+				continue
+			}
+
+			if next.Disabled {
+				utils.Log("CRON job " + next.Name + " is disabled, not running it after " + jobName)
+				recordSkippedStep(chain, next.Scheduler, next.Name, jobName, "job is disabled")
+				continue
+			}
+
+			utils.Log("CRON job " + next.Name + " starting after " + jobName)
+
+			chain.pending++
+			go jobRunnerInChain(next.Scheduler, next.Name, chain.ID, jobName, "after " + jobName, nil)(jobRunner_OnLog(next.Scheduler, next.Name), jobRunner_OnFail(next.Scheduler, next.Name), jobRunner_OnSuccess(next.Scheduler, next.Name))
+		}
+	}
+}
+
+func ListChainRunsRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "jobs_chains")
+		if errCo != nil {
+			utils.Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		opts := options.Find().SetLimit(maxChainRuns).SetSort(bson.D{{Key: "started", Value: -1}})
+		cursor, err := c.Find(context.Background(), bson.M{}, opts)
+		if err != nil {
+			utils.Error("ListChainRuns: Error while getting chains", err)
+			utils.HTTPError(w, "Jobs chains Get Error", http.StatusInternalServerError, "CRON002")
+			return
+		}
+		defer cursor.Close(context.Background())
+
+		chains := []ChainRun{}
+		if err = cursor.All(context.Background(), &chains); err != nil {
+			utils.Error("ListChainRuns: Error while decoding chains", err)
+			utils.HTTPError(w, "Jobs chains decode Error", http.StatusInternalServerError, "CRON004")
+			return
+		}
+
+		stored := map[string]bool{}
+		for _, chain := range chains {
+			stored[chain.ID] = true
+		}
+
+		// the running chains, and the finished ones not saved yet
+		CRONLock <- true
+		for _, running := range chainRuns {
+			if stored[running.ID] {
+				continue
+			}
+			chain := *running
+			chain.Steps = append([]ChainStep{}, chain.Steps...)
+			chains = append(chains, chain)
+		}
+		<-CRONLock
+
+		sort.Slice(chains, func(i, j int) bool {
+			return chains[i].Started.After(chains[j].Started)
+		})
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data":   chains,
+		})
+		return
+	} else {
+		utils.Error("ListChainRuns: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,340 @@
+package cron
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	conttype "github.com/docker/docker/api/types/container"
+	"github.com/gorilla/mux"
+	robfig "github.com/robfig/cron/v3"
+
+	"github.com/azukaar/cosmos-server/src/docker"
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// The scheduled actions of the containers run as jobs of the Containers scheduler. They come from the
+// cosmos-schedule-<action> labels and from DockerConfig.Schedules
+
+const containersScheduler = "Containers"
+
+var ContainerScheduleActions = []string{"start", "stop", "restart", "pause", "unpause"}
+
+var crontabParser = robfig.NewParser(robfig.Second | robfig.Minute | robfig.Hour | robfig.Dom | robfig.Month | robfig.Dow | robfig.Descriptor)
+
+type ContainerScheduleEntry struct {
+	utils.ContainerSchedule
+	// label or config
+	Source string `json:"source"`
+	// name of the job running it
+	Job string `json:"job"`
+}
+
+func ValidateContainerSchedule(schedule utils.ContainerSchedule) error {
+	valid := false
+	for _, action := range ContainerScheduleActions {
+		if schedule.Action == action {
+			valid = true
+		}
+	}
+	if !valid {
+		return errors.New("invalid action " + schedule.Action + ", expected one of " + strings.Join(ContainerScheduleActions, ", "))
+	}
+
+	if _, err := crontabParser.Parse(schedule.Crontab); err != nil {
+		return errors.New("invalid crontab " + schedule.Crontab + ": " + err.Error())
+	}
+
+	return nil
+}
+
+// GetContainerSchedules returns the schedules of all the containers, from their labels and the config
+func GetContainerSchedules() ([]ContainerScheduleEntry, error) {
+	containers, err := docker.ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	schedules := []ContainerScheduleEntry{}
+	names := map[string]int{}
+
+	add := func(schedule utils.ContainerSchedule, source string) {
+		if err := ValidateContainerSchedule(schedule); err != nil {
+			utils.Error("Container schedule of " + schedule.Container, err)
+			return
+		}
+
+		job := schedule.Container + " " + schedule.Action
+		names[job]++
+		if names[job] > 1 {
+			job = fmt.Sprintf("%s %d", job, names[job])
+		}
+
+		schedules = append(schedules, ContainerScheduleEntry{
+			ContainerSchedule: schedule,
+			Source: source,
+			Job: job,
+		})
+	}
+
+	for _, container := range containers {
+		name := strings.TrimPrefix(container.Names[0], "/")
+
+		for _, action := range ContainerScheduleActions {
+			for _, crontab := range strings.Split(container.Labels["cosmos-schedule-" + action], ";") {
+				if strings.TrimSpace(crontab) == "" {
+					continue
+				}
+
+				add(utils.ContainerSchedule{
+					Container: name,
+					Action: action,
+					Crontab: strings.TrimSpace(crontab),
+				}, "label")
+			}
+		}
+	}
+
+	for _, schedule := range utils.GetMainConfig().DockerConfig.Schedules {
+		add(schedule, "config")
+	}
+
+	return schedules, nil
+}
+
+// RunContainerAction starts, stops, restarts, pauses or unpauses a container
+func RunContainerAction(container string, action string) error {
+	if errD := docker.Connect(); errD != nil {
+		return errD
+	}
+
+	ctx := docker.DockerContext
+
+	switch action {
+	case "start":
+		return docker.DockerClient.ContainerStart(ctx, container, conttype.StartOptions{})
+	case "stop":
+		return docker.DockerClient.ContainerStop(ctx, container, conttype.StopOptions{})
+	case "restart":
+		return docker.DockerClient.ContainerRestart(ctx, container, conttype.StopOptions{})
+	case "pause":
+		return docker.DockerClient.ContainerPause(ctx, container)
+	case "unpause":
+		return docker.DockerClient.ContainerUnpause(ctx, container)
+	}
+
+	return errors.New("invalid action " + action)
+}
+
+func jobFromContainerAction(container string, action string) ExecuterFn {
+	return func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+		OnLog(fmt.Sprintf("Running %s on %s\n", action, container))
+
+		if err := RunContainerAction(container, action); err != nil {
+			OnFail(err)
+			return
+		}
+
+		utils.TriggerEvent(
+			"cosmos.docker.schedule." + action,
+			"Scheduled " + action + " of " + container,
+			"info",
+			"container@" + container,
+			map[string]interface{}{
+				"container": container,
+				"action": action,
+			},
+		)
+
+		OnSuccess()
+	}
+}
+
+// containerSchedulesChanged compares the schedules with the registered jobs, CRONLock must be held
+func containerSchedulesChanged(schedules []ContainerScheduleEntry) bool {
+	registered := jobsList[containersScheduler]
+	if len(registered) != len(schedules) {
+		return true
+	}
+
+	for _, schedule := range schedules {
+		job, ok := registered[schedule.Job]
+		if !ok || job.Crontab != schedule.Crontab || job.Container != schedule.Container || job.Disabled != schedule.Disabled {
+			return true
+		}
+	}
+
+	return false
+}
+
+func registerContainerSchedules(schedules []ContainerScheduleEntry) {
+	old := jobsList[containersScheduler]
+	resetScheduler(containersScheduler)
+
+	for _, schedule := range schedules {
+		j := ConfigJob{
+			Scheduler: containersScheduler,
+			Name: schedule.Job,
+			Job: jobFromContainerAction(schedule.Container, schedule.Action),
+			Crontab: schedule.Crontab,
+			Disabled: schedule.Disabled,
+			Container: schedule.Container,
+			Resource: "container@" + schedule.Container,
+			Logs: []string{},
+		}
+
+		if previous, ok := old[schedule.Job]; ok {
+			j.Logs = previous.Logs
+			j.Running = previous.Running
+			j.LastStarted = previous.LastStarted
+			j.LastRun = previous.LastRun
+			j.LastRunSuccess = previous.LastRunSuccess
+		}
+
+		registerJob(j)
+	}
+}
+
+var refreshSchedulesTimer *time.Timer
+var refreshSchedulesLock sync.Mutex
+
+// loadContainerSchedules registers the schedules of the containers and rebuilds the scheduler, if they changed.
+// Docker is listed before taking CRONLock, and listed again later if it cannot be reached
+func loadContainerSchedules() {
+	schedules, err := GetContainerSchedules()
+	if err != nil {
+		// already reported when it first failed, Cosmos may run without Docker
+		utils.Debug("Container schedules: " + err.Error())
+		retryContainerSchedules()
+		return
+	}
+
+	CRONLock <- true
+	changed := containerSchedulesChanged(schedules)
+	if changed {
+		registerContainerSchedules(schedules)
+	}
+	<-CRONLock
+
+	if changed {
+		InitScheduler()
+	}
+}
+
+func scheduleContainerSchedules(delay time.Duration) {
+	refreshSchedulesLock.Lock()
+	defer refreshSchedulesLock.Unlock()
+
+	if refreshSchedulesTimer != nil {
+		refreshSchedulesTimer.Stop()
+	}
+
+	refreshSchedulesTimer = time.AfterFunc(delay, loadContainerSchedules)
+}
+
+// retryContainerSchedules loads the schedules again once Docker answers, it may not be connected yet at boot
+func retryContainerSchedules() {
+	scheduleContainerSchedules(30 * time.Second)
+}
+
+// refreshContainerSchedules reloads the schedules once the containers stop changing, as their labels may have changed.
+// The scheduler is only rebuilt when the schedules did change
+func refreshContainerSchedules(attributes map[string]string) {
+	// the containers of CRON jobs and volume transfers come and go without schedules
+	if attributes["cosmos-cron-job"] != "" || attributes["cosmos-volume-helper"] != "" {
+		return
+	}
+
+	scheduleContainerSchedules(10 * time.Second)
+}
+
+// ContainerSchedulesRoute gets the schedules of a container, and replaces the ones of the config with a POST
+func ContainerSchedulesRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	errD := docker.Connect()
+	if errD != nil {
+		utils.Error("ContainerSchedules", errD)
+		utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+		return
+	}
+
+	container, err := docker.DockerClient.ContainerInspect(docker.DockerContext, mux.Vars(req)["containerId"])
+	if err != nil {
+		utils.Error("ContainerSchedules", err)
+		utils.HTTPError(w, "Container not found", http.StatusNotFound, "DS002")
+		return
+	}
+	name := strings.TrimPrefix(container.Name, "/")
+
+	if req.Method == "GET" {
+		all, err := GetContainerSchedules()
+		if err != nil {
+			utils.Error("ContainerSchedules", err)
+			utils.HTTPError(w, "Schedules Get Error: " + err.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		schedules := []ContainerScheduleEntry{}
+		for _, schedule := range all {
+			if schedule.Container == name {
+				schedules = append(schedules, schedule)
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": schedules,
+		})
+	} else if req.Method == "POST" {
+		var request []utils.ContainerSchedule
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			utils.Error("ContainerSchedules: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid JSON", http.StatusBadRequest, "DS003")
+			return
+		}
+
+		config := utils.ReadConfigFromFile()
+
+		schedules := []utils.ContainerSchedule{}
+		for _, schedule := range config.DockerConfig.Schedules {
+			if schedule.Container != name {
+				schedules = append(schedules, schedule)
+			}
+		}
+
+		for _, schedule := range request {
+			schedule.Container = name
+			if err := ValidateContainerSchedule(schedule); err != nil {
+				utils.HTTPError(w, err.Error(), http.StatusBadRequest, "DS003")
+				return
+			}
+			schedules = append(schedules, schedule)
+		}
+
+		config.DockerConfig.Schedules = schedules
+		utils.SetBaseMainConfig(config)
+
+		utils.Log("API: Set schedules of " + name)
+
+		go (func() {
+			InitJobs()
+			InitScheduler()
+		})()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("ContainerSchedules: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,154 @@
+package cron
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-units"
+
+	"github.com/azukaar/cosmos-server/src/docker"
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+var ephemeralNameRegex = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// logWriter sends everything written to it to the logs of a job
+type logWriter struct {
+	OnLog func(string)
+}
+
+func (l logWriter) Write(p []byte) (int, error) {
+	l.OnLog(string(p))
+	return len(p), nil
+}
+
+// JobFromEphemeralContainer runs the command of a job in a new container created from job.Image,
+// which is removed once the run is over
+func JobFromEphemeralContainer(job utils.CRONConfig) func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+	return func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+		err := docker.Connect()
+		if err != nil {
+			OnFail(err)
+			return
+		}
+
+		if _, _, err := docker.DockerClient.ImageInspectWithRaw(ctx, job.Image); err != nil {
+			OnLog("Pulling image " + job.Image + "\n")
+
+			out, err := docker.DockerPullImage(job.Image)
+			if err != nil {
+				OnFail(fmt.Errorf("failed to pull image %s: %v", job.Image, err))
+				return
+			}
+			io.Copy(io.Discard, out)
+			out.Close()
+		}
+
+		hostConfig := &container.HostConfig{
+			Binds: job.Mounts,
+		}
+
+		if job.Network != "" {
+			hostConfig.NetworkMode = container.NetworkMode(job.Network)
+		}
+
+		if job.Memory != "" {
+			memory, err := units.RAMInBytes(job.Memory)
+			if err != nil {
+				OnFail(fmt.Errorf("invalid memory limit %s: %v", job.Memory, err))
+				return
+			}
+			hostConfig.Resources.Memory = memory
+		}
+
+		if job.CPUs > 0 {
+			hostConfig.Resources.NanoCPUs = int64(job.CPUs * 1e9)
+		}
+
+		if job.PidsLimit > 0 {
+			pidsLimit := job.PidsLimit
+			hostConfig.Resources.PidsLimit = &pidsLimit
+		}
+
+		containerConfig := &container.Config{
+			Image: job.Image,
+			Env: append(append([]string{}, job.Env...), jobEnvFromContext(ctx)...),
+			Labels: map[string]string{
+				"cosmos-cron-job": job.Name,
+			},
+		}
+
+		if job.Command != "" {
+			containerConfig.Cmd = []string{"sh", "-c", job.Command}
+		}
+
+		name := "cosmos-cron-" + ephemeralNameRegex.ReplaceAllString(job.Name, "-") + "-" + strconv.FormatInt(time.Now().Unix(), 10)
+
+		created, err := docker.DockerClient.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, name)
+		if err != nil {
+			OnFail(fmt.Errorf("failed to create container: %v", err))
+			return
+		}
+
+		// the run context might be cancelled, the container has to be removed anyway
+		defer func() {
+			err := docker.DockerClient.ContainerRemove(context.Background(), created.ID, container.RemoveOptions{Force: true})
+			if err != nil {
+				utils.Error("CRON job " + job.Name + ": failed to remove container " + name, err)
+			}
+		}()
+
+		OnLog("Starting container " + name + "\n")
+
+		if err := docker.DockerClient.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+			OnFail(fmt.Errorf("failed to start container: %v", err))
+			return
+		}
+
+		logs, err := docker.DockerClient.ContainerLogs(ctx, created.ID, container.LogsOptions{
+			ShowStdout: true,
+			ShowStderr: true,
+			Follow: true,
+		})
+		if err != nil {
+			OnFail(fmt.Errorf("failed to read container logs: %v", err))
+			return
+		}
+		defer logs.Close()
+
+		// the logs end with the container, the result is only reported once they are all in the run
+		logsDone := make(chan struct{})
+		go func() {
+			stdcopy.StdCopy(logWriter{OnLog}, logWriter{OnLog}, logs)
+			close(logsDone)
+		}()
+
+		waitForLogs := func() {
+			select {
+			case <-logsDone:
+			case <-time.After(10 * time.Second):
+				utils.Warn("CRON job " + job.Name + ": the logs of " + name + " did not end")
+			}
+		}
+
+		statusCh, errCh := docker.DockerClient.ContainerWait(ctx, created.ID, container.WaitConditionNotRunning)
+		select {
+		case err := <-errCh:
+			waitForLogs()
+			OnFail(err)
+		case status := <-statusCh:
+			waitForLogs()
+			if status.StatusCode != 0 {
+				OnFail(fmt.Errorf("container exited with code %d", status.StatusCode))
+			} else {
+				OnSuccess()
+			}
+		}
+	}
+}
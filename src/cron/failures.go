@@ -0,0 +1,91 @@
+package cron
+
+import (
+	"fmt"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// notifyJobFailure runs the NotifyOnFailure actions of a job which failed all its attempts.
+// "notification" and "email" are sent from here, any other type goes through the monitoring alert actions
+func notifyJobFailure(job ConfigJob, err error, disabled bool) {
+	title := "header.notification.title.cronJobFailed"
+	message := "header.notification.message.cronJobFailed"
+	if disabled {
+		title = "header.notification.title.cronJobDisabled"
+		message = "header.notification.message.cronJobDisabled"
+	}
+
+	for _, action := range job.NotifyOnFailure {
+		utils.Log("CRON job " + job.Name + " failed, executing action " + action.Type)
+
+		if action.Type == "notification" {
+			utils.WriteNotification(utils.Notification{
+				Recipient: "admin",
+				Title: title,
+				Message: message,
+				Vars: job.Name,
+				Level: "error",
+				Link: "/cosmos-ui/cron",
+			})
+		} else if action.Type == "email" {
+			if !utils.GetMainConfig().EmailConfig.Enabled {
+				utils.Warn("CRON job " + job.Name + " failed but Email is not enabled")
+				continue
+			}
+
+			status := "failed"
+			if disabled {
+				status = "failed and was disabled"
+			}
+
+			users := utils.ListAllUsers("admin")
+			for _, user := range users {
+				if user.Email != "" {
+					utils.SendEmail([]string{user.Email}, "CRON job failed: " + job.Name,
+					fmt.Sprintf(`<h1>CRON job %s %s</h1>
+You are receiving this email because you are admin on a Cosmos
+server where a CRON job notifies on failure.<br />
+It failed %d time(s) in a row with the following error:<br />
+<pre>%s</pre>`, job.Name, status, job.ConsecutiveFailures, err.Error()))
+				}
+			}
+		} else if utils.ExecuteAlertAction != nil {
+			object := "job@" + job.Scheduler + "@" + job.Name
+			if job.Container != "" {
+				object = "container@" + job.Container
+			}
+
+			utils.ExecuteAlertAction(utils.Alert{
+				Name: "CRON job " + job.Name + " failed",
+				Severity: "error",
+				Actions: job.NotifyOnFailure,
+			}, action, utils.AlertMetricTrack{
+				Key: "cosmos.cron." + job.Scheduler + "." + job.Name,
+				Object: object,
+			})
+		}
+	}
+}
+
+// disableFailingJob stops scheduling a job after too many consecutive failures.
+// Custom jobs are also disabled in the config so it survives restarts
+func disableFailingJob(job ConfigJob) {
+	utils.Warn(fmt.Sprintf("CRON job %s failed %d times in a row, disabling it", job.Name, job.ConsecutiveFailures))
+
+	triggerJobEvent(job, "disabled", "CRON job " + job.Name + " disabled after too many failures", "error", map[string]interface{}{
+		"consecutiveFailures": job.ConsecutiveFailures,
+	})
+
+	if job.Scheduler == "Custom" {
+		config := utils.ReadConfigFromFile()
+		if configJob, ok := config.CRON[job.Name]; ok {
+			configJob.Enabled = false
+			config.CRON[job.Name] = configJob
+			utils.SetBaseMainConfig(config)
+			InitJobs()
+		}
+	}
+
+	InitScheduler()
+}
@@ -0,0 +1,314 @@
+package cron
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// JobRun is a finished run of a job, as stored in the jobs history
+type JobRun struct {
+	Id primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Scheduler string `json:"scheduler" bson:"scheduler"`
+	Name string `json:"name" bson:"name"`
+	Trigger string `json:"trigger" bson:"trigger"`
+	ChainID string `json:"chainId" bson:"chainId"`
+	Container string `json:"container" bson:"container"`
+	Resource string `json:"resource" bson:"resource"`
+	Started time.Time `json:"started" bson:"started"`
+	Ended time.Time `json:"ended" bson:"ended"`
+	Duration int64 `json:"duration" bson:"duration"`
+	Status string `json:"status" bson:"status"`
+	Error string `json:"error" bson:"error"`
+	Logs []string `json:"logs,omitempty" bson:"logs"`
+	// lines dropped from the start of the logs, past maxRunLogsSize
+	LogsTruncated int `json:"logsTruncated,omitempty" bson:"logsTruncated,omitempty"`
+}
+
+const defaultJobsHistoryRetention = 30
+
+// the logs of a run are saved whole up to maxRunLogsSize, a document of the database being limited to 16MB
+const maxRunLogsSize = 8 * 1024 * 1024
+
+// runLog is the log of a running job, saved with its run. The logs of the job only keep its last MaxLogs lines
+type runLog struct {
+	lines []string
+	size int
+	dropped int
+}
+
+// logs of the running jobs, by scheduler and name. Only accessed with CRONLock held
+var runLogs = map[string]*runLog{}
+
+func startRunLog(job ConfigJob) {
+	runLogs[job.Scheduler + "/" + job.Name] = &runLog{}
+}
+
+// appendRunLog adds a line to the log of the current run of a job, dropping the oldest ones past maxRunLogsSize
+func appendRunLog(job ConfigJob, line string) {
+	log, ok := runLogs[job.Scheduler + "/" + job.Name]
+	if !ok {
+		return
+	}
+
+	log.lines = append(log.lines, line)
+	log.size += len(line)
+
+	for log.size > maxRunLogsSize && len(log.lines) > 1 {
+		log.size -= len(log.lines[0])
+		log.lines = log.lines[1:]
+		log.dropped++
+	}
+}
+
+func initJobsHistory() {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "jobs")
+	if errCo != nil {
+		utils.Error("Jobs history - Database Connect", errCo)
+		return
+	}
+
+	model := mongo.IndexModel{
+		Keys: bson.D{{Key: "scheduler", Value: 1}, {Key: "name", Value: 1}, {Key: "started", Value: -1}},
+	}
+
+	_, err := c.Indexes().CreateOne(context.Background(), model)
+	if err != nil {
+		utils.Error("Jobs history - Create Index", err)
+	}
+}
+
+// saveJobRun stores the run that just ended in the jobs history, err being nil on success. CRONLock must be held
+func saveJobRun(job ConfigJob, err error) {
+	run := JobRun{
+		Scheduler: job.Scheduler,
+		Name: job.Name,
+		Trigger: job.Trigger,
+		ChainID: job.ChainID,
+		Container: job.Container,
+		Resource: job.Resource,
+		Started: job.LastStarted,
+		Ended: job.LastRun,
+		Duration: job.LastRun.Sub(job.LastStarted).Milliseconds(),
+		Status: "success",
+		Logs: append([]string{}, job.Logs...),
+	}
+
+	key := job.Scheduler + "/" + job.Name
+	if log, ok := runLogs[key]; ok {
+		run.Logs = log.lines
+		run.LogsTruncated = log.dropped
+		delete(runLogs, key)
+	}
+
+	if err != nil {
+		run.Status = "fail"
+		run.Error = err.Error()
+	}
+
+	go (func() {
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "jobs")
+		if errCo != nil {
+			utils.Error("Jobs history - Database Connect", errCo)
+			return
+		}
+
+		if _, err := c.InsertOne(context.Background(), run); err != nil {
+			utils.Error("Jobs history - Failed to save run of " + run.Name, err)
+		}
+	})()
+}
+
+// CleanupJobsHistory removes the runs older than the configured retention
+func CleanupJobsHistory() {
+	retention := utils.GetMainConfig().JobsHistoryRetentionDays
+	if retention <= 0 {
+		retention = defaultJobsHistoryRetention
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "jobs")
+	if errCo != nil {
+		utils.MajorError("Jobs history Cleanup", errCo)
+		return
+	}
+
+	del, err := c.DeleteMany(context.Background(), bson.M{"started": bson.M{"$lt": time.Now().AddDate(0, 0, -retention)}})
+	if err != nil {
+		utils.MajorError("Jobs history Cleanup", err)
+		return
+	}
+
+	utils.Log("Cleanup: jobs history " + strconv.Itoa(int(del.DeletedCount)) + " runs deleted")
+
+	cc, errCo := utils.GetCollection(utils.GetRootAppId(), "jobs_chains")
+	if errCo != nil {
+		utils.MajorError("Jobs chains Cleanup", errCo)
+		return
+	}
+
+	del, err = cc.DeleteMany(context.Background(), bson.M{"started": bson.M{"$lt": time.Now().AddDate(0, 0, -retention)}})
+	if err != nil {
+		utils.MajorError("Jobs chains Cleanup", err)
+		return
+	}
+
+	utils.Log("Cleanup: jobs chains " + strconv.Itoa(int(del.DeletedCount)) + " chains deleted")
+}
+
+func ListJobsHistoryRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		query := req.URL.Query()
+		dbQuery := bson.M{}
+
+		for _, field := range []string{"scheduler", "name", "status", "trigger", "chainId", "container", "resource"} {
+			if value := query.Get(field); value != "" {
+				dbQuery[field] = value
+			}
+		}
+
+		started := bson.M{}
+		if from := query.Get("from"); from != "" {
+			fromDate, err := time.Parse(time.RFC3339, from)
+			if err != nil {
+				utils.HTTPError(w, "Invalid from date", http.StatusBadRequest, "CRON001")
+				return
+			}
+			started["$gte"] = fromDate
+		}
+		if to := query.Get("to"); to != "" {
+			toDate, err := time.Parse(time.RFC3339, to)
+			if err != nil {
+				utils.HTTPError(w, "Invalid to date", http.StatusBadRequest, "CRON001")
+				return
+			}
+			started["$lte"] = toDate
+		}
+		if len(started) > 0 {
+			dbQuery["started"] = started
+		}
+
+		// search in the logs and the error of the runs
+		if search := query.Get("search"); search != "" {
+			pattern := primitive.Regex{Pattern: regexp.QuoteMeta(search), Options: "i"}
+			dbQuery["$or"] = bson.A{
+				bson.M{"logs": pattern},
+				bson.M{"error": pattern},
+			}
+		}
+
+		if page := query.Get("page"); page != "" {
+			pageId, err := primitive.ObjectIDFromHex(page)
+			if err != nil {
+				utils.HTTPError(w, "Invalid page", http.StatusBadRequest, "CRON001")
+				return
+			}
+			dbQuery["_id"] = bson.M{"$lt": pageId}
+		}
+
+		limit := int64(50)
+		if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 500 {
+			limit = int64(l)
+		}
+
+		opts := options.Find().SetLimit(limit).SetSort(bson.D{{Key: "_id", Value: -1}})
+		if query.Get("logs") != "true" {
+			opts.SetProjection(bson.M{"logs": 0})
+		}
+
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "jobs")
+		if errCo != nil {
+			utils.Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		cursor, err := c.Find(context.Background(), dbQuery, opts)
+		if err != nil {
+			utils.Error("JobsHistory: Error while getting runs", err)
+			utils.HTTPError(w, "Jobs history Get Error", http.StatusInternalServerError, "CRON002")
+			return
+		}
+		defer cursor.Close(context.Background())
+
+		runs := []JobRun{}
+		if err = cursor.All(context.Background(), &runs); err != nil {
+			utils.Error("JobsHistory: Error while decoding runs", err)
+			utils.HTTPError(w, "Jobs history decode Error", http.StatusInternalServerError, "CRON004")
+			return
+		}
+
+		totalCount, err := c.CountDocuments(context.Background(), dbQuery)
+		if err != nil {
+			utils.Error("JobsHistory: Error while counting runs", err)
+			utils.HTTPError(w, "Jobs history count Error", http.StatusInternalServerError, "CRON005")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"total":  totalCount,
+			"data":   runs,
+		})
+	} else {
+		utils.Error("JobsHistory: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func GetJobRunRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		// a malformed id cannot match any run
+		id, err := primitive.ObjectIDFromHex(mux.Vars(req)["id"])
+		if err != nil {
+			utils.HTTPError(w, "Run not found", http.StatusNotFound, "CRON003")
+			return
+		}
+
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "jobs")
+		if errCo != nil {
+			utils.Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		run := JobRun{}
+		err = c.FindOne(context.Background(), bson.M{"_id": id}).Decode(&run)
+		if err == mongo.ErrNoDocuments {
+			utils.HTTPError(w, "Run not found", http.StatusNotFound, "CRON003")
+			return
+		} else if err != nil {
+			utils.Error("JobsHistory: Error while getting run", err)
+			utils.HTTPError(w, "Jobs history Get Error", http.StatusInternalServerError, "CRON002")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data":   run,
+		})
+	} else {
+		utils.Error("JobRun: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -43,6 +43,15 @@ type ConfigJob struct {
 	Timeout time.Duration
 	MaxLogs int
 	Resource string
+	Retries int
+	RetryBackoff time.Duration
+	NotifyOnFailure []utils.AlertAction
+	DisableAfterFailures int
+	ConsecutiveFailures int
+	After []utils.CRONJobDependency
+	Triggers []utils.CRONEventTrigger
+	ChainID string
+	Trigger string
 }
 
 var jobsList = map[string]map[string]ConfigJob{}
@@ -63,6 +72,9 @@ func Init() {
 	}
 	
 	wasInit = true
+	utils.OnEvent = triggerEventJobs
+	docker.OnContainersChanged = refreshContainerSchedules
+	go initJobsHistory()
 	InitJobs()
 	InitScheduler()
 }
@@ -109,6 +121,7 @@ func JobFromCommandWithEnv(env []string, command string, args ...string) func(On
 
 					cmd := exec.CommandContext(ctx, command, args...)
 					cmd.Env = append(os.Environ(), env...)
+					cmd.Env = append(cmd.Env, jobEnvFromContext(ctx)...)
 					
 					// Create a pseudo-terminal (PTY)
 					ptmx, err := pty.Start(cmd)
@@ -173,6 +186,16 @@ func setTerminalSize(ptmx *os.File, rows, cols uint16) error {
 	})
 }
 
+type jobEnvKey struct{}
+
+// jobEnvFromContext returns the extra environment of the current run, set when a job is triggered by an event
+func jobEnvFromContext(ctx context.Context) []string {
+	if env, ok := ctx.Value(jobEnvKey{}).([]string); ok {
+		return env
+	}
+	return []string{}
+}
+
 type ExecuterFn func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc)
 
 func JobFromContainerCommand(containerID string, command string, args ...string) func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
@@ -199,6 +222,7 @@ func JobFromContainerCommand(containerID string, command string, args ...string)
 			// Create exec configuration
 			execConfig := types.ExecConfig{
 					Cmd:          append([]string{command}, args...),
+					Env:          jobEnvFromContext(ctx),
 					AttachStdout: true,
 					AttachStderr: true,
 			}
@@ -245,6 +269,13 @@ func JobFromContainerCommand(containerID string, command string, args ...string)
 }
 
 func InitJobs() {
+	// listed before taking CRONLock, a slow Docker daemon would otherwise hold every job
+	schedules, errSchedules := GetContainerSchedules()
+	if errSchedules != nil {
+		utils.Error("Container schedules", errSchedules)
+		retryContainerSchedules()
+	}
+
 	CRONLock <- true
 	defer func() { <-CRONLock }()
 
@@ -259,7 +290,9 @@ func InitJobs() {
 	for _, job := range configJobsList {
 		cmd := JobFromCommand("sh", "-c", job.Command)
 
-		if job.Container != "" {
+		if job.Image != "" {
+			cmd = JobFromEphemeralContainer(job)
+		} else if job.Container != "" {
 			cmd = JobFromContainerCommand(job.Container, "sh", "-c", job.Command)
 		}
 
@@ -275,8 +308,24 @@ func InitJobs() {
 			Logs: []string{},
 			Disabled: !job.Enabled,
 			Container: job.Container,
+			Retries: job.Retries,
+			NotifyOnFailure: job.NotifyOnFailure,
+			DisableAfterFailures: job.DisableAfterFailures,
+			After: append([]utils.CRONJobDependency{}, job.After...),
+			Triggers: job.Triggers,
 		}
 
+		for i, dep := range j.After {
+			if dep.Scheduler == "" {
+				j.After[i].Scheduler = "Custom"
+				if _, ok := configJobsList[dep.Job]; !ok {
+					utils.Warn("CRON job " + job.Name + " runs after " + dep.Job + ", which does not exist")
+				}
+			}
+		}
+
+		SetJobRetryPolicy(&j, job.Timeout, job.RetryBackoff)
+
 		if CustomScheduler, ok := jobsList["Custom"]; ok {
 			if old, ok := CustomScheduler[job.Name]; ok {
 				j.Logs = old.Logs
@@ -286,18 +335,53 @@ func InitJobs() {
 				j.LastRunSuccess = old.LastRunSuccess
 				j.Ctx = old.Ctx
 				j.CancelFunc = old.CancelFunc
+				j.ChainID = old.ChainID
+
+				// re-enabling a job gives it a fresh start
+				if !old.Disabled || j.Disabled {
+					j.ConsecutiveFailures = old.ConsecutiveFailures
+				}
 			}
 		}
 
 		registerJob(j)
 	}
+
+	if errSchedules == nil {
+		registerContainerSchedules(schedules)
+	}
 }
 
-func jobRunner(schedulerName, jobName string) func(OnLog func(string), OnFail func(error), OnSuccess func()) {
-	return func(OnLog func(string), OnFail func(error), OnSuccess func()) {
-			RunningLock <- true
-			defer func() { <-RunningLock }()
+// SetJobRetryPolicy parses the timeout and the retry backoff of a job, like "1h" and "30s"
+func SetJobRetryPolicy(j *ConfigJob, timeout string, retryBackoff string) {
+	if timeout != "" {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil {
+			utils.Error("CRON job " + j.Name + ": invalid timeout " + timeout, err)
+		} else {
+			j.Timeout = duration
+		}
+	}
+
+	if retryBackoff != "" {
+		backoff, err := time.ParseDuration(retryBackoff)
+		if err != nil {
+			utils.Error("CRON job " + j.Name + ": invalid retry backoff " + retryBackoff, err)
+		} else {
+			j.RetryBackoff = backoff
+		}
+	}
+}
+
+// jobRunner runs a job, source is what started it (schedule, manual, one-time...) and is kept in its run history
+func jobRunner(schedulerName, jobName, source string) func(OnLog func(string), OnFail func(error), OnSuccess func()) {
+	return jobRunnerInChain(schedulerName, jobName, "", "", source, nil)
+}
 
+// jobRunnerInChain runs a job as a step of a chain. An empty chainID starts a new chain if other jobs run after this one.
+// env is added to the environment of the commands run by the job
+func jobRunnerInChain(schedulerName, jobName, chainID, trigger, source string, env []string) func(OnLog func(string), OnFail func(error), OnSuccess func()) {
+	return func(OnLog func(string), OnFail func(error), OnSuccess func()) {
 			CRONLock <- true
 			
 			var job ConfigJob
@@ -305,23 +389,27 @@ func jobRunner(schedulerName, jobName string) func(OnLog func(string), OnFail fu
 			
 			if job, ok = jobsList[schedulerName][jobName]; !ok {
 					utils.Error("Scheduler: job "+jobName+" not found", nil)
+					skipChainStep(chainID, schedulerName, jobName, trigger, "job not found")
 					<-CRONLock
 					return
 			}
 
 			if job.Running {
 					utils.Error("Scheduler: job "+job.Name+" is already running", nil)
+					skipChainStep(chainID, schedulerName, jobName, trigger, "job is already running")
 					<-CRONLock
 					return
 			}
 
-			// Create context with timeout
-			// if job.Timeout == 0 {
-			// 		job.Timeout = 240 * time.Hour
-			// }
+			if chainID == "" && hasDependents(job) {
+				chainID = newChainRun()
+			}
+			startChainStep(chainID, job, trigger)
+			job.ChainID = chainID
+			job.Trigger = source
 
-			// ctx, cancel := context.WithTimeout(context.Background(), )
-			ctx, cancel := context.WithCancel(context.Background())
+			// cancelling this context stops the job and its retries, each attempt gets its own timeout
+			ctx, cancel := context.WithCancel(context.WithValue(context.Background(), jobEnvKey{}, env))
 			job.Ctx = ctx
 			job.LastStarted = time.Now()
 			job.LastRunSuccess = false
@@ -329,6 +417,7 @@ func jobRunner(schedulerName, jobName string) func(OnLog func(string), OnFail fu
 			job.Logs = []string{}
 			job.CancelFunc = cancel
 			jobsList[job.Scheduler][job.Name] = job
+			startRunLog(job)
 			<-CRONLock
 
 			// Ensure cleanup happens
@@ -339,6 +428,8 @@ func jobRunner(schedulerName, jobName string) func(OnLog func(string), OnFail fu
 							j.CancelFunc = nil
 							jobsList[schedulerName][jobName] = j
 					}
+					// saved with the run, unless the job was removed while running
+					delete(runLogs, schedulerName + "/" + jobName)
 					<-CRONLock
 					cancel()
 			}()
@@ -349,7 +440,69 @@ func jobRunner(schedulerName, jobName string) func(OnLog func(string), OnFail fu
 			
 			InternalProcessTracker.StartProcess()
 			
-			job.Job(OnLog, OnFail, OnSuccess, ctx, cancel)
+			err := runJobWithRetries(job, OnLog, ctx)
+			if err != nil {
+				OnFail(err)
+			} else {
+				OnSuccess()
+			}
+	}
+}
+
+// runJobWithRetries runs a job until it succeeds, is cancelled, or has no retries left. Each attempt holds
+// RunningLock, which is released while waiting for the next one so that the other jobs can run
+func runJobWithRetries(job ConfigJob, OnLog func(string), ctx context.Context) error {
+	backoff := job.RetryBackoff
+	if backoff == 0 {
+		backoff = 30 * time.Second
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptCtx, attemptCancel := context.WithCancel(ctx)
+		if job.Timeout > 0 {
+			attemptCtx, attemptCancel = context.WithTimeout(ctx, job.Timeout)
+		}
+
+		select {
+		case RunningLock <- true:
+		case <-ctx.Done():
+			attemptCancel()
+			return ctx.Err()
+		}
+
+		var jobErr error
+		func() {
+			defer func() { <-RunningLock }()
+
+			job.Job(OnLog, func(err error) {
+				if jobErr == nil {
+					jobErr = err
+				}
+			}, func() {}, attemptCtx, attemptCancel)
+		}()
+
+		if jobErr != nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+			jobErr = fmt.Errorf("job timed out after %s", job.Timeout)
+		}
+		attemptCancel()
+
+		if jobErr == nil || attempt >= job.Retries || ctx.Err() != nil {
+			return jobErr
+		}
+
+		wait := backoff * time.Duration(1 << attempt)
+		OnLog(fmt.Sprintf("Attempt %d/%d failed: %s. Retrying in %s\n", attempt + 1, job.Retries + 1, jobErr.Error(), wait))
+
+		triggerJobEvent(job, "retry", "CRON job " + job.Name + " failed, retrying", "warning", map[string]interface{}{
+			"error": jobErr.Error(),
+			"attempt": attempt + 1,
+		})
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 
@@ -367,6 +520,7 @@ func jobRunner_OnLog(schedulerName, jobName string) func(log string) {
 					}
 					job.Logs = append(job.Logs, log)
 					jobsList[job.Scheduler][job.Name] = job
+					appendRunLog(job, log)
 					utils.Debug(log)
 					triggerJobUpdated("log", job.Name, log)
 			}
@@ -379,9 +533,17 @@ func jobRunner_OnFail(schedulerName, jobName string) func(err error) {
 		CRONLock <- true
 		if job, ok := jobsList[schedulerName][jobName]; ok {
 			job.Logs = append(job.Logs, err.Error())
+			appendRunLog(job, err.Error())
 			job.LastRunSuccess = false
 			job.LastRun = time.Now()
 			job.Running = false
+			job.ConsecutiveFailures++
+
+			disable := job.DisableAfterFailures > 0 && job.ConsecutiveFailures >= job.DisableAfterFailures
+			if disable {
+				job.Disabled = true
+			}
+
 			jobsList[job.Scheduler][job.Name] = job
 			triggerJobUpdated("fail", job.Name, err.Error())
 			utils.MajorError("CRON job " + job.Name + " failed", err)
@@ -390,7 +552,18 @@ func jobRunner_OnFail(schedulerName, jobName string) func(err error) {
 
 			triggerJobEvent(job, "fail", "CRON job " + job.Name + " failed", "error", map[string]interface{}{
 				"error": err.Error(),
+				"consecutiveFailures": job.ConsecutiveFailures,
 			})
+
+			go notifyJobFailure(job, err, disable)
+
+			if disable {
+				go disableFailingJob(job)
+			}
+
+			saveJobRun(job, err)
+
+			endChainStep(job, false, err)
 		}
 		<-CRONLock
 	}
@@ -402,6 +575,7 @@ func jobRunner_OnSuccess(schedulerName, jobName string) func() {
 			job.LastRunSuccess = true
 			job.LastRun = time.Now()
 			job.Running = false
+			job.ConsecutiveFailures = 0
 			jobsList[job.Scheduler][job.Name] = job
 			triggerJobUpdated("success", job.Name)
 			utils.Log("CRON job " + job.Name + " finished")
@@ -409,6 +583,10 @@ func jobRunner_OnSuccess(schedulerName, jobName string) func() {
 			InternalProcessTracker.EndProcess()
 
 			triggerJobEvent(job, "success", "CRON job " + job.Name + " finished", "success", map[string]interface{}{})
+
+			saveJobRun(job, nil)
+
+			endChainStep(job, true, nil)
 		}
 		<-CRONLock
 	}
@@ -481,10 +659,15 @@ func InitScheduler() {
 				continue
 			}
 
+			// pipeline steps and event triggered jobs without a crontab only run when triggered
+			if job.Crontab == "" && (len(job.After) > 0 || len(job.Triggers) > 0) {
+				continue
+			}
+
 			_, err := scheduler.NewJob(
 				gocron.CronJob(job.Crontab, true),
 				gocron.NewTask(
-					jobRunner(job.Scheduler, job.Name),
+					jobRunner(job.Scheduler, job.Name, "schedule"),
 					jobRunner_OnLog(job.Scheduler, job.Name),
 					jobRunner_OnFail(job.Scheduler, job.Name),
 					jobRunner_OnSuccess(job.Scheduler, job.Name),
@@ -585,7 +768,7 @@ func ManualRunJob(scheduler string, name string) error {
 		<-CRONLock
 		// Execute the job
 		go (func() {
-			jobRunner(job.Scheduler, job.Name)(jobRunner_OnLog(job.Scheduler, job.Name), jobRunner_OnFail(job.Scheduler, job.Name), jobRunner_OnSuccess(job.Scheduler, job.Name))
+			jobRunner(job.Scheduler, job.Name, "manual")(jobRunner_OnLog(job.Scheduler, job.Name), jobRunner_OnFail(job.Scheduler, job.Name), jobRunner_OnSuccess(job.Scheduler, job.Name))
 		})()
 	} else {
 		<-CRONLock
@@ -615,7 +798,7 @@ func RunOneTimeJob(job ConfigJob) {
 	<-CRONLock
 
 	// Execute the job
-	jobRunner(job.Scheduler, job.Name)(jobRunner_OnLog(job.Scheduler, job.Name), jobRunner_OnFail(job.Scheduler, job.Name), jobRunner_OnSuccess(job.Scheduler, job.Name))
+	jobRunner(job.Scheduler, job.Name, "one-time")(jobRunner_OnLog(job.Scheduler, job.Name), jobRunner_OnFail(job.Scheduler, job.Name), jobRunner_OnSuccess(job.Scheduler, job.Name))
 }
 
 func AddJobConfig(job utils.CRONConfig) {
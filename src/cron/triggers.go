@@ -0,0 +1,93 @@
+package cron
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// a job is triggered at most once per minTriggerInterval, so that jobs triggering each other don't loop forever
+const minTriggerInterval = time.Minute
+
+// last time each job was triggered by an event, by scheduler and name. Only accessed with CRONLock held
+var lastTriggered = map[string]time.Time{}
+
+// eventPatternMatches matches an event id or object against a pattern where * matches anything
+func eventPatternMatches(pattern, value string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+
+	regex, err := regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+	if err != nil {
+		return false
+	}
+
+	return regex.MatchString(value)
+}
+
+// triggerEventJobs starts the jobs with a trigger matching an event sent with utils.TriggerEvent.
+// Docker events are sent as cosmos.docker.event.<type>.<action>, so they can be used as triggers too.
+// The event is passed to the job through the COSMOS_EVENT_* environment variables
+func triggerEventJobs(eventId string, label string, level string, object string, data map[string]interface{}) {
+	// the containers of the CRON jobs would trigger the jobs they run
+	if actor, ok := data["actor"].(events.Actor); ok && actor.Attributes["cosmos-cron-job"] != "" {
+		return
+	}
+
+	CRONLock <- true
+
+	toRun := []ConfigJob{}
+	for _, schedulerList := range jobsList {
+		for _, job := range schedulerList {
+			if job.Disabled || job.Running {
+				continue
+			}
+
+			// a job cannot trigger itself through its own events
+			ownEvent := "." + strings.Replace(job.Scheduler, ".", "_", -1) + "." + strings.Replace(job.Name, ".", "_", -1) + "."
+			if strings.HasPrefix(eventId, "cosmos.cron") && strings.Contains(eventId, ownEvent) {
+				continue
+			}
+
+			for _, trigger := range job.Triggers {
+				if eventPatternMatches(trigger.EventId, eventId) && (trigger.Object == "" || eventPatternMatches(trigger.Object, object)) {
+					key := job.Scheduler + "/" + job.Name
+					if time.Since(lastTriggered[key]) < minTriggerInterval {
+						utils.Debug("CRON job " + job.Name + " was triggered less than " + minTriggerInterval.String() + " ago, ignoring event " + eventId)
+						break
+					}
+
+					lastTriggered[key] = time.Now()
+					toRun = append(toRun, job)
+					break
+				}
+			}
+		}
+	}
+
+	<-CRONLock
+
+	if len(toRun) == 0 {
+		return
+	}
+
+	dataAsBytes, _ := json.Marshal(data)
+	env := []string{
+		"COSMOS_EVENT_ID=" + eventId,
+		"COSMOS_EVENT_LABEL=" + label,
+		"COSMOS_EVENT_LEVEL=" + level,
+		"COSMOS_EVENT_OBJECT=" + object,
+		"COSMOS_EVENT_DATA=" + string(dataAsBytes),
+	}
+
+	for _, job := range toRun {
+		utils.Log("CRON job " + job.Name + " triggered by event " + eventId)
+		go jobRunnerInChain(job.Scheduler, job.Name, "", "", "event " + eventId, env)(jobRunner_OnLog(job.Scheduler, job.Name), jobRunner_OnFail(job.Scheduler, job.Name), jobRunner_OnSuccess(job.Scheduler, job.Name))
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"bufio"
 	"strconv"
 	"os"
+	"io"
 	"io/ioutil"
 	"os/user"
 	"errors"
@@ -86,6 +87,17 @@ type ContainerCreateRequestContainer struct {
 	CapAdd []string `json:"cap_add,omitempty"`
 	CapDrop []string `json:"cap_drop,omitempty"`
 
+	MemLimit ComposeValue `json:"mem_limit,omitempty"`
+	MemReservation ComposeValue `json:"mem_reservation,omitempty"`
+	MemswapLimit ComposeValue `json:"memswap_limit,omitempty"`
+	CPUs ComposeValue `json:"cpus,omitempty"`
+	CPUShares int64 `json:"cpu_shares,omitempty"`
+	PidsLimit int64 `json:"pids_limit,omitempty"`
+	ShmSize ComposeValue `json:"shm_size,omitempty"`
+	Ulimits map[string]ContainerCreateRequestUlimit `json:"ulimits,omitempty"`
+	BlkioConfig ContainerCreateRequestBlkioConfig `json:"blkio_config,omitempty"`
+	Deploy ContainerCreateRequestDeploy `json:"deploy,omitempty"`
+
 	PostInstall []string `json:"post_install,omitempty"`	 
 }
 
@@ -233,9 +245,7 @@ func CreateServiceRoute(w http.ResponseWriter, req *http.Request) {
 				return 
 		}
 
-		decoder := json.NewDecoder(req.Body)
-		var serviceRequest DockerServiceCreateRequest
-		err := decoder.Decode(&serviceRequest)
+		serviceRequest, err := decodeServiceRequest(req)
 		if err != nil {
 			utils.Error("CreateService - decode - ", err)
 			fmt.Fprintf(w, "[OPERATION FAILED] Bad request: "+err.Error(), http.StatusBadRequest, "DS003")
@@ -257,6 +267,46 @@ func CreateServiceRoute(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// decodeServiceRequest reads either a cosmos-compose JSON, a JSON ComposeImportRequest
+// or, with a YAML content type, a raw docker-compose file
+func decodeServiceRequest(req *http.Request) (DockerServiceCreateRequest, error) {
+	return decodeServiceRequestFor(req, nil)
+}
+
+// decodeServiceRequestFor decodes a request replacing running services, containerNames being the
+// containers running them by service name
+func decodeServiceRequestFor(req *http.Request, containerNames map[string]string) (DockerServiceCreateRequest, error) {
+	var serviceRequest DockerServiceCreateRequest
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return serviceRequest, err
+	}
+
+	if strings.Contains(req.Header.Get("Content-Type"), "yaml") {
+		profiles := []string{}
+		if req.URL.Query().Get("profiles") != "" {
+			profiles = strings.Split(req.URL.Query().Get("profiles"), ",")
+		}
+
+		return ParseCompose(ComposeImportRequest{
+			Compose: string(body),
+			Profiles: profiles,
+			Name: req.URL.Query().Get("name"),
+			ContainerNames: containerNames,
+		})
+	}
+
+	var importRequest ComposeImportRequest
+	if err := json.Unmarshal(body, &importRequest); err == nil && importRequest.Compose != "" {
+		importRequest.ContainerNames = containerNames
+		return ParseCompose(importRequest)
+	}
+
+	err = json.Unmarshal(body, &serviceRequest)
+	return serviceRequest, err
+}
+
 // generatePorts is a helper function to generate a slice of ports from a string range.
 func generatePorts(portRangeStr string) []string {
 	portsStr := strings.Split(portRangeStr, "-")
@@ -495,6 +545,14 @@ func CreateService(serviceRequest DockerServiceCreateRequest, OnLog func(string)
 			containerConfig.StopTimeout = nil
 		}
 
+		// keep the dependencies, so the stack can be managed in order later on
+		if len(container.DependsOn) > 0 {
+			if containerConfig.Labels == nil {
+				containerConfig.Labels = map[string]string{}
+			}
+			containerConfig.Labels["cosmos-depends-on"] = FormatDependsOnLabel(container.DependsOn)
+		}
+
 		// check if there's an empty TZ env, if so, replace it with the host's TZ
 		if containerConfig.Env != nil {
 			for i, env := range containerConfig.Env {
@@ -589,6 +647,11 @@ func CreateService(serviceRequest DockerServiceCreateRequest, OnLog func(string)
 				continue
 			}
 
+			if warning := RootlessPortWarning(hostPort); warning != "" {
+				utils.Warn("CreateService: " + warning)
+				OnLog(utils.DoWarn("%s\n", warning))
+			}
+
 			// Get the existing bindings for this container port, if any
 			bindings := PortBindings[nat.Port(contPort)]
 
@@ -699,6 +762,14 @@ func CreateService(serviceRequest DockerServiceCreateRequest, OnLog func(string)
 			CapDrop:     container.CapDrop,
 		}
 
+		err = ApplyContainerResources(container, hostConfig)
+		if err != nil {
+			utils.Error("CreateService: Rolling back changes because of -- Container resources", err)
+			OnLog(utils.DoErr("Rolling back changes because of -- Container resources error: "+err.Error()))
+			Rollback(rollbackActions, OnLog)
+			return err
+		}
+
 		if container.Runtime != "" {
 			hostConfig.Runtime = strings.Join(strings.Fields(container.Runtime), " ")
 		}		
@@ -25,6 +25,24 @@ func ListContainersRoute(w http.ResponseWriter, req *http.Request) {
 	}
 	
 	if(req.Method == "GET") {
+		// ?host=all lists the containers of the whole Constellation, other hosts are proxied to the node
+		if req.URL.Query().Get("host") == "all" {
+			containers, failures, err := ListFleetContainers()
+
+			if err != nil {
+				utils.Error("ListContainersRoute: Error while getting containers", err)
+				utils.HTTPError(w, "Containers Get Error", http.StatusInternalServerError, "DL001")
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": "OK",
+				"data": containers,
+				"unreachable": failures,
+			})
+			return
+		}
+
 		containers, err := ListContainers()
 
 		if err != nil {
@@ -4,6 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/azukaar/cosmos-server/src/utils"
@@ -34,9 +37,26 @@ func GetContainerRoute(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		// status changes of the last days, 7 by default
+		days := 7
+		if req.URL.Query().Get("timelineDays") != "" {
+			days, err = strconv.Atoi(req.URL.Query().Get("timelineDays"))
+			if err != nil || days < 0 {
+				utils.HTTPError(w, "Invalid timelineDays", http.StatusBadRequest, "DS003")
+				return
+			}
+		}
+
+		timeline, err := GetContainerTimeline(strings.TrimPrefix(container.Name, "/"), time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			utils.Error("GetContainerRoute: Error while getting timeline", err)
+			timeline = []ContainerStatusEvent{}
+		}
+
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "OK",
 			"data":   container,
+			"timeline": timeline,
 		})
 	} else {
 		utils.Error("GetContainerRoute: Method not allowed " + req.Method, nil)
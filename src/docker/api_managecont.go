@@ -99,6 +99,12 @@ func ManageContainerRoute(w http.ResponseWriter, req *http.Request) {
 
 			utils.Log("Container Update - Image pulled " + imagename)
 
+			if !(utils.IsInsideContainer && containerName == os.Getenv("HOSTNAME")) {
+				if errH := RememberContainerImage(container, "manual-update"); errH != nil {
+					utils.Error("Container Update - Cannot keep previous image in history", errH)
+				}
+			}
+
 			_, err = RecreateContainer(container.Name, container)
 
 			if err != nil {
@@ -0,0 +1,187 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+func ListStacksRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		stacks, err := ListStacks()
+		if err != nil {
+			utils.Error("ListStacks", err)
+			utils.HTTPError(w, "Internal server error: " + err.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": stacks,
+		})
+	} else {
+		utils.Error("ListStacks: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func GetStackRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		stackName := utils.SanitizeSafe(mux.Vars(req)["stack"])
+
+		services, err := GetStackServices(stackName)
+		if err != nil {
+			utils.Error("GetStack", err)
+			utils.HTTPError(w, "Stack not found: " + err.Error(), http.StatusNotFound, "DS005")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": DockerServiceCreateRequest{
+				Services: services,
+			},
+		})
+	} else {
+		utils.Error("GetStack: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// ManageStackRoute runs start, stop, restart, update or remove on a whole stack, streaming the progress
+func ManageStackRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("ManageStack", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		vars := mux.Vars(req)
+		stackName := utils.SanitizeSafe(vars["stack"])
+		action := utils.Sanitize(vars["action"])
+
+		switch action {
+		case "start", "stop", "restart", "update", "remove":
+		default:
+			utils.HTTPError(w, "Invalid action", http.StatusBadRequest, "DS003")
+			return
+		}
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Transfer-Encoding", "chunked")
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			utils.Error("ManageStack - Cannot stream response", nil)
+			utils.HTTPError(w, "Cannot stream response", http.StatusInternalServerError, "DS004")
+			return
+		}
+
+		err := ManageStack(stackName, action, func(msg string) {
+			fmt.Fprint(w, msg)
+			flusher.Flush()
+		})
+
+		if err != nil {
+			utils.Error("ManageStack: " + action, err)
+			fmt.Fprintf(w, "[OPERATION FAILED] %s\n", err.Error())
+			flusher.Flush()
+			return
+		}
+
+		fmt.Fprint(w, "[OPERATION SUCCEEDED]")
+		flusher.Flush()
+	} else {
+		utils.Error("ManageStack: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// RedeployStackRoute replaces a stack by an edited definition (cosmos-compose or docker-compose).
+// With ?preview=true, only the differences with the running stack are returned
+func RedeployStackRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("RedeployStack", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		stackName := utils.SanitizeSafe(mux.Vars(req)["stack"])
+
+		next, err := decodeServiceRequestFor(req, StackContainerNames(stackName))
+		if err != nil {
+			utils.Error("RedeployStack - decode - ", err)
+			utils.HTTPError(w, "Bad request: " + err.Error(), http.StatusBadRequest, "DS003")
+			return
+		}
+
+		if req.URL.Query().Get("preview") == "true" {
+			current, err := GetStackServices(stackName)
+			if err != nil {
+				utils.Error("RedeployStack", err)
+				utils.HTTPError(w, "Stack not found: " + err.Error(), http.StatusNotFound, "DS005")
+				return
+			}
+
+			PrepareStackRequest(stackName, next)
+
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": "OK",
+				"data": DiffStack(current, next),
+			})
+			return
+		}
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Transfer-Encoding", "chunked")
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			utils.Error("RedeployStack - Cannot stream response", nil)
+			utils.HTTPError(w, "Cannot stream response", http.StatusInternalServerError, "DS004")
+			return
+		}
+
+		err = RedeployStack(stackName, next, func(msg string) {
+			fmt.Fprint(w, msg)
+			flusher.Flush()
+		})
+
+		if err != nil {
+			utils.Error("RedeployStack", err)
+			fmt.Fprintf(w, "[OPERATION FAILED] %s\n", err.Error())
+			flusher.Flush()
+		}
+	} else {
+		utils.Error("RedeployStack: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -26,6 +26,15 @@ type ContainerForm struct {
 	// we make this a int so that we can ignore 0
 	Interactive    int               `json:"interactive"`
 	NetworkMode 	 string            `json:"networkMode"`
+	// resources use the compose syntax, "0" removes a limit
+	MemLimit       ComposeValue      `json:"memLimit"`
+	MemReservation ComposeValue      `json:"memReservation"`
+	MemswapLimit   ComposeValue      `json:"memswapLimit"`
+	CPUs           ComposeValue      `json:"cpus"`
+	CPUShares      *int64            `json:"cpuShares"`
+	PidsLimit      *int64            `json:"pidsLimit"`
+	ShmSize        ComposeValue      `json:"shmSize"`
+	Ulimits        map[string]ContainerCreateRequestUlimit `json:"ulimits"`
 }
 
 func UpdateContainerRoute(w http.ResponseWriter, req *http.Request) {
@@ -127,6 +136,13 @@ func UpdateContainerRoute(w http.ResponseWriter, req *http.Request) {
 			}
 		}
 
+		err = updateContainerResources(form, container.HostConfig)
+		if err != nil {
+			utils.Error("UpdateContainer: Resources", err)
+			utils.HTTPError(w, "Invalid resources: "+err.Error(), http.StatusBadRequest, "DS003")
+			return
+		}
+
 		_, err = EditContainer(container.ID, container, false)
 		if err != nil {
 			utils.Error("UpdateContainer: EditContainer", err)
@@ -142,4 +158,41 @@ func UpdateContainerRoute(w http.ResponseWriter, req *http.Request) {
 		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
 		return
 	}
-}
\ No newline at end of file
+}
+
+// updateContainerResources applies the resources set in the form on top of the current ones
+func updateContainerResources(form ContainerForm, hostConfig *containerType.HostConfig) error {
+	current := ContainerCreateRequestContainer{}
+	ExportContainerResources(hostConfig, &current)
+
+	if form.MemLimit != "" {
+		current.MemLimit = form.MemLimit
+		// removing the limit removes the swap limit that goes with it
+		if form.MemLimit == "0" && current.MemswapLimit != "-1" {
+			current.MemswapLimit = ""
+		}
+	}
+	if form.MemReservation != "" {
+		current.MemReservation = form.MemReservation
+	}
+	if form.MemswapLimit != "" {
+		current.MemswapLimit = form.MemswapLimit
+	}
+	if form.CPUs != "" {
+		current.CPUs = form.CPUs
+	}
+	if form.CPUShares != nil {
+		current.CPUShares = *form.CPUShares
+	}
+	if form.PidsLimit != nil {
+		current.PidsLimit = *form.PidsLimit
+	}
+	if form.ShmSize != "" {
+		current.ShmSize = form.ShmSize
+	}
+	if form.Ulimits != nil {
+		current.Ulimits = form.Ulimits
+	}
+
+	return ApplyContainerResources(current, hostConfig)
+}
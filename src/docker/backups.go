@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"time"
 	
+	"github.com/docker/docker/api/types"
 	contstuff "github.com/docker/docker/api/types/container"
 
 	"github.com/azukaar/cosmos-server/src/utils"
@@ -37,8 +38,8 @@ func arePathsRelated(path1, path2 string) bool {
 	return false
 }
 
-// getStackContainers returns all containers that are part of the same stack as the given container
-func getStackContainers(containerID string) ([]string, error) {
+// GetStackContainers returns all containers that are part of the same stack as the given container
+func GetStackContainers(containerID string) ([]string, error) {
 	var stackContainers []string
 	
 	// Get the container details to find stack labels
@@ -85,6 +86,56 @@ func getStackContainers(containerID string) ([]string, error) {
 	return stackContainers, nil
 }
 
+// MountSourcePath returns the path on the host of a volume or bind mount, or "" for other mount types
+func MountSourcePath(mount types.MountPoint) string {
+	switch mount.Type {
+	case "bind":
+		return mount.Source
+	case "volume":
+		// For volumes, we need to check in /var/lib/docker/volumes
+		return filepath.Join("/var/lib/docker/volumes", mount.Name, "_data")
+	}
+	return ""
+}
+
+// ContainerMount is a volume or bind of a container, with its path on the host
+type ContainerMount struct {
+	Type        string
+	Name        string
+	Source      string
+	Destination string
+}
+
+// GetContainerMounts returns the volumes and binds of a container
+func GetContainerMounts(containerID string) ([]ContainerMount, error) {
+	errD := Connect()
+	if errD != nil {
+		return nil, errD
+	}
+
+	container, err := DockerClient.ContainerInspect(DockerContext, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := []ContainerMount{}
+	for _, mount := range container.Mounts {
+		sourcePath := MountSourcePath(mount)
+		if sourcePath == "" {
+			continue
+		}
+
+		mounts = append(mounts, ContainerMount{
+			Type:        string(mount.Type),
+			Name:        mount.Name,
+			Source:      sourcePath,
+			Destination: mount.Destination,
+		})
+	}
+
+	return mounts, nil
+}
+
 // GetContainersUsingPath returns a list of container IDs that have volumes or binds
 // that are either equal to or contained within the specified path
 func GetContainersUsingPath(path string) ([]string, error) {
@@ -119,15 +170,8 @@ func GetContainersUsingPath(path string) ([]string, error) {
 		// Check mounts (both volumes and binds)
 		isAffected := false
 		for _, mount := range fullContainer.Mounts {
-			var sourcePath string
-			
-			switch mount.Type {
-			case "bind":
-				sourcePath = mount.Source
-			case "volume":
-				// For volumes, we need to check in /var/lib/docker/volumes
-				sourcePath = filepath.Join("/var/lib/docker/volumes", mount.Name, "_data")
-			default:
+			sourcePath := MountSourcePath(mount)
+			if sourcePath == "" {
 				continue
 			}
 
@@ -141,7 +185,7 @@ func GetContainersUsingPath(path string) ([]string, error) {
 
 		if isAffected {
 			// Get all containers in the same stack
-			stackContainers, err := getStackContainers(container.ID)
+			stackContainers, err := GetStackContainers(container.ID)
 			if err != nil {
 				continue
 			}
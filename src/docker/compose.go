@@ -0,0 +1,855 @@
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// ComposeImportRequest is a docker-compose file sent to CreateServiceRoute instead of a DockerServiceCreateRequest
+type ComposeImportRequest struct {
+	// content of the docker-compose.yml file
+	Compose string `json:"compose"`
+	// content of the .env file used for the variable interpolation
+	Env string `json:"env"`
+	// content of the files referenced with env_file, by path
+	EnvFiles map[string]string `json:"envFiles"`
+	// enabled profiles, services without profiles are always enabled
+	Profiles []string `json:"profiles"`
+	// project name, defaults to the name of the compose file
+	Name string `json:"name"`
+	// containers already running the services, by service name. A service without container_name
+	// keeps the name of its container, so that a redeploy replaces it
+	ContainerNames map[string]string `json:"-"`
+}
+
+// ParseEnvFile reads a .env file, ignoring comments and empty lines
+func ParseEnvFile(content string) map[string]string {
+	env := map[string]string{}
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if key == "" {
+			continue
+		}
+
+		value := ""
+		if len(parts) == 2 {
+			value = strings.TrimSpace(parts[1])
+			if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+				value = value[1 : len(value)-1]
+			} else if idx := strings.Index(value, " #"); idx >= 0 {
+				value = strings.TrimSpace(value[:idx])
+			}
+		}
+
+		env[key] = value
+	}
+
+	return env
+}
+
+// normalizeYAML turns the map[interface{}]interface{} of yaml.v2 into JSON compatible values
+func normalizeYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := map[string]interface{}{}
+		for key, item := range v {
+			result[fmt.Sprint(key)] = normalizeYAML(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = normalizeYAML(item)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+var composeVarRegex = regexp.MustCompile(`\$(\$|\{[^}]*\}|[A-Za-z_][A-Za-z0-9_]*)`)
+
+// interpolateComposeString replaces $VAR, ${VAR}, ${VAR:-default}, ${VAR-default}, ${VAR:?error},
+// ${VAR?error}, ${VAR:+replacement} and ${VAR+replacement} the way docker-compose does. $$ is a literal $
+func interpolateComposeString(value string, env map[string]string) (string, error) {
+	var err error
+
+	result := composeVarRegex.ReplaceAllStringFunc(value, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+
+		expr := strings.TrimPrefix(match, "$")
+		expr = strings.TrimSuffix(strings.TrimPrefix(expr, "{"), "}")
+
+		i := 0
+		for i < len(expr) && (expr[i] == '_' || (expr[i] >= 'a' && expr[i] <= 'z') || (expr[i] >= 'A' && expr[i] <= 'Z') || (expr[i] >= '0' && expr[i] <= '9')) {
+			i++
+		}
+		name, modifier := expr[:i], expr[i:]
+
+		if name == "" {
+			err = fmt.Errorf("invalid interpolation format for %s", match)
+			return ""
+		}
+
+		varValue, set := env[name]
+
+		switch {
+		case modifier == "":
+			if !set {
+				utils.Warn("Compose: variable " + name + " is not set, defaulting to a blank string")
+			}
+			return varValue
+		case strings.HasPrefix(modifier, ":-"):
+			if varValue == "" {
+				return modifier[2:]
+			}
+			return varValue
+		case strings.HasPrefix(modifier, "-"):
+			if !set {
+				return modifier[1:]
+			}
+			return varValue
+		case strings.HasPrefix(modifier, ":?"):
+			if varValue == "" {
+				err = fmt.Errorf("required variable %s is missing a value: %s", name, modifier[2:])
+			}
+			return varValue
+		case strings.HasPrefix(modifier, "?"):
+			if !set {
+				err = fmt.Errorf("required variable %s is missing a value: %s", name, modifier[1:])
+			}
+			return varValue
+		case strings.HasPrefix(modifier, ":+"):
+			if varValue != "" {
+				return modifier[2:]
+			}
+			return ""
+		case strings.HasPrefix(modifier, "+"):
+			if set {
+				return modifier[1:]
+			}
+			return ""
+		}
+
+		err = fmt.Errorf("invalid interpolation format for %s", match)
+		return ""
+	})
+
+	return result, err
+}
+
+func interpolateCompose(value interface{}, env map[string]string) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return interpolateComposeString(v, env)
+	case map[string]interface{}:
+		for key, item := range v {
+			newItem, err := interpolateCompose(item, env)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = newItem
+		}
+		return v, nil
+	case []interface{}:
+		for i, item := range v {
+			newItem, err := interpolateCompose(item, env)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = newItem
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
+
+// removeComposeExtensions drops the x- fields, which are only meant to be reused through YAML anchors
+func removeComposeExtensions(definition map[string]interface{}) {
+	for key := range definition {
+		if strings.HasPrefix(key, "x-") {
+			delete(definition, key)
+		}
+	}
+}
+
+func composeMap(value interface{}) map[string]interface{} {
+	if m, ok := value.(map[string]interface{}); ok {
+		return m
+	}
+	return map[string]interface{}{}
+}
+
+func composeString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// composeStringList reads a value which can be a single string or a list of strings
+func composeStringList(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		result := []string{}
+		for _, item := range v {
+			result = append(result, composeString(item))
+		}
+		return result
+	default:
+		return []string{composeString(v)}
+	}
+}
+
+// composeList reads a value which can be a single item or a list
+func composeList(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case nil:
+		return []interface{}{}
+	case []interface{}:
+		return v
+	default:
+		return []interface{}{v}
+	}
+}
+
+// composeKeyValues reads a value which can be either a list of "key=value" or a map
+func composeKeyValues(value interface{}, separator string) map[string]interface{} {
+	result := map[string]interface{}{}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			result[key] = item
+		}
+	case []interface{}:
+		for _, item := range v {
+			parts := strings.SplitN(composeString(item), separator, 2)
+			if len(parts) == 2 {
+				result[parts[0]] = parts[1]
+			} else {
+				result[parts[0]] = nil
+			}
+		}
+	}
+
+	return result
+}
+
+func composeDuration(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return v, nil
+	case float64:
+		return int(v), nil
+	}
+
+	duration, err := time.ParseDuration(composeString(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %v", value)
+	}
+
+	return int(duration.Seconds()), nil
+}
+
+// composeMergeAppend lists the fields whose values are appended instead of replaced by extends
+var composeMergeAppend = map[string]bool{
+	"ports": true,
+	"expose": true,
+	"volumes": true,
+	"devices": true,
+	"dns": true,
+	"dns_search": true,
+	"cap_add": true,
+	"cap_drop": true,
+	"security_opt": true,
+	"extra_hosts": true,
+	"links": true,
+}
+
+func mergeComposeService(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for key, value := range base {
+		result[key] = value
+	}
+
+	for key, value := range override {
+		switch key {
+		case "environment", "labels", "sysctls":
+			merged := composeKeyValues(result[key], "=")
+			for k, v := range composeKeyValues(value, "=") {
+				merged[k] = v
+			}
+			result[key] = merged
+			continue
+		}
+
+		baseMap, baseIsMap := result[key].(map[string]interface{})
+		overrideMap, overrideIsMap := value.(map[string]interface{})
+		baseList, baseIsList := result[key].([]interface{})
+		overrideList, overrideIsList := value.([]interface{})
+
+		if baseIsMap && overrideIsMap {
+			result[key] = mergeComposeService(baseMap, overrideMap)
+		} else if baseIsList && overrideIsList && composeMergeAppend[key] {
+			result[key] = append(append([]interface{}{}, baseList...), overrideList...)
+		} else {
+			result[key] = value
+		}
+	}
+
+	return result
+}
+
+// resolveComposeExtends merges a service with the service it extends, in the same file
+func resolveComposeExtends(name string, services map[string]interface{}, resolving map[string]bool) (map[string]interface{}, error) {
+	service, ok := services[name].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("service %s is not defined", name)
+	}
+
+	extends, hasExtends := service["extends"]
+	if !hasExtends {
+		return service, nil
+	}
+
+	if resolving[name] {
+		return nil, fmt.Errorf("circular extends on service %s", name)
+	}
+	resolving[name] = true
+
+	baseName := ""
+	switch v := extends.(type) {
+	case string:
+		baseName = v
+	case map[string]interface{}:
+		if file := composeString(v["file"]); file != "" {
+			return nil, fmt.Errorf("service %s extends a service from %s, only services of the same file can be extended", name, file)
+		}
+		baseName = composeString(v["service"])
+	}
+
+	base, err := resolveComposeExtends(baseName, services, resolving)
+	if err != nil {
+		return nil, err
+	}
+
+	// depends_on and links are never inherited
+	inherited := map[string]interface{}{}
+	for key, value := range base {
+		if key != "depends_on" && key != "links" {
+			inherited[key] = value
+		}
+	}
+
+	overrides := map[string]interface{}{}
+	for key, value := range service {
+		if key != "extends" {
+			overrides[key] = value
+		}
+	}
+
+	merged := mergeComposeService(inherited, overrides)
+	services[name] = merged
+	delete(resolving, name)
+
+	return merged, nil
+}
+
+func composeProfileEnabled(service map[string]interface{}, profiles []string) bool {
+	serviceProfiles := composeStringList(service["profiles"])
+	if len(serviceProfiles) == 0 {
+		return true
+	}
+
+	for _, profile := range serviceProfiles {
+		for _, enabled := range profiles {
+			if profile == enabled || enabled == "*" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// convertComposePort converts a port of the short or long syntax to the format of CreateService.
+// A port without host port is only exposed
+func convertComposePort(port interface{}) (string, bool) {
+	if long, ok := port.(map[string]interface{}); ok {
+		target := composeString(long["target"])
+		published := composeString(long["published"])
+		protocol := composeString(long["protocol"])
+
+		if published == "" {
+			return target, false
+		}
+
+		result := published + ":" + target
+		if hostIP := composeString(long["host_ip"]); hostIP != "" {
+			result = hostIP + ":" + result
+		}
+		if protocol != "" {
+			result += "/" + protocol
+		}
+		return result, true
+	}
+
+	short := composeString(port)
+	if !strings.Contains(strings.Split(short, "/")[0], ":") {
+		return short, false
+	}
+
+	return short, true
+}
+
+// convertComposeVolume converts a volume of the short or long syntax to a mount.
+// Relative bind paths are resolved from the project folder
+func convertComposeVolume(volume interface{}, projectPath string, volumeNames map[string]string) (map[string]interface{}, error) {
+	mount := map[string]interface{}{}
+
+	if long, ok := volume.(map[string]interface{}); ok {
+		mount["Type"] = composeString(long["type"])
+		mount["Source"] = composeString(long["source"])
+		mount["Target"] = composeString(long["target"])
+		mount["ReadOnly"] = long["read_only"] == true
+		if mount["Type"] == "" {
+			mount["Type"] = "volume"
+		}
+	} else {
+		parts := strings.Split(composeString(volume), ":")
+
+		switch len(parts) {
+		case 1:
+			mount["Type"] = "volume"
+			mount["Target"] = parts[0]
+		case 2, 3:
+			mount["Source"] = parts[0]
+			mount["Target"] = parts[1]
+			if len(parts) == 3 {
+				for _, option := range strings.Split(parts[2], ",") {
+					if option == "ro" {
+						mount["ReadOnly"] = true
+					}
+				}
+			}
+
+			if strings.HasPrefix(parts[0], "/") || strings.HasPrefix(parts[0], ".") || strings.HasPrefix(parts[0], "~") {
+				mount["Type"] = "bind"
+			} else {
+				mount["Type"] = "volume"
+			}
+		default:
+			return nil, fmt.Errorf("invalid volume %v", volume)
+		}
+	}
+
+	source := composeString(mount["Source"])
+
+	if mount["Type"] == "bind" && !strings.HasPrefix(source, "/") {
+		if strings.HasPrefix(source, "~") {
+			return nil, fmt.Errorf("bind mount %s cannot use ~, use an absolute path", source)
+		}
+		mount["Source"] = path.Join(projectPath, source)
+	}
+
+	if mount["Type"] == "volume" && volumeNames[source] != "" {
+		mount["Source"] = volumeNames[source]
+	}
+
+	return mount, nil
+}
+
+// convertComposeService converts a service from a docker-compose file to the format of CreateService
+func convertComposeService(name string, service map[string]interface{}, req ComposeImportRequest, env map[string]string, projectName string, projectPath string, containerNames map[string]string, volumeNames map[string]string, networkNames map[string]string) (map[string]interface{}, error) {
+	removeComposeExtensions(service)
+
+	if _, ok := service["build"]; ok {
+		return nil, fmt.Errorf("service %s uses build, which is not supported. Use a pre-built image instead", name)
+	}
+
+	if composeString(service["image"]) == "" {
+		return nil, fmt.Errorf("service %s has no image", name)
+	}
+
+	delete(service, "profiles")
+	service["container_name"] = containerNames[name]
+
+	// environment, env_file values are overwritten by environment values
+	environment := map[string]string{}
+	for _, envFile := range composeList(service["env_file"]) {
+		filePath, required := "", true
+		if long, ok := envFile.(map[string]interface{}); ok {
+			filePath = composeString(long["path"])
+			if long["required"] == false {
+				required = false
+			}
+		} else {
+			filePath = composeString(envFile)
+		}
+
+		content, ok := req.EnvFiles[filePath]
+		if !ok {
+			content, ok = req.EnvFiles[filepath.Clean(filePath)]
+		}
+		if !ok {
+			if required {
+				return nil, fmt.Errorf("env_file %s of service %s was not provided", filePath, name)
+			}
+			continue
+		}
+
+		for key, value := range ParseEnvFile(content) {
+			environment[key] = value
+		}
+	}
+	delete(service, "env_file")
+
+	for key, value := range composeKeyValues(service["environment"], "=") {
+		if value == nil {
+			// no value, taken from the .env like compose takes it from the shell
+			if envValue, ok := env[key]; ok {
+				environment[key] = envValue
+			}
+			continue
+		}
+		environment[key] = composeString(value)
+	}
+
+	environmentList := []string{}
+	for key, value := range environment {
+		environmentList = append(environmentList, key + "=" + value)
+	}
+	sort.Strings(environmentList)
+	service["environment"] = environmentList
+
+	labels := map[string]string{}
+	for key, value := range composeKeyValues(service["labels"], "=") {
+		labels[key] = composeString(value)
+	}
+	if projectName != "" && labels["cosmos-stack"] == "" {
+		labels["cosmos-stack"] = projectName
+	}
+	// the replaced container keeps being found from the service on the next redeploy
+	if existing := req.ContainerNames[name]; existing != "" && existing == containerNames[name] {
+		labels["com.docker.compose.service"] = name
+	}
+	service["labels"] = labels
+
+	if sysctls, ok := service["sysctls"]; ok {
+		values := map[string]string{}
+		for key, value := range composeKeyValues(sysctls, "=") {
+			values[key] = composeString(value)
+		}
+		service["sysctls"] = values
+	}
+
+	if extraHosts, ok := service["extra_hosts"].(map[string]interface{}); ok {
+		hosts := []string{}
+		for host, ip := range extraHosts {
+			hosts = append(hosts, host + ":" + composeString(ip))
+		}
+		sort.Strings(hosts)
+		service["extra_hosts"] = hosts
+	}
+
+	for _, field := range []string{"command", "entrypoint"} {
+		if list, ok := service[field].([]interface{}); ok {
+			service[field] = strings.Join(composeStringList(list), " ")
+		} else if value, ok := service[field]; ok {
+			service[field] = composeString(value)
+		}
+	}
+
+	for _, field := range []string{"dns", "dns_search", "expose", "cap_add", "cap_drop", "security_opt", "links", "devices"} {
+		if value, ok := service[field]; ok {
+			service[field] = composeStringList(value)
+		}
+	}
+
+	// ports
+	ports := []string{}
+	expose, _ := service["expose"].([]string)
+	for _, port := range composeList(service["ports"]) {
+		converted, published := convertComposePort(port)
+		if published {
+			ports = append(ports, converted)
+		} else {
+			expose = append(expose, converted)
+		}
+	}
+	service["ports"] = ports
+	service["expose"] = expose
+
+	// volumes
+	mounts := []interface{}{}
+	for _, volume := range composeList(service["volumes"]) {
+		mount, err := convertComposeVolume(volume, projectPath, volumeNames)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %v", name, err)
+		}
+		mounts = append(mounts, mount)
+	}
+	service["volumes"] = mounts
+
+	// networks
+	if networks, ok := service["networks"]; ok {
+		serviceNetworks := map[string]interface{}{}
+		if list, ok := networks.([]interface{}); ok {
+			for _, network := range list {
+				serviceNetworks[composeString(network)] = map[string]interface{}{}
+			}
+		} else {
+			for network, config := range composeMap(networks) {
+				if config == nil {
+					config = map[string]interface{}{}
+				}
+				serviceNetworks[network] = config
+			}
+		}
+
+		renamed := map[string]interface{}{}
+		for network, config := range serviceNetworks {
+			if networkNames[network] != "" {
+				network = networkNames[network]
+			}
+			renamed[network] = config
+		}
+		service["networks"] = renamed
+	}
+
+	// depends_on references services, CreateService references containers
+	if dependsOn, ok := service["depends_on"]; ok {
+		dependencies := map[string]interface{}{}
+		if list, ok := dependsOn.([]interface{}); ok {
+			for _, dependency := range list {
+				dependencies[composeString(dependency)] = map[string]interface{}{"condition": "service_started"}
+			}
+		} else {
+			for dependency, condition := range composeMap(dependsOn) {
+				dependencies[dependency] = condition
+			}
+		}
+
+		renamed := map[string]interface{}{}
+		for dependency, condition := range dependencies {
+			containerName, ok := containerNames[dependency]
+			if !ok {
+				return nil, fmt.Errorf("service %s depends on %s, which is undefined or not in an enabled profile", name, dependency)
+			}
+			renamed[containerName] = condition
+		}
+		service["depends_on"] = renamed
+	}
+
+	// healthcheck, with durations in seconds
+	if healthcheck, ok := service["healthcheck"].(map[string]interface{}); ok {
+		converted := map[string]interface{}{}
+
+		if healthcheck["disable"] == true {
+			converted["test"] = []string{"NONE"}
+		} else if test, ok := healthcheck["test"].(string); ok {
+			converted["test"] = []string{"CMD-SHELL", test}
+		} else {
+			converted["test"] = composeStringList(healthcheck["test"])
+		}
+
+		for _, field := range []string{"interval", "timeout", "start_period"} {
+			seconds, err := composeDuration(healthcheck[field])
+			if err != nil {
+				return nil, fmt.Errorf("service %s: healthcheck %s: %v", name, field, err)
+			}
+			converted[field] = seconds
+		}
+		converted["retries"] = healthcheck["retries"]
+
+		service["healthcheck"] = converted
+	}
+
+	if gracePeriod, ok := service["stop_grace_period"]; ok {
+		seconds, err := composeDuration(gracePeriod)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: stop_grace_period: %v", name, err)
+		}
+		service["stop_grace_period"] = seconds
+	}
+
+	return service, nil
+}
+
+// ParseCompose converts a docker-compose v3 file to a DockerServiceCreateRequest.
+// Supports variable interpolation from the .env, x- extensions, short and long syntaxes,
+// env_file, profiles and extends (from the same file)
+func ParseCompose(req ComposeImportRequest) (DockerServiceCreateRequest, error) {
+	result := DockerServiceCreateRequest{}
+	env := ParseEnvFile(req.Env)
+
+	var raw interface{}
+	if err := yaml.Unmarshal([]byte(req.Compose), &raw); err != nil {
+		return result, fmt.Errorf("invalid compose file: %v", err)
+	}
+
+	document, ok := normalizeYAML(raw).(map[string]interface{})
+	if !ok {
+		return result, errors.New("invalid compose file: expected a mapping at the top level")
+	}
+
+	removeComposeExtensions(document)
+
+	interpolated, err := interpolateCompose(document, env)
+	if err != nil {
+		return result, err
+	}
+	document = interpolated.(map[string]interface{})
+
+	projectName := req.Name
+	if projectName == "" {
+		projectName = composeString(document["name"])
+	}
+	projectPath := utils.GetMainConfig().DockerConfig.DefaultDataPath
+	if projectName != "" {
+		projectPath = path.Join(projectPath, projectName)
+	}
+
+	// networks and volumes, external ones are expected to already exist
+	networkNames := map[string]string{}
+	networks := map[string]interface{}{}
+	for key, value := range composeMap(document["networks"]) {
+		network := composeMap(value)
+		removeComposeExtensions(network)
+
+		if name := composeString(network["name"]); name != "" {
+			networkNames[key] = name
+			key = name
+		}
+		delete(network, "name")
+
+		if network["external"] == true {
+			continue
+		}
+		delete(network, "external")
+
+		if ipam, ok := network["ipam"].(map[string]interface{}); ok {
+			if ipam["config"] == nil {
+				delete(ipam, "config")
+			}
+		}
+
+		if labels, ok := network["labels"]; ok {
+			values := map[string]string{}
+			for label, value := range composeKeyValues(labels, "=") {
+				values[label] = composeString(value)
+			}
+			network["labels"] = values
+		}
+
+		network["name"] = key
+		networks[key] = network
+	}
+
+	volumeNames := map[string]string{}
+	volumes := map[string]interface{}{}
+	for key, value := range composeMap(document["volumes"]) {
+		volume := composeMap(value)
+		removeComposeExtensions(volume)
+
+		if name := composeString(volume["name"]); name != "" {
+			volumeNames[key] = name
+			key = name
+		}
+
+		if volume["external"] == true {
+			continue
+		}
+
+		volumes[key] = map[string]interface{}{
+			"name": key,
+			"driver": composeString(volume["driver"]),
+		}
+	}
+
+	// services
+	rawServices := composeMap(document["services"])
+	if len(rawServices) == 0 {
+		return result, errors.New("invalid compose file: no services")
+	}
+
+	services := map[string]map[string]interface{}{}
+	for name := range rawServices {
+		service, err := resolveComposeExtends(name, rawServices, map[string]bool{})
+		if err != nil {
+			return result, err
+		}
+
+		if composeProfileEnabled(service, req.Profiles) {
+			services[name] = service
+		}
+	}
+
+	if len(services) == 0 {
+		return result, errors.New("no services enabled with the selected profiles")
+	}
+
+	containerNames := map[string]string{}
+	for name, service := range services {
+		containerNames[name] = name
+		if existing := req.ContainerNames[name]; existing != "" {
+			containerNames[name] = existing
+		}
+		if containerName := composeString(service["container_name"]); containerName != "" {
+			containerNames[name] = containerName
+		}
+	}
+
+	converted := map[string]interface{}{}
+	for name, service := range services {
+		convertedService, err := convertComposeService(name, service, req, env, projectName, projectPath, containerNames, volumeNames, networkNames)
+		if err != nil {
+			return result, err
+		}
+		converted[name] = convertedService
+	}
+
+	// reuse the JSON decoding of the regular requests
+	asJSON, err := json.Marshal(map[string]interface{}{
+		"services": converted,
+		"volumes": volumes,
+		"networks": networks,
+	})
+	if err != nil {
+		return result, err
+	}
+
+	err = json.Unmarshal(asJSON, &result)
+	if err != nil {
+		return result, fmt.Errorf("invalid compose file: %v", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,382 @@
+package docker
+
+import (
+	"bytes"
+	"errors"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+type ComposeHealthcheck struct {
+	Test []string `yaml:"test,omitempty"`
+	Interval string `yaml:"interval,omitempty"`
+	Timeout string `yaml:"timeout,omitempty"`
+	Retries int `yaml:"retries,omitempty"`
+	StartPeriod string `yaml:"start_period,omitempty"`
+}
+
+type ComposeServiceNetwork struct {
+	Aliases []string `yaml:"aliases,omitempty"`
+	IPV4Address string `yaml:"ipv4_address,omitempty"`
+	IPV6Address string `yaml:"ipv6_address,omitempty"`
+}
+
+type ComposeUlimit struct {
+	Soft int64 `yaml:"soft"`
+	Hard int64 `yaml:"hard"`
+}
+
+// ComposeService is a service as written in a docker-compose file
+type ComposeService struct {
+	Image string `yaml:"image"`
+	ContainerName string `yaml:"container_name,omitempty"`
+	Restart string `yaml:"restart,omitempty"`
+	Command string `yaml:"command,omitempty"`
+	Entrypoint string `yaml:"entrypoint,omitempty"`
+	WorkingDir string `yaml:"working_dir,omitempty"`
+	User string `yaml:"user,omitempty"`
+	Hostname string `yaml:"hostname,omitempty"`
+	Domainname string `yaml:"domainname,omitempty"`
+	Tty bool `yaml:"tty,omitempty"`
+	StdinOpen bool `yaml:"stdin_open,omitempty"`
+	Privileged bool `yaml:"privileged,omitempty"`
+	Runtime string `yaml:"runtime,omitempty"`
+	NetworkMode string `yaml:"network_mode,omitempty"`
+	StopSignal string `yaml:"stop_signal,omitempty"`
+	Environment []string `yaml:"environment,omitempty"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+	Ports []string `yaml:"ports,omitempty"`
+	Expose []string `yaml:"expose,omitempty"`
+	Volumes []string `yaml:"volumes,omitempty"`
+	Networks map[string]ComposeServiceNetwork `yaml:"networks,omitempty"`
+	Devices []string `yaml:"devices,omitempty"`
+	DNS []string `yaml:"dns,omitempty"`
+	DNSSearch []string `yaml:"dns_search,omitempty"`
+	ExtraHosts []string `yaml:"extra_hosts,omitempty"`
+	CapAdd []string `yaml:"cap_add,omitempty"`
+	CapDrop []string `yaml:"cap_drop,omitempty"`
+	SecurityOpt []string `yaml:"security_opt,omitempty"`
+	Sysctls map[string]string `yaml:"sysctls,omitempty"`
+	Healthcheck *ComposeHealthcheck `yaml:"healthcheck,omitempty"`
+	MemLimit string `yaml:"mem_limit,omitempty"`
+	MemReservation string `yaml:"mem_reservation,omitempty"`
+	MemswapLimit string `yaml:"memswap_limit,omitempty"`
+	CPUs string `yaml:"cpus,omitempty"`
+	CPUShares int64 `yaml:"cpu_shares,omitempty"`
+	PidsLimit int64 `yaml:"pids_limit,omitempty"`
+	ShmSize string `yaml:"shm_size,omitempty"`
+	Ulimits map[string]ComposeUlimit `yaml:"ulimits,omitempty"`
+}
+
+type ComposeNetwork struct {
+	Driver string `yaml:"driver,omitempty"`
+	Internal bool `yaml:"internal,omitempty"`
+	Attachable bool `yaml:"attachable,omitempty"`
+	EnableIPv6 bool `yaml:"enable_ipv6,omitempty"`
+}
+
+type ComposeVolume struct {
+	Driver string `yaml:"driver,omitempty"`
+}
+
+type ComposeFile struct {
+	Name string `yaml:"name,omitempty"`
+	Services map[string]ComposeService `yaml:"services"`
+	Networks map[string]ComposeNetwork `yaml:"networks,omitempty"`
+	Volumes map[string]ComposeVolume `yaml:"volumes,omitempty"`
+}
+
+// ContainerStackName returns the stack a container belongs to, from the Cosmos or docker-compose labels
+func ContainerStackName(labels map[string]string) string {
+	if labels["cosmos-stack"] != "" {
+		return labels["cosmos-stack"]
+	}
+	return labels["com.docker.compose.project"]
+}
+
+func composeSeconds(seconds int) string {
+	if seconds == 0 {
+		return ""
+	}
+	return strconv.Itoa(seconds) + "s"
+}
+
+// composePorts writes the ports in the short syntax, the bindings on every interface don't repeat their IP
+func composePorts(ports []string) []string {
+	result := []string{}
+	seen := map[string]bool{}
+
+	for _, port := range ports {
+		parts := strings.Split(port, ":")
+		hostIP := strings.Join(parts[:len(parts)-2], ":")
+		short := strings.Join(parts[len(parts)-2:], ":")
+
+		if hostIP != "" && hostIP != "0.0.0.0" && hostIP != "::" {
+			short = hostIP + ":" + short
+		}
+
+		if !seen[short] {
+			seen[short] = true
+			result = append(result, short)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return composePortNumber(result[i]) < composePortNumber(result[j])
+	})
+
+	return result
+}
+
+func composePortNumber(port string) int {
+	parts := strings.Split(strings.Split(port, "/")[0], ":")
+	number, _ := strconv.Atoi(parts[len(parts)-1])
+	return number
+}
+
+// composeEscape doubles the $ so that docker-compose, and ParseCompose, don't interpolate them
+func composeEscape(value string) string {
+	return strings.ReplaceAll(value, "$", "$$")
+}
+
+func composeEscapeList(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	result := make([]string, len(values))
+	for i, value := range values {
+		result[i] = composeEscape(value)
+	}
+	return result
+}
+
+func composeEscapeMap(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	result := map[string]string{}
+	for key, value := range values {
+		result[key] = composeEscape(value)
+	}
+	return result
+}
+
+// ContainerToComposeService converts an exported container to a docker-compose service
+func ContainerToComposeService(container ContainerCreateRequestContainer) ComposeService {
+	service := ComposeService{
+		Image: composeEscape(container.Image),
+		ContainerName: composeEscape(container.Name),
+		Restart: container.RestartPolicy,
+		Command: composeEscape(container.Command),
+		Entrypoint: composeEscape(container.Entrypoint),
+		WorkingDir: composeEscape(container.WorkingDir),
+		User: composeEscape(container.User),
+		Hostname: composeEscape(container.Hostname),
+		Domainname: composeEscape(container.Domainname),
+		Tty: container.Tty,
+		StdinOpen: container.StdinOpen,
+		Privileged: container.Privileged,
+		Runtime: container.Runtime,
+		StopSignal: container.StopSignal,
+		Environment: composeEscapeList(container.Environment),
+		Labels: map[string]string{},
+		Ports: composePorts(container.Ports),
+		Expose: container.Expose,
+		Devices: composeEscapeList(container.Devices),
+		DNS: container.DNS,
+		DNSSearch: container.DNSSearch,
+		ExtraHosts: composeEscapeList(container.ExtraHosts),
+		CapAdd: container.CapAdd,
+		CapDrop: container.CapDrop,
+		SecurityOpt: composeEscapeList(container.SecurityOpt),
+		Sysctls: composeEscapeMap(container.Sysctls),
+		MemLimit: string(container.MemLimit),
+		MemReservation: string(container.MemReservation),
+		MemswapLimit: string(container.MemswapLimit),
+		CPUs: string(container.CPUs),
+		CPUShares: container.CPUShares,
+		PidsLimit: container.PidsLimit,
+		ShmSize: string(container.ShmSize),
+	}
+
+	// the compose labels are set by docker-compose itself
+	for key, value := range container.Labels {
+		if !strings.HasPrefix(key, "com.docker.compose.") {
+			service.Labels[key] = composeEscape(value)
+		}
+	}
+
+	// the default network modes are implied by the networks
+	if container.NetworkMode != "default" && container.NetworkMode != "bridge" && !strings.HasPrefix(container.NetworkMode, "cosmos-") {
+		if _, ok := container.Networks[container.NetworkMode]; !ok {
+			service.NetworkMode = container.NetworkMode
+		}
+	}
+
+	if service.NetworkMode == "" {
+		service.Networks = map[string]ComposeServiceNetwork{}
+		for name, network := range container.Networks {
+			if name == "bridge" {
+				continue
+			}
+			service.Networks[name] = ComposeServiceNetwork{
+				Aliases: network.Aliases,
+				IPV4Address: network.IPV4Address,
+				IPV6Address: network.IPV6Address,
+			}
+		}
+	}
+
+	for _, mount := range container.Volumes {
+		volume := mount.Source + ":" + mount.Target
+		if mount.Source == "" {
+			volume = mount.Target
+		}
+		if mount.ReadOnly {
+			volume += ":ro"
+		}
+		service.Volumes = append(service.Volumes, composeEscape(volume))
+	}
+
+	if len(container.HealthCheck.Test) > 0 {
+		service.Healthcheck = &ComposeHealthcheck{
+			Test: composeEscapeList(container.HealthCheck.Test),
+			Interval: composeSeconds(container.HealthCheck.Interval),
+			Timeout: composeSeconds(container.HealthCheck.Timeout),
+			Retries: container.HealthCheck.Retries,
+			StartPeriod: composeSeconds(container.HealthCheck.StartPeriod),
+		}
+	}
+
+	if len(container.Ulimits) > 0 {
+		service.Ulimits = map[string]ComposeUlimit{}
+		for name, ulimit := range container.Ulimits {
+			service.Ulimits[name] = ComposeUlimit{
+				Soft: ulimit.Soft,
+				Hard: ulimit.Hard,
+			}
+		}
+	}
+
+	return service
+}
+
+// ExportStackCompose writes the containers of a stack, their networks and their volumes as a docker-compose file
+func ExportStackCompose(stack string) ([]byte, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	compose := ComposeFile{
+		Name: stack,
+		Services: map[string]ComposeService{},
+		Networks: map[string]ComposeNetwork{},
+		Volumes: map[string]ComposeVolume{},
+	}
+
+	for _, container := range containers {
+		if ContainerStackName(container.Labels) != stack {
+			continue
+		}
+
+		exported, err := ExportContainer(container.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		stripImageDefaults(&exported)
+
+		serviceName := container.Labels["com.docker.compose.service"]
+		if serviceName == "" {
+			serviceName = exported.Name
+		}
+
+		service := ContainerToComposeService(exported)
+		compose.Services[serviceName] = service
+
+		for _, mount := range exported.Volumes {
+			if mount.Type == "volume" && mount.Source != "" {
+				compose.Volumes[mount.Source] = ComposeVolume{}
+			}
+		}
+
+		for name := range service.Networks {
+			network, err := DockerClient.NetworkInspect(DockerContext, name, types.NetworkInspectOptions{})
+			if err != nil {
+				utils.Warn("ExportStackCompose: cannot inspect network " + name)
+				compose.Networks[name] = ComposeNetwork{}
+				continue
+			}
+
+			compose.Networks[name] = ComposeNetwork{
+				Driver: network.Driver,
+				Internal: network.Internal,
+				Attachable: network.Attachable,
+				EnableIPv6: network.EnableIPv6,
+			}
+		}
+	}
+
+	if len(compose.Services) == 0 {
+		return nil, errors.New("stack " + stack + " has no containers")
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	if err := encoder.Encode(compose); err != nil {
+		return nil, err
+	}
+	encoder.Close()
+
+	return buf.Bytes(), nil
+}
+
+func ExportStackComposeRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("ExportStackCompose", errD)
+			utils.HTTPError(w, "Internal server error: "+errD.Error(), http.StatusInternalServerError, "EC001")
+			return
+		}
+
+		stack := mux.Vars(req)["stack"]
+
+		compose, err := ExportStackCompose(stack)
+		if err != nil {
+			utils.Error("ExportStackCompose: Error while exporting stack", err)
+			utils.HTTPError(w, "Stack Export Error: "+err.Error(), http.StatusInternalServerError, "EC002")
+			return
+		}
+
+		if req.URL.Query().Get("raw") == "true" {
+			w.Header().Set("Content-Type", "application/yaml")
+			w.Header().Set("Content-Disposition", "attachment; filename=\"" + strings.ReplaceAll(utils.SanitizeNoSpace(stack), "\"", "") + ".docker-compose.yml\"")
+			w.Write(compose)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": string(compose),
+		})
+	} else {
+		utils.Error("ExportStackCompose: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
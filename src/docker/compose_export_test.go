@@ -0,0 +1,78 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/mount"
+	"gopkg.in/yaml.v2"
+)
+
+func TestComposeExportRoundTrip(t *testing.T) {
+	container := ContainerCreateRequestContainer{
+		Name: "app",
+		Image: "nginx:1.25",
+		Environment: []string{
+			"HASH=$2y$10$abcdefghijklmnopqrstuv",
+			"PASSWORD=pa$$word${NOT_A_VAR}",
+			"PLAIN=value",
+		},
+		Labels: map[string]string{
+			"traefik.http.middlewares.auth.basicauth.users": "admin:$apr1$xyz$abc",
+			"cosmos-stack": "app",
+		},
+		Command: "sh -c 'echo $HOME && echo $$'",
+		Entrypoint: "/entrypoint.sh ${MODE}",
+		Volumes: []mount.Mount{
+			{Type: "bind", Source: "/srv/app$data", Target: "/data"},
+		},
+		HealthCheck: ContainerCreateRequestContainerHealthcheck{
+			Test: []string{"CMD-SHELL", "curl -f http://localhost/$PATH_TO_CHECK || exit 1"},
+			Interval: 30,
+			Timeout: 5,
+			Retries: 3,
+		},
+	}
+
+	compose, err := yaml.Marshal(ComposeFile{
+		Name: "app",
+		Services: map[string]ComposeService{
+			"app": ContainerToComposeService(container),
+		},
+	})
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+
+	parsed, err := ParseCompose(ComposeImportRequest{
+		Compose: string(compose),
+		Env: "HOME=/root\nMODE=production\nPATH_TO_CHECK=health\nNOT_A_VAR=oops\n",
+	})
+	if err != nil {
+		t.Fatalf("ParseCompose failed: %v\n%s", err, compose)
+	}
+
+	service, ok := parsed.Services["app"]
+	if !ok {
+		t.Fatalf("service app is missing from %v", parsed.Services)
+	}
+
+	if !reflect.DeepEqual(service.Environment, container.Environment) {
+		t.Errorf("environment = %v, expected %v", service.Environment, container.Environment)
+	}
+	if !reflect.DeepEqual(service.Labels, container.Labels) {
+		t.Errorf("labels = %v, expected %v", service.Labels, container.Labels)
+	}
+	if service.Command != container.Command {
+		t.Errorf("command = %q, expected %q", service.Command, container.Command)
+	}
+	if service.Entrypoint != container.Entrypoint {
+		t.Errorf("entrypoint = %q, expected %q", service.Entrypoint, container.Entrypoint)
+	}
+	if !reflect.DeepEqual(service.HealthCheck, container.HealthCheck) {
+		t.Errorf("healthcheck = %v, expected %v", service.HealthCheck, container.HealthCheck)
+	}
+	if len(service.Volumes) != 1 || service.Volumes[0].Source != container.Volumes[0].Source || service.Volumes[0].Target != container.Volumes[0].Target {
+		t.Errorf("volumes = %v, expected %v", service.Volumes, container.Volumes)
+	}
+}
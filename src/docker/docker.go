@@ -10,13 +10,11 @@ import (
 	"io"
 	"fmt"
 	"strings"
-	"encoding/base64"
 	"encoding/json"
 	"sync"
 	"strconv"
 	"runtime"
 	"github.com/azukaar/cosmos-server/src/utils" 
-	"github.com/docker/cli/cli/config"
 
 	"github.com/docker/docker/client"
 	// natting "github.com/docker/go-connections/nat"
@@ -48,8 +46,18 @@ func getIdFromName(name string) (string, error) {
 }
 
 var DockerIsConnected = false
+// host the client was created for, to reconnect when DockerConfig.Host changes
+var dockerClientHost = ""
 
 func Connect() error {
+	host := EngineHost()
+
+	if DockerClient != nil && host != dockerClientHost {
+		utils.Log("Docker host changed, reconnecting to " + host)
+		DockerClient.Close()
+		DockerClient = nil
+	}
+
 	if DockerClient != nil {
 		// check if connection is still alive
 		ping, err := DockerClient.Ping(DockerContext)
@@ -64,7 +72,7 @@ func Connect() error {
 	}
 	if DockerClient == nil {
 		ctx := context.Background()
-		client, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		client, err := newDockerClient(host)
 		if err != nil {
 			DockerIsConnected = false
 			return err
@@ -73,11 +81,13 @@ func Connect() error {
 
 		DockerClient = client
 		DockerContext = ctx
+		dockerClientHost = host
 
 		ping, err := DockerClient.Ping(DockerContext)
 		if ping.APIVersion != "" && err == nil {
 			DockerIsConnected = true
 			utils.Log("Docker Connected")
+			detectRuntime()
 		} else {
 			DockerIsConnected = false
 			utils.Error("Docker Connection - Cannot ping Daemon. Is it running?", nil)
@@ -457,6 +467,10 @@ func Test() error {
 }
 
 func HasAutoUpdateOn(containerConfig types.ContainerJSON) bool {
+	if containerConfig.Config.Labels["cosmos-update-policy"] == "notify" {
+		return false
+	}
+
 	if containerConfig.Config.Labels["cosmos-auto-update"] == "true" {
 		return true
 	}
@@ -480,6 +494,8 @@ func CheckUpdatesAvailable() map[string]bool {
 		return result
 	}
 
+	plan := []UpdatePlanItem{}
+
 	for _, container := range containers {
 		utils.Log("Checking for updates for " + container.Image)
 		
@@ -495,39 +511,71 @@ func CheckUpdatesAvailable() map[string]bool {
 			continue
 		}
 
-		rc, err := DockerPullImage(container.Image)
-		if err != nil {
-			utils.Error("CheckUpdatesAvailable", err)
+		policy := GetUpdatePolicy(fullContainer)
+
+		// semver policies move to another tag instead of following the current one
+		if policy.Mode == "semver" {
+			if item, ok := checkSemverUpdate(fullContainer, policy); ok {
+				plan = append(plan, item)
+				result[container.Names[0]] = item.Status != "updated"
+			}
 			continue
 		}
 
-		scanner := bufio.NewScanner(rc)
-		defer  rc.Close()
-
 		needsUpdate := false
 
-		for scanner.Scan() {
-			newStr := scanner.Text()
-			// Check if a download has started
-			if strings.Contains(newStr, "\"status\":\"Pulling fs layer\"") {
+		// ask the registry first, so only the images which changed are pulled
+		available, errRegistry := CheckRegistryUpdate(container.Image)
+		if errRegistry == nil {
+			if available {
 				utils.Log("Updates available for " + container.Image)
 
 				result[container.Names[0]] = true
-				if !HasAutoUpdateOn(fullContainer) {
-					rc.Close()
-					break
-				} else {
+				if HasAutoUpdateOn(fullContainer) {
+					if _, err := pullImage(container.Image); err != nil {
+						utils.Error("CheckUpdatesAvailable - pull " + container.Image, err)
+						continue
+					}
 					needsUpdate = true
 				}
-			} else if strings.Contains(newStr, "\"status\":\"Status: Image is up to date") {
+			} else {
 				utils.Log("No updates available for " + container.Image)
+			}
+		} else {
+			utils.Warn("CheckUpdatesAvailable - Cannot check " + container.Image + " in its registry, pulling it instead: " + errRegistry.Error())
+
+			rc, err := DockerPullImage(container.Image)
+			if err != nil {
+				utils.Error("CheckUpdatesAvailable", err)
+				continue
+			}
+
+			scanner := bufio.NewScanner(rc)
+			defer  rc.Close()
+
+			for scanner.Scan() {
+				newStr := scanner.Text()
+				// Check if a download has started
+				if strings.Contains(newStr, "\"status\":\"Pulling fs layer\"") {
+					utils.Log("Updates available for " + container.Image)
+
+					result[container.Names[0]] = true
+					if !HasAutoUpdateOn(fullContainer) {
+						rc.Close()
+						break
+					} else {
+						needsUpdate = true
+					}
+				} else if strings.Contains(newStr, "\"status\":\"Status: Image is up to date") {
+					utils.Log("No updates available for " + container.Image)
 				
-				if !HasAutoUpdateOn(fullContainer) {
-					rc.Close()
-					break
+					if !HasAutoUpdateOn(fullContainer) {
+						rc.Close()
+						break
+					}
+				} else {
+					utils.Log(newStr)
 				}
-			} else {
-				utils.Log(newStr)
 			}
 		}
 
@@ -550,35 +598,37 @@ func CheckUpdatesAvailable() map[string]bool {
 			}
 		}
 
-		if needsUpdate && HasAutoUpdateOn(fullContainer) {
-			utils.TriggerEvent(
-				"cosmos.docker.container.update",
-				"Cosmos Container Update",
-				"success",
-				"",
-				map[string]interface{}{
-					"container": container.Names[0][1:],
+		if result[container.Names[0]] && policy.Mode == "notify" {
+			plan = append(plan, UpdatePlanItem{
+				Container: container.Names[0][1:],
+				Mode: policy.Mode,
+				Image: container.Image,
+				Target: container.Image,
+				Status: "notify",
+				Date: time.Now(),
 			})
+		}
 
-			utils.WriteNotification(utils.Notification{
-				Recipient: "admin",
-				Title: "header.notification.title.containerUpdate",
-				Message: "header.notification.message.containerUpdate",
-				Vars: container.Names[0][1:],
-				Level: "info",
-				Link: "/cosmos-ui/servapps/containers/" + container.Names[0][1:],
-			})
+		if needsUpdate && HasAutoUpdateOn(fullContainer) {
+			// do not install again an image which already failed and was rolled back
+			localImage, _, err := DockerClient.ImageInspectWithRaw(DockerContext, container.Image)
+			if err == nil && IsImageFailed(container.Names[0], localImage.ID) {
+				utils.Warn("CheckUpdatesAvailable - Update of " + container.Names[0] + " to " + localImage.ID + " failed before, skipping")
+				DockerClient.ImageTag(DockerContext, container.ImageID, container.Image)
+				continue
+			}
 
 			utils.Log("Downloaded new update for " + container.Image + " ready to install")
-			_, err := RecreateContainer(container.Names[0], fullContainer)
-			if err != nil {
-				utils.MajorError("Container failed to update", err)
-			} else {
+			item := installUpdate(fullContainer, policy, container.Image)
+			plan = append(plan, item)
+			if item.Status == "updated" {
 				result[container.Names[0]] = false
 			}
 		}
 	}
 
+	setUpdatesPlan(plan)
+
 	return result
 }
 
@@ -643,6 +693,13 @@ func SelfAction(action string) error {
 		Services: map[string]ContainerCreateRequestContainer {},
 	}
 
+	// the socket is mounted at the default path in the updater, whatever the engine and its socket on the host are
+	socket := hostSocketPath()
+	dockerHost := os.Getenv("DOCKER_HOST")
+	if strings.HasPrefix(dockerHost, "unix://") || (dockerHost == "" && utils.GetMainConfig().DockerConfig.Host != "") {
+		dockerHost = "unix:///var/run/docker.sock"
+	}
+
 	utils.TriggerEvent(
 		"cosmos.internal.self-updater",
 		"Cosmos Self Updater",
@@ -663,18 +720,18 @@ func SelfAction(action string) error {
 		Environment: []string{
 			"CONTAINER_NAME=" + containerName,
 			"ACTION=" + action,
-			"DOCKER_HOST=" + os.Getenv("DOCKER_HOST"),
+			"DOCKER_HOST=" + dockerHost,
 		},
 		Volumes: []mountType.Mount{
 			{
 				Type: mountType.TypeBind,
-				Source: "/var/run/docker.sock",
+				Source: socket,
 				Target: "/var/run/docker.sock",
 			},
 		},
 	};
 
-	utils.Log("Creating self-updater service: docker run -d --name cosmos-self-updater-agent -e CONTAINER_NAME=" + containerName + " -e ACTION=" + action + " -e DOCKER_HOST=" + os.Getenv("DOCKER_HOST") + " -v /var/run/docker.sock:/var/run/docker.sock azukaar/docker-self-updater:" + version)
+	utils.Log("Creating self-updater service: docker run -d --name cosmos-self-updater-agent -e CONTAINER_NAME=" + containerName + " -e ACTION=" + action + " -e DOCKER_HOST=" + dockerHost + " -v " + socket + ":/var/run/docker.sock azukaar/docker-self-updater:" + version)
 
 	err := CreateService(service, func (msg string) {})
 
@@ -716,25 +773,9 @@ func DockerPullImage(image string) (io.ReadCloser, error) {
 
 	options := types.ImagePullOptions{}
 
-	configfile, err := config.Load(config.Dir())
-	if err != nil {
-			utils.Error("DockerPull - Read config file error -", err)
-	} else {
-		slashIndex := strings.Index(image, "/")
-		
-		if slashIndex >= 1 && strings.ContainsAny(image[:slashIndex], ".:") {
-			repoURL := strings.Split(image, "/")[0]
-			creds, err := configfile.GetCredentialsStore(repoURL).Get(repoURL)
-			
-			if err != nil {
-				utils.Error("DockerPull - Read config file error -", err)
-				} else {	
-				encodedJSON, _ := json.Marshal(creds)
-				options.RegistryAuth = base64.URLEncoding.EncodeToString(encodedJSON)
-			}
-		} 
-	}
-	
+	// stored credentials first, then the Docker config file, for any registry including Docker Hub
+	options.RegistryAuth = imagePullAuth(image)
+
 	utils.Debug("DockerPull - Starting Pulling image " + image)
 
 	out, errPull := DockerClient.ImagePull(DockerContext, image, options)
@@ -0,0 +1,272 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/client"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// DockerRuntime is the engine behind the socket, docker or podman
+var DockerRuntime = "docker"
+// DockerRootless is true for rootless Docker and rootless Podman
+var DockerRootless = false
+
+func IsPodman() bool {
+	return DockerRuntime == "podman"
+}
+
+// IsDefaultNetwork is true for the networks created by the engine, which cannot be removed
+func IsDefaultNetwork(name string) bool {
+	return name == "bridge" || name == "host" || name == "none" || name == "podman"
+}
+
+// socketCandidates are the sockets tried in order when DockerConfig.Host and DOCKER_HOST are empty:
+// rootful Docker, rootless Docker, rootful Podman then rootless Podman
+func socketCandidates() []string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = "/run/user/" + strconv.Itoa(os.Getuid())
+	}
+
+	return []string{
+		"/var/run/docker.sock",
+		filepath.Join(runtimeDir, "docker.sock"),
+		"/run/podman/podman.sock",
+		filepath.Join(runtimeDir, "podman", "podman.sock"),
+	}
+}
+
+// EngineHost returns the engine to connect to, empty for the default of the Docker client
+func EngineHost() string {
+	if host := utils.GetMainConfig().DockerConfig.Host; host != "" {
+		if strings.HasPrefix(host, "/") {
+			return "unix://" + host
+		}
+		return host
+	}
+
+	if os.Getenv("DOCKER_HOST") != "" {
+		return ""
+	}
+
+	for _, socket := range socketCandidates() {
+		if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			return "unix://" + socket
+		}
+	}
+
+	return ""
+}
+
+func newDockerClient(host string) (*client.Client, error) {
+	options := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if host != "" {
+		options = append(options, client.WithHost(host))
+	}
+	return client.NewClientWithOpts(options...)
+}
+
+// detectRuntime finds whether the engine is Docker or Podman, and whether it runs rootless
+func detectRuntime() {
+	DockerRuntime = "docker"
+	DockerRootless = false
+
+	version, err := DockerClient.ServerVersion(DockerContext)
+	if err != nil {
+		utils.Error("Docker Connection - Cannot get the engine version", err)
+		return
+	}
+
+	for _, component := range version.Components {
+		if strings.Contains(strings.ToLower(component.Name), "podman") {
+			DockerRuntime = "podman"
+		}
+	}
+
+	info, err := DockerClient.Info(DockerContext)
+	if err != nil {
+		utils.Error("Docker Connection - Cannot get the engine info", err)
+		return
+	}
+
+	for _, option := range info.SecurityOptions {
+		if strings.Contains(option, "rootless") {
+			DockerRootless = true
+		}
+	}
+
+	mode := "rootful"
+	if DockerRootless {
+		mode = "rootless"
+	}
+	utils.Log("Docker Connection - Connected to " + DockerRuntime + " " + version.Version + " (" + mode + ") at " + DockerClient.DaemonHost())
+}
+
+// hostSocketPath returns the path of the engine socket on the host, which is the source of the socket
+// mounted in the Cosmos container
+func hostSocketPath() string {
+	socket := "/var/run/docker.sock"
+	if host, err := client.ParseHostURL(DockerClient.DaemonHost()); err == nil && host.Scheme == "unix" {
+		socket = host.Path
+	}
+
+	if utils.IsInsideContainer {
+		self, err := DockerClient.ContainerInspect(DockerContext, os.Getenv("HOSTNAME"))
+		if err == nil {
+			for _, mount := range self.Mounts {
+				if mount.Destination == socket {
+					return mount.Source
+				}
+			}
+		}
+	}
+
+	return socket
+}
+
+// rootless engines cannot publish the ports below this one, unless the host allows it
+const rootlessPortStart = 1024
+
+// RootlessPortWarning explains why a port cannot be published by a rootless engine, empty if it can
+func RootlessPortWarning(port string) string {
+	if !DockerRootless {
+		return ""
+	}
+
+	number, err := strconv.Atoi(strings.Split(port, "/")[0])
+	if err != nil || number >= rootlessPortStart {
+		return ""
+	}
+
+	if data, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err == nil {
+		if start, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && number >= start {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf("Port %d is privileged and cannot be published by a rootless %s, use a port above %d or allow it with sysctl net.ipv4.ip_unprivileged_port_start", number, DockerRuntime, rootlessPortStart - 1)
+}
+
+// Podman pods are managed with the libpod API, which the Docker client does not cover
+
+type PodContainer struct {
+	Id string `json:"Id"`
+	Names string `json:"Names"`
+	Status string `json:"Status"`
+}
+
+type Pod struct {
+	Id string `json:"Id"`
+	Name string `json:"Name"`
+	Status string `json:"Status"`
+	InfraId string `json:"InfraId"`
+	Containers []PodContainer `json:"Containers"`
+}
+
+func libpodRequest(method string, path string) (*http.Response, error) {
+	host, err := client.ParseHostURL(DockerClient.DaemonHost())
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := DockerClient.HTTPClient()
+
+	// the client of the Docker SDK dials the socket whatever the URL host is
+	base := "http://podman"
+	if host.Scheme == "tcp" {
+		base = "http://" + host.Host
+		if transport, ok := httpClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+			base = "https://" + host.Host
+		}
+	}
+
+	request, err := http.NewRequestWithContext(DockerContext, method, base + "/v4.0.0/libpod" + path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var result struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return nil, fmt.Errorf("podman answered %d: %s", resp.StatusCode, result.Message)
+	}
+
+	return resp, nil
+}
+
+// ListPods returns the Podman pods, none with Docker
+func ListPods() ([]Pod, error) {
+	pods := []Pod{}
+	if !IsPodman() {
+		return pods, nil
+	}
+
+	resp, err := libpodRequest("GET", "/pods/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&pods)
+	return pods, err
+}
+
+// podByName finds the pod of a stack, stacks without a stack label being named after their pod
+func podByName(name string) (Pod, bool) {
+	pods, err := ListPods()
+	if err != nil {
+		utils.Error("ListPods", err)
+		return Pod{}, false
+	}
+
+	for _, pod := range pods {
+		if pod.Name == name {
+			return pod, true
+		}
+	}
+
+	return Pod{}, false
+}
+
+// ManagePod runs a stack action on a whole pod
+func ManagePod(pod Pod, action string, OnLog func(string)) error {
+	path := "/pods/" + pod.Id + "/" + action
+	method := "POST"
+
+	switch action {
+	case "start", "stop", "restart", "pause", "unpause", "kill":
+	case "remove":
+		path = "/pods/" + pod.Id + "?force=true"
+		method = "DELETE"
+	default:
+		return fmt.Errorf("%s is not supported on pods", action)
+	}
+
+	utils.Log("ManagePod: " + action + " " + pod.Name)
+	OnLog(fmt.Sprintf("Running %s on pod %s...\n", action, pod.Name))
+
+	resp, err := libpodRequest(method, path)
+	if err != nil {
+		OnLog(utils.DoErr("%s pod %s failed: %s\n", action, pod.Name, err.Error()))
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
@@ -9,8 +9,28 @@ import (
 	"github.com/azukaar/cosmos-server/src/utils" 
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 )
 
+// normalizeEvent maps the Podman events to their Docker equivalent, Podman sending the health
+// as an attribute and naming some container actions differently
+func normalizeEvent(msg events.Message) events.Message {
+	if !IsPodman() || msg.Type != "container" {
+		return msg
+	}
+
+	switch {
+	case msg.Action == "health_status" && msg.Actor.Attributes["health_status"] != "":
+		msg.Action = events.Action("health_status: " + msg.Actor.Attributes["health_status"])
+	case msg.Action == "remove":
+		msg.Action = "destroy"
+	case msg.Action == "died":
+		msg.Action = "die"
+	}
+
+	return msg
+}
+
 func DockerListenEvents() error {
 	errD := Connect()
 	if errD != nil {
@@ -36,17 +56,19 @@ func DockerListenEvents() error {
 					msgs, errs = DockerClient.Events(context.Background(), types.EventsOptions{})
 
 				case msg := <-msgs:
+					msg = normalizeEvent(msg)
 					utils.Debug("Docker Event: " + (string)(msg.Type) + " " + (string)(msg.Action) + " " + msg.Actor.Attributes["name"])
 					if msg.Type == "container" && msg.Action == "start" {
 						onDockerStarted(msg.Actor.ID)
+						go CollectContainerLogs(msg.Actor.ID)
 					}
 
 					// on container destroy and network disconnect
 					if msg.Type == "container" && msg.Action == "destroy" {
-						onDockerDestroyed(msg.Actor.ID)
+						onDockerDestroyed(msg.Actor.ID, msg.Actor.Attributes)
 					}
 					if msg.Type == "container" && msg.Action == "create" {
-						onDockerCreated(msg.Actor.ID)
+						onDockerCreated(msg.Actor.ID, msg.Actor.Attributes)
 					}
 					if msg.Type == "network" && msg.Action == "disconnect" {
 						onNetworkDisconnect(msg.Actor.ID)
@@ -61,6 +83,12 @@ func DockerListenEvents() error {
 						onNetworkConnect(msg.Actor.ID)
 					}
 
+					var statusEvent ContainerStatusEvent
+					isStatusEvent := false
+					if msg.Type == "container" {
+						statusEvent, isStatusEvent = recordContainerEvent(msg.Actor.Attributes["name"], (string)(msg.Action), msg.Actor.Attributes)
+					}
+
 					if !strings.HasPrefix((string)(msg.Action), "exec_") {
 						level := "info"
 						if msg.Type == "image" {
@@ -72,6 +100,16 @@ func DockerListenEvents() error {
 						if msg.Action == "create" || msg.Action == "start" {
 							level = "success"
 						}
+						if isStatusEvent {
+							switch {
+							case statusEvent.Status == "oom-killed", statusEvent.Status == "exited" && statusEvent.Unexpected:
+								level = "error"
+							case statusEvent.Status == "unhealthy":
+								level = "warning"
+							case statusEvent.Status == "healthy":
+								level = "success"
+							}
+						}
 						
 						object := ""
 						if msg.Type == "container" {
@@ -84,19 +122,25 @@ func DockerListenEvents() error {
 							object = "volume@" + msg.Actor.Attributes["name"]
 						}
 						
-						utils.TriggerEvent(
-							"cosmos.docker.event." + (string)(msg.Type) + "." + (string)(msg.Action),
-							"Docker Event " + (string)(msg.Type) + " " + (string)(msg.Action),
-							level,
-							object,
-							map[string]interface{}{
+						data := map[string]interface{}{
 							"type": (string)(msg.Type),
 							"action": (string)(msg.Action),
 							"actor": msg.Actor,
 							"status": msg.Status,
 							"from": msg.From,
 							"scope": msg.Scope,
-						})
+						}
+						if isStatusEvent && statusEvent.Status == "exited" {
+							data["exitCode"] = statusEvent.ExitCode
+							data["unexpected"] = statusEvent.Unexpected
+						}
+
+						utils.TriggerEvent(
+							"cosmos.docker.event." + (string)(msg.Type) + "." + (string)(msg.Action),
+							"Docker Event " + (string)(msg.Type) + " " + (string)(msg.Action),
+							level,
+							object,
+							data)
 					}
 			}
 		}
@@ -144,9 +188,14 @@ func onDockerStarted(containerID string) {
 	DebouncedExportDocker()
 }
 
-func onDockerDestroyed(containerID string) {
+// OnContainersChanged is called when a container is created or destroyed, with the attributes of the event
+// which include the labels of the container
+var OnContainersChanged = func(attributes map[string]string) {}
+
+func onDockerDestroyed(containerID string, attributes map[string]string) {
 	utils.Debug("onDockerDestroyed: " + containerID)
 	DebouncedExportDocker()
+	OnContainersChanged(attributes)
 }
 
 func onNetworkDisconnect(networkID string) {
@@ -155,9 +204,11 @@ func onNetworkDisconnect(networkID string) {
 	DebouncedExportDocker()
 }
 
-func onDockerCreated(containerID string) {
+func onDockerCreated(containerID string, attributes map[string]string) {
 	utils.Debug("onDockerCreated: " + containerID)
 	DebouncedExportDocker()
+	DebouncedApplyNetworkPolicies()
+	OnContainersChanged(attributes)
 }
 
 func onNetworkDestroy(networkID string) {
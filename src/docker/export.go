@@ -107,7 +107,7 @@ func ExportContainer(containerID string) (ContainerCreateRequestContainer, error
 					return networks
 			}(),
 
-			DependsOn:      map[string]ContainerCreateRequestContainerDependsOnCont{},  // This is not directly available from inspect. It's part of docker-compose.
+			DependsOn:      ParseDependsOnLabel(detailedInfo.Config.Labels["cosmos-depends-on"]),  // Only kept in a label by CreateService
 			RestartPolicy:  string(detailedInfo.HostConfig.RestartPolicy.Name),
 			Devices:        func() []string {
 					var devices []string
@@ -119,6 +119,9 @@ func ExportContainer(containerID string) (ContainerCreateRequestContainer, error
 			Expose:         []string{},  // This information might need to be derived from other properties
 		}
 
+		// limits and reservations
+		ExportContainerResources(detailedInfo.HostConfig, &service)
+
 		// healthcheck
 		if detailedInfo.Config.Healthcheck != nil {
 			service.HealthCheck.Test = detailedInfo.Config.Healthcheck.Test
@@ -0,0 +1,160 @@
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+
+	"github.com/azukaar/cosmos-server/src/constellation"
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// HostContainer is a container of the fleet, with the Constellation node running it
+type HostContainer struct {
+	types.Container
+	// Constellation device name of the node, "local" for this server
+	Host string `json:"host"`
+}
+
+type DockerHost struct {
+	Name string `json:"name"`
+	IP string `json:"ip"`
+	Local bool `json:"local"`
+	Reachable bool `json:"reachable"`
+	Error string `json:"error,omitempty"`
+}
+
+// listRemoteContainers gets the containers of a node through its API
+func listRemoteContainers(host string) ([]types.Container, error) {
+	resp, err := constellation.RemoteNodeRequest(host, "GET", "/cosmos/api/servapps", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("host %s answered %d", host, resp.StatusCode)
+	}
+
+	var result struct {
+		Status string `json:"status"`
+		Data []types.Container `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Status != "OK" {
+		return nil, errors.New("host " + host + " answered " + result.Status)
+	}
+
+	return result.Data, nil
+}
+
+// ListFleetContainers returns the containers of this server and of all the Cosmos nodes of the Constellation.
+// The nodes that cannot be reached are returned with their error
+func ListFleetContainers() ([]HostContainer, map[string]string, error) {
+	local, err := ListContainers()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	all := []HostContainer{}
+	for _, container := range local {
+		all = append(all, HostContainer{Container: container, Host: "local"})
+	}
+
+	failures := map[string]string{}
+	if !utils.GetMainConfig().ConstellationConfig.Enabled {
+		return all, failures, nil
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, node := range constellation.GetCosmosNodes() {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+
+			containers, err := listRemoteContainers(host)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if err != nil {
+				utils.Warn("ListFleetContainers: cannot list containers of " + host + ": " + err.Error())
+				failures[host] = err.Error()
+				return
+			}
+
+			for _, container := range containers {
+				all = append(all, HostContainer{Container: container, Host: host})
+			}
+		}(node.DeviceName)
+	}
+
+	wg.Wait()
+
+	return all, failures, nil
+}
+
+// DockerHostsRoute lists the hosts that can be managed, this server and the Cosmos nodes of the Constellation
+func DockerHostsRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		hosts := []DockerHost{
+			{
+				Name: "local",
+				Local: true,
+				Reachable: Connect() == nil,
+			},
+		}
+
+		if utils.GetMainConfig().ConstellationConfig.Enabled {
+			nodes := constellation.GetCosmosNodes()
+			remote := make([]DockerHost, len(nodes))
+
+			var wg sync.WaitGroup
+			for i, node := range nodes {
+				remote[i] = DockerHost{
+					Name: node.DeviceName,
+					IP: node.IP,
+				}
+
+				wg.Add(1)
+				go func(host *DockerHost) {
+					defer wg.Done()
+
+					// the node only lets the master use the paths of the Docker API, listing the ServApps
+					// also checks that its Docker is up
+					resp, err := constellation.RemoteNodeRequest(host.Name, "GET", "/cosmos/api/servapps", nil)
+					if err != nil {
+						host.Error = err.Error()
+						return
+					}
+					resp.Body.Close()
+					host.Reachable = resp.StatusCode == http.StatusOK
+				}(&remote[i])
+			}
+			wg.Wait()
+
+			hosts = append(hosts, remote...)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": hosts,
+		})
+	} else {
+		utils.Error("DockerHosts: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
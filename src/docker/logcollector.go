@@ -0,0 +1,533 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	conttype "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// LogEntry is a line of the logs of a container, as stored by the log collector
+type LogEntry struct {
+	Id primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Container string `json:"container" bson:"container"`
+	Stream string `json:"stream" bson:"stream"`
+	Level string `json:"level" bson:"level"`
+	Message string `json:"message" bson:"message"`
+	Date time.Time `json:"date" bson:"date"`
+}
+
+const defaultLogRetentionDays = 7
+const logBatchSize = 500
+const logFlushInterval = 2 * time.Second
+
+var logLevelRegex = regexp.MustCompile(`(?i)\b(fatal|panic|crit(?:ical)?|err(?:or)?|warn(?:ing)?|info|notice|debug|trace)\b`)
+var logJSONLevelRegex = regexp.MustCompile(`(?i)"(?:level|severity|lvl)"\s*:\s*"(\w+)"`)
+
+// DetectLogLevel guesses the level of a log line from its content: error, warning, info or debug
+func DetectLogLevel(message string) string {
+	match := logJSONLevelRegex.FindStringSubmatch(message)
+	if match == nil {
+		// only look at the start of the line, where the loggers put the level
+		head := message
+		if len(head) > 80 {
+			head = head[:80]
+		}
+		match = logLevelRegex.FindStringSubmatch(head)
+	}
+
+	if match == nil {
+		return "info"
+	}
+
+	switch level := strings.ToLower(match[1]); {
+	case strings.HasPrefix(level, "fatal"), strings.HasPrefix(level, "panic"), strings.HasPrefix(level, "crit"), strings.HasPrefix(level, "err"):
+		return "error"
+	case strings.HasPrefix(level, "warn"):
+		return "warning"
+	case level == "debug", level == "trace":
+		return "debug"
+	}
+	return "info"
+}
+
+type logCollector struct {
+	config utils.LogCollectorConfig
+	ctx context.Context
+	cancel context.CancelFunc
+	entries chan LogEntry
+	followers map[string]context.CancelFunc
+	lock sync.Mutex
+	forwarders []*logForwarder
+}
+
+var collector *logCollector
+var collectorLock sync.Mutex
+
+// StartLogCollector (re)starts the log collector with the current configuration, or stops it if disabled
+func StartLogCollector() {
+	collectorLock.Lock()
+	defer collectorLock.Unlock()
+
+	if collector != nil {
+		collector.cancel()
+		collector = nil
+	}
+
+	config := utils.GetMainConfig().DockerConfig.LogCollector
+	if !config.Enabled {
+		return
+	}
+
+	if errD := Connect(); errD != nil {
+		utils.Error("LogCollector - Docker did not connect", errD)
+		return
+	}
+
+	if config.RetentionDays <= 0 {
+		config.RetentionDays = defaultLogRetentionDays
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	collector = &logCollector{
+		config: config,
+		ctx: ctx,
+		cancel: cancel,
+		entries: make(chan LogEntry, 10000),
+		followers: map[string]context.CancelFunc{},
+	}
+
+	for _, forwarder := range config.Forwarders {
+		collector.forwarders = append(collector.forwarders, newLogForwarder(forwarder))
+	}
+
+	initLogsCollection()
+
+	go collector.write()
+	go collector.cleanup()
+
+	containers, err := ListContainers()
+	if err != nil {
+		utils.Error("LogCollector - list containers", err)
+		return
+	}
+
+	for _, container := range containers {
+		if container.State == "running" {
+			collector.follow(container.ID)
+		}
+	}
+
+	utils.Log("LogCollector - collecting the logs of " + strconv.Itoa(len(collector.followers)) + " containers")
+}
+
+// CollectContainerLogs starts following the logs of a container which just started
+func CollectContainerLogs(containerID string) {
+	collectorLock.Lock()
+	current := collector
+	collectorLock.Unlock()
+
+	if current != nil {
+		current.follow(containerID)
+	}
+}
+
+func initLogsCollection() {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "logs")
+	if errCo != nil {
+		utils.Error("LogCollector - Database Connect", errCo)
+		return
+	}
+
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "container", Value: 1}, {Key: "date", Value: -1}}},
+		{Keys: bson.D{{Key: "date", Value: -1}}},
+		{Keys: bson.D{{Key: "message", Value: "text"}}},
+	}
+
+	if _, err := c.Indexes().CreateMany(context.Background(), models); err != nil {
+		utils.Error("LogCollector - Create Index", err)
+	}
+}
+
+// lastCollectedDate returns the date of the last log stored for a container, to resume without duplicates
+func lastCollectedDate(containerName string) time.Time {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "logs")
+	if errCo != nil {
+		return time.Time{}
+	}
+
+	var last LogEntry
+	err := c.FindOne(context.Background(), bson.M{"container": containerName}, options.FindOne().SetSort(bson.M{"date": -1})).Decode(&last)
+	if err != nil {
+		return time.Time{}
+	}
+	return last.Date
+}
+
+func (lc *logCollector) follow(containerID string) {
+	lc.lock.Lock()
+	_, followed := lc.followers[containerID]
+	lc.lock.Unlock()
+
+	if followed {
+		return
+	}
+
+	// Docker and the database are queried without the lock, the followers of other containers don't wait on them
+	container, err := DockerClient.ContainerInspect(DockerContext, containerID)
+	if err != nil {
+		utils.Error("LogCollector - inspect " + containerID, err)
+		return
+	}
+
+	name := strings.TrimPrefix(container.Name, "/")
+	for _, excluded := range lc.config.Exclude {
+		if excluded == name {
+			return
+		}
+	}
+
+	since := lastCollectedDate(name)
+
+	lc.lock.Lock()
+	if _, ok := lc.followers[containerID]; ok || lc.ctx.Err() != nil {
+		lc.lock.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(lc.ctx)
+	lc.followers[containerID] = cancel
+	lc.lock.Unlock()
+
+	sinceOption := ""
+	if !since.IsZero() {
+		sinceOption = since.Add(time.Nanosecond).Format(time.RFC3339Nano)
+	}
+
+	go func() {
+		defer func() {
+			lc.lock.Lock()
+			delete(lc.followers, containerID)
+			lc.lock.Unlock()
+			cancel()
+		}()
+
+		logs, err := DockerClient.ContainerLogs(ctx, containerID, conttype.LogsOptions{
+			ShowStdout: true,
+			ShowStderr: true,
+			Follow: true,
+			Timestamps: true,
+			Since: sinceOption,
+		})
+		if err != nil {
+			utils.Error("LogCollector - logs of " + name, err)
+			return
+		}
+		defer logs.Close()
+
+		if container.Config.Tty {
+			lc.readStream(name, "stdout", logs)
+			return
+		}
+
+		stdout, stdoutWriter := io.Pipe()
+		stderr, stderrWriter := io.Pipe()
+
+		go func() {
+			_, err := stdcopy.StdCopy(stdoutWriter, stderrWriter, logs)
+			stdoutWriter.CloseWithError(err)
+			stderrWriter.CloseWithError(err)
+		}()
+
+		done := make(chan bool)
+		go func() {
+			lc.readStream(name, "stderr", stderr)
+			done <- true
+		}()
+		lc.readStream(name, "stdout", stdout)
+		<-done
+	}()
+}
+
+func (lc *logCollector) readStream(containerName string, stream string, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// each line starts with its timestamp
+		date := time.Now()
+		if i := strings.Index(line, " "); i > 0 {
+			if parsed, err := time.Parse(time.RFC3339Nano, line[:i]); err == nil {
+				date = parsed
+				line = line[i+1:]
+			}
+		}
+
+		entry := LogEntry{
+			Container: containerName,
+			Stream: stream,
+			Level: DetectLogLevel(line),
+			Message: line,
+			Date: date,
+		}
+
+		select {
+		case lc.entries <- entry:
+		case <-lc.ctx.Done():
+			return
+		}
+	}
+}
+
+// write stores the collected logs by batches and sends them to the forwarders
+func (lc *logCollector) write() {
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+
+	batch := []LogEntry{}
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "logs")
+		if errCo != nil {
+			utils.Error("LogCollector - Database Connect", errCo)
+		} else {
+			documents := make([]interface{}, len(batch))
+			for i, entry := range batch {
+				documents[i] = entry
+			}
+			if _, err := c.InsertMany(context.Background(), documents, options.InsertMany().SetOrdered(false)); err != nil {
+				utils.Error("LogCollector - insert", err)
+			}
+		}
+
+		for _, forwarder := range lc.forwarders {
+			forwarder.enqueue(batch)
+		}
+
+		batch = []LogEntry{}
+	}
+
+	for {
+		select {
+		case entry := <-lc.entries:
+			batch = append(batch, entry)
+			if len(batch) >= logBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-lc.ctx.Done():
+			flush()
+			for _, forwarder := range lc.forwarders {
+				forwarder.stop()
+			}
+			return
+		}
+	}
+}
+
+// cleanup deletes the logs older than the retention every hour
+func (lc *logCollector) cleanup() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "logs")
+		if errCo == nil {
+			del, err := c.DeleteMany(context.Background(), bson.M{
+				"date": bson.M{"$lt": time.Now().AddDate(0, 0, -lc.config.RetentionDays)},
+			})
+			if err != nil {
+				utils.Error("LogCollector - cleanup", err)
+			} else if del.DeletedCount > 0 {
+				utils.Debug("LogCollector - cleanup: " + strconv.Itoa(int(del.DeletedCount)) + " logs deleted")
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-lc.ctx.Done():
+			return
+		}
+	}
+}
+
+// LogSearchRequest are the filters of a search in the collected logs
+type LogSearchRequest struct {
+	Containers []string
+	From time.Time
+	To time.Time
+	Levels []string
+	Stream string
+	// regular expression, case insensitive
+	Regex string
+	// full-text search on the words of the messages
+	Text string
+	// id of the last entry of the previous page
+	Before string
+	Limit int64
+}
+
+func SearchLogs(search LogSearchRequest) ([]LogEntry, error) {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "logs")
+	if errCo != nil {
+		return nil, errCo
+	}
+
+	filter := bson.M{}
+
+	if len(search.Containers) > 0 {
+		filter["container"] = bson.M{"$in": search.Containers}
+	}
+	if len(search.Levels) > 0 {
+		filter["level"] = bson.M{"$in": search.Levels}
+	}
+	if search.Stream != "" {
+		filter["stream"] = search.Stream
+	}
+
+	dateFilter := bson.M{}
+	if !search.From.IsZero() {
+		dateFilter["$gte"] = search.From
+	}
+	if !search.To.IsZero() {
+		dateFilter["$lte"] = search.To
+	}
+	if len(dateFilter) > 0 {
+		filter["date"] = dateFilter
+	}
+
+	if search.Regex != "" {
+		if _, err := regexp.Compile(search.Regex); err != nil {
+			return nil, err
+		}
+		filter["message"] = bson.M{"$regex": search.Regex, "$options": "i"}
+	}
+	if search.Text != "" {
+		filter["$text"] = bson.M{"$search": search.Text}
+	}
+
+	// the results are sorted by date then id, so the next page starts after the date and id of the
+	// last entry of the previous one
+	if search.Before != "" {
+		before, err := primitive.ObjectIDFromHex(search.Before)
+		if err != nil {
+			return nil, err
+		}
+
+		var last LogEntry
+		err = c.FindOne(context.Background(), bson.M{"_id": before}).Decode(&last)
+		if err == mongo.ErrNoDocuments {
+			// removed by the cleanup, with all the older logs
+			return []LogEntry{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		filter["$or"] = bson.A{
+			bson.M{"date": bson.M{"$lt": last.Date}},
+			bson.M{"date": last.Date, "_id": bson.M{"$lt": before}},
+		}
+	}
+
+	if search.Limit <= 0 || search.Limit > 1000 {
+		search.Limit = 100
+	}
+
+	cursor, err := c.Find(context.Background(), filter, options.Find().
+		SetSort(bson.D{{Key: "date", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(search.Limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	entries := []LogEntry{}
+	err = cursor.All(context.Background(), &entries)
+	return entries, err
+}
+
+func splitQueryList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// SearchLogsRoute searches the collected logs, with the filters containers, from, to (RFC3339), levels,
+// stream, regex, text, before (pagination) and limit
+func SearchLogsRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		query := req.URL.Query()
+
+		search := LogSearchRequest{
+			Containers: splitQueryList(query.Get("containers")),
+			Levels: splitQueryList(query.Get("levels")),
+			Stream: query.Get("stream"),
+			Regex: query.Get("regex"),
+			Text: query.Get("text"),
+			Before: query.Get("before"),
+		}
+
+		var err error
+		if query.Get("from") != "" {
+			if search.From, err = time.Parse(time.RFC3339, query.Get("from")); err != nil {
+				utils.HTTPError(w, "Invalid from date", http.StatusBadRequest, "DS003")
+				return
+			}
+		}
+		if query.Get("to") != "" {
+			if search.To, err = time.Parse(time.RFC3339, query.Get("to")); err != nil {
+				utils.HTTPError(w, "Invalid to date", http.StatusBadRequest, "DS003")
+				return
+			}
+		}
+		if query.Get("limit") != "" {
+			search.Limit, _ = strconv.ParseInt(query.Get("limit"), 10, 64)
+		}
+
+		entries, err := SearchLogs(search)
+		if err != nil {
+			utils.Error("SearchLogs", err)
+			utils.HTTPError(w, "Search failed: " + err.Error(), http.StatusBadRequest, "DS003")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": entries,
+		})
+	} else {
+		utils.Error("SearchLogs: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
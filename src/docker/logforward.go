@@ -0,0 +1,281 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// logForwarder sends the collected logs to a syslog, GELF or Loki endpoint
+type logForwarder struct {
+	config utils.LogForwarderConfig
+	containers map[string]bool
+	conn net.Conn
+	hostname string
+	// errors are only logged once until the endpoint works again
+	failing bool
+	// batches waiting to be sent, so that a slow endpoint does not hold the collector
+	queue chan []LogEntry
+	// batches are dropped while the queue is full, which is only logged once
+	dropping bool
+}
+
+// number of batches a forwarder keeps while its endpoint is slow or unreachable
+const logForwarderQueueSize = 100
+
+var logForwarderClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+func newLogForwarder(config utils.LogForwarderConfig) *logForwarder {
+	forwarder := &logForwarder{
+		config: config,
+		containers: map[string]bool{},
+		queue: make(chan []LogEntry, logForwarderQueueSize),
+	}
+
+	for _, container := range config.Containers {
+		forwarder.containers[container] = true
+	}
+
+	forwarder.hostname, _ = os.Hostname()
+
+	go forwarder.run()
+
+	return forwarder
+}
+
+// run sends the queued batches until the queue is closed
+func (f *logForwarder) run() {
+	for entries := range f.queue {
+		f.send(entries)
+	}
+	f.close()
+}
+
+// enqueue queues a batch without waiting, it is dropped if the queue is full
+func (f *logForwarder) enqueue(entries []LogEntry) {
+	select {
+	case f.queue <- entries:
+		f.dropping = false
+	default:
+		if !f.dropping {
+			utils.Warn("LogCollector - forwarder " + f.config.Name + " is too slow, dropping logs")
+		}
+		f.dropping = true
+	}
+}
+
+// stop sends the queued batches then closes the connection
+func (f *logForwarder) stop() {
+	close(f.queue)
+}
+
+// syslog severities, also used by GELF
+func logSyslogSeverity(level string) int {
+	switch level {
+	case "error":
+		return 3
+	case "warning":
+		return 4
+	case "debug":
+		return 7
+	}
+	return 6
+}
+
+func (f *logForwarder) send(entries []LogEntry) {
+	selected := []LogEntry{}
+	for _, entry := range entries {
+		if len(f.containers) == 0 || f.containers[entry.Container] {
+			selected = append(selected, entry)
+		}
+	}
+
+	if len(selected) == 0 {
+		return
+	}
+
+	var err error
+	switch f.config.Type {
+	case "syslog":
+		err = f.sendStream(selected, f.syslogMessage)
+	case "gelf":
+		if strings.HasPrefix(f.config.URL, "http") {
+			err = f.sendGELFHTTP(selected)
+		} else {
+			err = f.sendStream(selected, f.gelfMessage)
+		}
+	case "loki":
+		err = f.sendLoki(selected)
+	default:
+		err = errors.New("unknown forwarder type " + f.config.Type)
+	}
+
+	if err != nil {
+		if !f.failing {
+			utils.Error("LogCollector - forwarding to " + f.config.Name, err)
+		}
+		f.failing = true
+	} else {
+		f.failing = false
+	}
+}
+
+func (f *logForwarder) close() {
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+// syslogMessage formats an entry as RFC 5424, the app name being the container
+func (f *logForwarder) syslogMessage(entry LogEntry) []byte {
+	// facility user
+	priority := 8 + logSyslogSeverity(entry.Level)
+	message := fmt.Sprintf("<%d>1 %s %s %s - - - %s", priority, entry.Date.UTC().Format(time.RFC3339Nano), f.hostname, entry.Container, entry.Message)
+
+	if strings.HasPrefix(f.config.URL, "tcp") {
+		// octet counting framing
+		return []byte(strconv.Itoa(len(message)) + " " + message)
+	}
+	return []byte(message)
+}
+
+func (f *logForwarder) gelfEntry(entry LogEntry) map[string]interface{} {
+	return map[string]interface{}{
+		"version": "1.1",
+		"host": f.hostname,
+		"short_message": entry.Message,
+		"timestamp": float64(entry.Date.UnixNano()) / 1e9,
+		"level": logSyslogSeverity(entry.Level),
+		"_container": entry.Container,
+		"_stream": entry.Stream,
+	}
+}
+
+func (f *logForwarder) gelfMessage(entry LogEntry) []byte {
+	data, _ := json.Marshal(f.gelfEntry(entry))
+
+	if strings.HasPrefix(f.config.URL, "tcp") {
+		// TCP messages are delimited by a null byte
+		return append(data, 0)
+	}
+	// UDP messages bigger than a chunk would need the chunking, which is not supported
+	if len(data) > 8192 {
+		entry.Message = entry.Message[:max(0, len(entry.Message) - (len(data) - 8000))]
+		data, _ = json.Marshal(f.gelfEntry(entry))
+	}
+	return data
+}
+
+// sendStream sends the entries one by one over UDP or TCP, reconnecting if needed
+func (f *logForwarder) sendStream(entries []LogEntry, format func(LogEntry) []byte) error {
+	target, err := url.Parse(f.config.URL)
+	if err != nil {
+		return err
+	}
+	if target.Scheme != "udp" && target.Scheme != "tcp" {
+		return errors.New("invalid URL " + f.config.URL + ", expected udp:// or tcp://")
+	}
+
+	for _, entry := range entries {
+		if f.conn == nil {
+			f.conn, err = net.DialTimeout(target.Scheme, target.Host, 10 * time.Second)
+			if err != nil {
+				return err
+			}
+		}
+
+		f.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := f.conn.Write(format(entry)); err != nil {
+			f.close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *logForwarder) post(target string, body []byte) error {
+	resp, err := logForwarderClient.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %d", target, resp.StatusCode)
+	}
+	return nil
+}
+
+func (f *logForwarder) sendGELFHTTP(entries []LogEntry) error {
+	for _, entry := range entries {
+		data, _ := json.Marshal(f.gelfEntry(entry))
+		if err := f.post(f.config.URL, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendLoki pushes the entries with one stream per container and level
+func (f *logForwarder) sendLoki(entries []LogEntry) error {
+	type lokiStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string `json:"values"`
+	}
+
+	streams := map[string]*lokiStream{}
+	order := []string{}
+
+	for _, entry := range entries {
+		key := entry.Container + "/" + entry.Level
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{
+				Stream: map[string]string{
+					"job": "cosmos",
+					"host": f.hostname,
+					"container": entry.Container,
+					"level": entry.Level,
+				},
+				Values: [][2]string{},
+			}
+			streams[key] = stream
+			order = append(order, key)
+		}
+
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(entry.Date.UnixNano(), 10), entry.Message})
+	}
+
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, key := range order {
+		push.Streams = append(push.Streams, streams[key])
+	}
+
+	data, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+
+	target := strings.TrimSuffix(f.config.URL, "/")
+	if !strings.HasSuffix(target, "/loki/api/v1/push") {
+		target += "/loki/api/v1/push"
+	}
+
+	return f.post(target, data)
+}
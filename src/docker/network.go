@@ -80,6 +80,53 @@ func findAvailableSubnets(nb int) ([]string, error) {
 	return result, nil
 }
 
+// findAvailableSubnetFor finds a free subnet big enough for a number of containers, next to the
+// network address, the gateway and the broadcast address. The subnets are at least /28 like findAvailableSubnets
+func findAvailableSubnetFor(containers int) (string, error) {
+	maskSize := 28
+	for maskSize > 16 && (1 << uint(32 - maskSize)) < containers + 3 {
+		maskSize--
+	}
+	if (1 << uint(32 - maskSize)) < containers + 3 {
+		return "", errors.New("Too many containers for a single network")
+	}
+
+	networks, err := DockerClient.NetworkList(DockerContext, types.NetworkListOptions{})
+	if err != nil {
+		utils.Error("Docker Network List", err)
+		return "", err
+	}
+
+	_, pool, _ := net.ParseCIDR("172.16.0.0/12")
+	subnet := fmt.Sprintf("172.16.0.0/%d", maskSize)
+
+	for {
+		_, candidate, _ := net.ParseCIDR(subnet)
+		if !pool.Contains(candidate.IP) {
+			return "", errors.New("Not enough subnets available. Try cleaning up networks.")
+		}
+
+		overlaps := false
+		for _, network := range networks {
+			for _, config := range network.IPAM.Config {
+				_, existingNet, err := net.ParseCIDR(config.Subnet)
+				if err != nil {
+					continue
+				}
+				if existingNet.Contains(candidate.IP) || candidate.Contains(existingNet.IP) {
+					overlaps = true
+				}
+			}
+		}
+
+		if !overlaps {
+			return subnet, nil
+		}
+
+		subnet = getNextSubnet(subnet)
+	}
+}
+
 func CreateReasonableNetwork(name string, networkDef types.NetworkCreate) (types.NetworkCreateResponse, error) {
 	// if no subnet
 	if networkDef.IPAM == nil {
@@ -378,7 +425,7 @@ func _debounceNetworkCleanUp() func(string) {
 	var timer *time.Timer
 
 	return func(networkId string) {
-		if(networkId == "bridge" || networkId == "host" || networkId == "none") {
+		if(IsDefaultNetwork(networkId)) {
 			return
 		}
 
@@ -463,7 +510,7 @@ func NetworkCleanUp() {
 
 		// remove all non-attached networks
 		for _, network := range networks {
-			if network.Name == "bridge" || network.Name == "host" || network.Name == "none" {
+			if IsDefaultNetwork(network.Name) {
 				continue
 			}
 
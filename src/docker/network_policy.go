@@ -0,0 +1,500 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	conttype "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	network "github.com/docker/docker/api/types/network"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// The network policies of DockerConfig.NetworkPolicies are enforced with internal networks labelled
+// cosmos-policy. The allowed pairs are grouped in sets of containers that may all reach each other, each
+// set becoming one network, so that no container can reach one it is not allowed to. A shared network
+// opens every port both ways, so a policy is symmetric and cannot be limited to a port
+
+// NetworkPolicySemantics is returned with the policies, so that a client doesn't read them as directional
+const NetworkPolicySemantics = "A policy lets both containers reach each other, in both directions and on all ports"
+
+type NetworkGraphNode struct {
+	Name string `json:"name"`
+	Networks []string `json:"networks"`
+	// default-bridge or host-network, the containers that the policies cannot isolate
+	Flags []string `json:"flags"`
+}
+
+type NetworkGraphEdge struct {
+	A string `json:"a"`
+	B string `json:"b"`
+	// the networks A and B share, excluding the default ones
+	Networks []string `json:"networks"`
+	// whether a policy allows A and B to talk, in both directions and on all ports
+	Allowed bool `json:"allowed"`
+}
+
+type NetworkGraph struct {
+	Nodes []NetworkGraphNode `json:"nodes"`
+	Edges []NetworkGraphEdge `json:"edges"`
+}
+
+func ValidateNetworkPolicy(policy utils.NetworkPolicy) error {
+	if policy.From == "" || policy.To == "" {
+		return errors.New("a policy needs a from and a to container")
+	}
+	if policy.From == policy.To {
+		return errors.New("a container cannot have a policy to itself")
+	}
+	return nil
+}
+
+func policyPair(a string, b string) [2]string {
+	if a > b {
+		return [2]string{b, a}
+	}
+	return [2]string{a, b}
+}
+
+// policyGroups covers the allowed pairs with the fewest groups it can find, a group only taking
+// containers that may reach all of its members
+func policyGroups(pairs map[[2]string]bool) [][]string {
+	allowed := map[string]map[string]bool{}
+	edges := [][2]string{}
+	for pair := range pairs {
+		for i := 0; i < 2; i++ {
+			if allowed[pair[i]] == nil {
+				allowed[pair[i]] = map[string]bool{}
+			}
+		}
+		allowed[pair[0]][pair[1]] = true
+		allowed[pair[1]][pair[0]] = true
+		edges = append(edges, pair)
+	}
+
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i][0] != edges[j][0] {
+			return edges[i][0] < edges[j][0]
+		}
+		return edges[i][1] < edges[j][1]
+	})
+
+	covered := map[[2]string]bool{}
+	groups := [][]string{}
+
+	for _, edge := range edges {
+		if covered[edge] {
+			continue
+		}
+
+		group := []string{edge[0], edge[1]}
+
+		candidates := []string{}
+		for candidate := range allowed[edge[0]] {
+			if allowed[edge[1]][candidate] {
+				candidates = append(candidates, candidate)
+			}
+		}
+		sort.Strings(candidates)
+
+		for _, candidate := range candidates {
+			reachesAll := true
+			coversNew := false
+			for _, member := range group {
+				if !allowed[member][candidate] {
+					reachesAll = false
+					break
+				}
+				if !covered[policyPair(member, candidate)] {
+					coversNew = true
+				}
+			}
+
+			// joining without covering a new pair would only add a connection
+			if reachesAll && coversNew {
+				group = append(group, candidate)
+			}
+		}
+
+		for i := range group {
+			for j := i + 1; j < len(group); j++ {
+				covered[policyPair(group[i], group[j])] = true
+			}
+		}
+
+		sort.Strings(group)
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+func policyNetworkName(members []string) string {
+	hash := sha256.Sum256([]byte(strings.Join(members, ",")))
+	return "cosmos-policy-" + hex.EncodeToString(hash[:])[:10]
+}
+
+func policyContainerName(container types.Container) string {
+	if len(container.Names) == 0 {
+		return container.ID
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
+}
+
+// ApplyNetworkPolicies creates, updates and removes the policy networks to match the policies
+func ApplyNetworkPolicies() error {
+	if errD := Connect(); errD != nil {
+		return errD
+	}
+
+	DockerNetworkLock <- true
+	defer func() { <-DockerNetworkLock }()
+
+	containers, err := DockerClient.ContainerList(DockerContext, conttype.ListOptions{All: true})
+	if err != nil {
+		return err
+	}
+
+	usable := map[string]bool{}
+	for _, container := range containers {
+		mode := container.HostConfig.NetworkMode
+		if mode == "host" || strings.HasPrefix(mode, "container:") {
+			continue
+		}
+		usable[policyContainerName(container)] = true
+	}
+
+	pairs := map[[2]string]bool{}
+	for _, policy := range utils.GetMainConfig().DockerConfig.NetworkPolicies {
+		if err := ValidateNetworkPolicy(policy); err != nil {
+			utils.Warn("NetworkPolicies: ignoring policy " + policy.From + " to " + policy.To + ": " + err.Error())
+			continue
+		}
+		if !usable[policy.From] || !usable[policy.To] {
+			utils.Warn("NetworkPolicies: ignoring policy " + policy.From + " to " + policy.To + ", a container is missing or uses the network of another")
+			continue
+		}
+		pairs[policyPair(policy.From, policy.To)] = true
+	}
+
+	desired := map[string][]string{}
+	for _, group := range policyGroups(pairs) {
+		desired[policyNetworkName(group)] = group
+	}
+
+	existing, err := DockerClient.NetworkList(DockerContext, types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", "cosmos-policy=true")),
+	})
+	if err != nil {
+		return err
+	}
+
+	// the stopped containers are attached too, the inspect of a network only lists the running ones
+	attached := map[string]map[string]string{}
+	for _, container := range containers {
+		for netName := range container.NetworkSettings.Networks {
+			if attached[netName] == nil {
+				attached[netName] = map[string]string{}
+			}
+			attached[netName][policyContainerName(container)] = container.ID
+		}
+	}
+
+	for _, net := range existing {
+		members, isDesired := desired[net.Name]
+
+		connected := map[string]bool{}
+		for name, id := range attached[net.Name] {
+			isMember := false
+			for _, member := range members {
+				if member == name {
+					isMember = true
+				}
+			}
+
+			if isMember {
+				connected[name] = true
+				continue
+			}
+
+			utils.Log("NetworkPolicies: disconnecting " + name + " from " + net.Name)
+			if err := DockerClient.NetworkDisconnect(DockerContext, net.ID, id, true); err != nil {
+				return err
+			}
+		}
+
+		if !isDesired {
+			utils.Log("NetworkPolicies: removing " + net.Name)
+			if err := DockerClient.NetworkRemove(DockerContext, net.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, member := range members {
+			if !connected[member] {
+				if err := ConnectToNetworkSync(net.Name, member); err != nil {
+					return err
+				}
+			}
+		}
+
+		delete(desired, net.Name)
+	}
+
+	names := []string{}
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		members := desired[name]
+
+		subnet, err := findAvailableSubnetFor(len(members))
+		if err != nil {
+			return err
+		}
+
+		utils.Log("NetworkPolicies: creating " + name + " for " + strings.Join(members, ", "))
+
+		_, err = DockerClient.NetworkCreate(DockerContext, name, types.NetworkCreate{
+			CheckDuplicate: true,
+			Internal: true,
+			Attachable: true,
+			Labels: map[string]string{
+				"cosmos-policy": "true",
+				"cosmos-policy-members": strings.Join(members, ","),
+			},
+			IPAM: &network.IPAM{
+				Config: []network.IPAMConfig{
+					network.IPAMConfig{
+						Subnet: subnet,
+					},
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			if err := ConnectToNetworkSync(name, member); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+var applyPoliciesTimer *time.Timer
+var applyPoliciesLock sync.Mutex
+
+// DebouncedApplyNetworkPolicies re-applies the policies once the containers stop changing, a recreated
+// container having lost its policy networks
+func DebouncedApplyNetworkPolicies() {
+	if len(utils.GetMainConfig().DockerConfig.NetworkPolicies) == 0 {
+		return
+	}
+
+	applyPoliciesLock.Lock()
+	defer applyPoliciesLock.Unlock()
+
+	if applyPoliciesTimer != nil {
+		applyPoliciesTimer.Stop()
+	}
+
+	applyPoliciesTimer = time.AfterFunc(10 * time.Second, func() {
+		if err := ApplyNetworkPolicies(); err != nil {
+			utils.Error("NetworkPolicies", err)
+		}
+	})
+}
+
+// GetNetworkGraph returns which containers can talk to which, through the networks they share, along with
+// the pairs the policies allow
+func GetNetworkGraph() (NetworkGraph, error) {
+	graph := NetworkGraph{
+		Nodes: []NetworkGraphNode{},
+		Edges: []NetworkGraphEdge{},
+	}
+
+	if errD := Connect(); errD != nil {
+		return graph, errD
+	}
+
+	containers, err := DockerClient.ContainerList(DockerContext, conttype.ListOptions{All: true})
+	if err != nil {
+		return graph, err
+	}
+
+	edges := map[[2]string]*NetworkGraphEdge{}
+	getEdge := func(a string, b string) *NetworkGraphEdge {
+		pair := policyPair(a, b)
+		if edges[pair] == nil {
+			edges[pair] = &NetworkGraphEdge{
+				A: pair[0],
+				B: pair[1],
+				Networks: []string{},
+			}
+		}
+		return edges[pair]
+	}
+
+	members := map[string][]string{}
+
+	for _, container := range containers {
+		name := policyContainerName(container)
+		node := NetworkGraphNode{
+			Name: name,
+			Networks: []string{},
+			Flags: []string{},
+		}
+
+		mode := container.HostConfig.NetworkMode
+		if mode == "host" {
+			node.Flags = append(node.Flags, "host-network")
+		}
+
+		for netName := range container.NetworkSettings.Networks {
+			node.Networks = append(node.Networks, netName)
+
+			if netName == "bridge" || netName == "podman" {
+				node.Flags = append(node.Flags, "default-bridge")
+			}
+			if !IsDefaultNetwork(netName) {
+				members[netName] = append(members[netName], name)
+			}
+		}
+		sort.Strings(node.Networks)
+
+		graph.Nodes = append(graph.Nodes, node)
+	}
+
+	for netName, names := range members {
+		for i := range names {
+			for j := i + 1; j < len(names); j++ {
+				edge := getEdge(names[i], names[j])
+				edge.Networks = append(edge.Networks, netName)
+			}
+		}
+	}
+
+	for _, policy := range utils.GetMainConfig().DockerConfig.NetworkPolicies {
+		if ValidateNetworkPolicy(policy) != nil {
+			continue
+		}
+
+		getEdge(policy.From, policy.To).Allowed = true
+	}
+
+	for _, edge := range edges {
+		sort.Strings(edge.Networks)
+		graph.Edges = append(graph.Edges, *edge)
+	}
+
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		return graph.Nodes[i].Name < graph.Nodes[j].Name
+	})
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].A != graph.Edges[j].A {
+			return graph.Edges[i].A < graph.Edges[j].A
+		}
+		return graph.Edges[i].B < graph.Edges[j].B
+	})
+
+	return graph, nil
+}
+
+// NetworkPoliciesRoute gets the network policies, and replaces and applies them with a POST
+func NetworkPoliciesRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		policies := utils.GetMainConfig().DockerConfig.NetworkPolicies
+		if policies == nil {
+			policies = []utils.NetworkPolicy{}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": policies,
+			"semantics": NetworkPolicySemantics,
+		})
+	} else if req.Method == "POST" {
+		var request []utils.NetworkPolicy
+		// a port or a direction would otherwise be dropped, and the policy applied wider than it reads
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			utils.Error("NetworkPolicies: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid JSON: " + err.Error() + ". " + NetworkPolicySemantics, http.StatusBadRequest, "NP001")
+			return
+		}
+
+		for _, policy := range request {
+			if err := ValidateNetworkPolicy(policy); err != nil {
+				utils.HTTPError(w, err.Error(), http.StatusBadRequest, "NP001")
+				return
+			}
+		}
+
+		config := utils.ReadConfigFromFile()
+		config.DockerConfig.NetworkPolicies = request
+		utils.SetBaseMainConfig(config)
+
+		utils.Log("API: Set network policies")
+
+		if err := ApplyNetworkPolicies(); err != nil {
+			utils.Error("NetworkPolicies", err)
+			utils.HTTPError(w, "Network policies saved but not applied: " + err.Error(), http.StatusInternalServerError, "NP002")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"semantics": NetworkPolicySemantics,
+		})
+	} else {
+		utils.Error("NetworkPolicies: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// NetworkGraphRoute shows who can talk to whom, and flags the containers on the default bridge or the host network
+func NetworkGraphRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		graph, err := GetNetworkGraph()
+		if err != nil {
+			utils.Error("NetworkGraph", err)
+			utils.HTTPError(w, "Network Graph Error: " + err.Error(), http.StatusInternalServerError, "NP003")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": graph,
+		})
+	} else {
+		utils.Error("NetworkGraph: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,286 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// RegistryCredentials are the credentials used for the images of a registry. The password is encrypted in the database
+type RegistryCredentials struct {
+	Id primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Host string `json:"host" bson:"host"`
+	Username string `json:"username" bson:"username"`
+	Password string `json:"-" bson:"password"`
+	Date time.Time `json:"date" bson:"date"`
+}
+
+type RegistryCredentialsRequest struct {
+	Host string `json:"host" validate:"required,max=255"`
+	Username string `json:"username" validate:"required,max=255"`
+	// empty to keep the current password when editing
+	Password string `json:"password" validate:"max=4096"`
+}
+
+// NormalizeRegistryHost turns a registry address like https://ghcr.io/ or index.docker.io into the
+// host used in the image references
+func NormalizeRegistryHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.Split(host, "/")[0]
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com", "hub.docker.com":
+		return "docker.io"
+	}
+
+	return host
+}
+
+// GetRegistryCredentials returns the stored credentials of a registry, if any
+func GetRegistryCredentials(host string) (string, string, bool) {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "registries")
+	if errCo != nil {
+		utils.Error("GetRegistryCredentials", errCo)
+		return "", "", false
+	}
+
+	var creds RegistryCredentials
+	err := c.FindOne(context.Background(), bson.M{"host": NormalizeRegistryHost(host)}).Decode(&creds)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			utils.Error("GetRegistryCredentials", err)
+		}
+		return "", "", false
+	}
+
+	password, err := utils.DecryptSecret(creds.Password)
+	if err != nil {
+		utils.Error("GetRegistryCredentials - " + creds.Host, err)
+		return "", "", false
+	}
+
+	return creds.Username, password, true
+}
+
+// dockerConfigCredentials reads the credentials of a registry from the Docker config file (docker login)
+func dockerConfigCredentials(host string) (string, string) {
+	configfile, err := config.Load(config.Dir())
+	if err != nil {
+		utils.Error("RegistryAuth - Read config file error -", err)
+		return "", ""
+	}
+
+	key := host
+	if host == "docker.io" {
+		key = "https://index.docker.io/v1/"
+	}
+
+	creds, err := configfile.GetCredentialsStore(key).Get(key)
+	if err != nil {
+		utils.Error("RegistryAuth - Read credentials error -", err)
+		return "", ""
+	}
+
+	return creds.Username, creds.Password
+}
+
+// registryAuth returns the credentials to use for a registry: the ones stored in Cosmos,
+// or the ones of the Docker config file, or anonymous
+func registryAuth(host string) (string, string) {
+	if username, password, ok := GetRegistryCredentials(host); ok {
+		return username, password
+	}
+
+	return dockerConfigCredentials(host)
+}
+
+// imagePullAuth returns the encoded credentials to pull an image, empty to pull anonymously
+func imagePullAuth(image string) string {
+	parsed, err := ParseRegistryImage(image)
+	if err != nil {
+		return ""
+	}
+
+	username, password := registryAuth(parsed.Registry)
+	if username == "" {
+		return ""
+	}
+
+	encoded, err := registry.EncodeAuthConfig(registry.AuthConfig{
+		Username: username,
+		Password: password,
+		ServerAddress: parsed.Registry,
+	})
+	if err != nil {
+		utils.Error("ImagePullAuth", err)
+		return ""
+	}
+
+	return encoded
+}
+
+func RegistriesRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "registries")
+	if errCo != nil {
+		utils.Error("Database Connect", errCo)
+		utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+		return
+	}
+
+	if req.Method == "GET" {
+		registries := []RegistryCredentials{}
+
+		cursor, err := c.Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"host": 1}))
+		if err != nil {
+			utils.Error("ListRegistries", err)
+			utils.HTTPError(w, "Database error", http.StatusInternalServerError, "DB001")
+			return
+		}
+		defer cursor.Close(context.Background())
+
+		if err := cursor.All(context.Background(), &registries); err != nil {
+			utils.Error("ListRegistries", err)
+			utils.HTTPError(w, "Database error", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": registries,
+		})
+	} else if req.Method == "POST" {
+		var request RegistryCredentialsRequest
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			utils.Error("SetRegistry: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid JSON", http.StatusBadRequest, "DS003")
+			return
+		}
+
+		errV := utils.Validate.Struct(request)
+		if errV != nil {
+			utils.Error("SetRegistry: Invalid User Request", errV)
+			utils.HTTPError(w, errV.Error(), http.StatusBadRequest, "DS003")
+			return
+		}
+
+		host := NormalizeRegistryHost(request.Host)
+		password := request.Password
+
+		if password == "" {
+			_, current, ok := GetRegistryCredentials(host)
+			if !ok {
+				utils.HTTPError(w, "A password is required", http.StatusBadRequest, "DS003")
+				return
+			}
+			password = current
+		}
+
+		// check the credentials unless asked not to, e.g. for a registry which is offline
+		if req.URL.Query().Get("skipCheck") != "true" {
+			if errD := Connect(); errD != nil {
+				utils.Error("SetRegistry", errD)
+				utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+				return
+			}
+
+			_, err := DockerClient.RegistryLogin(DockerContext, registry.AuthConfig{
+				Username: request.Username,
+				Password: password,
+				ServerAddress: host,
+			})
+			if err != nil {
+				utils.Error("SetRegistry: Login failed", err)
+				utils.HTTPError(w, "Login to " + host + " failed: " + err.Error(), http.StatusBadRequest, "DS006")
+				return
+			}
+		}
+
+		encrypted, err := utils.EncryptSecret(password)
+		if err != nil {
+			utils.Error("SetRegistry: Encrypt", err)
+			utils.HTTPError(w, "Internal server error: " + err.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		_, err = c.UpdateOne(context.Background(), bson.M{"host": host}, bson.M{
+			"$set": bson.M{
+				"host": host,
+				"username": request.Username,
+				"password": encrypted,
+				"date": time.Now(),
+			},
+		}, options.Update().SetUpsert(true))
+		if err != nil {
+			utils.Error("SetRegistry", err)
+			utils.HTTPError(w, "Database error", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		utils.Log("API: Set credentials of registry " + host)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("Registries: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func DeleteRegistryRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "DELETE" {
+		host := NormalizeRegistryHost(mux.Vars(req)["host"])
+
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "registries")
+		if errCo != nil {
+			utils.Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		result, err := c.DeleteOne(context.Background(), bson.M{"host": host})
+		if err == nil && result.DeletedCount == 0 {
+			err = errors.New("no credentials for registry " + host)
+		}
+		if err != nil {
+			utils.Error("DeleteRegistry", err)
+			utils.HTTPError(w, err.Error(), http.StatusNotFound, "DS005")
+			return
+		}
+
+		utils.Log("API: Deleted credentials of registry " + host)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("DeleteRegistry: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,418 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+)
+
+// RegistryImage is an image reference split in the parts used by the registry API
+type RegistryImage struct {
+	Registry string
+	Repository string
+	Tag string
+	Digest string
+}
+
+// ParseRegistryImage normalizes an image reference like nginx:1.25 to docker.io/library/nginx:1.25
+func ParseRegistryImage(image string) (RegistryImage, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return RegistryImage{}, err
+	}
+
+	result := RegistryImage{
+		Registry: reference.Domain(named),
+		Repository: reference.Path(named),
+		Tag: "latest",
+	}
+
+	if tagged, ok := named.(reference.Tagged); ok {
+		result.Tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		result.Digest = digested.Digest().String()
+		if _, ok := named.(reference.Tagged); !ok {
+			result.Tag = ""
+		}
+	}
+
+	return result, nil
+}
+
+// WithTag returns the reference of the same repository with another tag
+func (image RegistryImage) WithTag(tag string) string {
+	name := image.Registry + "/" + image.Repository
+	if image.Registry == "docker.io" {
+		name = strings.TrimPrefix(image.Repository, "library/")
+	}
+	return name + ":" + tag
+}
+
+func registryHost(registry string) string {
+	if registry == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return registry
+}
+
+var registryClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+var challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// registryToken answers a Bearer challenge of a registry with a token for the requested scope
+func registryToken(registry string, challenge string) (string, error) {
+	params := map[string]string{}
+	for _, match := range challengeParamRegex.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+
+	if params["realm"] == "" {
+		return "", errors.New("invalid authentication challenge from " + registry)
+	}
+
+	query := url.Values{}
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		query.Set("scope", params["scope"])
+	}
+
+	req, err := http.NewRequest("GET", params["realm"] + "?" + query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	if username, password := registryAuth(registry); username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("authentication to %s failed with status %d", registry, resp.StatusCode)
+	}
+
+	var token struct {
+		Token string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+// RegistryRequest calls the registry API, answering the Bearer or Basic authentication challenge if needed
+func RegistryRequest(method string, registry string, path string, accept []string) (*http.Response, error) {
+	target := "https://" + registryHost(registry) + path
+
+	do := func(authorization string) (*http.Response, error) {
+		req, err := http.NewRequest(method, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, mediaType := range accept {
+			req.Header.Add("Accept", mediaType)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return registryClient.Do(req)
+	}
+
+	resp, err := do("")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	switch {
+	case strings.HasPrefix(strings.ToLower(challenge), "bearer"):
+		token, err := registryToken(registry, challenge)
+		if err != nil {
+			return nil, err
+		}
+		return do("Bearer " + token)
+	case strings.HasPrefix(strings.ToLower(challenge), "basic"):
+		username, password := registryAuth(registry)
+		if username == "" {
+			return nil, errors.New("registry " + registry + " requires credentials")
+		}
+		return do("Basic " + base64.StdEncoding.EncodeToString([]byte(username + ":" + password)))
+	}
+
+	return nil, errors.New("registry " + registry + " requires an unsupported authentication")
+}
+
+var linkNextRegex = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// ListRegistryTags lists the tags of the repository of an image
+func ListRegistryTags(image string) ([]string, error) {
+	parsed, err := ParseRegistryImage(image)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []string{}
+	path := "/v2/" + parsed.Repository + "/tags/list?n=1000"
+
+	// follow the pagination, with a limit for the registries always returning a next page
+	for page := 0; path != "" && page < 50; page++ {
+		resp, err := RegistryRequest("GET", parsed.Registry, path, []string{"application/json"})
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("cannot list tags of %s, registry answered %d", image, resp.StatusCode)
+		}
+
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, list.Tags...)
+
+		path = ""
+		if match := linkNextRegex.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+			path = match[1]
+			if next, err := url.Parse(path); err == nil && next.IsAbs() {
+				path = next.RequestURI()
+			}
+		}
+	}
+
+	return tags, nil
+}
+
+const (
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+)
+
+var manifestMediaTypes = []string{
+	mediaTypeOCIIndex,
+	mediaTypeDockerManifestList,
+	mediaTypeOCIManifest,
+	mediaTypeDockerManifest,
+}
+
+// RegistryManifest is the manifest a tag points to. For multi-arch images (manifest lists and OCI indexes),
+// Platforms has the digest of each platform manifest, with keys like linux/arm64/v8
+type RegistryManifest struct {
+	Digest string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	Platforms map[string]string `json:"platforms,omitempty"`
+	Date time.Time `json:"date"`
+}
+
+// how long the manifests of the registries are kept before asking again
+var registryCacheDuration = 1 * time.Hour
+
+var registryCache = map[string]RegistryManifest{}
+var registryCacheLock sync.Mutex
+
+func manifestPlatformKey(os string, architecture string, variant string) string {
+	key := os + "/" + architecture
+	if variant != "" {
+		key += "/" + variant
+	}
+	return key
+}
+
+// fetchRegistryManifest resolves a tag with a HEAD request, which is not counted in the Docker Hub pull limits.
+// The manifest itself is only downloaded for multi-arch images, or if the registry does not send the digest
+func fetchRegistryManifest(image RegistryImage) (RegistryManifest, error) {
+	ref := image.Tag
+	if image.Digest != "" {
+		ref = image.Digest
+	}
+	path := "/v2/" + image.Repository + "/manifests/" + ref
+
+	resp, err := RegistryRequest("HEAD", image.Registry, path, manifestMediaTypes)
+	if err != nil {
+		return RegistryManifest{}, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return RegistryManifest{}, fmt.Errorf("cannot get manifest of %s, registry answered %d", image.WithTag(ref), resp.StatusCode)
+	}
+
+	manifest := RegistryManifest{
+		Digest: resp.Header.Get("Docker-Content-Digest"),
+		MediaType: strings.Split(resp.Header.Get("Content-Type"), ";")[0],
+		Date: time.Now(),
+	}
+
+	isIndex := manifest.MediaType == mediaTypeDockerManifestList || manifest.MediaType == mediaTypeOCIIndex
+	if manifest.Digest != "" && !isIndex {
+		return manifest, nil
+	}
+
+	resp, err = RegistryRequest("GET", image.Registry, path, manifestMediaTypes)
+	if err != nil {
+		return RegistryManifest{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return RegistryManifest{}, fmt.Errorf("cannot get manifest of %s, registry answered %d", image.WithTag(ref), resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4 << 20))
+	if err != nil {
+		return RegistryManifest{}, err
+	}
+
+	if manifest.Digest == "" {
+		manifest.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	}
+
+	var content struct {
+		MediaType string `json:"mediaType"`
+		Manifests []struct {
+			Digest string `json:"digest"`
+			Platform struct {
+				OS string `json:"os"`
+				Architecture string `json:"architecture"`
+				Variant string `json:"variant"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &content); err != nil {
+		return RegistryManifest{}, err
+	}
+
+	if manifest.MediaType == "" {
+		manifest.MediaType = content.MediaType
+	}
+
+	if len(content.Manifests) > 0 {
+		manifest.Platforms = map[string]string{}
+		for _, platform := range content.Manifests {
+			key := manifestPlatformKey(platform.Platform.OS, platform.Platform.Architecture, platform.Platform.Variant)
+			// the attestation manifests have an unknown platform
+			if _, exists := manifest.Platforms[key]; !exists && platform.Platform.OS != "unknown" {
+				manifest.Platforms[key] = platform.Digest
+			}
+		}
+	}
+
+	return manifest, nil
+}
+
+// GetRegistryManifest returns the manifest a tag points to in its registry, cached for an hour
+func GetRegistryManifest(image string) (RegistryManifest, error) {
+	parsed, err := ParseRegistryImage(image)
+	if err != nil {
+		return RegistryManifest{}, err
+	}
+
+	key := parsed.Registry + "/" + parsed.Repository + ":" + parsed.Tag + "@" + parsed.Digest
+
+	registryCacheLock.Lock()
+	cached, ok := registryCache[key]
+	registryCacheLock.Unlock()
+
+	if ok && time.Since(cached.Date) < registryCacheDuration {
+		return cached, nil
+	}
+
+	manifest, err := fetchRegistryManifest(parsed)
+	if err != nil {
+		return RegistryManifest{}, err
+	}
+
+	registryCacheLock.Lock()
+	registryCache[key] = manifest
+	registryCacheLock.Unlock()
+
+	return manifest, nil
+}
+
+// CheckRegistryUpdate compares the local image of a reference with the manifest in its registry,
+// without pulling it. Locally built images, which have no repo digest, cannot be checked
+func CheckRegistryUpdate(image string) (bool, error) {
+	parsed, err := ParseRegistryImage(image)
+	if err != nil {
+		return false, err
+	}
+
+	if parsed.Digest != "" && parsed.Tag == "" {
+		// pinned to a digest, never changes
+		return false, nil
+	}
+
+	localImage, _, err := DockerClient.ImageInspectWithRaw(DockerContext, image)
+	if err != nil {
+		return false, err
+	}
+
+	localDigests := map[string]bool{}
+	for _, repoDigest := range localImage.RepoDigests {
+		local, err := ParseRegistryImage(repoDigest)
+		if err == nil && local.Registry == parsed.Registry && local.Repository == parsed.Repository {
+			localDigests[local.Digest] = true
+		}
+	}
+
+	if len(localDigests) == 0 {
+		return false, errors.New("image " + image + " has no digest from its registry")
+	}
+
+	manifest, err := GetRegistryManifest(image)
+	if err != nil {
+		return false, err
+	}
+
+	if localDigests[manifest.Digest] {
+		return false, nil
+	}
+
+	// the image was pulled for its platform only, compare with the manifest of that platform
+	if manifest.Platforms != nil {
+		platform := manifestPlatformKey(localImage.Os, localImage.Architecture, localImage.Variant)
+		if digest, ok := manifest.Platforms[platform]; ok && localDigests[digest] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
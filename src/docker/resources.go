@@ -0,0 +1,279 @@
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	conttype "github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+)
+
+// ComposeValue is a compose value which can be written either as a string or as a number,
+// like mem_limit: 512m / mem_limit: 536870912 or cpus: "0.5" / cpus: 0.5
+type ComposeValue string
+
+func (v *ComposeValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = ComposeValue(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("invalid value %s, expected a string or a number", string(data))
+	}
+
+	*v = ComposeValue(n.String())
+	return nil
+}
+
+// ContainerCreateRequestUlimit is a ulimit, written either as a single number
+// (nproc: 65535) or with a soft and hard value (nofile: {soft: 20000, hard: 40000})
+type ContainerCreateRequestUlimit struct {
+	Soft int64 `json:"soft"`
+	Hard int64 `json:"hard"`
+}
+
+func (u *ContainerCreateRequestUlimit) UnmarshalJSON(data []byte) error {
+	var single int64
+	if err := json.Unmarshal(data, &single); err == nil {
+		u.Soft = single
+		u.Hard = single
+		return nil
+	}
+
+	type ulimit ContainerCreateRequestUlimit
+	var full ulimit
+	if err := json.Unmarshal(data, &full); err != nil {
+		return fmt.Errorf("invalid ulimit %s", string(data))
+	}
+
+	*u = ContainerCreateRequestUlimit(full)
+	return nil
+}
+
+type ContainerCreateRequestResources struct {
+	CPUs ComposeValue `json:"cpus,omitempty"`
+	Memory ComposeValue `json:"memory,omitempty"`
+	Pids int64 `json:"pids,omitempty"`
+}
+
+type ContainerCreateRequestDeploy struct {
+	Resources struct {
+		Limits ContainerCreateRequestResources `json:"limits,omitempty"`
+		Reservations ContainerCreateRequestResources `json:"reservations,omitempty"`
+	} `json:"resources,omitempty"`
+}
+
+type ContainerCreateRequestBlkioConfig struct {
+	Weight uint16 `json:"weight,omitempty"`
+}
+
+func parseComposeMemory(name string, value ComposeValue) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	bytes, err := units.RAMInBytes(string(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %s: %v", name, value, err)
+	}
+
+	return bytes, nil
+}
+
+func parseComposeCPUs(name string, value ComposeValue) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	cpus, err := strconv.ParseFloat(string(value), 64)
+	if err != nil || cpus < 0 {
+		return 0, fmt.Errorf("invalid %s %s", name, value)
+	}
+
+	return int64(cpus * 1e9), nil
+}
+
+// parseComposeMemorySwap reads memswap_limit, -1 for an unlimited swap. Without it, 0 lets Docker use
+// twice the memory limit
+func parseComposeMemorySwap(value ComposeValue, memory int64) (int64, error) {
+	if value == "-1" {
+		return -1, nil
+	}
+
+	memorySwap, err := parseComposeMemory("memswap_limit", value)
+	if err != nil || memorySwap == 0 {
+		return 0, err
+	}
+
+	if memory == 0 {
+		return 0, errors.New("memswap_limit needs a mem_limit")
+	}
+	if memorySwap < memory {
+		return 0, errors.New("memswap_limit cannot be lower than mem_limit")
+	}
+
+	return memorySwap, nil
+}
+
+func formatComposeCPUs(nanoCPUs int64) ComposeValue {
+	return ComposeValue(strconv.FormatFloat(float64(nanoCPUs) / 1e9, 'f', -1, 64))
+}
+
+// formatComposeMemory writes a size in bytes the way compose files do, using the largest exact unit
+func formatComposeMemory(bytes int64) ComposeValue {
+	for _, unit := range []struct{ suffix string; size int64 }{
+		{"g", units.GiB},
+		{"m", units.MiB},
+		{"k", units.KiB},
+	} {
+		if bytes % unit.size == 0 {
+			return ComposeValue(strconv.FormatInt(bytes / unit.size, 10) + unit.suffix)
+		}
+	}
+
+	return ComposeValue(strconv.FormatInt(bytes, 10))
+}
+
+// ApplyContainerResources sets the limits and reservations of a service on its host config.
+// The top level fields (mem_limit, cpus...) take precedence over deploy.resources
+func ApplyContainerResources(container ContainerCreateRequestContainer, hostConfig *conttype.HostConfig) error {
+	limits := container.Deploy.Resources.Limits
+	reservations := container.Deploy.Resources.Reservations
+
+	memLimit := container.MemLimit
+	if memLimit == "" {
+		memLimit = limits.Memory
+	}
+	memory, err := parseComposeMemory("mem_limit", memLimit)
+	if err != nil {
+		return err
+	}
+
+	memReservation := container.MemReservation
+	if memReservation == "" {
+		memReservation = reservations.Memory
+	}
+	memoryReservation, err := parseComposeMemory("mem_reservation", memReservation)
+	if err != nil {
+		return err
+	}
+
+	if memory > 0 && memoryReservation > memory {
+		return errors.New("mem_reservation cannot be greater than mem_limit")
+	}
+
+	memorySwap, err := parseComposeMemorySwap(container.MemswapLimit, memory)
+	if err != nil {
+		return err
+	}
+
+	cpus := container.CPUs
+	if cpus == "" {
+		cpus = limits.CPUs
+	}
+	nanoCPUs, err := parseComposeCPUs("cpus", cpus)
+	if err != nil {
+		return err
+	}
+
+	shmSize, err := parseComposeMemory("shm_size", container.ShmSize)
+	if err != nil {
+		return err
+	}
+
+	hostConfig.Resources.Memory = memory
+	hostConfig.Resources.MemoryReservation = memoryReservation
+	// always set, a recreated container keeping the swap of its old limit would be refused
+	hostConfig.Resources.MemorySwap = memorySwap
+	hostConfig.Resources.NanoCPUs = nanoCPUs
+	hostConfig.Resources.CPUShares = container.CPUShares
+	hostConfig.Resources.BlkioWeight = container.BlkioConfig.Weight
+	hostConfig.ShmSize = shmSize
+
+	pidsLimit := container.PidsLimit
+	if pidsLimit == 0 {
+		pidsLimit = limits.Pids
+	}
+	if pidsLimit != 0 {
+		hostConfig.Resources.PidsLimit = &pidsLimit
+	} else {
+		hostConfig.Resources.PidsLimit = nil
+	}
+
+	hostConfig.Resources.Ulimits = ulimitsToDocker(container.Ulimits)
+
+	return nil
+}
+
+func ulimitsToDocker(ulimits map[string]ContainerCreateRequestUlimit) []*units.Ulimit {
+	if len(ulimits) == 0 {
+		return nil
+	}
+
+	names := []string{}
+	for name := range ulimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := []*units.Ulimit{}
+	for _, name := range names {
+		result = append(result, &units.Ulimit{
+			Name: strings.TrimSpace(name),
+			Soft: ulimits[name].Soft,
+			Hard: ulimits[name].Hard,
+		})
+	}
+
+	return result
+}
+
+// ExportContainerResources reads the limits and reservations of a container back into a service
+func ExportContainerResources(hostConfig *conttype.HostConfig, service *ContainerCreateRequestContainer) {
+	if hostConfig == nil {
+		return
+	}
+
+	if hostConfig.Resources.Memory > 0 {
+		service.MemLimit = formatComposeMemory(hostConfig.Resources.Memory)
+	}
+	// the default swap is twice the memory limit, only a custom one is kept
+	if hostConfig.Resources.MemorySwap == -1 {
+		service.MemswapLimit = "-1"
+	} else if hostConfig.Resources.MemorySwap > 0 && hostConfig.Resources.MemorySwap != 2 * hostConfig.Resources.Memory {
+		service.MemswapLimit = formatComposeMemory(hostConfig.Resources.MemorySwap)
+	}
+	if hostConfig.Resources.MemoryReservation > 0 {
+		service.MemReservation = formatComposeMemory(hostConfig.Resources.MemoryReservation)
+	}
+	if hostConfig.Resources.NanoCPUs > 0 {
+		service.CPUs = formatComposeCPUs(hostConfig.Resources.NanoCPUs)
+	}
+	service.CPUShares = hostConfig.Resources.CPUShares
+	if hostConfig.Resources.PidsLimit != nil && *hostConfig.Resources.PidsLimit > 0 {
+		service.PidsLimit = *hostConfig.Resources.PidsLimit
+	}
+	service.BlkioConfig.Weight = hostConfig.Resources.BlkioWeight
+
+	// 64m is the default size of /dev/shm, no need to export it
+	if hostConfig.ShmSize > 0 && hostConfig.ShmSize != 64 * units.MiB {
+		service.ShmSize = formatComposeMemory(hostConfig.ShmSize)
+	}
+
+	if len(hostConfig.Resources.Ulimits) > 0 {
+		service.Ulimits = map[string]ContainerCreateRequestUlimit{}
+		for _, ulimit := range hostConfig.Resources.Ulimits {
+			service.Ulimits[ulimit.Name] = ContainerCreateRequestUlimit{
+				Soft: ulimit.Soft,
+				Hard: ulimit.Hard,
+			}
+		}
+	}
+}
@@ -0,0 +1,513 @@
+package docker
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	imagetype "github.com/docker/docker/api/types/image"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// ImageHistoryEntry is an image a container used before an update or a rollback.
+// The image is kept locally with a cosmos-rollback tag so the container can go back to it
+type ImageHistoryEntry struct {
+	Id primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Container string `json:"container" bson:"container"`
+	Image string `json:"image" bson:"image"`
+	ImageID string `json:"imageId" bson:"imageId"`
+	RepoDigests []string `json:"repoDigests" bson:"repoDigests"`
+	RollbackTag string `json:"rollbackTag" bson:"rollbackTag"`
+	Reason string `json:"reason" bson:"reason"`
+	Date time.Time `json:"date" bson:"date"`
+	// the image failed the health check after an update and should not be installed again automatically
+	Failed bool `json:"failed" bson:"failed"`
+}
+
+const maxImageHistory = 5
+const defaultUpdateHealthTimeout = 120 * time.Second
+const defaultUpdateGracePeriod = 30 * time.Second
+
+var rollbackTagRegex = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+func rollbackTag(containerName string, imageID string) string {
+	name := rollbackTagRegex.ReplaceAllString(strings.ToLower(strings.TrimPrefix(containerName, "/")), "-")
+	id := strings.TrimPrefix(imageID, "sha256:")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return "cosmos-rollback:" + name + "-" + id
+}
+
+// RememberContainerImage keeps the image currently used by a container in its history, before it gets replaced
+func RememberContainerImage(container types.ContainerJSON, reason string) error {
+	containerName := strings.TrimPrefix(container.Name, "/")
+	tag := rollbackTag(containerName, container.Image)
+
+	err := DockerClient.ImageTag(DockerContext, container.Image, tag)
+	if err != nil {
+		return err
+	}
+
+	entry := ImageHistoryEntry{
+		Container: containerName,
+		Image: container.Config.Image,
+		ImageID: container.Image,
+		RollbackTag: tag,
+		Reason: reason,
+		Date: time.Now(),
+	}
+
+	if image, _, err := DockerClient.ImageInspectWithRaw(DockerContext, container.Image); err == nil {
+		entry.RepoDigests = image.RepoDigests
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "images")
+	if errCo != nil {
+		return errCo
+	}
+
+	if _, err := c.InsertOne(context.Background(), entry); err != nil {
+		return err
+	}
+
+	pruneImageHistory(containerName)
+	return nil
+}
+
+// pruneImageHistory only keeps the last images of a container, and untags the older ones
+func pruneImageHistory(containerName string) {
+	history, err := GetImageHistory(containerName)
+	if err != nil || len(history) <= maxImageHistory {
+		return
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "images")
+	if errCo != nil {
+		return
+	}
+
+	for _, entry := range history[maxImageHistory:] {
+		// the failed images are kept so they are not installed again
+		if entry.Failed {
+			continue
+		}
+
+		DockerClient.ImageRemove(DockerContext, entry.RollbackTag, imagetype.RemoveOptions{})
+		c.DeleteOne(context.Background(), bson.M{"_id": entry.Id})
+	}
+}
+
+// GetImageHistory returns the images previously used by a container, most recent first
+func GetImageHistory(containerName string) ([]ImageHistoryEntry, error) {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "images")
+	if errCo != nil {
+		return nil, errCo
+	}
+
+	cursor, err := c.Find(context.Background(), bson.M{"container": strings.TrimPrefix(containerName, "/")}, options.Find().SetSort(bson.D{{Key: "date", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	history := []ImageHistoryEntry{}
+	if err := cursor.All(context.Background(), &history); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// MarkImageFailed flags an image which failed the health check of a container
+func MarkImageFailed(container types.ContainerJSON) {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "images")
+	if errCo != nil {
+		utils.Error("MarkImageFailed", errCo)
+		return
+	}
+
+	containerName := strings.TrimPrefix(container.Name, "/")
+	_, err := c.UpdateOne(context.Background(),
+		bson.M{"container": containerName, "imageId": container.Image},
+		bson.M{"$set": bson.M{
+			"failed": true,
+			"image": container.Config.Image,
+			"reason": "failed-update",
+			"date": time.Now(),
+			"rollbackTag": rollbackTag(containerName, container.Image),
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		utils.Error("MarkImageFailed", err)
+	}
+}
+
+// IsImageFailed checks if an image already failed the health check of a container after an update
+func IsImageFailed(containerName string, imageID string) bool {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "images")
+	if errCo != nil {
+		return false
+	}
+
+	count, err := c.CountDocuments(context.Background(), bson.M{
+		"container": strings.TrimPrefix(containerName, "/"),
+		"imageId": imageID,
+		"failed": true,
+	})
+
+	return err == nil && count > 0
+}
+
+// probeContainerRoutes sends a request to the routes of a container, which are expected to answer without a server error
+func probeContainerRoutes(containerName string, path string) error {
+	routes := utils.GetMainConfig().HTTPConfig.ProxyConfig.Routes
+	probed := 0
+
+	for _, route := range routes {
+		if route.Disabled || route.Mode != "SERVAPP" {
+			continue
+		}
+
+		target, err := url.Parse(route.Target)
+		if err != nil || target.Hostname() != containerName {
+			continue
+		}
+
+		client := &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: route.AcceptInsecureHTTPSTarget},
+			},
+		}
+
+		resp, err := client.Get(strings.TrimSuffix(route.Target, "/") + path)
+		if err != nil {
+			return fmt.Errorf("probe of route %s failed: %v", route.Name, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("probe of route %s failed with status %d", route.Name, resp.StatusCode)
+		}
+
+		probed++
+	}
+
+	if probed == 0 {
+		return errors.New("no route to probe")
+	}
+
+	return nil
+}
+
+// WaitContainerHealthy waits for a container to pass its healthcheck, and its HTTP probe if the
+// cosmos-update-probe label is set (to true or to the path to request on its routes).
+// Containers without either have to keep running for a grace period
+func WaitContainerHealthy(containerName string) error {
+	container, err := DockerClient.ContainerInspect(DockerContext, containerName)
+	if err != nil {
+		return err
+	}
+
+	timeout := defaultUpdateHealthTimeout
+	if seconds, err := strconv.Atoi(container.Config.Labels["cosmos-update-timeout"]); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	grace := defaultUpdateGracePeriod
+	if grace > timeout {
+		grace = timeout
+	}
+
+	probe := container.Config.Labels["cosmos-update-probe"]
+	probePath := ""
+	if strings.HasPrefix(probe, "/") {
+		probePath = probe
+	}
+	hasProbe := probe != "" && probe != "false"
+
+	started := time.Now()
+	restartCount := container.RestartCount
+	var lastErr error
+
+	for time.Since(started) < timeout {
+		time.Sleep(5 * time.Second)
+
+		container, err = DockerClient.ContainerInspect(DockerContext, containerName)
+		if err != nil {
+			return err
+		}
+
+		if !container.State.Running || container.State.Restarting || container.RestartCount > restartCount {
+			return fmt.Errorf("container stopped with exit code %d", container.State.ExitCode)
+		}
+
+		healthy := true
+		if container.State.Health != nil {
+			switch container.State.Health.Status {
+			case "unhealthy":
+				return errors.New("container is unhealthy")
+			case "healthy":
+				healthy = true
+			default:
+				healthy = false
+			}
+		}
+
+		if !healthy {
+			continue
+		}
+
+		if hasProbe {
+			lastErr = probeContainerRoutes(strings.TrimPrefix(container.Name, "/"), probePath)
+			if lastErr == nil {
+				return nil
+			}
+		} else if container.State.Health != nil || time.Since(started) >= grace {
+			return nil
+		}
+	}
+
+	if lastErr != nil {
+		return fmt.Errorf("container did not become healthy in %s: %v", timeout, lastErr)
+	}
+	return fmt.Errorf("container did not become healthy in %s", timeout)
+}
+
+// RollbackContainer recreates a container with a previous image. The image reference (the current one
+// if imageRef is empty) is tagged back to that image, so the container keeps its configuration
+func RollbackContainer(containerName string, imageID string, imageRef string) error {
+	container, err := DockerClient.ContainerInspect(DockerContext, containerName)
+	if err != nil {
+		return err
+	}
+
+	if imageRef == "" {
+		imageRef = container.Config.Image
+	}
+
+	if strings.Contains(imageRef, "@") {
+		return errors.New("image " + imageRef + " is pinned by digest and cannot be rolled back")
+	}
+
+	if _, _, err := DockerClient.ImageInspectWithRaw(DockerContext, imageID); err != nil {
+		return errors.New("image " + imageID + " is not available anymore")
+	}
+
+	if container.Image != imageID && !IsImageFailed(containerName, container.Image) {
+		if err := RememberContainerImage(container, "rollback"); err != nil {
+			utils.Error("RollbackContainer: cannot keep current image in history", err)
+		}
+	}
+
+	err = DockerClient.ImageTag(DockerContext, imageID, imageRef)
+	if err != nil {
+		return err
+	}
+	container.Config.Image = imageRef
+
+	_, err = RecreateContainer(container.Name, container)
+	if err != nil {
+		return err
+	}
+
+	utils.TriggerEvent(
+		"cosmos.docker.container.rollback",
+		"Cosmos Container Rollback",
+		"warning",
+		"container@" + strings.TrimPrefix(container.Name, "/"),
+		map[string]interface{}{
+			"container": strings.TrimPrefix(container.Name, "/"),
+			"image": container.Config.Image,
+			"imageId": imageID,
+	})
+
+	return nil
+}
+
+// SafeUpdateContainer recreates a container with its newly pulled image (or newImage if set), waits
+// for it to be healthy and rolls back to the previous image if it isn't
+func SafeUpdateContainer(container types.ContainerJSON, newImage string) error {
+	containerName := strings.TrimPrefix(container.Name, "/")
+	previousRef := container.Config.Image
+
+	// Cosmos updates itself through the self updater
+	if utils.IsInsideContainer && containerName == os.Getenv("HOSTNAME") {
+		_, err := RecreateContainer(container.Name, container)
+		return err
+	}
+
+	previousImage := container.Image
+
+	errH := RememberContainerImage(container, "update")
+
+	if newImage != "" {
+		container.Config.Image = newImage
+	}
+
+	if errH != nil {
+		utils.Error("SafeUpdateContainer: cannot keep previous image of " + containerName + ", updating without rollback", errH)
+		_, err := RecreateContainer(container.Name, container)
+		return err
+	}
+
+	_, err := RecreateContainer(container.Name, container)
+	if err == nil {
+		err = WaitContainerHealthy(containerName)
+		if err == nil {
+			return nil
+		}
+	}
+
+	utils.MajorError("Container " + containerName + " failed after update, rolling back", err)
+
+	if updated, errI := DockerClient.ContainerInspect(DockerContext, containerName); errI == nil {
+		MarkImageFailed(updated)
+	}
+
+	errR := RollbackContainer(containerName, previousImage, previousRef)
+	if errR != nil {
+		utils.MajorError("Container " + containerName + " failed to roll back", errR)
+		return errR
+	}
+
+	utils.WriteNotification(utils.Notification{
+		Recipient: "admin",
+		Title: "header.notification.title.containerRollback",
+		Message: "header.notification.message.containerRollback",
+		Vars: containerName,
+		Level: "error",
+		Link: "/cosmos-ui/servapps/containers/" + containerName,
+	})
+
+	return fmt.Errorf("update failed and was rolled back: %v", err)
+}
+
+func ImageHistoryRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		containerName := utils.SanitizeSafe(mux.Vars(req)["containerId"])
+
+		history, err := GetImageHistory(containerName)
+		if err != nil {
+			utils.Error("ImageHistory", err)
+			utils.HTTPError(w, "Internal server error: " + err.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": history,
+		})
+	} else {
+		utils.Error("ImageHistory: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+type RollbackContainerRequestJSON struct {
+	// image to go back to, defaults to the last image of the history which didn't fail
+	ImageID string `json:"imageId"`
+}
+
+func RollbackContainerRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("RollbackContainer", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		containerName := utils.SanitizeSafe(mux.Vars(req)["containerId"])
+
+		if utils.IsInsideContainer && containerName == os.Getenv("HOSTNAME") {
+			utils.Error("RollbackContainer - Container cannot roll itself back", nil)
+			utils.HTTPError(w, "Container cannot roll itself back", http.StatusBadRequest, "DS003")
+			return
+		}
+
+		var request RollbackContainerRequestJSON
+		json.NewDecoder(req.Body).Decode(&request)
+
+		history, err := GetImageHistory(containerName)
+		if err != nil {
+			utils.Error("RollbackContainer", err)
+			utils.HTTPError(w, "Internal server error: " + err.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		// go back to the reference the image was used with
+		imageRef := ""
+		for _, entry := range history {
+			if entry.ImageID == request.ImageID {
+				imageRef = entry.Image
+				break
+			}
+		}
+
+		if request.ImageID == "" {
+			current, err := DockerClient.ContainerInspect(DockerContext, containerName)
+			if err != nil {
+				utils.Error("RollbackContainer", err)
+				utils.HTTPError(w, "Container not found: " + err.Error(), http.StatusNotFound, "DS005")
+				return
+			}
+
+			for _, entry := range history {
+				if !entry.Failed && entry.ImageID != current.Image {
+					request.ImageID = entry.ImageID
+					imageRef = entry.Image
+					break
+				}
+			}
+
+			if request.ImageID == "" {
+				utils.HTTPError(w, "No previous image to roll back to", http.StatusNotFound, "DS005")
+				return
+			}
+		}
+
+		utils.Log("RollbackContainer: rolling back " + containerName + " to " + request.ImageID)
+
+		err = RollbackContainer(containerName, request.ImageID, imageRef)
+		if err != nil {
+			utils.Error("RollbackContainer", err)
+			utils.HTTPError(w, "Rollback failed: " + err.Error(), http.StatusInternalServerError, "DS004")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("RollbackContainer: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,762 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// ImagePackage is a package installed in an image. Source is the source package the advisories refer to
+type ImagePackage struct {
+	Name string `json:"name" bson:"name"`
+	Version string `json:"version" bson:"version"`
+	Source string `json:"source" bson:"source"`
+	SourceVersion string `json:"sourceVersion" bson:"sourceVersion"`
+}
+
+type ImageVulnerability struct {
+	ID string `json:"id" bson:"id"`
+	Aliases []string `json:"aliases" bson:"aliases"`
+	Package string `json:"package" bson:"package"`
+	Version string `json:"version" bson:"version"`
+	FixedVersion string `json:"fixedVersion" bson:"fixedVersion"`
+	Severity string `json:"severity" bson:"severity"`
+	Summary string `json:"summary" bson:"summary"`
+}
+
+// ImageScanResult is the last scan of the image of a container
+type ImageScanResult struct {
+	Container string `json:"container" bson:"container"`
+	Image string `json:"image" bson:"image"`
+	ImageID string `json:"imageId" bson:"imageId"`
+	Ecosystem string `json:"ecosystem" bson:"ecosystem"`
+	Packages int `json:"packages" bson:"packages"`
+	Vulnerabilities []ImageVulnerability `json:"vulnerabilities,omitempty" bson:"vulnerabilities"`
+	Counts map[string]int `json:"counts" bson:"counts"`
+	Date time.Time `json:"date" bson:"date"`
+	Error string `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// files read from the images to list their packages
+var inventoryFiles = map[string]bool{
+	"etc/os-release": true,
+	"usr/lib/os-release": true,
+	"var/lib/dpkg/status": true,
+	"lib/apk/db/installed": true,
+}
+
+func isInventoryFile(name string) bool {
+	// distroless images have one file per package
+	return inventoryFiles[name] || strings.HasPrefix(name, "var/lib/dpkg/status.d/")
+}
+
+type layerInventory struct {
+	files map[string][]byte
+	whiteouts []string
+	opaqueDirs []string
+}
+
+func readLayerInventory(r io.Reader) (layerInventory, error) {
+	inventory := layerInventory{
+		files: map[string][]byte{},
+	}
+
+	buffered := bufio.NewReader(r)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return inventory, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = buffered
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return inventory, err
+		}
+
+		name := strings.TrimPrefix(path.Clean("/" + header.Name), "/")
+		dir, base := path.Split(name)
+
+		if base == ".wh..wh..opq" {
+			inventory.opaqueDirs = append(inventory.opaqueDirs, dir)
+		} else if strings.HasPrefix(base, ".wh.") {
+			inventory.whiteouts = append(inventory.whiteouts, dir + strings.TrimPrefix(base, ".wh."))
+		} else if isInventoryFile(name) && header.Typeflag == tar.TypeReg {
+			data, err := io.ReadAll(io.LimitReader(tr, 64 << 20))
+			if err != nil {
+				return inventory, err
+			}
+			inventory.files[name] = data
+		}
+	}
+
+	return inventory, nil
+}
+
+// readImageInventory exports an image and reads its package databases, applying the layers in order
+func readImageInventory(imageID string) (map[string][]byte, error) {
+	out, err := DockerClient.ImageSave(DockerContext, []string{imageID})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	// the manifest can come after the layers in the archive, so it is read in two passes
+	tmp, err := os.CreateTemp("", "cosmos-scan-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, out); err != nil {
+		return nil, err
+	}
+
+	var manifest []struct {
+		Layers []string `json:"Layers"`
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(tmp)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == "manifest.json" {
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	if len(manifest) == 0 {
+		return nil, errors.New("no manifest in the export of image " + imageID)
+	}
+
+	layers := map[string]layerInventory{}
+	wanted := map[string]bool{}
+	for _, layer := range manifest[0].Layers {
+		wanted[layer] = true
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	tr = tar.NewReader(tmp)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if wanted[header.Name] {
+			inventory, err := readLayerInventory(tr)
+			if err != nil {
+				return nil, err
+			}
+			layers[header.Name] = inventory
+		}
+	}
+
+	files := map[string][]byte{}
+	for _, layer := range manifest[0].Layers {
+		inventory := layers[layer]
+
+		for _, dir := range inventory.opaqueDirs {
+			for name := range files {
+				if strings.HasPrefix(name, dir) {
+					delete(files, name)
+				}
+			}
+		}
+		for _, removed := range inventory.whiteouts {
+			for name := range files {
+				if name == removed || strings.HasPrefix(name, removed + "/") {
+					delete(files, name)
+				}
+			}
+		}
+		for name, data := range inventory.files {
+			files[name] = data
+		}
+	}
+
+	return files, nil
+}
+
+func parseOSRelease(data []byte) map[string]string {
+	values := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) == 2 {
+			values[kv[0]] = strings.Trim(kv[1], `"'`)
+		}
+	}
+	return values
+}
+
+// imageEcosystem returns the OSV ecosystem of the distribution of an image, like Debian:12 or Alpine:v3.19
+func imageEcosystem(files map[string][]byte) (string, error) {
+	data, ok := files["etc/os-release"]
+	if !ok {
+		data, ok = files["usr/lib/os-release"]
+	}
+	if !ok {
+		return "", errors.New("unknown distribution, no os-release file")
+	}
+
+	release := parseOSRelease(data)
+	version := release["VERSION_ID"]
+
+	switch release["ID"] {
+	case "debian":
+		if version == "" {
+			return "", errors.New("Debian testing and unstable are not supported")
+		}
+		return "Debian:" + strings.Split(version, ".")[0], nil
+	case "ubuntu":
+		return "Ubuntu:" + version, nil
+	case "alpine":
+		parts := strings.Split(version, ".")
+		if len(parts) < 2 {
+			return "", errors.New("unknown Alpine version " + version)
+		}
+		return "Alpine:v" + parts[0] + "." + parts[1], nil
+	}
+
+	return "", errors.New("distribution " + release["ID"] + " is not supported")
+}
+
+func parseDpkgStatus(data []byte) []ImagePackage {
+	packages := []ImagePackage{}
+
+	for _, stanza := range strings.Split(string(data), "\n\n") {
+		fields := map[string]string{}
+		for _, line := range strings.Split(stanza, "\n") {
+			if line == "" || line[0] == ' ' || line[0] == '\t' {
+				continue
+			}
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) == 2 {
+				fields[kv[0]] = strings.TrimSpace(kv[1])
+			}
+		}
+
+		if fields["Package"] == "" || fields["Version"] == "" {
+			continue
+		}
+		if status, ok := fields["Status"]; ok && !strings.HasSuffix(status, " installed") {
+			continue
+		}
+
+		pkg := ImagePackage{
+			Name: fields["Package"],
+			Version: fields["Version"],
+			Source: fields["Package"],
+			SourceVersion: fields["Version"],
+		}
+
+		// Source: name (version), the version being there only if it differs from the binary one
+		if source := fields["Source"]; source != "" {
+			parts := strings.SplitN(source, " ", 2)
+			pkg.Source = parts[0]
+			if len(parts) == 2 {
+				pkg.SourceVersion = strings.Trim(parts[1], "() ")
+			}
+		}
+
+		packages = append(packages, pkg)
+	}
+
+	return packages
+}
+
+func parseApkInstalled(data []byte) []ImagePackage {
+	packages := []ImagePackage{}
+
+	for _, stanza := range strings.Split(string(data), "\n\n") {
+		pkg := ImagePackage{}
+		for _, line := range strings.Split(stanza, "\n") {
+			if len(line) < 2 || line[1] != ':' {
+				continue
+			}
+			switch line[0] {
+			case 'P':
+				pkg.Name = line[2:]
+			case 'V':
+				pkg.Version = line[2:]
+			case 'o':
+				pkg.Source = line[2:]
+			}
+		}
+
+		if pkg.Name == "" || pkg.Version == "" {
+			continue
+		}
+		if pkg.Source == "" {
+			pkg.Source = pkg.Name
+		}
+		pkg.SourceVersion = pkg.Version
+
+		packages = append(packages, pkg)
+	}
+
+	return packages
+}
+
+// ListImagePackages returns the distribution and the packages installed in an image
+func ListImagePackages(imageID string) (string, []ImagePackage, error) {
+	files, err := readImageInventory(imageID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ecosystem, err := imageEcosystem(files)
+	if err != nil {
+		return "", nil, err
+	}
+
+	packages := []ImagePackage{}
+	for name, data := range files {
+		switch {
+		case name == "var/lib/dpkg/status" || strings.HasPrefix(name, "var/lib/dpkg/status.d/"):
+			packages = append(packages, parseDpkgStatus(data)...)
+		case name == "lib/apk/db/installed":
+			packages = append(packages, parseApkInstalled(data)...)
+		}
+	}
+
+	return ecosystem, packages, nil
+}
+
+// ScanImage lists the packages of an image and matches them with the vulnerability database
+func ScanImage(imageID string) ImageScanResult {
+	result := ImageScanResult{
+		ImageID: imageID,
+		Vulnerabilities: []ImageVulnerability{},
+		Counts: map[string]int{},
+		Date: time.Now(),
+	}
+
+	ecosystem, packages, err := ListImagePackages(imageID)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Ecosystem = ecosystem
+	result.Packages = len(packages)
+
+	vulnerabilities, err := FindVulnerabilities(ecosystem, packages)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Vulnerabilities = vulnerabilities
+	for _, vulnerability := range vulnerabilities {
+		result.Counts[vulnerability.Severity]++
+	}
+
+	return result
+}
+
+var vulnerabilityCounts map[string]map[string]int
+var vulnerabilityCountsLock sync.Mutex
+var scanLock sync.Mutex
+
+// GetVulnerabilityCounts returns the number of vulnerabilities of each container by severity, for the metrics
+func GetVulnerabilityCounts() map[string]map[string]int {
+	vulnerabilityCountsLock.Lock()
+	defer vulnerabilityCountsLock.Unlock()
+
+	if vulnerabilityCounts == nil {
+		vulnerabilityCounts = map[string]map[string]int{}
+
+		results, err := GetScanResults()
+		if err != nil {
+			utils.Error("GetVulnerabilityCounts", err)
+			return vulnerabilityCounts
+		}
+
+		for _, result := range results {
+			if result.Error == "" {
+				vulnerabilityCounts[result.Container] = result.Counts
+			}
+		}
+	}
+
+	counts := map[string]map[string]int{}
+	for container, byseverity := range vulnerabilityCounts {
+		counts[container] = byseverity
+	}
+	return counts
+}
+
+// saveScanResult stores the scan of a container, and alerts on the critical vulnerabilities which are new
+func saveScanResult(result ImageScanResult) error {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "scans")
+	if errCo != nil {
+		return errCo
+	}
+
+	var previous ImageScanResult
+	err := c.FindOne(context.Background(), bson.M{"container": result.Container}).Decode(&previous)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	// a failed scan keeps the vulnerabilities of the last successful one, so the next scan
+	// does not alert again on those already known
+	if result.Error != "" {
+		_, err = c.UpdateOne(context.Background(), bson.M{"container": result.Container}, bson.M{
+			"$set": bson.M{
+				"error": result.Error,
+				"date": result.Date,
+			},
+			"$setOnInsert": bson.M{
+				"image": result.Image,
+				"imageId": result.ImageID,
+			},
+		}, options.Update().SetUpsert(true))
+		return err
+	}
+
+	_, err = c.ReplaceOne(context.Background(), bson.M{"container": result.Container}, result, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	vulnerabilityCountsLock.Lock()
+	if vulnerabilityCounts != nil {
+		vulnerabilityCounts[result.Container] = result.Counts
+	}
+	vulnerabilityCountsLock.Unlock()
+
+	known := map[string]bool{}
+	for _, vulnerability := range previous.Vulnerabilities {
+		known[vulnerability.ID + "/" + vulnerability.Package] = true
+	}
+
+	newCritical := []string{}
+	for _, vulnerability := range result.Vulnerabilities {
+		if vulnerability.Severity == "CRITICAL" && !known[vulnerability.ID + "/" + vulnerability.Package] {
+			newCritical = append(newCritical, vulnerability.ID + " (" + vulnerability.Package + ")")
+		}
+	}
+
+	if len(newCritical) > 0 {
+		utils.TriggerEvent(
+			"cosmos.docker.vulnerability.critical",
+			"New critical vulnerabilities in " + result.Container,
+			"warning",
+			"container@" + result.Container,
+			map[string]interface{}{
+				"container": result.Container,
+				"image": result.Image,
+				"vulnerabilities": newCritical,
+		})
+
+		utils.WriteNotification(utils.Notification{
+			Recipient: "admin",
+			Title: "header.notification.title.criticalVulnerabilities",
+			Message: "header.notification.message.criticalVulnerabilities",
+			Vars: result.Container,
+			Level: "warn",
+			Link: "/cosmos-ui/servapps/containers/" + result.Container,
+		})
+	}
+
+	return nil
+}
+
+// ScanContainer scans the image of a container and stores the result
+func ScanContainer(containerName string) (ImageScanResult, error) {
+	container, err := DockerClient.ContainerInspect(DockerContext, containerName)
+	if err != nil {
+		return ImageScanResult{}, err
+	}
+
+	result := ScanImage(container.Image)
+	result.Container = strings.TrimPrefix(container.Name, "/")
+	result.Image = container.Config.Image
+
+	return result, saveScanResult(result)
+}
+
+// ScanAllContainers scans the images of all the containers, each image being scanned once
+func ScanAllContainers() {
+	if !scanLock.TryLock() {
+		utils.Warn("ScanAllContainers - a scan is already running")
+		return
+	}
+	defer scanLock.Unlock()
+
+	status, err := GetVulnerabilityDBStatus()
+	if err != nil {
+		utils.Error("ScanAllContainers", err)
+		return
+	}
+	if status.Entries == 0 {
+		utils.Log("ScanAllContainers - the vulnerability database is empty, import one to scan the containers")
+		return
+	}
+
+	containers, err := ListContainers()
+	if err != nil {
+		utils.Error("ScanAllContainers", err)
+		return
+	}
+
+	scanned := map[string]ImageScanResult{}
+
+	for _, container := range containers {
+		result, ok := scanned[container.ImageID]
+		if !ok {
+			utils.Log("ScanAllContainers - scanning " + container.Image)
+			result = ScanImage(container.ImageID)
+			scanned[container.ImageID] = result
+		}
+
+		result.Container = strings.TrimPrefix(container.Names[0], "/")
+		result.Image = container.Image
+
+		if result.Error != "" {
+			utils.Warn("ScanAllContainers - cannot scan " + result.Container + ": " + result.Error)
+		}
+
+		if err := saveScanResult(result); err != nil {
+			utils.Error("ScanAllContainers - save " + result.Container, err)
+		}
+	}
+
+	utils.Log("ScanAllContainers - scanned " + strconv.Itoa(len(scanned)) + " images")
+}
+
+// GetScanResults returns the last scan of each container, without the list of vulnerabilities
+func GetScanResults() ([]ImageScanResult, error) {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "scans")
+	if errCo != nil {
+		return nil, errCo
+	}
+
+	cursor, err := c.Find(context.Background(), bson.M{}, options.Find().
+		SetSort(bson.M{"container": 1}).
+		SetProjection(bson.M{"vulnerabilities": 0}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	results := []ImageScanResult{}
+	err = cursor.All(context.Background(), &results)
+	return results, err
+}
+
+func VulnerabilitiesRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		results, err := GetScanResults()
+		if err != nil {
+			utils.Error("Vulnerabilities", err)
+			utils.HTTPError(w, "Database error", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": results,
+		})
+	} else {
+		utils.Error("Vulnerabilities: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// ScanAllContainersRoute starts a scan of all the containers in the background
+func ScanAllContainersRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("ScanAllContainers", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		go ScanAllContainers()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("ScanAllContainers: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// VulnerabilityDBRoute returns the state of the vulnerability database (GET), or imports OSV files in it (POST)
+func VulnerabilityDBRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		status, err := GetVulnerabilityDBStatus()
+		if err != nil {
+			utils.Error("VulnerabilityDB", err)
+			utils.HTTPError(w, "Database error", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": status,
+		})
+	} else if req.Method == "POST" {
+		tmp, err := os.CreateTemp("", "cosmos-vulndb-*")
+		if err != nil {
+			utils.Error("VulnerabilityDB", err)
+			utils.HTTPError(w, "Internal server error: " + err.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		body := io.Reader(req.Body)
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+			file, _, err := req.FormFile("file")
+			if err != nil {
+				utils.Error("VulnerabilityDB", err)
+				utils.HTTPError(w, "Missing file", http.StatusBadRequest, "DS003")
+				return
+			}
+			defer file.Close()
+			body = file
+		}
+
+		if _, err := io.Copy(tmp, body); err != nil {
+			utils.Error("VulnerabilityDB", err)
+			utils.HTTPError(w, "Upload failed: " + err.Error(), http.StatusBadRequest, "DS003")
+			return
+		}
+
+		imported, err := ImportVulnerabilityDB(tmp)
+		if err != nil {
+			utils.Error("VulnerabilityDB: Import", err)
+			utils.HTTPError(w, "Import failed: " + err.Error(), http.StatusBadRequest, "DS003")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": imported,
+		})
+	} else {
+		utils.Error("VulnerabilityDB: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// ContainerVulnerabilitiesRoute returns the last scan of a container (GET), or scans it now (POST)
+func ContainerVulnerabilitiesRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	containerName := utils.SanitizeSafe(mux.Vars(req)["containerId"])
+
+	if req.Method == "GET" {
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "scans")
+		if errCo != nil {
+			utils.Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		var result ImageScanResult
+		err := c.FindOne(context.Background(), bson.M{"container": containerName}).Decode(&result)
+		if err == mongo.ErrNoDocuments {
+			utils.HTTPError(w, "Container was not scanned yet", http.StatusNotFound, "DS005")
+			return
+		} else if err != nil {
+			utils.Error("ContainerVulnerabilities", err)
+			utils.HTTPError(w, "Database error", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": result,
+		})
+	} else if req.Method == "POST" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("ContainerVulnerabilities", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		result, err := ScanContainer(containerName)
+		if err != nil {
+			utils.Error("ContainerVulnerabilities: Scan", err)
+			utils.HTTPError(w, "Scan failed: " + err.Error(), http.StatusInternalServerError, "DS004")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": result,
+		})
+	} else {
+		utils.Error("ContainerVulnerabilities: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,899 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	conttype "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	volumeTypes "github.com/docker/docker/api/types/volume"
+	"github.com/gorilla/mux"
+
+	"github.com/azukaar/cosmos-server/src/constellation"
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// A ServApp is migrated by the source Cosmos pushing it to the target one, authenticated with a
+// short lived token created by an admin of the target. The source ships the compose export of the
+// container and its volumes, and the target recreates it
+
+const migrationTokenHeader = "x-cosmos-migration-token"
+const migrationTokenDuration = time.Hour
+
+type migrationSession struct {
+	Expires time.Time
+	Container string
+	// volumes and bind directories announced by the check and not received yet, the only ones that can be imported
+	Volumes map[string]bool
+	Binds map[string]bool
+	// everything announced by the check, the only mounts and networks the migrated ServApp can use
+	AnnouncedVolumes map[string]bool
+	AnnouncedBinds map[string]bool
+	AnnouncedNetworks map[string]bool
+	// volumes and bind directories created here by the migration, removed if it does not complete
+	Created []mount.Mount
+}
+
+var migrationSessions = map[string]*migrationSession{}
+var migrationSessionsLock sync.Mutex
+
+type MigrationCheckRequest struct {
+	Container string `json:"container" validate:"required"`
+	Volumes []string `json:"volumes"`
+	Binds []string `json:"binds"`
+	Networks []string `json:"networks"`
+}
+
+type MigrateServAppRequest struct {
+	// Constellation device name, host, host:port or URL of the target Cosmos
+	Target string `json:"target" validate:"required"`
+	Token string `json:"token" validate:"required"`
+	RemoveSource bool `json:"removeSource"`
+}
+
+func getMigrationSession(req *http.Request) *migrationSession {
+	token := req.Header.Get(migrationTokenHeader)
+	if token == "" {
+		return nil
+	}
+
+	migrationSessionsLock.Lock()
+	defer migrationSessionsLock.Unlock()
+
+	// the expired sessions are removed by expireMigrationSession
+	for key, session := range migrationSessions {
+		if time.Now().After(session.Expires) {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+			return session
+		}
+	}
+
+	return nil
+}
+
+// MigrationTokenRoute creates a token allowing another Cosmos to migrate a ServApp to this one
+func MigrationTokenRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			utils.Error("MigrationToken", err)
+			utils.HTTPError(w, "Internal server error: " + err.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		token := hex.EncodeToString(random)
+		expires := time.Now().Add(migrationTokenDuration)
+
+		migrationSessionsLock.Lock()
+		migrationSessions[token] = &migrationSession{
+			Expires: expires,
+			Volumes: map[string]bool{},
+			Binds: map[string]bool{},
+		}
+		migrationSessionsLock.Unlock()
+
+		time.AfterFunc(migrationTokenDuration, func() {
+			expireMigrationSession(token)
+		})
+
+		utils.Log("API: Migration token created")
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": map[string]interface{}{
+				"token": token,
+				"expires": expires,
+			},
+		})
+	} else {
+		utils.Error("MigrationToken: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// MigrationCheckRoute is called by the source before shipping anything, the container and its volumes must not exist here
+func MigrationCheckRoute(w http.ResponseWriter, req *http.Request) {
+	session := getMigrationSession(req)
+	if session == nil {
+		utils.HTTPError(w, "Invalid migration token", http.StatusUnauthorized, "HTTP004")
+		return
+	}
+
+	if req.Method == "POST" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("MigrationCheck", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		var request MigrationCheckRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			utils.Error("MigrationCheck: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid JSON", http.StatusBadRequest, "DS003")
+			return
+		}
+
+		if errV := utils.Validate.Struct(request); errV != nil {
+			utils.HTTPError(w, errV.Error(), http.StatusBadRequest, "DS003")
+			return
+		}
+
+		// a new check restarts the migration, what a failed attempt received would be refused as existing
+		rollbackMigrationSession(session)
+
+		for _, network := range request.Networks {
+			if IsDefaultNetwork(network) {
+				utils.HTTPError(w, "Network " + network + " cannot be migrated", http.StatusBadRequest, "DS003")
+				return
+			}
+		}
+
+		if _, err := DockerClient.ContainerInspect(DockerContext, request.Container); err == nil {
+			utils.HTTPError(w, "Container " + request.Container + " already exists on the target", http.StatusConflict, "DS006")
+			return
+		}
+
+		for _, volume := range request.Volumes {
+			if _, err := DockerClient.VolumeInspect(DockerContext, volume); err == nil {
+				utils.HTTPError(w, "Volume " + volume + " already exists on the target", http.StatusConflict, "DS006")
+				return
+			}
+		}
+
+		if err := validateMigrationBinds(request.Binds); err != nil {
+			utils.HTTPError(w, err.Error(), http.StatusConflict, "DS006")
+			return
+		}
+
+		migrationSessionsLock.Lock()
+		session.Container = request.Container
+		session.Volumes = map[string]bool{}
+		for _, volume := range request.Volumes {
+			session.Volumes[volume] = true
+		}
+		session.Binds = map[string]bool{}
+		for _, bind := range request.Binds {
+			session.Binds[bind] = true
+		}
+		session.AnnouncedVolumes = map[string]bool{}
+		for volume := range session.Volumes {
+			session.AnnouncedVolumes[volume] = true
+		}
+		session.AnnouncedBinds = map[string]bool{}
+		for bind := range session.Binds {
+			session.AnnouncedBinds[bind] = true
+		}
+		session.AnnouncedNetworks = map[string]bool{}
+		for _, network := range request.Networks {
+			session.AnnouncedNetworks[network] = true
+		}
+		migrationSessionsLock.Unlock()
+
+		utils.Log("API: Migration check passed for " + request.Container)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("MigrationCheck: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// MigrationVolumeRoute receives the content of a volume (?volume=) or of a bind directory (?bind=) announced by the check
+func MigrationVolumeRoute(w http.ResponseWriter, req *http.Request) {
+	session := getMigrationSession(req)
+	if session == nil {
+		utils.HTTPError(w, "Invalid migration token", http.StatusUnauthorized, "HTTP004")
+		return
+	}
+
+	if req.Method == "POST" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("MigrationVolume", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		volume := req.URL.Query().Get("volume")
+		bind := req.URL.Query().Get("bind")
+
+		// each volume and bind is received once, the check having made sure it did not exist
+		migrationSessionsLock.Lock()
+		allowed := (volume != "" && session.Volumes[volume]) || (bind != "" && session.Binds[bind])
+		delete(session.Volumes, volume)
+		delete(session.Binds, bind)
+		migrationSessionsLock.Unlock()
+
+		if !allowed {
+			utils.HTTPError(w, "Volume not part of the migration", http.StatusForbidden, "DS003")
+			return
+		}
+
+		target := mount.Mount{
+			Type: mount.TypeVolume,
+			Source: volume,
+		}
+
+		if volume != "" {
+			_, err := DockerClient.VolumeCreate(DockerContext, volumeTypes.CreateOptions{
+				Name: volume,
+			})
+			if err != nil {
+				utils.Error("MigrationVolume: Create", err)
+				utils.HTTPError(w, "Volume creation error: " + err.Error(), http.StatusInternalServerError, "DS004")
+				return
+			}
+		} else {
+			target = mount.Mount{
+				Type: mount.TypeBind,
+				Source: bind,
+				BindOptions: &mount.BindOptions{
+					CreateMountpoint: true,
+				},
+			}
+		}
+
+		migrationSessionsLock.Lock()
+		session.Created = append(session.Created, mount.Mount{Type: target.Type, Source: target.Source})
+		migrationSessionsLock.Unlock()
+
+		utils.Log("API: Migration receiving " + target.Source)
+
+		if err := ImportMount(target, req.Body); err != nil {
+			utils.Error("MigrationVolume", err)
+			utils.HTTPError(w, "Import failed: " + err.Error(), http.StatusInternalServerError, "DS004")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("MigrationVolume: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// MigrationServAppRoute recreates the migrated ServApp, streaming the creation logs, and ends the migration
+func MigrationServAppRoute(w http.ResponseWriter, req *http.Request) {
+	session := getMigrationSession(req)
+	if session == nil {
+		utils.HTTPError(w, "Invalid migration token", http.StatusUnauthorized, "HTTP004")
+		return
+	}
+
+	if req.Method == "POST" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("MigrationServApp", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		var serviceRequest DockerServiceCreateRequest
+		if err := json.NewDecoder(req.Body).Decode(&serviceRequest); err != nil {
+			utils.Error("MigrationServApp: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid JSON", http.StatusBadRequest, "DS003")
+			return
+		}
+
+		migrationSessionsLock.Lock()
+		container := session.Container
+		errM := validateMigrationService(session, serviceRequest)
+		migrationSessionsLock.Unlock()
+
+		if _, ok := serviceRequest.Services[container]; !ok || len(serviceRequest.Services) != 1 {
+			utils.HTTPError(w, "ServApp not part of the migration", http.StatusForbidden, "DS003")
+			return
+		}
+
+		if errM != nil {
+			utils.Error("MigrationServApp: Refused ServApp", errM)
+			utils.HTTPError(w, errM.Error(), http.StatusForbidden, "DS003")
+			return
+		}
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Transfer-Encoding", "chunked")
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+			return
+		}
+
+		utils.Log("API: Migration creating ServApp " + container)
+
+		err := CreateService(serviceRequest,
+			func(msg string) {
+				fmt.Fprint(w, msg)
+				flusher.Flush()
+			},
+		)
+
+		if err != nil {
+			rollbackMigrationSession(session)
+			return
+		}
+
+		migrationSessionsLock.Lock()
+		for key, s := range migrationSessions {
+			if s == session {
+				delete(migrationSessions, key)
+			}
+		}
+		migrationSessionsLock.Unlock()
+	} else {
+		utils.Error("MigrationServApp: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// MigrationAbortRoute is called by the source when a migration fails, to remove what this server received
+func MigrationAbortRoute(w http.ResponseWriter, req *http.Request) {
+	session := getMigrationSession(req)
+	if session == nil {
+		utils.HTTPError(w, "Invalid migration token", http.StatusUnauthorized, "HTTP004")
+		return
+	}
+
+	if req.Method == "POST" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("MigrationAbort", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		utils.Log("API: Migration aborted")
+
+		rollbackMigrationSession(session)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("MigrationAbort: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// rollbackMigrationSession removes the volumes and bind directories received by a migration which did not
+// complete, so that it can be tried again
+func rollbackMigrationSession(session *migrationSession) {
+	migrationSessionsLock.Lock()
+	created := session.Created
+	session.Created = nil
+	migrationSessionsLock.Unlock()
+
+	for _, m := range created {
+		utils.Log("Migration: removing " + m.Source + " received by an incomplete migration")
+
+		if m.Type == mount.TypeVolume {
+			if err := DockerClient.VolumeRemove(DockerContext, m.Source, true); err != nil {
+				utils.Error("Migration: remove volume " + m.Source, err)
+			}
+		} else if err := os.RemoveAll(migrationBindHostPath(m.Source)); err != nil {
+			utils.Error("Migration: remove directory " + m.Source, err)
+		}
+	}
+}
+
+// expireMigrationSession ends a migration when its token expires, removing what it received if it did not complete
+func expireMigrationSession(token string) {
+	migrationSessionsLock.Lock()
+	session, ok := migrationSessions[token]
+	received := ok && len(session.Created) > 0
+	delete(migrationSessions, token)
+	migrationSessionsLock.Unlock()
+
+	if !received {
+		return
+	}
+
+	if errD := Connect(); errD != nil {
+		utils.Error("Migration: cannot remove what an expired migration received", errD)
+		return
+	}
+
+	rollbackMigrationSession(session)
+}
+
+// validateMigrationService makes sure the migrated ServApp only uses what the check announced, and nothing
+// giving it access to the host: the token holder is not an admin of this Cosmos
+func validateMigrationService(session *migrationSession, serviceRequest DockerServiceCreateRequest) error {
+	for name := range serviceRequest.Volumes {
+		if !session.AnnouncedVolumes[name] {
+			return errors.New("volume " + name + " not part of the migration")
+		}
+	}
+
+	for name, network := range serviceRequest.Networks {
+		if !session.AnnouncedNetworks[name] {
+			return errors.New("network " + name + " not part of the migration")
+		}
+		if network.Driver != "" && network.Driver != "bridge" {
+			return errors.New("network " + name + " uses the " + network.Driver + " driver, only bridge networks can be migrated")
+		}
+	}
+
+	for _, service := range serviceRequest.Services {
+		for _, m := range service.Volumes {
+			switch m.Type {
+			case mount.TypeVolume:
+				// anonymous volumes are created empty
+				if m.Source != "" && !session.AnnouncedVolumes[m.Source] {
+					return errors.New("volume " + m.Source + " not part of the migration")
+				}
+			case mount.TypeBind:
+				if !session.AnnouncedBinds[m.Source] {
+					return errors.New("bind " + m.Source + " not part of the migration")
+				}
+			case mount.TypeTmpfs:
+			default:
+				return errors.New("mount type " + string(m.Type) + " cannot be migrated")
+			}
+		}
+
+		for name := range service.Networks {
+			if name != "bridge" && !session.AnnouncedNetworks[name] {
+				return errors.New("network " + name + " not part of the migration")
+			}
+		}
+
+		mode := service.NetworkMode
+		if mode != "" && mode != "default" && mode != "bridge" && mode != "none" && !session.AnnouncedNetworks[mode] {
+			return errors.New("network mode " + mode + " cannot be migrated")
+		}
+
+		// the compose format has no pid or ipc mode, these always stay private to the container
+		if service.Privileged {
+			return errors.New("privileged ServApps cannot be migrated")
+		}
+		if len(service.CapAdd) > 0 {
+			return errors.New("ServApps with added capabilities cannot be migrated")
+		}
+		if len(service.Devices) > 0 {
+			return errors.New("ServApps with devices cannot be migrated")
+		}
+		if len(service.SecurityOpt) > 0 {
+			return errors.New("ServApps with security options cannot be migrated")
+		}
+	}
+
+	return nil
+}
+
+// validateMigrationBinds refuses the bind directories that exist on this host or contain one another, so that
+// a migration cannot overwrite the files of the host
+func validateMigrationBinds(binds []string) error {
+	for i, bind := range binds {
+		if !filepath.IsAbs(bind) || filepath.Clean(bind) != bind || bind == "/" {
+			return errors.New("invalid bind directory " + bind)
+		}
+
+		for j, other := range binds {
+			if i != j && (bind == other || strings.HasPrefix(other, bind + "/")) {
+				return errors.New("bind directories " + bind + " and " + other + " overlap")
+			}
+		}
+
+		if utils.IsInsideContainer {
+			if _, err := os.Stat("/mnt/host"); os.IsNotExist(err) {
+				return errors.New("cannot check the bind directories, mount the host / in Cosmos with -v /:/mnt/host")
+			}
+		}
+
+		if _, err := os.Lstat(migrationBindHostPath(bind)); !os.IsNotExist(err) {
+			return errors.New("bind directory " + bind + " already exists on the target")
+		}
+	}
+
+	return nil
+}
+
+// migrationBindHostPath is where Cosmos sees a directory of the host
+func migrationBindHostPath(bind string) string {
+	if utils.IsInsideContainer {
+		return "/mnt/host" + bind
+	}
+	return bind
+}
+
+var migrationClient = &http.Client{}
+
+// the Constellation nodes are reached by their IP, which their certificate does not cover. The tunnel
+// authenticates them instead
+var migrationConstellationClient = &http.Client{
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+func migrationClientFor(target string) *http.Client {
+	if parsed, err := url.Parse(target); err == nil && utils.IsConstellationIP(parsed.Hostname()) {
+		return migrationConstellationClient
+	}
+	return migrationClient
+}
+
+// migrationTargetURL resolves a Constellation device name, a host or an URL into the API root of the target
+func migrationTargetURL(target string) (string, error) {
+	if ip := constellation.GetDeviceIp(target); ip != "" {
+		target = ip
+	}
+
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		target = "https://" + target
+	}
+
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Host == "" {
+		return "", errors.New("invalid migration target " + target)
+	}
+
+	// the token and the volumes only travel in clear inside the Constellation
+	if parsed.Scheme != "https" && !utils.IsConstellationIP(parsed.Hostname()) {
+		return "", errors.New("migration target " + target + " must use https outside of the Constellation")
+	}
+
+	return parsed.Scheme + "://" + parsed.Host + "/cosmos", nil
+}
+
+func migrationPost(target string, token string, path string, contentType string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest("POST", target + path, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set(migrationTokenHeader, token)
+
+	resp, err := migrationClientFor(target).Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var result utils.HTTPErrorResult
+		if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Message != "" {
+			return nil, errors.New(result.Message)
+		}
+		return nil, fmt.Errorf("target answered %d", resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+// migrationPostJSON posts a JSON request and discards the answer
+func migrationPostJSON(target string, token string, path string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	resp, err := migrationPost(target, token, path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// shipMount streams a volume or bind of the source to the target, gzipped
+func shipMount(target string, token string, source mount.Mount, query string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ExportMount(source, pw, true))
+	}()
+
+	resp, err := migrationPost(target, token, "/api/migration/volume?" + query, "application/gzip", pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// MigrateServApp moves a container and its volumes to another Cosmos. The source is stopped while its volumes
+// are copied, then left stopped (or removed) once the target created the ServApp, and restarted if anything fails
+func MigrateServApp(containerID string, request MigrateServAppRequest, OnLog func(string)) (err error) {
+	container, err := DockerClient.ContainerInspect(DockerContext, containerID)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(container.Name, "/")
+
+	target, err := migrationTargetURL(request.Target)
+	if err != nil {
+		return err
+	}
+
+	OnLog(fmt.Sprintf("Migrating %s to %s...\n", name, target))
+
+	volumes := []string{}
+	binds := []string{}
+	bindMounts := []mount.Mount{}
+	skippedBinds := map[string]bool{}
+	for _, m := range container.Mounts {
+		if m.Type == mount.TypeVolume {
+			volumes = append(volumes, m.Name)
+		} else if m.Type == mount.TypeBind {
+			// only directories are copied, files and sockets are usually host specific
+			stat, err := DockerClient.ContainerStatPath(DockerContext, container.ID, m.Destination)
+			if err != nil || !stat.Mode.IsDir() {
+				OnLog(utils.DoWarn("Bind %s is not a directory, it will not be migrated\n", m.Source))
+				skippedBinds[m.Source] = true
+				continue
+			}
+			binds = append(binds, m.Source)
+			bindMounts = append(bindMounts, mount.Mount{Type: mount.TypeBind, Source: m.Source})
+		}
+	}
+
+	networks := []string{}
+	for networkName := range container.NetworkSettings.Networks {
+		if !IsDefaultNetwork(networkName) {
+			networks = append(networks, networkName)
+		}
+	}
+
+	err = migrationPostJSON(target, request.Token, "/api/migration/check", MigrationCheckRequest{
+		Container: name,
+		Volumes: volumes,
+		Binds: binds,
+		Networks: networks,
+	})
+	if err != nil {
+		return errors.New("target check failed: " + err.Error())
+	}
+
+	// the target removes what it received, so that the migration can be tried again
+	defer func() {
+		if err != nil {
+			if errA := migrationPostJSON(target, request.Token, "/api/migration/abort", nil); errA != nil {
+				OnLog(utils.DoWarn("Cannot clean up the target, it will be when the token expires: %s\n", errA.Error()))
+			}
+		}
+	}()
+
+	service, err := ExportContainer(container.ID)
+	if err != nil {
+		return err
+	}
+
+	// the target refuses the binds it did not receive
+	migratedMounts := []mount.Mount{}
+	for _, m := range service.Volumes {
+		if m.Type == mount.TypeBind && skippedBinds[m.Source] {
+			continue
+		}
+		migratedMounts = append(migratedMounts, m)
+	}
+	service.Volumes = migratedMounts
+
+	serviceRequest := DockerServiceCreateRequest{
+		Services: map[string]ContainerCreateRequestContainer{
+			name: service,
+		},
+		Volumes: map[string]ContainerCreateRequestVolume{},
+		Networks: map[string]ContainerCreateRequestNetwork{},
+	}
+
+	for _, volume := range volumes {
+		serviceRequest.Volumes[volume] = ContainerCreateRequestVolume{Name: volume}
+	}
+
+	for _, networkName := range networks {
+		network, err := DockerClient.NetworkInspect(DockerContext, networkName, types.NetworkInspectOptions{})
+		if err != nil {
+			return err
+		}
+
+		migrated := ContainerCreateRequestNetwork{
+			Name: networkName,
+			Driver: network.Driver,
+			Attachable: network.Attachable,
+			Internal: network.Internal,
+			EnableIPv6: network.EnableIPv6,
+			Labels: network.Labels,
+		}
+		migrated.IPAM.Driver = network.IPAM.Driver
+		serviceRequest.Networks[networkName] = migrated
+	}
+
+	wasRunning := container.State.Running
+	restore := func() {
+		if wasRunning {
+			OnLog("Restarting the source container...\n")
+			if err := DockerClient.ContainerStart(DockerContext, container.ID, conttype.StartOptions{}); err != nil {
+				OnLog(utils.DoErr("Cannot restart the source container: %s\n", err.Error()))
+			}
+		}
+	}
+
+	if wasRunning {
+		OnLog("Stopping the source container...\n")
+		if err := DockerClient.ContainerStop(DockerContext, container.ID, conttype.StopOptions{}); err != nil {
+			return err
+		}
+	}
+
+	for _, volume := range volumes {
+		OnLog(fmt.Sprintf("Copying volume %s...\n", volume))
+		err := shipMount(target, request.Token, mount.Mount{Type: mount.TypeVolume, Source: volume}, "volume=" + url.QueryEscape(volume))
+		if err != nil {
+			restore()
+			return errors.New("copy of volume " + volume + " failed: " + err.Error())
+		}
+	}
+
+	for _, bind := range bindMounts {
+		OnLog(fmt.Sprintf("Copying directory %s...\n", bind.Source))
+		err := shipMount(target, request.Token, bind, "bind=" + url.QueryEscape(bind.Source))
+		if err != nil {
+			restore()
+			return errors.New("copy of directory " + bind.Source + " failed: " + err.Error())
+		}
+	}
+
+	OnLog("Creating the ServApp on the target...\n")
+
+	body, err := json.Marshal(serviceRequest)
+	if err != nil {
+		restore()
+		return err
+	}
+
+	resp, err := migrationPost(target, request.Token, "/api/migration/servapp", "application/json", bytes.NewReader(body))
+	if err != nil {
+		restore()
+		return err
+	}
+	defer resp.Body.Close()
+
+	succeeded := false
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, "[OPERATION SUCCEEDED]") {
+			succeeded = true
+		}
+		OnLog("[target] " + line + "\n")
+	}
+
+	if !succeeded {
+		restore()
+		return errors.New("ServApp creation failed on the target")
+	}
+
+	if request.RemoveSource {
+		OnLog("Removing the source container...\n")
+		if err := DockerClient.ContainerRemove(DockerContext, container.ID, conttype.RemoveOptions{}); err != nil {
+			OnLog(utils.DoWarn("Cannot remove the source container: %s\n", err.Error()))
+		}
+	}
+
+	utils.TriggerEvent(
+		"cosmos.docker.migrated",
+		"ServApp migrated",
+		"success",
+		"container@" + name,
+		map[string]interface{}{
+			"container": name,
+			"target": request.Target,
+		},
+	)
+
+	return nil
+}
+
+// MigrateServAppRoute migrates a ServApp to another Cosmos, streaming the progress
+func MigrateServAppRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("MigrateServApp", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		var request MigrateServAppRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			utils.Error("MigrateServApp: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid JSON", http.StatusBadRequest, "DS003")
+			return
+		}
+
+		if errV := utils.Validate.Struct(request); errV != nil {
+			utils.HTTPError(w, errV.Error(), http.StatusBadRequest, "DS003")
+			return
+		}
+
+		containerID := utils.SanitizeSafe(mux.Vars(req)["containerId"])
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Transfer-Encoding", "chunked")
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+			return
+		}
+
+		OnLog := func(msg string) {
+			fmt.Fprint(w, msg)
+			flusher.Flush()
+		}
+
+		utils.Log("API: Migrate ServApp " + containerID + " to " + request.Target)
+
+		if err := MigrateServApp(containerID, request, OnLog); err != nil {
+			utils.Error("MigrateServApp", err)
+			OnLog(utils.DoErr("%s\n", err.Error()))
+			OnLog("[OPERATION FAILED]\n")
+			return
+		}
+
+		OnLog("[OPERATION SUCCEEDED]\n")
+	} else {
+		utils.Error("MigrateServApp: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,543 @@
+package docker
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	contstuff "github.com/docker/docker/api/types/container"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+type StackContainer struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	Service string `json:"service"`
+	Image string `json:"image"`
+	State string `json:"state"`
+	Status string `json:"status"`
+}
+
+// Stack is a group of containers deployed together, sharing a cosmos-stack or docker-compose project label.
+// With Podman, the pods are stacks too
+type Stack struct {
+	Name string `json:"name"`
+	// the stack is a Podman pod, managed as a whole
+	Pod bool `json:"pod,omitempty"`
+	Status string `json:"status"`
+	Running int `json:"running"`
+	Containers []StackContainer `json:"containers"`
+}
+
+type StackFieldChange struct {
+	Field string `json:"field"`
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+type StackServiceDiff struct {
+	Name string `json:"name"`
+	// added, removed, changed or unchanged
+	Status string `json:"status"`
+	Changes []StackFieldChange `json:"changes,omitempty"`
+}
+
+// FormatDependsOnLabel writes depends_on as name:condition,name:condition to keep it in a label
+func FormatDependsOnLabel(dependsOn map[string]ContainerCreateRequestContainerDependsOnCont) string {
+	dependencies := []string{}
+	for name, dependency := range dependsOn {
+		dependencies = append(dependencies, name + ":" + dependency.Condition)
+	}
+	sort.Strings(dependencies)
+	return strings.Join(dependencies, ",")
+}
+
+// ParseDependsOnLabel reads the cosmos-depends-on label, and the com.docker.compose.depends_on
+// label of docker-compose which has the same format with an extra restart field
+func ParseDependsOnLabel(label string) map[string]ContainerCreateRequestContainerDependsOnCont {
+	dependsOn := map[string]ContainerCreateRequestContainerDependsOnCont{}
+
+	for _, dependency := range strings.Split(label, ",") {
+		parts := strings.Split(strings.TrimSpace(dependency), ":")
+		if parts[0] == "" {
+			continue
+		}
+
+		dependsOn[parts[0]] = ContainerCreateRequestContainerDependsOnCont{}
+		if len(parts) > 1 {
+			dependsOn[parts[0]] = ContainerCreateRequestContainerDependsOnCont{
+				Condition: parts[1],
+			}
+		}
+	}
+
+	return dependsOn
+}
+
+// ListStacks groups the containers by stack, containers without a stack are not listed
+func ListStacks() ([]Stack, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	// containers of a pod without a stack label are grouped by pod, without its infra container
+	podOf := map[string]string{}
+	infra := map[string]bool{}
+	pods, err := ListPods()
+	if err != nil {
+		utils.Error("ListStacks: cannot list the pods", err)
+	}
+	for _, pod := range pods {
+		infra[pod.InfraId] = true
+		for _, container := range pod.Containers {
+			podOf[container.Id] = pod.Name
+		}
+	}
+
+	stacks := map[string]*Stack{}
+	for _, container := range containers {
+		stackName := ContainerStackName(container.Labels)
+		isPod := false
+		if stackName == "" && !infra[container.ID] {
+			stackName = podOf[container.ID]
+			isPod = stackName != ""
+		}
+		if stackName == "" {
+			continue
+		}
+
+		stack, ok := stacks[stackName]
+		if !ok {
+			stack = &Stack{
+				Name: stackName,
+				Pod: isPod,
+				Containers: []StackContainer{},
+			}
+			stacks[stackName] = stack
+		}
+
+		name := strings.TrimPrefix(container.Names[0], "/")
+		service := container.Labels["com.docker.compose.service"]
+		if service == "" {
+			service = name
+		}
+
+		stack.Containers = append(stack.Containers, StackContainer{
+			ID: container.ID,
+			Name: name,
+			Service: service,
+			Image: container.Image,
+			State: container.State,
+			Status: container.Status,
+		})
+
+		if container.State == "running" {
+			stack.Running++
+		}
+	}
+
+	result := []Stack{}
+	for _, stack := range stacks {
+		switch stack.Running {
+		case 0:
+			stack.Status = "stopped"
+		case len(stack.Containers):
+			stack.Status = "running"
+		default:
+			stack.Status = "partial"
+		}
+
+		sort.Slice(stack.Containers, func(i, j int) bool {
+			return stack.Containers[i].Name < stack.Containers[j].Name
+		})
+		result = append(result, *stack)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result, nil
+}
+
+// getPodStack returns the pod of a stack listed from its pod rather than from labels
+func getPodStack(stackName string) (Pod, bool) {
+	if !IsPodman() {
+		return Pod{}, false
+	}
+
+	stacks, err := ListStacks()
+	if err != nil {
+		return Pod{}, false
+	}
+
+	for _, stack := range stacks {
+		if stack.Name == stackName && stack.Pod {
+			return podByName(stackName)
+		}
+	}
+
+	return Pod{}, false
+}
+
+// stripImageDefaults removes the environment variables and labels a container inherited from its image
+func stripImageDefaults(service *ContainerCreateRequestContainer) {
+	image, _, err := DockerClient.ImageInspectWithRaw(DockerContext, service.Image)
+	if err != nil || image.Config == nil {
+		return
+	}
+
+	imageEnv := map[string]bool{}
+	for _, env := range image.Config.Env {
+		imageEnv[env] = true
+	}
+
+	environment := []string{}
+	for _, env := range service.Environment {
+		if !imageEnv[env] {
+			environment = append(environment, env)
+		}
+	}
+	service.Environment = environment
+
+	for key, value := range image.Config.Labels {
+		if service.Labels[key] == value {
+			delete(service.Labels, key)
+		}
+	}
+}
+
+// GetStackServices exports the containers of a stack, by container name.
+// Dependencies on containers outside of the stack are ignored
+func GetStackServices(stackName string) (map[string]ContainerCreateRequestContainer, error) {
+	stacks, err := ListStacks()
+	if err != nil {
+		return nil, err
+	}
+
+	var stack *Stack
+	for i := range stacks {
+		if stacks[i].Name == stackName {
+			stack = &stacks[i]
+		}
+	}
+
+	if stack == nil {
+		return nil, errors.New("stack " + stackName + " not found")
+	}
+
+	services := map[string]ContainerCreateRequestContainer{}
+	serviceToContainer := map[string]string{}
+
+	for _, container := range stack.Containers {
+		service, err := ExportContainer(container.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		stripImageDefaults(&service)
+
+		if composeDependsOn := service.Labels["com.docker.compose.depends_on"]; composeDependsOn != "" && len(service.DependsOn) == 0 {
+			service.DependsOn = ParseDependsOnLabel(composeDependsOn)
+		}
+
+		services[service.Name] = service
+		serviceToContainer[container.Service] = service.Name
+	}
+
+	for name, service := range services {
+		dependsOn := map[string]ContainerCreateRequestContainerDependsOnCont{}
+		for dependency, condition := range service.DependsOn {
+			if containerName, ok := serviceToContainer[dependency]; ok {
+				dependency = containerName
+			}
+			if _, ok := services[dependency]; ok {
+				dependsOn[dependency] = condition
+			}
+		}
+		service.DependsOn = dependsOn
+		services[name] = service
+	}
+
+	return services, nil
+}
+
+// ManageStack runs an action on all the containers of a stack, in dependency order.
+// stop and remove run in the reverse order, so dependents go down before their dependencies.
+// Pods have no update action, their containers are updated one by one
+func ManageStack(stackName string, action string, OnLog func(string)) error {
+	if pod, ok := getPodStack(stackName); ok && action != "update" {
+		return ManagePod(pod, action, OnLog)
+	}
+
+	services, err := GetStackServices(stackName)
+	if err != nil {
+		return err
+	}
+
+	ordered, _, err := ReOrderServices(services)
+	if err != nil {
+		return err
+	}
+
+	if action == "stop" || action == "remove" {
+		for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+	}
+
+	for _, service := range ordered {
+		if utils.IsInsideContainer && service.Name == os.Getenv("HOSTNAME") && action != "update" {
+			OnLog(utils.DoWarn("Skipping %s, Cosmos cannot %s itself\n", service.Name, action))
+			continue
+		}
+
+		utils.Log("ManageStack: " + action + " " + service.Name)
+		OnLog(fmt.Sprintf("Running %s on %s...\n", action, service.Name))
+
+		switch action {
+		case "start":
+			err = DockerClient.ContainerStart(DockerContext, service.Name, contstuff.StartOptions{})
+		case "stop":
+			err = DockerClient.ContainerStop(DockerContext, service.Name, contstuff.StopOptions{})
+		case "restart":
+			err = DockerClient.ContainerRestart(DockerContext, service.Name, contstuff.StopOptions{})
+		case "remove":
+			DockerClient.ContainerStop(DockerContext, service.Name, contstuff.StopOptions{})
+			err = DockerClient.ContainerRemove(DockerContext, service.Name, contstuff.RemoveOptions{})
+		case "update":
+			err = updateStackContainer(service.Name, OnLog)
+		default:
+			return errors.New("invalid action " + action)
+		}
+
+		if err != nil {
+			OnLog(utils.DoErr("%s %s failed: %s\n", action, service.Name, err.Error()))
+			return err
+		}
+	}
+
+	return nil
+}
+
+func updateStackContainer(containerName string, OnLog func(string)) error {
+	container, err := DockerClient.ContainerInspect(DockerContext, containerName)
+	if err != nil {
+		return err
+	}
+
+	OnLog(fmt.Sprintf("Pulling image %s\n", container.Config.Image))
+
+	out, err := DockerPullImage(container.Config.Image)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// wait for image pull to finish
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		OnLog(scanner.Text() + "\n")
+	}
+
+	_, err = RecreateContainer(container.Name, container)
+	if err != nil {
+		return err
+	}
+
+	utils.UpdateAvailable[container.Name] = false
+	return nil
+}
+
+// normalizeService turns a service into comparable values, as they would be sent as JSON
+func normalizeService(service ContainerCreateRequestContainer) map[string]interface{} {
+	result := map[string]interface{}{}
+	asJSON, _ := json.Marshal(service)
+	json.Unmarshal(asJSON, &result)
+	return result
+}
+
+func isEmptyValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		for _, item := range v {
+			if !isEmptyValue(item) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// DiffStack compares the running services of a stack with a new definition.
+// Fields left empty in the new definition use the Docker defaults and are not reported
+func DiffStack(current map[string]ContainerCreateRequestContainer, next DockerServiceCreateRequest) []StackServiceDiff {
+	diffs := []StackServiceDiff{}
+	seen := map[string]bool{}
+
+	for _, service := range next.Services {
+		seen[service.Name] = true
+
+		old, exists := current[service.Name]
+		if !exists {
+			diffs = append(diffs, StackServiceDiff{
+				Name: service.Name,
+				Status: "added",
+			})
+			continue
+		}
+
+		oldValues := normalizeService(old)
+		newValues := normalizeService(service)
+
+		fields := []string{}
+		for field := range newValues {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		changes := []StackFieldChange{}
+		for _, field := range fields {
+			if isEmptyValue(newValues[field]) && isEmptyValue(oldValues[field]) {
+				continue
+			}
+			if isEmptyValue(newValues[field]) && field != "environment" && field != "labels" {
+				continue
+			}
+			if !reflect.DeepEqual(oldValues[field], newValues[field]) {
+				changes = append(changes, StackFieldChange{
+					Field: field,
+					Old: oldValues[field],
+					New: newValues[field],
+				})
+			}
+		}
+
+		status := "unchanged"
+		if len(changes) > 0 {
+			status = "changed"
+		}
+
+		diffs = append(diffs, StackServiceDiff{
+			Name: service.Name,
+			Status: status,
+			Changes: changes,
+		})
+	}
+
+	for name := range current {
+		if !seen[name] {
+			diffs = append(diffs, StackServiceDiff{
+				Name: name,
+				Status: "removed",
+			})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Name < diffs[j].Name
+	})
+
+	return diffs
+}
+
+// StackContainerNames returns the containers of a stack by compose service, so that a docker-compose
+// redeploy of a compose project replaces its <project>-<service>-1 containers
+func StackContainerNames(stackName string) map[string]string {
+	names := map[string]string{}
+
+	stacks, err := ListStacks()
+	if err != nil {
+		return names
+	}
+
+	for _, stack := range stacks {
+		if stack.Name != stackName {
+			continue
+		}
+		for _, container := range stack.Containers {
+			if container.Service != container.Name {
+				names[container.Service] = container.Name
+			}
+		}
+	}
+
+	return names
+}
+
+// PrepareStackRequest names the services of a new definition and labels them as part of the stack
+func PrepareStackRequest(stackName string, next DockerServiceCreateRequest) {
+	for key, service := range next.Services {
+		if service.Name == "" {
+			service.Name = key
+		}
+		if service.Labels == nil {
+			service.Labels = map[string]string{}
+		}
+		service.Labels["cosmos-stack"] = stackName
+		next.Services[key] = service
+	}
+}
+
+// RedeployStack replaces a stack by a new definition. Its services are created or overwritten
+// with CreateService, then the containers which are not part of the definition anymore are removed
+func RedeployStack(stackName string, next DockerServiceCreateRequest, OnLog func(string)) error {
+	if _, ok := getPodStack(stackName); ok {
+		return errors.New("stack " + stackName + " is a Podman pod, which cannot be redeployed from a compose definition")
+	}
+
+	current, err := GetStackServices(stackName)
+	if err != nil {
+		return err
+	}
+
+	PrepareStackRequest(stackName, next)
+
+	err = CreateService(next, OnLog)
+	if err != nil {
+		return err
+	}
+
+	for _, diff := range DiffStack(current, next) {
+		if diff.Status != "removed" {
+			continue
+		}
+
+		if utils.IsInsideContainer && diff.Name == os.Getenv("HOSTNAME") {
+			continue
+		}
+
+		utils.Log("RedeployStack: removing " + diff.Name)
+		OnLog(fmt.Sprintf("Removing %s, not part of the stack anymore\n", diff.Name))
+
+		DockerClient.ContainerStop(DockerContext, diff.Name, contstuff.StopOptions{})
+		err := DockerClient.ContainerRemove(DockerContext, diff.Name, contstuff.RemoveOptions{})
+		if err != nil {
+			utils.Error("RedeployStack: remove " + diff.Name, err)
+			OnLog(utils.DoErr("Cannot remove %s: %s\n", diff.Name, err.Error()))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package docker
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// ContainerStatusEvent is a change of status of a container, for its timeline
+type ContainerStatusEvent struct {
+	Id primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Container string `json:"container" bson:"container"`
+	// running, exited, oom-killed, healthy, unhealthy, paused or removed
+	Status string `json:"status" bson:"status"`
+	ExitCode int `json:"exitCode,omitempty" bson:"exitCode,omitempty"`
+	// the container stopped without being asked to (crash, OOM kill)
+	Unexpected bool `json:"unexpected,omitempty" bson:"unexpected,omitempty"`
+	Date time.Time `json:"date" bson:"Date"`
+}
+
+// ContainerHealthMetrics are the restarts and OOM kills of a container in the last containerEventWindow
+type ContainerHealthMetrics struct {
+	Restarts int
+	OOMKills int
+	Unhealthy bool
+}
+
+const containerEventWindow = 10 * time.Minute
+
+var recentCrashes = map[string][]time.Time{}
+var recentOOMKills = map[string][]time.Time{}
+// containers being stopped or restarted on purpose, so their exit is not a crash
+var stoppingContainers = map[string]bool{}
+var containerEventsLock sync.Mutex
+
+func pruneRecent(dates []time.Time) []time.Time {
+	limit := time.Now().Add(-containerEventWindow)
+	kept := []time.Time{}
+	for _, date := range dates {
+		if date.After(limit) {
+			kept = append(kept, date)
+		}
+	}
+	return kept
+}
+
+// ContainerEventStatus turns a Docker container event into a status of the timeline, empty if it does not change it.
+// The health events have actions like "health_status: unhealthy"
+func ContainerEventStatus(action string) string {
+	switch {
+	case action == "start", action == "unpause":
+		return "running"
+	case action == "die":
+		return "exited"
+	case action == "oom":
+		return "oom-killed"
+	case action == "pause":
+		return "paused"
+	case action == "destroy":
+		return "removed"
+	case strings.HasPrefix(action, "health_status: "):
+		return strings.TrimPrefix(action, "health_status: ")
+	}
+	return ""
+}
+
+// recordContainerEvent keeps the restarts and OOM kills for the metrics, and stores the status changes.
+// It returns the status event recorded, if any
+func recordContainerEvent(containerName string, action string, attributes map[string]string) (ContainerStatusEvent, bool) {
+	containerEventsLock.Lock()
+
+	switch action {
+	case "kill", "stop", "restart":
+		stoppingContainers[containerName] = true
+	case "start":
+		delete(stoppingContainers, containerName)
+	}
+
+	status := ContainerEventStatus(action)
+	if status == "" {
+		containerEventsLock.Unlock()
+		return ContainerStatusEvent{}, false
+	}
+
+	event := ContainerStatusEvent{
+		Container: containerName,
+		Status: status,
+		Date: time.Now(),
+	}
+
+	switch action {
+	case "die":
+		event.ExitCode, _ = strconv.Atoi(attributes["exitCode"])
+		event.Unexpected = !stoppingContainers[containerName]
+		if event.Unexpected {
+			recentCrashes[containerName] = append(pruneRecent(recentCrashes[containerName]), event.Date)
+		}
+	case "oom":
+		event.Unexpected = true
+		recentOOMKills[containerName] = append(pruneRecent(recentOOMKills[containerName]), event.Date)
+	case "destroy":
+		delete(stoppingContainers, containerName)
+	}
+
+	containerEventsLock.Unlock()
+
+	// stored in the background, a slow database would otherwise hold the Docker events
+	go (func() {
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "container_status")
+		if errCo != nil {
+			utils.Error("RecordContainerEvent - Database Connect", errCo)
+			return
+		}
+
+		if _, err := c.InsertOne(context.Background(), event); err != nil {
+			utils.Error("RecordContainerEvent", err)
+		}
+	})()
+
+	return event, true
+}
+
+// GetContainerHealthMetrics returns the restarts, OOM kills and health of all the containers
+func GetContainerHealthMetrics() map[string]ContainerHealthMetrics {
+	result := map[string]ContainerHealthMetrics{}
+
+	containers, err := ListContainers()
+	if err != nil {
+		utils.Error("GetContainerHealthMetrics", err)
+		return result
+	}
+
+	containerEventsLock.Lock()
+	defer containerEventsLock.Unlock()
+
+	for _, container := range containers {
+		name := strings.TrimPrefix(container.Names[0], "/")
+
+		recentCrashes[name] = pruneRecent(recentCrashes[name])
+		recentOOMKills[name] = pruneRecent(recentOOMKills[name])
+
+		result[name] = ContainerHealthMetrics{
+			Restarts: len(recentCrashes[name]),
+			OOMKills: len(recentOOMKills[name]),
+			Unhealthy: strings.Contains(container.Status, "(unhealthy)"),
+		}
+	}
+
+	return result
+}
+
+// GetContainerTimeline returns the status changes of a container since a date, most recent first
+func GetContainerTimeline(containerName string, since time.Time) ([]ContainerStatusEvent, error) {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "container_status")
+	if errCo != nil {
+		return nil, errCo
+	}
+
+	cursor, err := c.Find(context.Background(), bson.M{
+		"container": containerName,
+		"Date": bson.M{"$gte": since},
+	}, options.Find().SetSort(bson.M{"Date": -1}).SetLimit(500))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	timeline := []ContainerStatusEvent{}
+	err = cursor.All(context.Background(), &timeline)
+	return timeline, err
+}
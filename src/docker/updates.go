@@ -0,0 +1,598 @@
+package docker
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/docker/docker/api/types"
+	"github.com/gorilla/mux"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// UpdatePolicy is how a container follows the new versions of its image, stored in its labels:
+// cosmos-update-policy (digest, semver or notify), cosmos-update-semver and cosmos-update-window
+type UpdatePolicy struct {
+	// digest: install the new images of the current tag
+	// semver: move to the highest tag matching Range
+	// notify: only notify of the new images
+	// empty: the updates are only shown in the UI
+	Mode string `json:"mode"`
+	Range string `json:"range,omitempty"`
+	// maintenance window, like "Mon-Fri 02:00-05:00; Sun 00:00-06:00", defaults to the DockerConfig one
+	Window string `json:"window,omitempty"`
+}
+
+// UpdatePlanItem is a container with an update available, and what was done with it
+type UpdatePlanItem struct {
+	Container string `json:"container"`
+	Mode string `json:"mode"`
+	Image string `json:"image"`
+	Target string `json:"target"`
+	// updated, failed, scheduled (waiting for the maintenance window), notify or skipped (update failed before)
+	Status string `json:"status"`
+	Error string `json:"error,omitempty"`
+	Date time.Time `json:"date"`
+}
+
+var updatesPlan = []UpdatePlanItem{}
+var updatesPlanLock sync.Mutex
+
+// GetUpdatePolicy reads the update policy of a container. The cosmos-auto-update label alone means digest
+func GetUpdatePolicy(container types.ContainerJSON) UpdatePolicy {
+	labels := container.Config.Labels
+
+	policy := UpdatePolicy{
+		Mode: labels["cosmos-update-policy"],
+		Range: labels["cosmos-update-semver"],
+		Window: labels["cosmos-update-window"],
+	}
+
+	if policy.Mode == "" && labels["cosmos-auto-update"] == "true" {
+		policy.Mode = "digest"
+	}
+
+	if policy.Window == "" {
+		policy.Window = utils.GetMainConfig().DockerConfig.UpdateWindow
+	}
+
+	return policy
+}
+
+func ValidateUpdatePolicy(policy UpdatePolicy) error {
+	switch policy.Mode {
+	case "", "digest", "notify":
+	case "semver":
+		if _, err := semver.NewConstraint(policy.Range); err != nil {
+			return fmt.Errorf("invalid semver range %s: %v", policy.Range, err)
+		}
+	default:
+		return errors.New("invalid update policy " + policy.Mode)
+	}
+
+	_, err := ParseMaintenanceWindows(policy.Window)
+	return err
+}
+
+type maintenanceWindow struct {
+	// nil for every day
+	days map[time.Weekday]bool
+	// minutes since midnight
+	start int
+	end int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseWindowTime(value string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) != 2 {
+		return 0, errors.New("invalid time " + value + ", expected HH:MM")
+	}
+
+	hours, errH := strconv.Atoi(parts[0])
+	minutes, errM := strconv.Atoi(parts[1])
+	if errH != nil || errM != nil || hours < 0 || hours > 24 || minutes < 0 || minutes > 59 {
+		return 0, errors.New("invalid time " + value + ", expected HH:MM")
+	}
+
+	return hours * 60 + minutes, nil
+}
+
+func parseWindowDays(value string) (map[time.Weekday]bool, error) {
+	days := map[time.Weekday]bool{}
+
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		bounds := strings.Split(strings.TrimSpace(part), "-")
+
+		from, ok := weekdays[bounds[0][:min(3, len(bounds[0]))]]
+		if !ok {
+			return nil, errors.New("invalid day " + part)
+		}
+		to := from
+
+		if len(bounds) == 2 {
+			to, ok = weekdays[bounds[1][:min(3, len(bounds[1]))]]
+			if !ok {
+				return nil, errors.New("invalid day " + part)
+			}
+		}
+
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// ParseMaintenanceWindows reads windows like "Mon-Fri 02:00-05:00; Sat,Sun 00:00-08:00" or "22:00-02:00"
+func ParseMaintenanceWindows(spec string) ([]maintenanceWindow, error) {
+	windows := []maintenanceWindow{}
+
+	for _, part := range strings.Split(spec, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, errors.New("invalid maintenance window " + part)
+		}
+
+		window := maintenanceWindow{}
+		if len(fields) == 2 {
+			days, err := parseWindowDays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			window.days = days
+		}
+
+		hours := strings.Split(fields[len(fields)-1], "-")
+		if len(hours) != 2 {
+			return nil, errors.New("invalid maintenance window " + part + ", expected HH:MM-HH:MM")
+		}
+
+		var err error
+		if window.start, err = parseWindowTime(hours[0]); err != nil {
+			return nil, err
+		}
+		if window.end, err = parseWindowTime(hours[1]); err != nil {
+			return nil, err
+		}
+
+		windows = append(windows, window)
+	}
+
+	return windows, nil
+}
+
+// InMaintenanceWindow checks if updates are allowed at a time. No window means anytime.
+// A window ending before it starts goes over midnight, and belongs to the day it starts
+func InMaintenanceWindow(spec string, t time.Time) bool {
+	windows, err := ParseMaintenanceWindows(spec)
+	if err != nil {
+		utils.Error("InMaintenanceWindow", err)
+		return false
+	}
+
+	if len(windows) == 0 {
+		return true
+	}
+
+	now := t.Hour() * 60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	for _, window := range windows {
+		if window.start <= window.end {
+			if now >= window.start && now < window.end && (window.days == nil || window.days[today]) {
+				return true
+			}
+		} else {
+			if now >= window.start && (window.days == nil || window.days[today]) {
+				return true
+			}
+			if now < window.end && (window.days == nil || window.days[yesterday]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// versionTagRegex splits a tag into a prefix (v, release-), a version and a variant suffix (-alpine, -bookworm)
+var versionTagRegex = regexp.MustCompile(`^([^0-9]*)([0-9]+(?:\.[0-9]+){0,2})(.*)$`)
+
+type versionTag struct {
+	prefix string
+	version *semver.Version
+	components int
+	suffix string
+}
+
+func parseVersionTag(tag string) (versionTag, bool) {
+	match := versionTagRegex.FindStringSubmatch(tag)
+	if match == nil {
+		return versionTag{}, false
+	}
+
+	version, err := semver.NewVersion(match[2])
+	if err != nil {
+		return versionTag{}, false
+	}
+
+	return versionTag{
+		prefix: match[1],
+		version: version,
+		components: strings.Count(match[2], ".") + 1,
+		suffix: match[3],
+	}, true
+}
+
+// FindSemverUpdate returns the highest tag of the image repository matching the range and newer than the current tag.
+// Tags keep the style of the current one: its prefix like v, its variant suffix like -alpine, and its number of
+// components, so that 15.3-alpine moves to 15.4-alpine and never to 15.4 or to the floating 16-alpine
+func FindSemverUpdate(image string, versionRange string) (string, error) {
+	parsed, err := ParseRegistryImage(image)
+	if err != nil {
+		return "", err
+	}
+
+	current, ok := parseVersionTag(parsed.Tag)
+	if !ok {
+		return "", errors.New("tag " + parsed.Tag + " of " + image + " is not a version")
+	}
+
+	constraint, err := semver.NewConstraint(versionRange)
+	if err != nil {
+		return "", err
+	}
+
+	tags, err := ListRegistryTags(image)
+	if err != nil {
+		return "", err
+	}
+
+	bestTag := ""
+	best := current.version
+
+	for _, tag := range tags {
+		candidate, ok := parseVersionTag(tag)
+		if !ok || candidate.prefix != current.prefix || candidate.suffix != current.suffix || candidate.components != current.components {
+			continue
+		}
+
+		if !constraint.Check(candidate.version) {
+			continue
+		}
+
+		if candidate.version.GreaterThan(best) {
+			best = candidate.version
+			bestTag = tag
+		}
+	}
+
+	if bestTag == "" {
+		return "", nil
+	}
+
+	return parsed.WithTag(bestTag), nil
+}
+
+func pullImage(image string) (string, error) {
+	out, err := DockerPullImage(image)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	// wait for image pull to finish
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		utils.Debug(scanner.Text())
+	}
+
+	pulled, _, err := DockerClient.ImageInspectWithRaw(DockerContext, image)
+	if err != nil {
+		return "", err
+	}
+
+	return pulled.ID, nil
+}
+
+// installUpdate updates a container now if its maintenance window is open, or schedules it
+func installUpdate(container types.ContainerJSON, policy UpdatePolicy, target string) UpdatePlanItem {
+	containerName := strings.TrimPrefix(container.Name, "/")
+
+	item := UpdatePlanItem{
+		Container: containerName,
+		Mode: policy.Mode,
+		Image: container.Config.Image,
+		Target: target,
+		Date: time.Now(),
+	}
+
+	if policy.Mode == "notify" {
+		item.Status = "notify"
+		return item
+	}
+
+	if !InMaintenanceWindow(policy.Window, time.Now()) {
+		utils.Log("Update of " + containerName + " to " + target + " scheduled for the maintenance window " + policy.Window)
+		item.Status = "scheduled"
+		return item
+	}
+
+	newImage := ""
+	if policy.Mode == "semver" {
+		newImage = target
+	}
+
+	utils.TriggerEvent(
+		"cosmos.docker.container.update",
+		"Cosmos Container Update",
+		"success",
+		"",
+		map[string]interface{}{
+			"container": containerName,
+			"target": target,
+	})
+
+	utils.WriteNotification(utils.Notification{
+		Recipient: "admin",
+		Title: "header.notification.title.containerUpdate",
+		Message: "header.notification.message.containerUpdate",
+		Vars: containerName,
+		Level: "info",
+		Link: "/cosmos-ui/servapps/containers/" + containerName,
+	})
+
+	err := SafeUpdateContainer(container, newImage)
+	if err != nil {
+		utils.MajorError("Container failed to update", err)
+		item.Status = "failed"
+		item.Error = err.Error()
+	} else {
+		item.Status = "updated"
+	}
+
+	return item
+}
+
+// checkSemverUpdate looks for a newer version matching the range of a container with the semver policy
+func checkSemverUpdate(container types.ContainerJSON, policy UpdatePolicy) (UpdatePlanItem, bool) {
+	containerName := strings.TrimPrefix(container.Name, "/")
+
+	target, err := FindSemverUpdate(container.Config.Image, policy.Range)
+	if err != nil {
+		utils.Error("CheckUpdatesAvailable - semver " + containerName, err)
+		return UpdatePlanItem{}, false
+	}
+
+	if target == "" {
+		utils.Log("No version matching " + policy.Range + " newer than " + container.Config.Image)
+		return UpdatePlanItem{}, false
+	}
+
+	utils.Log("Updates available for " + container.Config.Image + ": " + target)
+
+	imageID, err := pullImage(target)
+	if err != nil {
+		utils.Error("CheckUpdatesAvailable - pull " + target, err)
+		return UpdatePlanItem{}, false
+	}
+
+	if IsImageFailed(containerName, imageID) {
+		utils.Warn("CheckUpdatesAvailable - Update of " + containerName + " to " + target + " failed before, skipping")
+		return UpdatePlanItem{
+			Container: containerName,
+			Mode: policy.Mode,
+			Image: container.Config.Image,
+			Target: target,
+			Status: "skipped",
+			Date: time.Now(),
+		}, true
+	}
+
+	return installUpdate(container, policy, target), true
+}
+
+// setUpdatesPlan keeps the result of the last updates check, and notifies the admins of the
+// containers which were updated or are waiting to be updated
+func setUpdatesPlan(plan []UpdatePlanItem) {
+	updatesPlanLock.Lock()
+	updatesPlan = plan
+	updatesPlanLock.Unlock()
+
+	changes := []string{}
+	for _, item := range plan {
+		if item.Status != "skipped" {
+			changes = append(changes, item.Container + " (" + item.Target + ", " + item.Status + ")")
+		}
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+
+	sort.Strings(changes)
+
+	utils.WriteNotification(utils.Notification{
+		Recipient: "admin",
+		Title: "header.notification.title.containerUpdatesAvailable",
+		Message: "header.notification.message.containerUpdatesAvailable",
+		Vars: strings.Join(changes, ", "),
+		Level: "info",
+		Link: "/cosmos-ui/servapps",
+	})
+}
+
+// ApplyScheduledUpdates installs the updates waiting for their maintenance window to open
+func ApplyScheduledUpdates() {
+	updatesPlanLock.Lock()
+	scheduled := []int{}
+	for i, item := range updatesPlan {
+		if item.Status == "scheduled" {
+			scheduled = append(scheduled, i)
+		}
+	}
+	updatesPlanLock.Unlock()
+
+	for _, i := range scheduled {
+		updatesPlanLock.Lock()
+		item := updatesPlan[i]
+		updatesPlanLock.Unlock()
+
+		container, err := DockerClient.ContainerInspect(DockerContext, item.Container)
+		if err != nil {
+			utils.Error("ApplyScheduledUpdates - " + item.Container, err)
+			continue
+		}
+
+		policy := GetUpdatePolicy(container)
+		if policy.Mode != item.Mode || !InMaintenanceWindow(policy.Window, time.Now()) {
+			continue
+		}
+
+		result := installUpdate(container, policy, item.Target)
+
+		updatesPlanLock.Lock()
+		if i < len(updatesPlan) && updatesPlan[i].Container == item.Container {
+			updatesPlan[i] = result
+		}
+		updatesPlanLock.Unlock()
+
+		if result.Status == "updated" {
+			utils.UpdateAvailable[container.Name] = false
+		}
+	}
+}
+
+func UpdatesPlanRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		updatesPlanLock.Lock()
+		plan := append([]UpdatePlanItem{}, updatesPlan...)
+		updatesPlanLock.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": plan,
+		})
+	} else {
+		utils.Error("UpdatesPlan: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// UpdatePolicyRoute reads (GET) or changes (POST) the update policy of a container
+func UpdatePolicyRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	errD := Connect()
+	if errD != nil {
+		utils.Error("UpdatePolicy", errD)
+		utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+		return
+	}
+
+	containerName := utils.SanitizeSafe(mux.Vars(req)["containerId"])
+
+	container, err := DockerClient.ContainerInspect(DockerContext, containerName)
+	if err != nil {
+		utils.Error("UpdatePolicy Inspect", err)
+		utils.HTTPError(w, "Internal server error: " + err.Error(), http.StatusInternalServerError, "DS002")
+		return
+	}
+
+	if req.Method == "GET" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": GetUpdatePolicy(container),
+		})
+	} else if req.Method == "POST" {
+		if utils.IsInsideContainer && containerName == os.Getenv("HOSTNAME") {
+			utils.Error("UpdatePolicy - Container cannot update itself", nil)
+			utils.HTTPError(w, "Use the Cosmos auto-update setting for Cosmos itself", http.StatusBadRequest, "DS003")
+			return
+		}
+
+		var policy UpdatePolicy
+		err := json.NewDecoder(req.Body).Decode(&policy)
+		if err != nil {
+			utils.Error("UpdatePolicy", err)
+			utils.HTTPError(w, "Invalid JSON", http.StatusBadRequest, "DS003")
+			return
+		}
+
+		if err := ValidateUpdatePolicy(policy); err != nil {
+			utils.HTTPError(w, err.Error(), http.StatusBadRequest, "DS003")
+			return
+		}
+
+		autoUpdate := "false"
+		if policy.Mode == "digest" || policy.Mode == "semver" {
+			autoUpdate = "true"
+		}
+
+		AddLabels(container, map[string]string{
+			"cosmos-auto-update": autoUpdate,
+			"cosmos-update-policy": policy.Mode,
+			"cosmos-update-semver": policy.Range,
+			"cosmos-update-window": policy.Window,
+		})
+
+		for _, label := range []string{"cosmos-update-policy", "cosmos-update-semver", "cosmos-update-window"} {
+			if container.Config.Labels[label] == "" {
+				delete(container.Config.Labels, label)
+			}
+		}
+
+		utils.Log("API: Set update policy " + policy.Mode + " : " + containerName)
+
+		_, errEdit := EditContainer(container.ID, container, false)
+		if errEdit != nil {
+			utils.Error("UpdatePolicy Edit", errEdit)
+			utils.HTTPError(w, "Internal server error: " + errEdit.Error(), http.StatusInternalServerError, "DS004")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("UpdatePolicy: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
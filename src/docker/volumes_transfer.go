@@ -0,0 +1,386 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	conttype "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	volumeTypes "github.com/docker/docker/api/types/volume"
+	"github.com/gorilla/mux"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// the volumes are copied with the archive API of a stopped container mounting them, which works
+// the same whether Cosmos runs in a container or not
+const volumeHelperImage = "busybox:latest"
+
+func volumeHelper(mounts []mount.Mount) (string, func(), error) {
+	if _, _, err := DockerClient.ImageInspectWithRaw(DockerContext, volumeHelperImage); err != nil {
+		if _, err := pullImage(volumeHelperImage); err != nil {
+			return "", nil, err
+		}
+	}
+
+	created, err := DockerClient.ContainerCreate(DockerContext, &conttype.Config{
+		Image: volumeHelperImage,
+		Cmd: []string{"true"},
+		Labels: map[string]string{
+			"cosmos-volume-helper": "true",
+		},
+	}, &conttype.HostConfig{
+		Mounts: mounts,
+	}, nil, nil, "")
+	if err != nil {
+		return "", nil, err
+	}
+
+	cleanup := func() {
+		err := DockerClient.ContainerRemove(DockerContext, created.ID, conttype.RemoveOptions{Force: true})
+		if err != nil {
+			utils.Error("VolumeHelper - remove", err)
+		}
+	}
+
+	return created.ID, cleanup, nil
+}
+
+// rewriteVolumeArchive moves the files of a tar (optionally gzipped) under volume/, removing the top
+// directory prefix first if the files are in it. Archives of ExportMount have their files under volume/
+func rewriteVolumeArchive(r io.Reader, w io.Writer, prefix string) error {
+	buffered := bufio.NewReader(r)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = buffered
+	}
+
+	rename := func(name string) (string, error) {
+		name = path.Clean(strings.TrimPrefix(name, "/"))
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return "", errors.New("invalid path in archive: " + name)
+		}
+		if name == prefix {
+			name = "."
+		} else {
+			name = strings.TrimPrefix(name, prefix + "/")
+		}
+		if name == "." {
+			return "volume", nil
+		}
+		return "volume/" + name, nil
+	}
+
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Name, err = rename(header.Name); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeLink {
+			if header.Linkname, err = rename(header.Linkname); err != nil {
+				return err
+			}
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// ExportMount writes the content of a volume, or of a host directory for a bind, as a tar with the files under volume/
+func ExportMount(source mount.Mount, w io.Writer, compress bool) error {
+	source.Target = "/volume"
+	source.ReadOnly = true
+
+	id, cleanup, err := volumeHelper([]mount.Mount{source})
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	reader, _, err := DockerClient.CopyFromContainer(DockerContext, id, "/volume")
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if !compress {
+		_, err = io.Copy(w, reader)
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, reader); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ImportMount extracts a tar (optionally gzipped) into a volume or a host directory, keeping the owners of the files
+func ImportMount(target mount.Mount, r io.Reader) error {
+	target.Target = "/volume"
+	target.ReadOnly = false
+
+	id, cleanup, err := volumeHelper([]mount.Mount{target})
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(rewriteVolumeArchive(r, pw, "volume"))
+	}()
+
+	err = DockerClient.CopyToContainer(DockerContext, id, "/", pr, types.CopyToContainerOptions{
+		CopyUIDGID: true,
+	})
+	pr.CloseWithError(err)
+	return err
+}
+
+// CloneVolume creates a new volume with the driver, labels and content of another one
+func CloneVolume(sourceName string, targetName string) (err error) {
+	source, err := DockerClient.VolumeInspect(DockerContext, sourceName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := DockerClient.VolumeInspect(DockerContext, targetName); err == nil {
+		return errors.New("volume " + targetName + " already exists")
+	}
+
+	_, err = DockerClient.VolumeCreate(DockerContext, volumeTypes.CreateOptions{
+		Name: targetName,
+		Driver: source.Driver,
+		DriverOpts: source.Options,
+		Labels: source.Labels,
+	})
+	if err != nil {
+		return err
+	}
+
+	// deferred first so that it runs last, once the helper mounting the volume is removed
+	defer func() {
+		if err != nil {
+			if errR := DockerClient.VolumeRemove(DockerContext, targetName, true); errR != nil {
+				utils.Error("CloneVolume - remove " + targetName, errR)
+			}
+		}
+	}()
+
+	id, cleanup, err := volumeHelper([]mount.Mount{
+		{Type: mount.TypeVolume, Source: sourceName, Target: "/from", ReadOnly: true},
+		{Type: mount.TypeVolume, Source: targetName, Target: "/volume"},
+	})
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	reader, _, err := DockerClient.CopyFromContainer(DockerContext, id, "/from")
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(rewriteVolumeArchive(reader, pw, "from"))
+	}()
+
+	err = DockerClient.CopyToContainer(DockerContext, id, "/", pr, types.CopyToContainerOptions{
+		CopyUIDGID: true,
+	})
+	pr.CloseWithError(err)
+	return err
+}
+
+// ExportVolumeRoute downloads the content of a volume as a tar, gzipped with ?compress=true
+func ExportVolumeRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("ExportVolume", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		volumeName := utils.SanitizeSafe(mux.Vars(req)["volumeName"])
+		compress := req.URL.Query().Get("compress") == "true"
+
+		if _, err := DockerClient.VolumeInspect(DockerContext, volumeName); err != nil {
+			utils.Error("ExportVolume", err)
+			utils.HTTPError(w, "Volume not found", http.StatusNotFound, "DS005")
+			return
+		}
+
+		filename := volumeName + ".tar"
+		w.Header().Set("Content-Type", "application/x-tar")
+		if compress {
+			filename += ".gz"
+			w.Header().Set("Content-Type", "application/gzip")
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename=\"" + filename + "\"")
+
+		utils.Log("API: Export volume " + volumeName)
+
+		err := ExportMount(mount.Mount{Type: mount.TypeVolume, Source: volumeName}, w, compress)
+		if err != nil {
+			// the headers are already sent, the download is only cut
+			utils.Error("ExportVolume", err)
+		}
+	} else {
+		utils.Error("ExportVolume: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// ImportVolumeRoute extracts a tarball (raw or gzip body, or a multipart "file") into a volume, created if needed.
+// Importing into an existing volume requires ?overwrite=true
+func ImportVolumeRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("ImportVolume", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		volumeName := utils.SanitizeSafe(mux.Vars(req)["volumeName"])
+
+		if _, err := DockerClient.VolumeInspect(DockerContext, volumeName); err == nil {
+			if req.URL.Query().Get("overwrite") != "true" {
+				utils.HTTPError(w, "Volume already exists, use overwrite=true to import into it", http.StatusConflict, "DS006")
+				return
+			}
+		} else {
+			_, err := DockerClient.VolumeCreate(DockerContext, volumeTypes.CreateOptions{
+				Name: volumeName,
+			})
+			if err != nil {
+				utils.Error("ImportVolume: Create", err)
+				utils.HTTPError(w, "Volume creation error: " + err.Error(), http.StatusInternalServerError, "DS004")
+				return
+			}
+		}
+
+		body := io.Reader(req.Body)
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+			file, _, err := req.FormFile("file")
+			if err != nil {
+				utils.Error("ImportVolume", err)
+				utils.HTTPError(w, "Missing file", http.StatusBadRequest, "DS003")
+				return
+			}
+			defer file.Close()
+			body = file
+		}
+
+		utils.Log("API: Import volume " + volumeName)
+
+		err := ImportMount(mount.Mount{Type: mount.TypeVolume, Source: volumeName}, body)
+		if err != nil {
+			utils.Error("ImportVolume", err)
+			utils.HTTPError(w, "Import failed: " + err.Error(), http.StatusInternalServerError, "DS004")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("ImportVolume: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+type CloneVolumeRequest struct {
+	Name string `json:"name" validate:"required,max=255"`
+}
+
+func CloneVolumeRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		errD := Connect()
+		if errD != nil {
+			utils.Error("CloneVolume", errD)
+			utils.HTTPError(w, "Internal server error: " + errD.Error(), http.StatusInternalServerError, "DS002")
+			return
+		}
+
+		var request CloneVolumeRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			utils.Error("CloneVolume: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid JSON", http.StatusBadRequest, "DS003")
+			return
+		}
+
+		if errV := utils.Validate.Struct(request); errV != nil {
+			utils.HTTPError(w, errV.Error(), http.StatusBadRequest, "DS003")
+			return
+		}
+
+		volumeName := utils.SanitizeSafe(mux.Vars(req)["volumeName"])
+		target := utils.SanitizeSafe(request.Name)
+
+		utils.Log("API: Clone volume " + volumeName + " to " + target)
+
+		if err := CloneVolume(volumeName, target); err != nil {
+			utils.Error("CloneVolume", err)
+			utils.HTTPError(w, "Clone failed: " + err.Error(), http.StatusInternalServerError, "DS004")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("CloneVolume: Method not allowed " + req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
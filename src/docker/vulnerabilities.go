@@ -0,0 +1,754 @@
+package docker
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// The vulnerability database is imported offline from OSV files (https://osv.dev), for example
+// the all.zip archives of the Debian, Ubuntu and Alpine ecosystems
+
+type osvEvent struct {
+	Introduced string `json:"introduced,omitempty" bson:"introduced,omitempty"`
+	Fixed string `json:"fixed,omitempty" bson:"fixed,omitempty"`
+	LastAffected string `json:"last_affected,omitempty" bson:"lastAffected,omitempty"`
+}
+
+type osvEntry struct {
+	ID string `json:"id"`
+	Aliases []string `json:"aliases"`
+	Summary string `json:"summary"`
+	Details string `json:"details"`
+	Modified time.Time `json:"modified"`
+	Withdrawn string `json:"withdrawn"`
+	Severity []struct {
+		Type string `json:"type"`
+		Score string `json:"score"`
+	} `json:"severity"`
+	DatabaseSpecific map[string]interface{} `json:"database_specific"`
+	Affected []struct {
+		Package struct {
+			Ecosystem string `json:"ecosystem"`
+			Name string `json:"name"`
+		} `json:"package"`
+		Ranges []struct {
+			Type string `json:"type"`
+			Events []osvEvent `json:"events"`
+		} `json:"ranges"`
+		Versions []string `json:"versions"`
+		EcosystemSpecific map[string]interface{} `json:"ecosystem_specific"`
+		DatabaseSpecific map[string]interface{} `json:"database_specific"`
+	} `json:"affected"`
+}
+
+// VulnerabilityRecord is a vulnerability of a package in an ecosystem, as stored in the database
+type VulnerabilityRecord struct {
+	VulnID string `json:"id" bson:"vulnId"`
+	Aliases []string `json:"aliases" bson:"aliases"`
+	Ecosystem string `json:"ecosystem" bson:"ecosystem"`
+	Package string `json:"package" bson:"package"`
+	Summary string `json:"summary" bson:"summary"`
+	Severity string `json:"severity" bson:"severity"`
+	// ranges of ECOSYSTEM versions, each one a list of events
+	Ranges [][]osvEvent `json:"ranges" bson:"ranges"`
+	Versions []string `json:"versions" bson:"versions"`
+	Modified time.Time `json:"modified" bson:"modified"`
+}
+
+type VulnerabilityDBStatus struct {
+	Entries int64 `json:"entries"`
+	Ecosystems []string `json:"ecosystems"`
+	LastImport time.Time `json:"lastImport"`
+}
+
+var severityOrder = map[string]int{
+	"CRITICAL": 4,
+	"HIGH": 3,
+	"MEDIUM": 2,
+	"LOW": 1,
+	"UNKNOWN": 0,
+}
+
+// normalizeEcosystem keeps the distribution and its version, Ubuntu:22.04:LTS becoming Ubuntu:22.04
+func normalizeEcosystem(ecosystem string) string {
+	parts := strings.SplitN(ecosystem, ":", 3)
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+	return strings.Join(parts, ":")
+}
+
+func normalizeSeverity(severity string) string {
+	switch strings.ToUpper(strings.TrimSpace(severity)) {
+	case "CRITICAL":
+		return "CRITICAL"
+	case "HIGH", "IMPORTANT":
+		return "HIGH"
+	case "MEDIUM", "MODERATE":
+		return "MEDIUM"
+	case "LOW", "NEGLIGIBLE", "UNIMPORTANT":
+		return "LOW"
+	}
+	return "UNKNOWN"
+}
+
+// cvss3Score computes the base score of a CVSS v3 vector like CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H
+func cvss3Score(vector string) (float64, error) {
+	if !strings.HasPrefix(vector, "CVSS:3") {
+		return 0, errors.New("not a CVSS v3 vector")
+	}
+
+	metrics := map[string]string{}
+	for _, part := range strings.Split(vector, "/")[1:] {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) == 2 {
+			metrics[kv[0]] = kv[1]
+		}
+	}
+
+	weights := map[string]map[string]float64{
+		"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+		"AC": {"L": 0.77, "H": 0.44},
+		"UI": {"N": 0.85, "R": 0.62},
+		"C": {"H": 0.56, "L": 0.22, "N": 0},
+		"I": {"H": 0.56, "L": 0.22, "N": 0},
+		"A": {"H": 0.56, "L": 0.22, "N": 0},
+	}
+
+	values := map[string]float64{}
+	for metric, options := range weights {
+		value, ok := options[metrics[metric]]
+		if !ok {
+			return 0, errors.New("invalid CVSS vector " + vector)
+		}
+		values[metric] = value
+	}
+
+	changed := metrics["S"] == "C"
+	privileges := map[string]float64{"N": 0.85, "L": 0.62, "H": 0.27}
+	if changed {
+		privileges = map[string]float64{"N": 0.85, "L": 0.68, "H": 0.5}
+	}
+	pr, ok := privileges[metrics["PR"]]
+	if !ok {
+		return 0, errors.New("invalid CVSS vector " + vector)
+	}
+
+	roundUp := func(value float64) float64 {
+		return math.Ceil(value * 10 - 1e-9) / 10
+	}
+
+	iss := 1 - (1 - values["C"]) * (1 - values["I"]) * (1 - values["A"])
+	impact := 6.42 * iss
+	if changed {
+		impact = 7.52 * (iss - 0.029) - 3.25 * math.Pow(iss - 0.02, 15)
+	}
+	exploitability := 8.22 * values["AV"] * values["AC"] * pr * values["UI"]
+
+	if impact <= 0 {
+		return 0, nil
+	}
+	if changed {
+		return roundUp(math.Min(1.08 * (impact + exploitability), 10)), nil
+	}
+	return roundUp(math.Min(impact + exploitability, 10)), nil
+}
+
+func cvssSeverity(score float64) string {
+	switch {
+	case score >= 9:
+		return "CRITICAL"
+	case score >= 7:
+		return "HIGH"
+	case score >= 4:
+		return "MEDIUM"
+	case score > 0:
+		return "LOW"
+	}
+	return "UNKNOWN"
+}
+
+// osvSeverity finds the severity of an entry from the CVSS vectors, or from the labels of the databases
+func osvSeverity(entry osvEntry, ecosystemSpecific map[string]interface{}, databaseSpecific map[string]interface{}) string {
+	best := "UNKNOWN"
+	consider := func(severity string) {
+		if severityOrder[severity] > severityOrder[best] {
+			best = severity
+		}
+	}
+
+	for _, severity := range entry.Severity {
+		if score, err := cvss3Score(severity.Score); err == nil {
+			consider(cvssSeverity(score))
+		} else if !strings.HasPrefix(severity.Score, "CVSS:") {
+			consider(normalizeSeverity(severity.Score))
+		}
+	}
+
+	if best != "UNKNOWN" {
+		return best
+	}
+
+	for _, specific := range []map[string]interface{}{ecosystemSpecific, databaseSpecific, entry.DatabaseSpecific} {
+		for _, key := range []string{"severity", "urgency"} {
+			if label, ok := specific[key].(string); ok {
+				consider(normalizeSeverity(strings.TrimSuffix(label, "*")))
+			}
+		}
+	}
+
+	return best
+}
+
+func osvToRecords(entry osvEntry) []VulnerabilityRecord {
+	records := []VulnerabilityRecord{}
+
+	if entry.ID == "" || entry.Withdrawn != "" {
+		return records
+	}
+
+	summary := entry.Summary
+	if summary == "" {
+		summary = strings.SplitN(strings.TrimSpace(entry.Details), "\n", 2)[0]
+	}
+	if len(summary) > 300 {
+		summary = summary[:300]
+	}
+
+	for _, affected := range entry.Affected {
+		record := VulnerabilityRecord{
+			VulnID: entry.ID,
+			Aliases: entry.Aliases,
+			Ecosystem: normalizeEcosystem(affected.Package.Ecosystem),
+			Package: affected.Package.Name,
+			Summary: summary,
+			Severity: osvSeverity(entry, affected.EcosystemSpecific, affected.DatabaseSpecific),
+			Ranges: [][]osvEvent{},
+			Versions: affected.Versions,
+			Modified: entry.Modified,
+		}
+
+		for _, r := range affected.Ranges {
+			if r.Type == "ECOSYSTEM" {
+				record.Ranges = append(record.Ranges, r.Events)
+			}
+		}
+
+		if record.Package != "" && record.Ecosystem != "" {
+			records = append(records, record)
+		}
+	}
+
+	return records
+}
+
+func parseOSVData(data []byte) ([]osvEntry, error) {
+	data = bytes.TrimSpace(data)
+
+	if bytes.HasPrefix(data, []byte("[")) {
+		entries := []osvEntry{}
+		err := json.Unmarshal(data, &entries)
+		return entries, err
+	}
+
+	var entry osvEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return []osvEntry{entry}, nil
+}
+
+// ImportVulnerabilityDB imports OSV entries from a zip of JSON files, a JSON file, or a JSON array.
+// Entries already in the database are replaced
+func ImportVulnerabilityDB(file *os.File) (int, error) {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "vulnerabilities")
+	if errCo != nil {
+		return 0, errCo
+	}
+
+	_, err := c.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "ecosystem", Value: 1}, {Key: "package", Value: 1}},
+	})
+	if err != nil {
+		utils.Error("ImportVulnerabilityDB - Create Index", err)
+	}
+
+	imported := 0
+	batch := []mongo.WriteModel{}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := c.BulkWrite(context.Background(), batch, options.BulkWrite().SetOrdered(false))
+		batch = []mongo.WriteModel{}
+		return err
+	}
+
+	add := func(data []byte) error {
+		entries, err := parseOSVData(data)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			for _, record := range osvToRecords(entry) {
+				batch = append(batch, mongo.NewReplaceOneModel().
+					SetFilter(bson.M{"vulnId": record.VulnID, "ecosystem": record.Ecosystem, "package": record.Package}).
+					SetReplacement(record).
+					SetUpsert(true))
+				imported++
+			}
+		}
+
+		if len(batch) >= 1000 {
+			return flush()
+		}
+		return nil
+	}
+
+	magic := make([]byte, 2)
+	if _, err := file.ReadAt(magic, 0); err != nil {
+		return 0, err
+	}
+
+	if string(magic) == "PK" {
+		stat, err := file.Stat()
+		if err != nil {
+			return 0, err
+		}
+
+		archive, err := zip.NewReader(file, stat.Size())
+		if err != nil {
+			return 0, err
+		}
+
+		for _, f := range archive.File {
+			if !strings.HasSuffix(f.Name, ".json") {
+				continue
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				return imported, err
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return imported, err
+			}
+
+			if err := add(data); err != nil {
+				utils.Warn("ImportVulnerabilityDB - skipping " + f.Name + ": " + err.Error())
+			}
+		}
+	} else {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return 0, err
+		}
+		if err := add(data); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := flush(); err != nil {
+		return imported, err
+	}
+
+	utils.Log("ImportVulnerabilityDB - imported " + strconv.Itoa(imported) + " vulnerabilities")
+
+	meta, errCo := utils.GetCollection(utils.GetRootAppId(), "vulnerabilities_meta")
+	if errCo == nil {
+		meta.UpdateOne(context.Background(), bson.M{"_id": "import"}, bson.M{
+			"$set": bson.M{"date": time.Now()},
+		}, options.Update().SetUpsert(true))
+	}
+
+	return imported, nil
+}
+
+func GetVulnerabilityDBStatus() (VulnerabilityDBStatus, error) {
+	status := VulnerabilityDBStatus{
+		Ecosystems: []string{},
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "vulnerabilities")
+	if errCo != nil {
+		return status, errCo
+	}
+
+	count, err := c.EstimatedDocumentCount(context.Background())
+	if err != nil {
+		return status, err
+	}
+	status.Entries = count
+
+	ecosystems, err := c.Distinct(context.Background(), "ecosystem", bson.M{})
+	if err != nil {
+		return status, err
+	}
+	for _, ecosystem := range ecosystems {
+		if name, ok := ecosystem.(string); ok {
+			status.Ecosystems = append(status.Ecosystems, name)
+		}
+	}
+	sort.Strings(status.Ecosystems)
+
+	meta, errCo := utils.GetCollection(utils.GetRootAppId(), "vulnerabilities_meta")
+	if errCo == nil {
+		var lastImport struct {
+			Date time.Time `bson:"date"`
+		}
+		if meta.FindOne(context.Background(), bson.M{"_id": "import"}).Decode(&lastImport) == nil {
+			status.LastImport = lastImport.Date
+		}
+	}
+
+	return status, nil
+}
+
+// compareDebianVersions compares two Debian package versions ([epoch:]upstream[-revision]) like dpkg does
+func compareDebianVersions(a string, b string) int {
+	splitEpoch := func(version string) (int, string) {
+		if i := strings.Index(version, ":"); i >= 0 {
+			epoch, _ := strconv.Atoi(version[:i])
+			return epoch, version[i+1:]
+		}
+		return 0, version
+	}
+
+	epochA, restA := splitEpoch(a)
+	epochB, restB := splitEpoch(b)
+	if epochA != epochB {
+		if epochA < epochB {
+			return -1
+		}
+		return 1
+	}
+
+	splitRevision := func(version string) (string, string) {
+		if i := strings.LastIndex(version, "-"); i >= 0 {
+			return version[:i], version[i+1:]
+		}
+		return version, ""
+	}
+
+	upstreamA, revisionA := splitRevision(restA)
+	upstreamB, revisionB := splitRevision(restB)
+
+	if result := compareDebianPart(upstreamA, upstreamB); result != 0 {
+		return result
+	}
+	return compareDebianPart(revisionA, revisionB)
+}
+
+func debianCharOrder(c byte) int {
+	switch {
+	case c == '~':
+		return -1
+	case unicode.IsLetter(rune(c)):
+		return int(c)
+	case c == 0:
+		return 0
+	}
+	return int(c) + 256
+}
+
+func compareDebianPart(a string, b string) int {
+	for a != "" || b != "" {
+		// non-digit part, ~ sorting before everything, letters before the other characters
+		for (a != "" && !unicode.IsDigit(rune(a[0]))) || (b != "" && !unicode.IsDigit(rune(b[0]))) {
+			var ca, cb byte
+			if a != "" && !unicode.IsDigit(rune(a[0])) {
+				ca = a[0]
+			}
+			if b != "" && !unicode.IsDigit(rune(b[0])) {
+				cb = b[0]
+			}
+
+			oa, ob := debianCharOrder(ca), debianCharOrder(cb)
+			if oa != ob {
+				if oa < ob {
+					return -1
+				}
+				return 1
+			}
+
+			if ca != 0 {
+				a = a[1:]
+			}
+			if cb != 0 {
+				b = b[1:]
+			}
+		}
+
+		// digit part
+		na, nb := 0, 0
+		for a != "" && unicode.IsDigit(rune(a[0])) {
+			na = na * 10 + int(a[0] - '0')
+			a = a[1:]
+		}
+		for b != "" && unicode.IsDigit(rune(b[0])) {
+			nb = nb * 10 + int(b[0] - '0')
+			b = b[1:]
+		}
+		if na != nb {
+			if na < nb {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return 0
+}
+
+var alpineSuffixOrder = map[string]int{
+	"alpha": -4,
+	"beta": -3,
+	"pre": -2,
+	"rc": -1,
+	"": 0,
+	"cvs": 1,
+	"svn": 2,
+	"git": 3,
+	"hg": 4,
+	"p": 5,
+}
+
+// compareAlpineVersions compares two apk versions like 1.2.3b_rc1-r4
+func compareAlpineVersions(a string, b string) int {
+	type alpineVersion struct {
+		numbers []int
+		letter string
+		suffix string
+		suffixNumber int
+		release int
+	}
+
+	parse := func(version string) alpineVersion {
+		result := alpineVersion{}
+
+		if i := strings.LastIndex(version, "-r"); i >= 0 {
+			result.release, _ = strconv.Atoi(version[i+2:])
+			version = version[:i]
+		}
+
+		if i := strings.Index(version, "_"); i >= 0 {
+			suffix := version[i+1:]
+			version = version[:i]
+			end := strings.IndexFunc(suffix, unicode.IsDigit)
+			if end < 0 {
+				end = len(suffix)
+			}
+			result.suffix = suffix[:end]
+			result.suffixNumber, _ = strconv.Atoi(suffix[end:])
+		}
+
+		if version != "" && unicode.IsLetter(rune(version[len(version)-1])) {
+			result.letter = version[len(version)-1:]
+			version = version[:len(version)-1]
+		}
+
+		for _, part := range strings.Split(version, ".") {
+			number, _ := strconv.Atoi(part)
+			result.numbers = append(result.numbers, number)
+		}
+
+		return result
+	}
+
+	compareInts := func(x int, y int) int {
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	}
+
+	va, vb := parse(a), parse(b)
+
+	for i := 0; i < len(va.numbers) || i < len(vb.numbers); i++ {
+		na, nb := 0, 0
+		if i < len(va.numbers) {
+			na = va.numbers[i]
+		}
+		if i < len(vb.numbers) {
+			nb = vb.numbers[i]
+		}
+		if result := compareInts(na, nb); result != 0 {
+			return result
+		}
+	}
+
+	if result := strings.Compare(va.letter, vb.letter); result != 0 {
+		return result
+	}
+	if result := compareInts(alpineSuffixOrder[va.suffix], alpineSuffixOrder[vb.suffix]); result != 0 {
+		return result
+	}
+	if result := compareInts(va.suffixNumber, vb.suffixNumber); result != 0 {
+		return result
+	}
+	return compareInts(va.release, vb.release)
+}
+
+func compareEcosystemVersions(ecosystem string, a string, b string) int {
+	if strings.HasPrefix(ecosystem, "Alpine") {
+		return compareAlpineVersions(a, b)
+	}
+	return compareDebianVersions(a, b)
+}
+
+// affectedVersion checks a version against a vulnerability, and returns the version fixing it if known
+func affectedVersion(record VulnerabilityRecord, version string) (bool, string) {
+	for _, affected := range record.Versions {
+		if affected == version {
+			return true, ""
+		}
+	}
+
+	compare := func(a string, b string) int {
+		return compareEcosystemVersions(record.Ecosystem, a, b)
+	}
+
+	eventVersion := func(event osvEvent) string {
+		if event.Introduced != "" {
+			return event.Introduced
+		} else if event.Fixed != "" {
+			return event.Fixed
+		}
+		return event.LastAffected
+	}
+
+	for _, events := range record.Ranges {
+		sorted := append([]osvEvent{}, events...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if sorted[i].Introduced == "0" {
+				return sorted[j].Introduced != "0"
+			}
+			if sorted[j].Introduced == "0" {
+				return false
+			}
+			return compare(eventVersion(sorted[i]), eventVersion(sorted[j])) < 0
+		})
+
+		affected := false
+		fixed := ""
+
+		for _, event := range sorted {
+			switch {
+			case event.Introduced != "":
+				if event.Introduced == "0" || compare(version, event.Introduced) >= 0 {
+					affected = true
+				}
+			case event.Fixed != "":
+				if compare(version, event.Fixed) >= 0 {
+					affected = false
+				} else if affected && fixed == "" {
+					fixed = event.Fixed
+				}
+			case event.LastAffected != "":
+				if compare(version, event.LastAffected) > 0 {
+					affected = false
+				}
+			}
+		}
+
+		if affected {
+			return true, fixed
+		}
+	}
+
+	return false, ""
+}
+
+// FindVulnerabilities returns the vulnerabilities of the packages installed in an ecosystem
+func FindVulnerabilities(ecosystem string, packages []ImagePackage) ([]ImageVulnerability, error) {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "vulnerabilities")
+	if errCo != nil {
+		return nil, errCo
+	}
+
+	// the advisories are about the source packages
+	bySource := map[string][]ImagePackage{}
+	names := []string{}
+	for _, pkg := range packages {
+		if _, ok := bySource[pkg.Source]; !ok {
+			names = append(names, pkg.Source)
+		}
+		bySource[pkg.Source] = append(bySource[pkg.Source], pkg)
+	}
+
+	results := []ImageVulnerability{}
+	seen := map[string]bool{}
+
+	for start := 0; start < len(names); start += 500 {
+		end := min(start + 500, len(names))
+
+		cursor, err := c.Find(context.Background(), bson.M{
+			"ecosystem": ecosystem,
+			"package": bson.M{"$in": names[start:end]},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		records := []VulnerabilityRecord{}
+		err = cursor.All(context.Background(), &records)
+		cursor.Close(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			for _, pkg := range bySource[record.Package] {
+				key := record.VulnID + "/" + pkg.Source + "/" + pkg.SourceVersion
+				if seen[key] {
+					continue
+				}
+
+				if affected, fixed := affectedVersion(record, pkg.SourceVersion); affected {
+					seen[key] = true
+					results = append(results, ImageVulnerability{
+						ID: record.VulnID,
+						Aliases: record.Aliases,
+						Package: pkg.Source,
+						Version: pkg.SourceVersion,
+						FixedVersion: fixed,
+						Severity: record.Severity,
+						Summary: record.Summary,
+					})
+				}
+			}
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if severityOrder[results[i].Severity] != severityOrder[results[j].Severity] {
+			return severityOrder[results[i].Severity] > severityOrder[results[j].Severity]
+		}
+		return results[i].ID < results[j].ID
+	})
+
+	return results, nil
+}
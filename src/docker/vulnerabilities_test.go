@@ -0,0 +1,113 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestCvss3Score(t *testing.T) {
+	tests := []struct {
+		vector string
+		score  float64
+	}{
+		// CVE-2021-44228 (log4shell)
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:C/C:H/I:H/A:H", 10.0},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H", 9.8},
+		{"CVSS:3.1/AV:N/AC:L/PR:L/UI:N/S:C/C:H/I:H/A:H", 9.9},
+		{"CVSS:3.1/AV:L/AC:L/PR:L/UI:N/S:U/C:H/I:H/A:H", 7.8},
+		// CVE-2014-0160 (heartbleed)
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:N/A:N", 7.5},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:H", 7.5},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:R/S:C/C:L/I:L/A:N", 6.1},
+		{"CVSS:3.1/AV:N/AC:H/PR:N/UI:N/S:U/C:H/I:N/A:N", 5.9},
+		{"CVSS:3.0/AV:N/AC:L/PR:L/UI:N/S:U/C:L/I:N/A:N", 4.3},
+		{"CVSS:3.1/AV:P/AC:H/PR:H/UI:R/S:U/C:L/I:N/A:N", 1.6},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:N", 0},
+	}
+
+	for _, test := range tests {
+		score, err := cvss3Score(test.vector)
+		if err != nil {
+			t.Errorf("cvss3Score(%s) failed: %v", test.vector, err)
+			continue
+		}
+		if score != test.score {
+			t.Errorf("cvss3Score(%s) = %v, expected %v", test.vector, score, test.score)
+		}
+	}
+}
+
+func TestCvss3ScoreInvalid(t *testing.T) {
+	for _, vector := range []string{
+		"AV:N/AC:L/Au:N/C:P/I:P/A:P",
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H",
+		"CVSS:3.1/AV:X/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H",
+		"CVSS:3.1/AV:N/AC:L/UI:N/S:U/C:H/I:H/A:H",
+	} {
+		if _, err := cvss3Score(vector); err == nil {
+			t.Errorf("cvss3Score(%s) should fail", vector)
+		}
+	}
+}
+
+func TestCompareDebianVersions(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		result int
+	}{
+		{"1.0", "1.0", 0},
+		{"0:1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.9", "1.10", -1},
+		{"1:0.9", "2.0", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0~", "1.0", -1},
+		{"1.0", "1.0-1", -1},
+		{"1.0", "1.0a", -1},
+		{"1.0a", "1.0+", -1},
+		{"2.0-1", "2.0-1+deb12u1", -1},
+		{"2.36-9+deb12u4", "2.36-9+deb12u10", -1},
+		{"7.88.1-10+deb12u5", "7.88.1-10+deb12u6", -1},
+		{"3.0.11-1~deb12u2", "3.0.11-1", -1},
+		{"1.2.3-1ubuntu1", "1.2.3-1", 1},
+	}
+
+	for _, test := range tests {
+		if result := compareDebianVersions(test.a, test.b); result != test.result {
+			t.Errorf("compareDebianVersions(%s, %s) = %d, expected %d", test.a, test.b, result, test.result)
+		}
+		if result := compareDebianVersions(test.b, test.a); result != -test.result {
+			t.Errorf("compareDebianVersions(%s, %s) = %d, expected %d", test.b, test.a, result, -test.result)
+		}
+	}
+}
+
+func TestCompareAlpineVersions(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		result int
+	}{
+		{"1.2.3-r0", "1.2.3-r0", 0},
+		{"1.2", "1.2-r0", 0},
+		{"1.2.3-r0", "1.2.3-r1", -1},
+		{"1.2.9", "1.2.10", -1},
+		{"3.0.8-r0", "3.0.12-r0", -1},
+		{"1.2.3_rc1-r0", "1.2.3-r0", -1},
+		{"1.2_alpha", "1.2_beta", -1},
+		{"1.2_beta2", "1.2_rc1", -1},
+		{"1.2_rc1", "1.2_rc2", -1},
+		{"1.2.3", "1.2.3_p1", -1},
+		{"1.2.3", "1.2.3a", -1},
+		{"1.2.3a", "1.2.3b", -1},
+		{"1.36.1-r5", "1.36.1-r15", -1},
+	}
+
+	for _, test := range tests {
+		if result := compareAlpineVersions(test.a, test.b); result != test.result {
+			t.Errorf("compareAlpineVersions(%s, %s) = %d, expected %d", test.a, test.b, result, test.result)
+		}
+		if result := compareAlpineVersions(test.b, test.a); result != -test.result {
+			t.Errorf("compareAlpineVersions(%s, %s) = %d, expected %d", test.b, test.a, result, -test.result)
+		}
+	}
+}
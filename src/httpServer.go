@@ -238,6 +238,18 @@ func tokenMiddleware(next http.Handler) http.Handler {
 		r.Header.Del("x-cosmos-user-role")
 		r.Header.Del("x-cosmos-mfa")
 
+		// the Constellation master managing the Docker of this node
+		if constellation.IsRemoteDockerPath(r.URL.Path) && constellation.IsMasterRequest(r) {
+			r.Header.Set("x-cosmos-user", "constellation-master:" + r.Header.Get("x-cstln-remote-user"))
+			r.Header.Set("x-cosmos-role", strconv.Itoa((int)(utils.ADMIN)))
+			r.Header.Set("x-cosmos-user-role", strconv.Itoa((int)(utils.ADMIN)))
+			r.Header.Set("x-cosmos-mfa", "0")
+			r.Header.Del("x-cstln-auth")
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		role, u, err := user.RefreshUserToken(w, r)
 
 		if err != nil {
@@ -501,13 +513,34 @@ func InitServer() *mux.Router {
 	srapiAdmin.HandleFunc("/api/images/pull", docker.PullImage)
 	srapiAdmin.HandleFunc("/api/images", docker.InspectImageRoute)
 
+	srapiAdmin.HandleFunc("/api/logs", docker.SearchLogsRoute)
+
+	srapiAdmin.HandleFunc("/api/vulnerabilities/db", docker.VulnerabilityDBRoute)
+	srapiAdmin.HandleFunc("/api/vulnerabilities/scan", docker.ScanAllContainersRoute)
+	srapiAdmin.HandleFunc("/api/vulnerabilities", docker.VulnerabilitiesRoute)
+
+	srapiAdmin.HandleFunc("/api/registries/{host}", docker.DeleteRegistryRoute)
+	srapiAdmin.HandleFunc("/api/registries", docker.RegistriesRoute)
+
+	srapiAdmin.HandleFunc("/api/volume/{volumeName}/export", docker.ExportVolumeRoute)
+	srapiAdmin.HandleFunc("/api/volume/{volumeName}/import", docker.ImportVolumeRoute)
+	srapiAdmin.HandleFunc("/api/volume/{volumeName}/clone", docker.CloneVolumeRoute)
 	srapiAdmin.HandleFunc("/api/volume/{volumeName}", docker.DeleteVolumeRoute)
 	srapiAdmin.HandleFunc("/api/volumes", docker.VolumesRoute)
 
 	srapiAdmin.HandleFunc("/api/network/{networkID}", docker.DeleteNetworkRoute)
 	srapiAdmin.HandleFunc("/api/networks", docker.NetworkRoutes)
+	srapiAdmin.HandleFunc("/api/network-policies", docker.NetworkPoliciesRoute)
+	srapiAdmin.HandleFunc("/api/network-policies/graph", docker.NetworkGraphRoute)
 
 	srapiAdmin.HandleFunc("/api/migrate-host", docker.MigrateToHostModeRoute)
+
+	// authenticated with a migration token, created by an admin of this server
+	srapiAdmin.HandleFunc("/api/migration/token", docker.MigrationTokenRoute)
+	srapiAdmin.HandleFunc("/api/migration/check", docker.MigrationCheckRoute)
+	srapiAdmin.HandleFunc("/api/migration/volume", docker.MigrationVolumeRoute)
+	srapiAdmin.HandleFunc("/api/migration/servapp", docker.MigrationServAppRoute)
+	srapiAdmin.HandleFunc("/api/migration/abort", docker.MigrationAbortRoute)
 	
 	srapiAdmin.HandleFunc("/api/servapps/{containerId}/manage/{action}", docker.ManageContainerRoute)
 	srapiAdmin.HandleFunc("/api/servapps/{containerId}/secure/{status}", docker.SecureContainerRoute)
@@ -516,12 +549,27 @@ func InitServer() *mux.Router {
 	srapiAdmin.HandleFunc("/api/servapps/{containerId}/terminal/{action}", docker.TerminalRoute)
 	srapiAdmin.HandleFunc("/api/servapps/{containerId}/update", docker.UpdateContainerRoute)
 	srapiAdmin.HandleFunc("/api/servapps/{containerId}/export", docker.ExportContainerRoute)
+	srapiAdmin.HandleFunc("/api/servapps/{containerId}/migrate", docker.MigrateServAppRoute)
 	srapiAdmin.HandleFunc("/api/servapps/{containerId}/", docker.GetContainerRoute)
 	srapiAdmin.HandleFunc("/api/servapps/{containerId}/network/{networkId}", docker.NetworkContainerRoutes)
 	srapiAdmin.HandleFunc("/api/servapps/{containerId}/networks", docker.NetworkContainerRoutes)
 	srapiAdmin.HandleFunc("/api/servapps/{containerId}/check-update", docker.CanUpdateImageRoute)
+	srapiAdmin.HandleFunc("/api/servapps/{containerId}/image-history", docker.ImageHistoryRoute)
+	srapiAdmin.HandleFunc("/api/servapps/{containerId}/rollback", docker.RollbackContainerRoute)
+	srapiAdmin.HandleFunc("/api/servapps/{containerId}/update-policy", docker.UpdatePolicyRoute)
+	srapiAdmin.HandleFunc("/api/servapps/{containerId}/schedules", cron.ContainerSchedulesRoute)
+	srapiAdmin.HandleFunc("/api/servapps/{containerId}/vulnerabilities", docker.ContainerVulnerabilitiesRoute)
+	srapiAdmin.HandleFunc("/api/servapps/{containerId}/backups", backups.ServAppBackupsRoute)
+	srapiAdmin.HandleFunc("/api/servapps/{containerId}/restore", backups.RestoreServAppRoute)
+	srapiAdmin.HandleFunc("/api/servapps/updates", docker.UpdatesPlanRoute)
+	srapiAdmin.HandleFunc("/api/servapps/hosts", docker.DockerHostsRoute)
 	srapiAdmin.HandleFunc("/api/servapps", docker.ContainersRoute)
 	srapiAdmin.HandleFunc("/api/docker-service", docker.CreateServiceRoute)
+	srapiAdmin.HandleFunc("/api/stacks/{stack}/compose", docker.ExportStackComposeRoute)
+	srapiAdmin.HandleFunc("/api/stacks/{stack}/redeploy", docker.RedeployStackRoute)
+	srapiAdmin.HandleFunc("/api/stacks/{stack}/manage/{action}", docker.ManageStackRoute)
+	srapiAdmin.HandleFunc("/api/stacks/{stack}", docker.GetStackRoute)
+	srapiAdmin.HandleFunc("/api/stacks", docker.ListStacksRoute)
 	
 	srapiAdmin.HandleFunc("/api/markets", market.MarketGet)
 
@@ -559,6 +607,9 @@ func InitServer() *mux.Router {
 	srapiAdmin.HandleFunc("/api/jobs/get", cron.GetJobRoute)
 	srapiAdmin.HandleFunc("/api/jobs/delete", cron.DeleteJobRoute)
 	srapiAdmin.HandleFunc("/api/jobs/running", cron.GetRunningJobsRoute)
+	srapiAdmin.HandleFunc("/api/jobs/chains", cron.ListChainRunsRoute)
+	srapiAdmin.HandleFunc("/api/jobs/history", cron.ListJobsHistoryRoute)
+	srapiAdmin.HandleFunc("/api/jobs/history/{id}", cron.GetJobRunRoute)
 
 	srapiAdmin.HandleFunc("/api/smart-def", storage.ListSmartDef)
 	srapiAdmin.HandleFunc("/api/disks", storage.ListDisksRoute)
@@ -574,11 +625,14 @@ func InitServer() *mux.Router {
 	srapiAdmin.HandleFunc("/api/list-dir", storage.ListDirectoryRoute)
 	srapiAdmin.HandleFunc("/api/new-dir", storage.CreateFolderRoute)
 
+	srapiAdmin.HandleFunc("/api/backups-bundle/download", backups.DownloadBundleRoute)
+	srapiAdmin.HandleFunc("/api/backups-bundle/edit", backups.EditBundleRoute)
 	srapiAdmin.HandleFunc("/api/backups-repository", backups.ListRepos)
 	srapiAdmin.HandleFunc("/api/backups-repository/{name}/snapshots", backups.ListSnapshotsRouteFromRepo)
 	srapiAdmin.HandleFunc("/api/backups/{name}/snapshots", backups.ListSnapshotsRoute)
 	srapiAdmin.HandleFunc("/api/backups/{name}/{snapshot}/folders", backups.ListFoldersRoute) 
 	srapiAdmin.HandleFunc("/api/backups/{name}/restore", backups.RestoreBackupRoute)
+	srapiAdmin.HandleFunc("/api/backups/{name}/retention-preview", backups.PreviewRetentionRoute)
 	srapiAdmin.HandleFunc("/api/backups", backups.AddBackupRoute)
 	srapiAdmin.HandleFunc("/api/backups/edit", backups.EditBackupRoute)
 	srapiAdmin.HandleFunc("/api/backups/{name}", backups.RemoveBackupRoute)
@@ -623,6 +677,8 @@ func InitServer() *mux.Router {
 
 	SecureAPI(srapi, false, false)
 	SecureAPI(srapiAdmin, false, false)
+	// after the authentication, ?host= sends the Docker requests to another Constellation node
+	srapiAdmin.Use(constellation.RemoteHostMiddleware)
 	
 	pwd,_ := os.Getwd()
 	utils.Log("Starting in " + pwd)
@@ -719,6 +775,8 @@ func RestartServer() {
 
 	docker.BootstrapAllContainersFromTags()
 
+	docker.StartLogCollector()
+
 	go func() {
 		if HTTPServer2 != nil {
 			HTTPServer2.Shutdown(context.Background())
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"math/rand"
 	"time"
 	"context"
@@ -22,6 +23,7 @@ import (
 	"github.com/azukaar/cosmos-server/src/backups"
 	
 	"github.com/kardianos/service"
+	"golang.org/x/term"
 )
 
 
@@ -66,6 +68,44 @@ func HandleCLIArgs() bool {
 			storage.RunRClone(args)
 
 			return true
+	} else if len(args) > 0 && args[0] == "restore-bundle" {
+		if len(args) < 2 {
+			fmt.Println("Usage: cosmos restore-bundle <bundle-file> [--force]")
+			fmt.Println("The bundle password is read from COSMOS_BUNDLE_PASSWORD or prompted")
+			return true
+		}
+
+		force := len(args) > 2 && args[2] == "--force"
+
+		// the password is used as typed, spaces included
+		password := os.Getenv("COSMOS_BUNDLE_PASSWORD")
+		if password == "" {
+			fmt.Print("Bundle password: ")
+			if term.IsTerminal(int(os.Stdin.Fd())) {
+				typed, err := term.ReadPassword(int(os.Stdin.Fd()))
+				fmt.Println()
+				if err != nil {
+					log.Fatal(err)
+				}
+				password = string(typed)
+			} else {
+				line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+				password = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			}
+		}
+
+		initConfigFolder()
+		utils.InitLogs()
+
+		err := backups.RestoreBundle(args[1], password, force, func(msg string) {
+			fmt.Println(strings.TrimSuffix(msg, "\n"))
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println("Bundle restored. Start Cosmos to resume operations.")
+		return true
 	} else if len(args) > 0 && args[0] == "service" {
 		// Get the executable's directory
 		execPath, err := os.Executable()
@@ -191,7 +231,7 @@ func main() {
 	cosmos()
 }
 
-func cosmos() {
+func initConfigFolder() {
 	docker.IsInsideContainer()
 
 	if os.Getenv("COSMOS_CONFIG_FOLDER") != "" {
@@ -199,6 +239,10 @@ func cosmos() {
 	} else if utils.IsInsideContainer {
 		utils.CONFIGFOLDER = "/config/"
 	}
+}
+
+func cosmos() {
+	initConfigFolder()
 
 	utils.InitLogs()
 
@@ -224,6 +268,7 @@ func cosmos() {
 	
 	// utils.ReBootstrapContainer = docker.BootstrapContainerFromTags
 	utils.PushShieldMetrics = metrics.PushShieldMetrics
+	utils.ExecuteAlertAction = metrics.ExecuteAction
 	utils.GetContainerIPByName = docker.GetContainerIPByName
 	utils.DoesContainerExist = docker.DoesContainerExist
 	utils.CheckDockerNetworkMode = docker.CheckDockerNetworkMode
@@ -244,6 +289,8 @@ func cosmos() {
 
 	docker.DockerListenEvents()
 
+	docker.StartLogCollector()
+
 	docker.BootstrapAllContainersFromTags()
 
 	docker.RemoveSelfUpdater()
@@ -1,15 +1,31 @@
 package metrics
 
 import (
+	"sync"
 	"time"
 
 	"github.com/azukaar/cosmos-server/src/utils"
 )
 
 
+// last request of each route, kept even with the monitoring disabled as scale-to-zero relies on it
+var routeActivity = map[string]time.Time{}
+var routeActivityLock sync.Mutex
+
+// RouteLastActivity returns the time of the last request of a route, zero if none since the start
+func RouteLastActivity(route string) time.Time {
+	routeActivityLock.Lock()
+	defer routeActivityLock.Unlock()
+	return routeActivity[route]
+}
+
 func PushRequestMetrics(route utils.ProxyRouteConfig, statusCode int, TimeStarted time.Time, size int64) error {
 	responseTime := time.Since(TimeStarted)
 
+	routeActivityLock.Lock()
+	routeActivity[route.Name] = time.Now()
+	routeActivityLock.Unlock()
+
 	if !utils.GetMainConfig().MonitoringDisabled {
 		if statusCode >= 400 {
 			PushSetMetric("proxy.all.error", 1, DataDef{
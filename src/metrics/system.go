@@ -248,6 +248,54 @@ func GetSystemMetrics() {
 		}
 	}
 
+	// unexpected restarts and OOM kills in the last 10 minutes, and health of the containers
+	for container, health := range docker.GetContainerHealthMetrics() {
+		containerName := strings.Replace(container, ".", "_", -1)
+
+		unhealthy := 0
+		if health.Unhealthy {
+			unhealthy = 1
+		}
+
+		PushSetMetric("system.docker.restarts."+containerName, health.Restarts, DataDef{
+			Period:       time.Second * 30,
+			Label:        "Docker restarts (10 min) " + containerName,
+			AggloType:    "max",
+			SetOperation: "max",
+			Object:       "container@" + containerName,
+		})
+		PushSetMetric("system.docker.oom."+containerName, health.OOMKills, DataDef{
+			Period:       time.Second * 30,
+			Label:        "Docker OOM kills (10 min) " + containerName,
+			AggloType:    "max",
+			SetOperation: "max",
+			Object:       "container@" + containerName,
+		})
+		PushSetMetric("system.docker.unhealthy."+containerName, unhealthy, DataDef{
+			Max:          1,
+			Period:       time.Second * 30,
+			Label:        "Docker unhealthy " + containerName,
+			AggloType:    "max",
+			SetOperation: "max",
+			Object:       "container@" + containerName,
+		})
+	}
+
+	// vulnerabilities found by the last scans
+	for container, counts := range docker.GetVulnerabilityCounts() {
+		containerName := strings.Replace(container, ".", "_", -1)
+
+		for _, severity := range []string{"CRITICAL", "HIGH", "MEDIUM", "LOW"} {
+			PushSetMetric("system.docker.vulnerabilities." + strings.ToLower(severity) + "." + containerName, counts[severity], DataDef{
+				Period:    time.Second * 30,
+				Label:     "Docker " + strings.ToLower(severity) + " vulnerabilities " + containerName,
+				AggloType: "max",
+				SetOperation: "max",
+				Object:    "container@" + containerName,
+			})
+		}
+	}
+
 	// Disk health
 	disks, err := storage.ListDisks()
 	if err != nil {
@@ -194,6 +194,10 @@ func NewProxy(targetHost string, AcceptInsecureHTTPSTarget bool, DisableHeaderHa
 
 	proxy.Transport = transport
 
+	if route.Mode == "SERVAPP" && route.ScaleToZero.Enabled {
+		proxy.ErrorHandler = scaleToZeroErrorHandler(route)
+	}
+
 	proxy.ModifyResponse = func(resp *http.Response) error {
 		utils.Debug("Response from backend: " + resp.Status)
 		utils.Debug("URL was " + resp.Request.URL.String())
@@ -125,6 +125,8 @@ func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination htt
 		destination = http.StripPrefix(route.PathPrefix, destination)
 	}
 
+	destination = ScaleToZeroMiddleware(route)(destination)
+
 	destination = AddConstellationToken(route)(destination)
 
 	for filter := range route.AddionalFilters {
@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	conttype "github.com/docker/docker/api/types/container"
+
+	"github.com/azukaar/cosmos-server/src/docker"
+	"github.com/azukaar/cosmos-server/src/metrics"
+	"github.com/azukaar/cosmos-server/src/utils"
+)
+
+// Scale-to-zero routes start their stopped container on the first request. StopIdleServApps stops them
+// again once none of their routes had a request for IdleMinutes, from the activity of PushRequestMetrics
+
+const scaleToZeroDefaultIdle = 30 * time.Minute
+// how long a held request waits for the container to be ready
+const scaleToZeroStartTimeout = 2 * time.Minute
+
+// the activity of the routes is only known since the server started
+var scaleToZeroWatchStarted = time.Now()
+
+// requests in progress per route, a route with an open request is never idle
+var scaleToZeroActive = map[string]int{}
+var scaleToZeroActiveLock sync.Mutex
+
+// containers known to be ready, which the requests reach without asking Docker. A container leaves it
+// when it is stopped for being idle, or when the proxy cannot connect to it
+var scaleToZeroReady = map[string]bool{}
+var scaleToZeroReadyLock sync.Mutex
+
+// serializes the starts and stops of each container, so that concurrent requests start it once
+var scaleToZeroStartLocks = map[string]*sync.Mutex{}
+var scaleToZeroStartLocksLock sync.Mutex
+
+const startingPage = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta http-equiv="refresh" content="3">
+	<title>Starting...</title>
+	<style>
+		body { font-family: sans-serif; background: #1e1e1e; color: #eee; display: flex; align-items: center; justify-content: center; height: 100vh; margin: 0; }
+	</style>
+</head>
+<body>
+	<div>
+		<h2>Starting...</h2>
+		<p>This application was asleep and is starting, the page will reload once it is ready.</p>
+	</div>
+</body>
+</html>`
+
+func scaleToZeroContainer(route utils.ProxyRouteConfig) string {
+	target, err := url.Parse(route.Target)
+	if err != nil {
+		return ""
+	}
+	return target.Hostname()
+}
+
+func scaleToZeroIdle(route utils.ProxyRouteConfig) time.Duration {
+	if route.ScaleToZero.IdleMinutes > 0 {
+		return time.Duration(route.ScaleToZero.IdleMinutes) * time.Minute
+	}
+	return scaleToZeroDefaultIdle
+}
+
+func markRouteActive(route string, delta int) {
+	scaleToZeroActiveLock.Lock()
+	defer scaleToZeroActiveLock.Unlock()
+
+	scaleToZeroActive[route] += delta
+	if scaleToZeroActive[route] <= 0 {
+		delete(scaleToZeroActive, route)
+	}
+}
+
+func isRouteActive(route string) bool {
+	scaleToZeroActiveLock.Lock()
+	defer scaleToZeroActiveLock.Unlock()
+	return scaleToZeroActive[route] > 0
+}
+
+func isServAppKnownReady(containerName string) bool {
+	scaleToZeroReadyLock.Lock()
+	defer scaleToZeroReadyLock.Unlock()
+	return scaleToZeroReady[containerName]
+}
+
+func setServAppReady(containerName string, ready bool) {
+	scaleToZeroReadyLock.Lock()
+	defer scaleToZeroReadyLock.Unlock()
+
+	if ready {
+		scaleToZeroReady[containerName] = true
+	} else {
+		delete(scaleToZeroReady, containerName)
+	}
+}
+
+func servAppStartLock(containerName string) *sync.Mutex {
+	scaleToZeroStartLocksLock.Lock()
+	defer scaleToZeroStartLocksLock.Unlock()
+
+	if scaleToZeroStartLocks[containerName] == nil {
+		scaleToZeroStartLocks[containerName] = &sync.Mutex{}
+	}
+	return scaleToZeroStartLocks[containerName]
+}
+
+// startServApp starts or unpauses the container of a route if needed
+func startServApp(containerName string) error {
+	lock := servAppStartLock(containerName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if errD := docker.Connect(); errD != nil {
+		return errD
+	}
+
+	container, err := docker.DockerClient.ContainerInspect(docker.DockerContext, containerName)
+	if err != nil {
+		return err
+	}
+
+	if container.State.Paused {
+		utils.Log("ScaleToZero: unpausing " + containerName)
+		return docker.DockerClient.ContainerUnpause(docker.DockerContext, containerName)
+	}
+
+	if container.State.Running || container.State.Restarting {
+		return nil
+	}
+
+	utils.Log("ScaleToZero: starting " + containerName)
+
+	err = docker.DockerClient.ContainerStart(docker.DockerContext, containerName, conttype.StartOptions{})
+	if err != nil {
+		return err
+	}
+
+	utils.TriggerEvent(
+		"cosmos.docker.scale-to-zero.start",
+		"ServApp " + containerName + " started by a request",
+		"info",
+		"container@" + containerName,
+		map[string]interface{}{
+			"container": containerName,
+		},
+	)
+
+	return nil
+}
+
+// isServAppReady checks that the container is running, healthy if it has a health check, and that the
+// route target accepts connections
+func isServAppReady(route utils.ProxyRouteConfig, containerName string) bool {
+	container, err := docker.DockerClient.ContainerInspect(docker.DockerContext, containerName)
+	if err != nil || !container.State.Running || container.State.Paused {
+		return false
+	}
+
+	if container.State.Health != nil && container.State.Health.Status != types.Healthy {
+		return false
+	}
+
+	target, err := url.Parse(route.Target)
+	if err != nil {
+		return false
+	}
+
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	host := target.Hostname()
+	if !utils.IsInsideContainer || utils.IsHostNetwork {
+		host, err = docker.GetContainerIPByName(containerName)
+		if err != nil {
+			return false
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 2 * time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	return true
+}
+
+// ScaleToZeroMiddleware starts the stopped container of a scale-to-zero route, then holds the request
+// until it is ready or answers with a starting page
+func ScaleToZeroMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !route.ScaleToZero.Enabled || route.Mode != "SERVAPP" {
+			return next
+		}
+
+		containerName := scaleToZeroContainer(route)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			markRouteActive(route.Name, 1)
+			defer markRouteActive(route.Name, -1)
+
+			if isServAppKnownReady(containerName) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if err := startServApp(containerName); err != nil {
+				utils.Error("ScaleToZero: cannot start " + containerName, err)
+				utils.HTTPError(w, "ServApp could not be started", http.StatusBadGateway, "SZ001")
+				return
+			}
+
+			if !isServAppReady(route, containerName) {
+				if !route.ScaleToZero.HoldRequests {
+					writeStartingPage(w)
+					return
+				}
+
+				deadline := time.After(scaleToZeroStartTimeout)
+				ticker := time.NewTicker(time.Second)
+				defer ticker.Stop()
+
+				for !isServAppReady(route, containerName) {
+					select {
+					case <-r.Context().Done():
+						return
+					case <-deadline:
+						utils.Error("ScaleToZero: " + containerName + " is not ready after " + scaleToZeroStartTimeout.String(), nil)
+						utils.HTTPError(w, "ServApp is not ready", http.StatusGatewayTimeout, "SZ002")
+						return
+					case <-ticker.C:
+					}
+				}
+			}
+
+			setServAppReady(containerName, true)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeStartingPage(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "3")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(startingPage))
+}
+
+// scaleToZeroErrorHandler handles the proxy failing to reach the container, which was stopped from
+// elsewhere: the next request checks it again and starts it
+func scaleToZeroErrorHandler(route utils.ProxyRouteConfig) func(http.ResponseWriter, *http.Request, error) {
+	containerName := scaleToZeroContainer(route)
+
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		utils.Error("ScaleToZero: cannot reach " + containerName, err)
+		setServAppReady(containerName, false)
+		writeStartingPage(w)
+	}
+}
+
+// StopIdleServApps stops the containers whose scale-to-zero routes had no request for their idle time
+func StopIdleServApps() {
+	lastActivity := map[string]time.Time{}
+	idleTime := map[string]time.Duration{}
+	busy := map[string]bool{}
+
+	for _, route := range utils.GetMainConfig().HTTPConfig.ProxyConfig.Routes {
+		if route.Disabled || !route.ScaleToZero.Enabled || route.Mode != "SERVAPP" {
+			continue
+		}
+
+		containerName := scaleToZeroContainer(route)
+		if containerName == "" {
+			continue
+		}
+
+		if isRouteActive(route.Name) {
+			busy[containerName] = true
+		}
+
+		if last := metrics.RouteLastActivity(route.Name); last.After(lastActivity[containerName]) {
+			lastActivity[containerName] = last
+		}
+
+		// a container shared by several routes is stopped once they are all idle
+		if idle := scaleToZeroIdle(route); idle > idleTime[containerName] {
+			idleTime[containerName] = idle
+		}
+	}
+
+	if len(idleTime) == 0 {
+		return
+	}
+
+	if errD := docker.Connect(); errD != nil {
+		utils.Error("ScaleToZero", errD)
+		return
+	}
+
+	for containerName, idle := range idleTime {
+		if busy[containerName] {
+			continue
+		}
+
+		container, err := docker.DockerClient.ContainerInspect(docker.DockerContext, containerName)
+		if err != nil {
+			utils.Error("ScaleToZero: cannot inspect " + containerName, err)
+			continue
+		}
+
+		if !container.State.Running || container.State.Paused {
+			continue
+		}
+
+		last := lastActivity[containerName]
+		if scaleToZeroWatchStarted.After(last) {
+			last = scaleToZeroWatchStarted
+		}
+		// a container started by hand gets its full idle time
+		if started, err := time.Parse(time.RFC3339Nano, container.State.StartedAt); err == nil && started.After(last) {
+			last = started
+		}
+
+		if time.Since(last) < idle {
+			continue
+		}
+
+		utils.Log("ScaleToZero: stopping " + containerName + ", idle since " + last.Format(time.RFC3339))
+
+		lock := servAppStartLock(containerName)
+		lock.Lock()
+		setServAppReady(containerName, false)
+		err = docker.DockerClient.ContainerStop(docker.DockerContext, containerName, conttype.StopOptions{})
+		lock.Unlock()
+
+		if err != nil {
+			utils.Error("ScaleToZero: cannot stop " + containerName, err)
+			continue
+		}
+
+		utils.TriggerEvent(
+			"cosmos.docker.scale-to-zero.stop",
+			"ServApp " + containerName + " stopped after being idle",
+			"info",
+			"container@" + containerName,
+			map[string]interface{}{
+				"container": containerName,
+				"idleSince": last,
+			},
+		)
+	}
+}
@@ -76,6 +76,8 @@ func StatusRoute(w http.ResponseWriter, req *http.Request) {
 				"hostmode": utils.IsHostNetwork || !utils.IsInsideContainer || utils.GetMainConfig().DisableHostModeWarning,
 				"database": utils.DBStatus,
 				"docker": docker.DockerIsConnected,
+				"dockerRuntime": docker.DockerRuntime,
+				"dockerRootless": docker.DockerRootless,
 				"backup_status": docker.ExportError,
 				"letsencrypt": utils.GetMainConfig().HTTPConfig.HTTPSCertificateMode == "LETSENCRYPT" && utils.GetMainConfig().HTTPConfig.SSLEmail == "",
 				"domain": utils.GetMainConfig().HTTPConfig.Hostname == "localhost" || utils.GetMainConfig().HTTPConfig.Hostname == "0.0.0.0",
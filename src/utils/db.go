@@ -178,7 +178,8 @@ func GetEmbeddedCollection(applicationId string, collection string) (lungo.IColl
 	}, nil
 }
 
-func GetCollection(applicationId string, collection string) (*mongo.Collection, error) {
+// GetDatabase returns the main database, holding the collections of GetCollection
+func GetDatabase() (*mongo.Database, error) {
 	if client == nil {
 		errCo := DB()
 		if errCo != nil {
@@ -191,10 +192,19 @@ func GetCollection(applicationId string, collection string) (*mongo.Collection,
 	name := os.Getenv("MONGODB_NAME"); if name == "" {
 		name = "COSMOS"
 	}
+
+	return client.Database(name), nil
+}
+
+func GetCollection(applicationId string, collection string) (*mongo.Collection, error) {
+	db, err := GetDatabase()
+	if err != nil {
+		return nil, err
+	}
 	
 	// Debug("Getting collection " + applicationId + "_" + collection + " from database " + name)
 	
-	c := client.Database(name).Collection(applicationId + "_" + collection)
+	c := db.Collection(applicationId + "_" + collection)
 	
 	return c, nil
 }
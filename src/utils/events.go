@@ -26,5 +26,9 @@ func TriggerEvent(eventId string, label string, level string, object string, dat
 		"object": object,
 		"_search": eventId + " " + dataAsString,
 	})
+
+	if OnEvent != nil {
+		go OnEvent(eventId, label, level, object, data)
+	}
 }
 
@@ -314,6 +314,12 @@ func BlockPostWithoutReferer(next http.Handler) http.Handler {
 	})
 }
 
+// isConstellationRequest is a request between Cosmos nodes, reaching this server by its Constellation IP
+func isConstellationRequest(r *http.Request, reqHostNoPort string) bool {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return GetMainConfig().ConstellationConfig.Enabled && IsConstellationIP(reqHostNoPort) && IsConstellationIP(ip)
+}
+
 func EnsureHostname(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		og := GetMainConfig().HTTPConfig.Hostname
@@ -342,6 +348,10 @@ func EnsureHostname(next http.Handler) http.Handler {
 				isOk = true
 			}
 		}
+
+		if isConstellationRequest(r, reqHostNoPort) {
+			isOk = true
+		}
 		
 		if !isOk {
 			PushShieldMetrics("hostname")
@@ -409,6 +419,11 @@ func EnsureHostnameCosmosAPI(next http.Handler) http.Handler {
 			}
 		}
 
+		if isConstellationRequest(r, reqHostNoPort) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		if og != reqHostNoPort {
 			PushShieldMetrics("hostname")
 			Error("Invalid Hostname " + r.Host + " for API request to " + r.URL.Path, nil)
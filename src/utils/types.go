@@ -106,6 +106,7 @@ type Config struct {
 	AdminConstellationOnly bool
 	Storage StorageConfig
 	CRON map[string]CRONConfig
+	JobsHistoryRetentionDays int
 	Licence string
 	ServerToken string
 	RemoteStorage RemoteStorageConfig
@@ -120,6 +121,31 @@ type CRONConfig struct {
 	Crontab string
 	Command string
 	Container string
+	Image string
+	Mounts []string
+	Env []string
+	Network string
+	Memory string
+	CPUs float64
+	PidsLimit int64
+	Timeout string
+	Retries int
+	RetryBackoff string
+	NotifyOnFailure []AlertAction
+	DisableAfterFailures int
+	After []CRONJobDependency
+	Triggers []CRONEventTrigger
+}
+
+type CRONEventTrigger struct {
+	EventId string
+	Object string
+}
+
+type CRONJobDependency struct {
+	Scheduler string
+	Job string
+	On string
 }
 
 type StorageConfig struct {
@@ -207,9 +233,56 @@ type SmartShieldPolicy struct {
 }
 
 type DockerConfig struct {
+	// engine socket or URL, like unix:///run/podman/podman.sock. Empty to use DOCKER_HOST or
+	// the first socket found of rootful Docker, rootless Docker, rootful Podman and rootless Podman
+	Host string
 	SkipPruneNetwork bool
 	SkipPruneImages bool
 	DefaultDataPath string
+	// default maintenance window of the container updates, like "Mon-Fri 02:00-05:00", empty for anytime
+	UpdateWindow string
+	LogCollector LogCollectorConfig
+	Schedules []ContainerSchedule
+	NetworkPolicies []NetworkPolicy
+}
+
+// NetworkPolicy allows two containers to reach each other. The policies are enforced with internal networks,
+// which are neither directional nor filter the ports: To can reach From as well, on any port
+type NetworkPolicy struct {
+	From string
+	To string
+	Description string
+}
+
+// ContainerSchedule runs an action on a container at a crontab. Schedules can also be set
+// with cosmos-schedule-<action> labels, several crontabs being separated by ;
+type ContainerSchedule struct {
+	Container string
+	// start, stop, restart, pause or unpause
+	Action string
+	// with seconds, like "0 0 22 * * *"
+	Crontab string
+	Disabled bool
+}
+
+// LogCollectorConfig is the optional collector storing the logs of all the containers, for the search and the forwarding
+type LogCollectorConfig struct {
+	Enabled bool
+	// days the collected logs are kept, 7 by default
+	RetentionDays int
+	// containers not collected
+	Exclude []string
+	Forwarders []LogForwarderConfig
+}
+
+type LogForwarderConfig struct {
+	Name string
+	// syslog, gelf or loki
+	Type string
+	// udp://host:514 or tcp://host:514 for syslog and gelf, http(s):// for loki and gelf
+	URL string
+	// containers forwarded, empty for all
+	Containers []string
 }
 
 type ProxyConfig struct {
@@ -254,6 +327,17 @@ type ProxyRouteConfig struct {
 	TunnelVia                  string                      `yaml:"tunnel_via,omitempty"`
 	TunneledHost							 string                      `yaml:"tunneled_host,omitempty"`
 	ExtraHeaders               map[string]string           `yaml:"extra_headers,omitempty"`
+	ScaleToZero                ScaleToZeroConfig           `yaml:"scale_to_zero,omitempty"`
+}
+
+// ScaleToZeroConfig lets a SERVAPP route start its stopped container on the first request, and stop it
+// again when the route is idle
+type ScaleToZeroConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// minutes without requests before the container is stopped, 30 when empty
+	IdleMinutes int `yaml:"idle_minutes,omitempty"`
+	// hold the requests until the container is ready, instead of answering with a starting page
+	HoldRequests bool `yaml:"hold_requests,omitempty"`
 }
 
 type EmailConfig struct {
@@ -442,15 +526,43 @@ type RemoteStorageConfig struct {
 type BackupConfig struct {
 	Disable bool
 	Backups map[string]SingleBackupConfig
+	DRBundle DRBundleConfig
+}
+
+type DRBundleConfig struct {
+	Enabled bool
+	Backup string
+	Crontab string
+	Password string
+	// bundles older than the policy are removed after each new bundle, the default keeping the last 7
+	Retention *BackupRetentionPolicy `json:",omitempty"`
 }
 
 type SingleBackupConfig struct {
 	Name string
+	Engine string
 	Repository string
 	Password string
 	Source string 
 	Crontab string
 	CrontabForget string
 	RetentionPolicy string
+	Retention *BackupRetentionPolicy `json:",omitempty"`
 	AutoStopContainers bool
+	// applied to the backup and forget jobs, like the CRON jobs
+	Timeout string `json:",omitempty"`
+	Retries int `json:",omitempty"`
+	RetryBackoff string `json:",omitempty"`
+	NotifyOnFailure []AlertAction `json:",omitempty"`
+}
+
+type BackupRetentionPolicy struct {
+	KeepLast int
+	KeepHourly int
+	KeepDaily int
+	KeepWeekly int
+	KeepMonthly int
+	KeepYearly int
+	KeepWithin string
+	KeepTags []string
 }
\ No newline at end of file
@@ -19,6 +19,9 @@ import (
 	"os/exec"
 	"encoding/hex"
 	"crypto/sha256"
+	"crypto/aes"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
 	_url "net/url"
 	osnet "net"
 	
@@ -59,6 +62,8 @@ var GetContainerIPByName func(string) (string, error)
 var DoesContainerExist func(string) bool
 var CheckDockerNetworkMode func() string
 var WaitForAllJobs func()
+var ExecuteAlertAction func(Alert, AlertAction, AlertMetricTrack)
+var OnEvent func(eventId string, label string, level string, object string, data map[string]interface{})
 var StopAllRCloneProcess func(bool)
 
 var ResyncConstellationNodes = func() {}
@@ -1201,3 +1206,57 @@ func FindRouteByReqHost(hostname string) (string, *ProxyRouteConfig) {
 
 	return hostname, proxyRoute
 }
+
+// secretKey derives the key used to store secrets in the database from the server's private auth key
+func secretKey() []byte {
+	key := sha256.Sum256([]byte("cosmos-secrets:" + GetMainConfig().HTTPConfig.AuthPrivateKey))
+	return key[:]
+}
+
+// EncryptSecret encrypts a secret with AES-256-GCM before storing it, and returns it base64 encoded
+func EncryptSecret(secret string) (string, error) {
+	block, err := aes.NewCipher(secretKey())
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := cryptorand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func DecryptSecret(encrypted string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(secretKey())
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("encrypted secret is truncated")
+	}
+
+	secret, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("cannot decrypt secret, the server key changed or the secret is corrupted")
+	}
+
+	return string(secret), nil
+}